@@ -48,6 +48,9 @@ type LexerConfig struct {
 	LstripBlocks        bool
 	NewlineSequence     string
 	KeepTrailingNewline bool
+	// RecordWhitespace makes the lexer record every whitespace trim in the
+	// token stream, see TokenStream.WhitespaceTrims.
+	RecordWhitespace bool
 }
 
 func DefaultLexerConfig() LexerConfig {
@@ -254,19 +257,19 @@ func (l *Lexer) buildRootParts() string {
 // buildCommentEndPattern builds the regex pattern for comment end
 func (l *Lexer) buildCommentEndPattern(blockSuffix string) string {
 	e := regexp.QuoteMeta
-	return e(l.config.Delimiters.CommentEnd)
+	return "[\\-+]?" + e(l.config.Delimiters.CommentEnd)
 }
 
 // buildBlockEndPattern builds the regex pattern for block end
 func (l *Lexer) buildBlockEndPattern(blockSuffix string) string {
 	e := regexp.QuoteMeta
-	return e(l.config.Delimiters.BlockEnd)
+	return "[\\-+]?" + e(l.config.Delimiters.BlockEnd)
 }
 
 // buildVariableEndPattern builds the regex pattern for variable end
 func (l *Lexer) buildVariableEndPattern() string {
 	e := regexp.QuoteMeta
-	return e(l.config.Delimiters.VariableEnd)
+	return "\\-?" + e(l.config.Delimiters.VariableEnd)
 }
 
 // buildRawEndPattern builds the regex pattern for raw block end
@@ -282,7 +285,7 @@ func (l *Lexer) buildRawEndPattern(blockSuffix string) string {
 
 // Tokenize tokenizes the given source string and returns a stream of tokens
 func (l *Lexer) Tokenize(source, name, filename string, initialState LexerState) (*TokenStream, error) {
-	tokens, err := l.tokeniter(source, name, filename, initialState)
+	tokens, trims, err := l.tokeniter(source, name, filename, initialState)
 	if err != nil {
 		return nil, err
 	}
@@ -291,11 +294,13 @@ func (l *Lexer) Tokenize(source, name, filename string, initialState LexerState)
 	if err != nil {
 		return nil, err
 	}
-	return NewTokenStream(wrappedTokens), nil
+	stream := NewTokenStream(wrappedTokens)
+	stream.trims = trims
+	return stream, nil
 }
 
 // tokeniter implements the core tokenization logic based on Python's tokeniter
-func (l *Lexer) tokeniter(source, name, filename string, initialState LexerState) ([]TokenInfo, error) {
+func (l *Lexer) tokeniter(source, name, filename string, initialState LexerState) ([]TokenInfo, []WhitespaceTrim, error) {
 	// Normalize newlines to ensure consistent line counting
 	source = l.normalizeNewlines(source)
 
@@ -314,7 +319,7 @@ func (l *Lexer) tokeniter(source, name, filename string, initialState LexerState
 	stack := []LexerState{StateRoot}
 	if initialState != "" && initialState != StateRoot {
 		if initialState != StateVariableBegin && initialState != StateBlockBegin {
-			return nil, fmt.Errorf("invalid initial state: %s", initialState)
+			return nil, nil, fmt.Errorf("invalid initial state: %s", initialState)
 		}
 		stack = append(stack, initialState)
 	}
@@ -327,9 +332,14 @@ func (l *Lexer) tokeniter(source, name, filename string, initialState LexerState
 
 	// Track if we're at the start of a line for lstrip_blocks
 	lineStarting := true
-	suppressNextNewline := false
 
 	var tokens []TokenInfo
+	var trims []WhitespaceTrim
+	recordTrim := func(tok TokenInfo, tag, reason, removed string) {
+		if l.config.RecordWhitespace {
+			trims = append(trims, WhitespaceTrim{Line: tok.Line, Column: tok.Column, Tag: tag, Reason: reason, Removed: removed})
+		}
+	}
 
 	// Add infinite loop protection - limit maximum iterations
 	maxIterations := sourceLen * 10 // Reasonable upper bound
@@ -402,22 +412,12 @@ func (l *Lexer) tokeniter(source, name, filename string, initialState LexerState
 			)
 			if boundary > 0 {
 				rawSegment := source[pos : pos+boundary]
-				outputSegment := rawSegment
-				if suppressNextNewline && strings.HasSuffix(rawSegment, "\n") {
-					outputSegment = strings.TrimSuffix(rawSegment, "\n")
-					suppressNextNewline = false
-				} else if suppressNextNewline {
-					suppressNextNewline = false
-				}
-
-				if outputSegment != "" {
-					tokens = append(tokens, TokenInfo{
-						Line:   lineno,
-						Column: column,
-						Type:   "data",
-						Value:  outputSegment,
-					})
-				}
+				tokens = append(tokens, TokenInfo{
+					Line:   lineno,
+					Column: column,
+					Type:   "data",
+					Value:  rawSegment,
+				})
 
 				newlines := strings.Count(rawSegment, "\n")
 				lineno += newlines
@@ -438,21 +438,15 @@ func (l *Lexer) tokeniter(source, name, filename string, initialState LexerState
 
 		// Emit standalone newlines to preserve output and reset line state
 		if currentState == StateRoot && strings.HasPrefix(source[pos:], "\n") {
-			prevLine := lineno
-			prevColumn := column
+			tokens = append(tokens, TokenInfo{
+				Line:   lineno,
+				Column: column,
+				Type:   "data",
+				Value:  "\n",
+			})
 			pos++
 			lineno++
 			column = 1
-			if suppressNextNewline {
-				suppressNextNewline = false
-			} else {
-				tokens = append(tokens, TokenInfo{
-					Line:   prevLine,
-					Column: prevColumn,
-					Type:   "data",
-					Value:  "\n",
-				})
-			}
 			lineStarting = true
 			matched = true
 			iterations++
@@ -461,6 +455,11 @@ func (l *Lexer) tokeniter(source, name, filename string, initialState LexerState
 
 		// Try each rule for the current state
 		for _, rule := range statetokens {
+			// Jinja's float pattern has a (?<!\.) lookbehind so that foo.0.1
+			// lexes as two integer subscripts; RE2 cannot express it.
+			if rule.Regex == FloatRegex && pos > 0 && source[pos-1] == '.' {
+				continue
+			}
 			loc := rule.Regex.FindStringSubmatchIndex(source[pos:])
 			if loc == nil || loc[0] != 0 {
 				continue
@@ -473,7 +472,43 @@ func (l *Lexer) tokeniter(source, name, filename string, initialState LexerState
 			// Process the match and generate tokens
 			newTokens, strippedCount, err := l.processMatch(rule, source, loc, pos, lineno, column, filename, balancingStack, lineStarting)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
+			}
+
+			// A "-" inside the raw tags ({% raw -%} or {%- endraw %}) trims
+			// the raw text itself.
+			if currentState == StateRawBegin && len(newTokens) == 1 && newTokens[0].Type == "raw_data" && len(tokens) > 0 {
+				raw := &newTokens[0]
+				endTag := matchText[len(raw.Value):]
+				begin := tokens[len(tokens)-1]
+				beginMarker := "-" + l.config.Delimiters.BlockEnd
+				if strings.HasSuffix(begin.Value, beginMarker) {
+					if n := leadingWhitespace(raw.Value, true, false); n > 0 {
+						removed := raw.Value[:n]
+						markerTag := TokenInfo{Line: begin.Line, Column: begin.Column + utf8.RuneCountInString(begin.Value) - utf8.RuneCountInString(beginMarker)}
+						recordTrim(markerTag, beginMarker, TrimMarker, removed)
+						raw.Line += strings.Count(removed, "\n")
+						if idx := strings.LastIndex(removed, "\n"); idx >= 0 {
+							raw.Column = utf8.RuneCountInString(removed[idx+1:]) + 1
+						} else {
+							raw.Column += utf8.RuneCountInString(removed)
+						}
+						raw.Value = raw.Value[n:]
+					}
+				}
+				endMarker := l.config.Delimiters.BlockStart + "-"
+				if strings.HasPrefix(endTag, endMarker) {
+					if kept := strings.TrimRight(raw.Value, " \t\r\n"); kept != raw.Value {
+						removed := raw.Value[len(kept):]
+						before := matchText[:len(matchText)-len(endTag)]
+						markerTag := TokenInfo{Line: lineno + strings.Count(before, "\n"), Column: column + utf8.RuneCountInString(before)}
+						if idx := strings.LastIndex(before, "\n"); idx >= 0 {
+							markerTag.Column = utf8.RuneCountInString(before[idx+1:]) + 1
+						}
+						recordTrim(markerTag, endMarker, TrimMarker, removed)
+						raw.Value = kept
+					}
+				}
 			}
 
 			// Update position tracking using the full match text
@@ -533,16 +568,77 @@ func (l *Lexer) tokeniter(source, name, filename string, initialState LexerState
 
 			// Add generated tokens
 			tokens = append(tokens, newTokens...)
-			if l.config.TrimBlocks && currentState == StateBlockBegin {
-				for _, tok := range newTokens {
-					if tok.Type == "block_end" {
-						suppressNextNewline = true
-						break
+			if rule.NewState == nil || *rule.NewState != "#bygroup" {
+				pos = matchEnd
+			}
+
+			// Apply whitespace control around tags
+			if len(newTokens) > 0 {
+				tag := newTokens[len(newTokens)-1]
+				switch tag.Type {
+				case "block_begin", "variable_begin", "comment_begin", "raw_begin":
+					// "-" strips preceding whitespace; "+" keeps it even
+					// when lstrip_blocks is enabled.
+					sign := ""
+					if tag.Type == "raw_begin" {
+						rest := strings.TrimLeft(strings.TrimPrefix(tag.Value, l.config.Delimiters.BlockStart), " \t")
+						if strings.HasPrefix(rest, "-") || strings.HasPrefix(rest, "+") {
+							sign = rest[:1]
+						}
+					} else if pos < sourceLen && (source[pos] == '-' || source[pos] == '+') {
+						sign = source[pos : pos+1]
+						pos++
+						column++
+					}
+					lstrip := l.config.LstripBlocks && tag.Type != "variable_begin"
+					var removed string
+					tokens, removed = stripBeforeTag(tokens, sign, lstrip)
+					if removed != "" {
+						if sign == "-" {
+							recordTrim(tag, tag.Value+sign, TrimMarker, removed)
+						} else {
+							recordTrim(tag, tag.Value, TrimLstripBlocks, removed)
+						}
 					}
 				}
 			}
-			if rule.NewState == nil || *rule.NewState != "#bygroup" {
-				pos = matchEnd
+
+			if rule.NewState != nil && *rule.NewState == "#pop" {
+				endDelimiter := ""
+				switch currentState {
+				case StateBlockBegin:
+					endDelimiter = l.config.Delimiters.BlockEnd
+				case StateVariableBegin:
+					endDelimiter = l.config.Delimiters.VariableEnd
+				case StateCommentBegin:
+					endDelimiter = l.config.Delimiters.CommentEnd
+				}
+				if endDelimiter != "" {
+					marker := strings.HasSuffix(matchText, "-"+endDelimiter)
+					keep := strings.HasSuffix(matchText, "+"+endDelimiter)
+					if (marker || keep) && currentState != StateCommentBegin {
+						tokens[len(tokens)-1].Value = endDelimiter
+					}
+					trimBlocks := l.config.TrimBlocks && (currentState == StateBlockBegin || currentState == StateCommentBegin) && !keep
+					if n := leadingWhitespace(source[pos:], marker, trimBlocks); n > 0 {
+						removed := source[pos : pos+n]
+						endTag := TokenInfo{Line: lineno, Column: column - utf8.RuneCountInString(endDelimiter)}
+						if marker {
+							endTag.Column--
+							recordTrim(endTag, "-"+endDelimiter, TrimMarker, removed)
+						} else {
+							recordTrim(endTag, endDelimiter, TrimTrimBlocks, removed)
+						}
+						lineno += strings.Count(removed, "\n")
+						if idx := strings.LastIndex(removed, "\n"); idx >= 0 {
+							column = utf8.RuneCountInString(removed[idx+1:]) + 1
+						} else {
+							column += utf8.RuneCountInString(removed)
+						}
+						lineStarting = strings.HasSuffix(removed, "\n")
+						pos += n
+					}
+				}
 			}
 			matched = true
 			iterations++
@@ -555,7 +651,7 @@ func (l *Lexer) tokeniter(source, name, filename string, initialState LexerState
 			}
 			// If no rule matched, we have an unexpected character
 			rune, _ := utf8.DecodeRuneInString(source[pos:])
-			return nil, &LexerError{
+			return nil, nil, &LexerError{
 				Message: fmt.Sprintf("unexpected character %q", rune),
 				Line:    lineno,
 				Column:  column,
@@ -566,7 +662,7 @@ func (l *Lexer) tokeniter(source, name, filename string, initialState LexerState
 
 	// Check if we exited due to infinite loop protection
 	if iterations >= maxIterations {
-		return nil, &LexerError{
+		return nil, nil, &LexerError{
 			Message: "lexer infinite loop detected - possible regex or state machine issue",
 			Line:    lineno,
 			Column:  column,
@@ -576,7 +672,7 @@ func (l *Lexer) tokeniter(source, name, filename string, initialState LexerState
 
 	// Final validation - check for unclosed constructs
 	if len(balancingStack) > 0 {
-		return nil, &LexerError{
+		return nil, nil, &LexerError{
 			Message: fmt.Sprintf("unclosed %q", string(balancingStack[len(balancingStack)-1])),
 			Line:    lineno,
 			Column:  column,
@@ -631,7 +727,7 @@ validateRemaining:
 		case StateLineComment:
 			expectedTag = "end of line"
 		}
-		return nil, &LexerError{
+		return nil, nil, &LexerError{
 			Message: fmt.Sprintf("unclosed construct - missing %s", expectedTag),
 			Line:    lineno,
 			Column:  column,
@@ -639,7 +735,7 @@ validateRemaining:
 		}
 	}
 
-	return tokens, nil
+	return tokens, trims, nil
 }
 
 // TokenInfo represents intermediate token information
@@ -764,12 +860,12 @@ func (l *Lexer) isRawLikeTag(match string) bool {
 	blockEnd := strings.ToLower(l.config.Delimiters.BlockEnd)
 
 	lower = strings.TrimPrefix(lower, blockStart)
-	lower = strings.TrimPrefix(lower, "-")
+	lower = strings.TrimLeft(lower, "-+")
 	lower = strings.TrimSpace(lower)
 	if strings.HasSuffix(lower, blockEnd) {
 		lower = strings.TrimSuffix(lower, blockEnd)
 	}
-	lower = strings.TrimSuffix(lower, "-")
+	lower = strings.TrimRight(lower, "-+")
 	lower = strings.TrimSpace(lower)
 	return strings.HasPrefix(lower, "raw") || strings.HasPrefix(lower, "verbatim")
 }
@@ -115,6 +115,7 @@ func (t Token) String() string {
 type TokenStream struct {
 	tokens []Token
 	pos    int
+	trims  []WhitespaceTrim
 }
 
 func NewTokenStream(tokens []Token) *TokenStream {
@@ -124,6 +125,12 @@ func NewTokenStream(tokens []Token) *TokenStream {
 	}
 }
 
+// WhitespaceTrims returns the whitespace removed by whitespace control while
+// lexing. It is only populated when LexerConfig.RecordWhitespace is set.
+func (ts *TokenStream) WhitespaceTrims() []WhitespaceTrim {
+	return ts.trims
+}
+
 func (ts *TokenStream) Next() Token {
 	if ts.pos >= len(ts.tokens) {
 		return Token{Type: TokenEOF}
@@ -147,6 +154,16 @@ func (ts *TokenStream) PeekN(n int) Token {
 	return ts.tokens[ts.pos+n]
 }
 
+// Position returns the index of the next token, for use with Seek.
+func (ts *TokenStream) Position() int {
+	return ts.pos
+}
+
+// Seek moves the stream back (or forward) to a position from Position.
+func (ts *TokenStream) Seek(pos int) {
+	ts.pos = pos
+}
+
 func (ts *TokenStream) Consume(expected TokenType) (Token, error) {
 	token := ts.Next()
 	if token.Type != expected {
@@ -0,0 +1,98 @@
+package lexer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Reasons reported in WhitespaceTrim.
+const (
+	TrimMarker       = "marker"
+	TrimLstripBlocks = "lstrip_blocks"
+	TrimTrimBlocks   = "trim_blocks"
+)
+
+// WhitespaceTrim records whitespace removed from the template source by a
+// "-" marker, lstrip_blocks or trim_blocks.
+type WhitespaceTrim struct {
+	Line    int    // line of the tag responsible for the trim
+	Column  int    // column of the tag responsible for the trim
+	Tag     string // the delimiter as written, e.g. "{%-" or "%}"
+	Reason  string // TrimMarker, TrimLstripBlocks or TrimTrimBlocks
+	Removed string // the whitespace that was removed
+}
+
+func (w WhitespaceTrim) String() string {
+	return fmt.Sprintf("%d:%d %s removed %q (%s)", w.Line, w.Column, w.Tag, w.Removed, w.Reason)
+}
+
+// stripBeforeTag applies left-side whitespace control to the data tokens
+// preceding the tag token at the end of tokens. It returns the updated
+// tokens and the removed text.
+func stripBeforeTag(tokens []TokenInfo, sign string, lstrip bool) ([]TokenInfo, string) {
+	tagIndex := len(tokens) - 1
+	start := tagIndex
+	for start > 0 && tokens[start-1].Type == "data" {
+		start--
+	}
+
+	var builder strings.Builder
+	for _, tok := range tokens[start:tagIndex] {
+		builder.WriteString(tok.Value)
+	}
+	data := builder.String()
+
+	var keep string
+	switch {
+	case sign == "-":
+		keep = strings.TrimRight(data, " \t\r\n")
+	case sign == "" && lstrip:
+		lastNewline := strings.LastIndex(data, "\n")
+		if lastNewline < 0 && start > 0 {
+			// Another tag precedes this one on the same line.
+			return tokens, ""
+		}
+		if strings.Trim(data[lastNewline+1:], " \t") != "" {
+			return tokens, ""
+		}
+		keep = data[:lastNewline+1]
+	default:
+		return tokens, ""
+	}
+
+	removed := data[len(keep):]
+	if removed == "" {
+		return tokens, ""
+	}
+
+	tag := tokens[tagIndex]
+	end := tagIndex
+	for n := len(removed); n > 0; {
+		prev := &tokens[end-1]
+		if len(prev.Value) <= n {
+			n -= len(prev.Value)
+			end--
+			continue
+		}
+		prev.Value = prev.Value[:len(prev.Value)-n]
+		n = 0
+	}
+	return append(tokens[:end], tag), removed
+}
+
+// leadingWhitespace returns the length of the whitespace after a tag that is
+// removed by a "-" marker or, when trimBlocks is set, by trim_blocks.
+func leadingWhitespace(text string, marker, trimBlocks bool) int {
+	if marker {
+		return len(text) - len(strings.TrimLeft(text, " \t\r\n"))
+	}
+	if trimBlocks {
+		if strings.HasPrefix(text, "\r\n") {
+			return 2
+		}
+		if strings.HasPrefix(text, "\n") {
+			return 1
+		}
+	}
+	return 0
+}
@@ -406,6 +406,9 @@ type CallBlock struct {
 	VarArg     *Name           `json:"vararg"`
 	KwArg      *Name           `json:"kwarg"`
 	Body       []Node          `json:"body"`
+	// Target is set for `{% set x = call ... %}` and receives the call result
+	// instead of it being written to the output.
+	Target Expr `json:"target,omitempty"`
 }
 
 func (c *CallBlock) Accept(visitor Visitor) interface{} {
@@ -437,6 +440,10 @@ func (c *CallBlock) GetChildren() []Node {
 
 	children = append(children, c.Body...)
 
+	if c.Target != nil {
+		children = append(children, c.Target)
+	}
+
 	return children
 }
 
@@ -652,6 +659,11 @@ type Include struct {
 	Template      Expr `json:"template"`
 	WithContext   bool `json:"with_context"`
 	IgnoreMissing bool `json:"ignore_missing"`
+	// Only restricts the shared context to the listed names. A keyword
+	// without a value passes the variable of the same name through.
+	Only []*Keyword `json:"only,omitempty"`
+	// Else is rendered instead when none of the templates exist.
+	Else []Node `json:"else,omitempty"`
 }
 
 func (i *Include) Accept(visitor Visitor) interface{} {
@@ -659,10 +671,17 @@ func (i *Include) Accept(visitor Visitor) interface{} {
 }
 
 func (i *Include) GetChildren() []Node {
+	children := []Node{}
 	if i.Template != nil {
-		return []Node{i.Template}
+		children = append(children, i.Template)
 	}
-	return []Node{}
+	for _, kw := range i.Only {
+		if kw.Value != nil {
+			children = append(children, kw.Value)
+		}
+	}
+	children = append(children, i.Else...)
+	return children
 }
 
 func (i *Include) String() string {
@@ -240,6 +240,49 @@ func (p *Parser) Parse() (*nodes.Template, error) {
 	return template, nil
 }
 
+// isCallBlockAhead reports whether the upcoming tokens start a call block
+// (`call macro()` or `call(args) macro()`) rather than an expression that
+// merely invokes something named call.
+func (p *Parser) isCallBlockAhead() bool {
+	token := p.stream.Peek()
+	if token.Type != lexer.TokenName || token.Value != "call" {
+		return false
+	}
+	next := p.stream.PeekN(1)
+	if next.Type == lexer.TokenName {
+		return !isExpressionKeyword(next.Value)
+	}
+	if next.Type != lexer.TokenLeftParen {
+		return false
+	}
+	depth := 0
+	for i := 1; ; i++ {
+		tok := p.stream.PeekN(i)
+		switch tok.Type {
+		case lexer.TokenEOF, lexer.TokenBlockEnd:
+			return false
+		case lexer.TokenLeftParen:
+			depth++
+		case lexer.TokenRightParen:
+			depth--
+			if depth == 0 {
+				after := p.stream.PeekN(i + 1)
+				return after.Type == lexer.TokenName && !isExpressionKeyword(after.Value)
+			}
+		}
+	}
+}
+
+// isExpressionKeyword reports whether name continues an expression, so a
+// call followed by it (`call(1) if x else y`) is not a call block.
+func isExpressionKeyword(name string) bool {
+	switch name {
+	case "if", "else", "and", "or", "not", "in", "is":
+		return true
+	}
+	return false
+}
+
 // ParseSet parses an assign statement
 func (p *Parser) ParseSet() (nodes.Node, error) {
 	lineno := p.stream.Next().Line // consume 'set'
@@ -250,6 +293,16 @@ func (p *Parser) ParseSet() (nodes.Node, error) {
 	}
 
 	if p.SkipIf(lexer.TokenAssign) {
+		if p.isCallBlockAhead() {
+			node, err := p.ParseCallBlock()
+			if err != nil {
+				return nil, err
+			}
+			callBlock := node.(*nodes.CallBlock)
+			callBlock.Target = target
+			callBlock.SetPosition(nodes.NewPosition(lineno, 0))
+			return callBlock, nil
+		}
 		expr, err := p.ParseTuple()
 		if err != nil {
 			return nil, err
@@ -140,6 +140,21 @@ func (p *Parser) testNotIn() bool {
 	return isNot && isIn
 }
 
+// parseInTestOperand parses the container of an "is in" test into a call of
+// the in test, accepting both "is in seq" and "is in(seq)".
+func (p *Parser) parseInTestOperand(inToken lexer.Token) (nodes.Expr, error) {
+	name := &nodes.Name{Name: "in", Ctx: "load"}
+	name.SetPosition(nodes.NewPosition(inToken.Line, inToken.Column))
+
+	container, err := p.ParseMath1()
+	if err != nil {
+		return nil, err
+	}
+	call := &nodes.Call{Node: name, Args: []nodes.Expr{container}}
+	call.SetPosition(name.GetPosition())
+	return call, nil
+}
+
 // ParseCompare parses comparison expressions
 func (p *Parser) ParseCompare() (nodes.Expr, error) {
 	lineno := p.Current().Line
@@ -156,13 +171,26 @@ func (p *Parser) ParseCompare() (nodes.Expr, error) {
 		// Check for comparison operators - can be TokenComparison type or specific value in compareOperators map
 		if token.Type == lexer.TokenComparison || compareOperators[token.Value] {
 			p.stream.Next()
-			right, err := p.ParseMath1()
+			op := token.Value
+			if op == "is" && p.stream.Peek().Type == lexer.TokenNot {
+				p.stream.Next()
+				op = "isnot"
+			}
+
+			var right nodes.Expr
+			var err error
+			if next := p.stream.Peek(); (op == "is" || op == "isnot") && next.Type == lexer.TokenComparison && next.Value == "in" {
+				// "in" is also the name of a test: x is in seq
+				right, err = p.parseInTestOperand(p.stream.Next())
+			} else {
+				right, err = p.ParseMath1()
+			}
 			if err != nil {
 				return nil, err
 			}
 
 			ops = append(ops, &nodes.Operand{
-				Op:   token.Value,
+				Op:   op,
 				Expr: right,
 			})
 		} else if p.SkipIfByName("in") {
@@ -699,6 +727,24 @@ func (p *Parser) parseSubscript(node nodes.Expr) (nodes.Expr, error) {
 	lineno := token.Line
 
 	if token.Type == lexer.TokenDot {
+		// foo.0 is item access with an integer key, as in Jinja
+		if next := p.stream.Peek(); next.Type == lexer.TokenNumber && p.isInteger(next.Value) {
+			p.stream.Next()
+			index, err := strconv.ParseInt(next.Value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid integer: %s", next.Value)
+			}
+			indexNode := &nodes.Const{Value: index}
+			indexNode.SetPosition(nodes.NewPosition(lineno, 0))
+			getitem := &nodes.Getitem{
+				Node: node,
+				Arg:  indexNode,
+				Ctx:  nodes.CtxLoad,
+			}
+			getitem.SetPosition(nodes.NewPosition(lineno, 0))
+			return getitem, nil
+		}
+
 		attrToken, err := p.Expect(lexer.TokenName)
 		if err != nil {
 			return nil, err
@@ -52,6 +52,7 @@ type Environment struct {
 	LineStatementPrefix string
 	LineCommentPrefix   string
 	EnableAsync         bool
+	WhitespaceDebug     bool
 }
 
 // Parser represents the central parsing class Jinja uses
@@ -76,6 +77,7 @@ func NewParser(env *Environment, source, name, filename string, state string) (*
 		lexerConfig.KeepTrailingNewline = env.KeepTrailingNewline
 		lexerConfig.Delimiters.LineStatement = env.LineStatementPrefix
 		lexerConfig.Delimiters.LineComment = env.LineCommentPrefix
+		lexerConfig.RecordWhitespace = env.WhitespaceDebug
 	}
 	l := lexer.NewLexer(lexerConfig)
 
@@ -106,6 +108,12 @@ func NewParser(env *Environment, source, name, filename string, state string) (*
 	return parser, nil
 }
 
+// WhitespaceTrims returns the whitespace removed by whitespace control. It is
+// only populated when the environment enables WhitespaceDebug.
+func (p *Parser) WhitespaceTrims() []lexer.WhitespaceTrim {
+	return p.stream.WhitespaceTrims()
+}
+
 // Fail creates a syntax error with position information
 func (p *Parser) Fail(msg string, lineno int, errType error) error {
 	if lineno == 0 {
@@ -130,6 +130,51 @@ func TestParser_BasicExpressions(t *testing.T) {
 				}
 			},
 		},
+		{
+			name:     "DottedIntegerSubscript",
+			template: "{{ rows.0.1 }}",
+			validate: func(t *testing.T, tmpl *nodes.Template) {
+				output, ok := tmpl.Body[0].(*nodes.Output)
+				if !ok {
+					t.Fatalf("expected Output node, got %T", tmpl.Body[0])
+				}
+				outer, ok := output.Nodes[0].(*nodes.Getitem)
+				if !ok {
+					t.Fatalf("expected Getitem node, got %T", output.Nodes[0])
+				}
+				inner, ok := outer.Node.(*nodes.Getitem)
+				if !ok {
+					t.Fatalf("expected nested Getitem node, got %T", outer.Node)
+				}
+				if inner.Arg.(*nodes.Const).Value != int64(0) || outer.Arg.(*nodes.Const).Value != int64(1) {
+					t.Errorf("expected indexes 0 and 1, got %v and %v", inner.Arg, outer.Arg)
+				}
+			},
+		},
+		{
+			name:     "IsNotInTest",
+			template: "{{ x is not in items }}",
+			validate: func(t *testing.T, tmpl *nodes.Template) {
+				output, ok := tmpl.Body[0].(*nodes.Output)
+				if !ok {
+					t.Fatalf("expected Output node, got %T", tmpl.Body[0])
+				}
+				compare, ok := output.Nodes[0].(*nodes.Compare)
+				if !ok {
+					t.Fatalf("expected Compare node, got %T", output.Nodes[0])
+				}
+				if len(compare.Ops) != 1 || compare.Ops[0].Op != "isnot" {
+					t.Fatalf("expected a single isnot operand, got %#v", compare.Ops)
+				}
+				call, ok := compare.Ops[0].Expr.(*nodes.Call)
+				if !ok {
+					t.Fatalf("expected Call operand, got %T", compare.Ops[0].Expr)
+				}
+				if name := call.Node.(*nodes.Name).Name; name != "in" || len(call.Args) != 1 {
+					t.Errorf("expected in test with one argument, got %s with %d", name, len(call.Args))
+				}
+			},
+		},
 	}
 
 	for _, tt := range tests {
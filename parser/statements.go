@@ -164,10 +164,81 @@ func (p *Parser) ParseInclude() (nodes.Node, error) {
 		return nil, err
 	}
 
+	// Handle "only a, b=expr" restricting the shared context
+	if p.stream.Peek().Type == lexer.TokenName && p.stream.Peek().Value == "only" {
+		if !include.WithContext {
+			return nil, p.Fail("include without context cannot use only", lineno, &TemplateSyntaxError{})
+		}
+		p.stream.Next() // consume 'only'
+		for {
+			nameToken, err := p.Expect(lexer.TokenName)
+			if err != nil {
+				return nil, err
+			}
+			keyword := &nodes.Keyword{Key: nameToken.Value}
+			if p.SkipIf(lexer.TokenAssign) {
+				value, err := p.ParseExpression()
+				if err != nil {
+					return nil, err
+				}
+				keyword.Value = value
+			}
+			include.Only = append(include.Only, keyword)
+			if !p.SkipIf(lexer.TokenComma) {
+				break
+			}
+		}
+	}
+
+	if err := p.parseIncludeElse(include); err != nil {
+		return nil, err
+	}
+
 	include.SetPosition(nodes.NewPosition(lineno, 0))
 	return include, nil
 }
 
+// parseIncludeElse parses an optional "{% else %}...{% endinclude %}"
+// fallback directly after an include. Inside if and for bodies the else may
+// belong to the enclosing statement instead, so a fallback that does not
+// parse there rewinds the stream and leaves the else to the parent.
+func (p *Parser) parseIncludeElse(include *nodes.Include) error {
+	stream := p.stream
+	if stream.Peek().Type != lexer.TokenBlockEnd || stream.PeekN(1).Type != lexer.TokenBlockStart ||
+		stream.PeekN(2).Type != lexer.TokenName || stream.PeekN(2).Value != "else" {
+		return nil
+	}
+
+	mark := stream.Position()
+	tagDepth, endDepth := len(p.tagStack), len(p.endTokenStack)
+	p.Skip(3) // consume block end, block start and 'else'
+	body, err := p.ParseStatements([]string{"name:endinclude"}, true)
+	if err != nil {
+		if !p.enclosingAcceptsElse() {
+			return err
+		}
+		stream.Seek(mark)
+		p.tagStack, p.endTokenStack = p.tagStack[:tagDepth], p.endTokenStack[:endDepth]
+		return nil
+	}
+	include.Else = body
+	return nil
+}
+
+// enclosingAcceptsElse reports whether the innermost open statement can
+// take an else branch of its own.
+func (p *Parser) enclosingAcceptsElse() bool {
+	if len(p.endTokenStack) == 0 {
+		return false
+	}
+	for _, rule := range p.endTokenStack[len(p.endTokenStack)-1] {
+		if rule == "name:else" {
+			return true
+		}
+	}
+	return false
+}
+
 // ParseNamespace parses a namespace declaration block
 func (p *Parser) ParseNamespace() (nodes.Node, error) {
 	lineno := p.stream.Next().Line // consume 'namespace'
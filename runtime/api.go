@@ -6,7 +6,6 @@ import (
 	"path/filepath"
 
 	"github.com/deicod/gojinja/nodes"
-	"github.com/deicod/gojinja/parser"
 )
 
 // Simple API functions for ease of use
@@ -80,24 +79,19 @@ func JoinPath(env *Environment, template, parent string) (string, error) {
 
 // ParseString parses a template string using this environment
 func (env *Environment) ParseString(templateString, name string) (*Template, error) {
-	parserEnv := &parser.Environment{
-		TrimBlocks:          env.trimBlocks,
-		LstripBlocks:        env.lstripBlocks,
-		KeepTrailingNewline: env.keepTrailingNewline,
-		LineStatementPrefix: env.lineStatementPrefix,
-		LineCommentPrefix:   env.lineCommentPrefix,
-		Extensions:          env.Extensions(),
-		EnableAsync:         env.IsAsyncEnabled(),
-	}
-
 	// Parse template using the parser
-	ast, err := parser.ParseTemplateWithEnv(parserEnv, templateString, name, name)
+	ast, trims, err := env.parseSource(templateString, name)
 	if err != nil {
-		return nil, WrapError(err, nodes.Position{}, nil)
+		return nil, err
 	}
 
 	// Create template from AST
-	return env.NewTemplateFromAST(ast, name)
+	tmpl, err := env.NewTemplateFromAST(ast, name)
+	if err != nil {
+		return nil, err
+	}
+	env.attachSourceInfo(tmpl, templateString, trims)
+	return tmpl, nil
 }
 
 // ExecuteToString is a convenience function that parses and renders a template string
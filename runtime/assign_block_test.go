@@ -73,3 +73,39 @@ func TestAssignBlockWithContext(t *testing.T) {
 		t.Fatalf("expected %q, got %q", expected, strings.TrimSpace(result))
 	}
 }
+
+func TestAssignBlockFilterChainMatchesExpressionForm(t *testing.T) {
+	chains := []string{
+		"upper|replace('A', 'b')",
+		"replace('a', 'b')|upper",
+		"trim|title|replace(' ', '-')",
+		"wordwrap(3, wrapstring='|')|upper",
+	}
+
+	for _, chain := range chains {
+		blockOut, err := ExecuteToString("{% set x|"+chain+" %}  aaa bbb {% endset %}{{ x }}", nil)
+		if err != nil {
+			t.Fatalf("block form %q: execute error: %v", chain, err)
+		}
+		exprOut, err := ExecuteToString("{% set x = '  aaa bbb '|"+chain+" %}{{ x }}", nil)
+		if err != nil {
+			t.Fatalf("expression form %q: execute error: %v", chain, err)
+		}
+		if blockOut != exprOut {
+			t.Fatalf("chain %q: block form gave %q, expression form gave %q", chain, blockOut, exprOut)
+		}
+	}
+}
+
+func TestAssignBlockAutoescapeCapturesMarkup(t *testing.T) {
+	env := NewEnvironment()
+	env.SetAutoescape(true)
+
+	out, err := ExecuteToStringWithEnvironment(env, "{% set x %}<b>{{ value }}</b>{% endset %}{{ x }}", map[string]interface{}{"value": "<i>"})
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	if out != "<b>&lt;i&gt;</b>" {
+		t.Fatalf("expected captured block not to be escaped twice, got %q", out)
+	}
+}
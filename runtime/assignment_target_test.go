@@ -1,6 +1,7 @@
 package runtime
 
 import (
+	"errors"
 	"strings"
 	"testing"
 )
@@ -181,3 +182,65 @@ func TestSetNestedIndexAndAttribute(t *testing.T) {
 		t.Fatalf("expected nested index assignment to update value, got %q", strings.TrimSpace(result))
 	}
 }
+
+func TestSetTupleFromCallResult(t *testing.T) {
+	env := NewEnvironment()
+	env.AddGlobal("split_name", func(full string) []string {
+		return strings.SplitN(full, " ", 2)
+	})
+	env.AddGlobal("split_pair", func(pair string) (string, string, error) {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return "", "", errors.New("missing '='")
+		}
+		return key, value, nil
+	})
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{`{% set first, last = split_name("Ada Lovelace") %}{{ last }}, {{ first }}`, "Lovelace, Ada"},
+		{`{% set key, value = split_pair("lang=go") %}{{ key }}:{{ value }}`, "lang:go"},
+		{`{% set x, y = point() %}{{ x }}/{{ y }}`, "1/2"},
+		{`{% set a, (b, c) = nested() %}{{ a }}{{ b }}{{ c }}`, "xyz"},
+		{`{% macro pair() %}ok{% endmacro %}{% set a, b = pair() %}{{ b }}{{ a }}`, "ko"},
+		{`{% set a, b = "é!" %}{{ b }}{{ a }}`, "!é"},
+	}
+
+	vars := map[string]interface{}{
+		"point": func() [2]int { return [2]int{1, 2} },
+		"nested": func() []interface{} {
+			return []interface{}{"x", []string{"y", "z"}}
+		},
+	}
+	for _, tt := range tests {
+		tmpl, err := env.ParseString(tt.template, "tuple")
+		if err != nil {
+			t.Fatalf("%s: parse error: %v", tt.template, err)
+		}
+		result, err := tmpl.ExecuteToString(vars)
+		if err != nil {
+			t.Fatalf("%s: execute error: %v", tt.template, err)
+		}
+		if result != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, result)
+		}
+	}
+
+	tmpl, err := env.ParseString(`{% set key, value = split_pair("lang") %}`, "tuple_error")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if _, err := tmpl.ExecuteToString(nil); err == nil || !strings.Contains(err.Error(), "missing '='") {
+		t.Fatalf("expected function error, got %v", err)
+	}
+
+	tmpl, err = env.ParseString(`{% set a, b, c = split_name("Ada Lovelace") %}`, "tuple_size")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if _, err := tmpl.ExecuteToString(nil); err == nil || !strings.Contains(err.Error(), "size mismatch") {
+		t.Fatalf("expected size mismatch error, got %v", err)
+	}
+}
@@ -1,6 +1,11 @@
 package runtime
 
-import "testing"
+import (
+	"html/template"
+	"strings"
+	"sync"
+	"testing"
+)
 
 func TestEnvironmentAutoescapeDefaults(t *testing.T) {
 	env := NewEnvironment()
@@ -157,3 +162,188 @@ func TestSelectAutoescapeIntegration(t *testing.T) {
 		t.Fatalf("expected environment selector to use default false for unmatched extensions")
 	}
 }
+
+func TestAutoescapeMarkupFiltersEscapeOnce(t *testing.T) {
+	env := NewEnvironment()
+	env.SetAutoescape(true)
+
+	vars := map[string]interface{}{
+		"value":  "<b>&</b>",
+		"markup": Markup("<b>&amp;</b>"),
+	}
+	cases := []struct {
+		name string
+		tpl  string
+		want string
+	}{
+		{"escape then safe", "{{ value|e|safe }}", "&lt;b&gt;&amp;&lt;/b&gt;"},
+		{"safe twice", "{{ value|safe|safe }}", "<b>&</b>"},
+		{"escape twice", "{{ value|e|e }}", "&lt;b&gt;&amp;&lt;/b&gt;"},
+		{"markup escape", "{{ markup|e }}", "<b>&amp;</b>"},
+		{"markup forceescape", "{{ markup|forceescape }}", "&lt;b&gt;&amp;amp;&lt;/b&gt;"},
+		{"markup plain", "{{ markup }}", "<b>&amp;</b>"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := ExecuteToStringWithEnvironment(env, tt.tpl, vars)
+			if err != nil {
+				t.Fatalf("execution error: %v", err)
+			}
+			if out != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, out)
+			}
+		})
+	}
+}
+
+func TestAutoescapeHTMLTemplateTypesRenderUnescaped(t *testing.T) {
+	env := NewEnvironment()
+	env.SetAutoescape(true)
+
+	out, err := ExecuteToStringWithEnvironment(env, "{{ snippet }}|{{ script }}|{{ plain }}", map[string]interface{}{
+		"snippet": template.HTML("<p>Hi & bye</p>"),
+		"script":  template.JS("a < b && c"),
+		"plain":   "<p>",
+	})
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if out != "<p>Hi & bye</p>|a < b && c|&lt;p&gt;" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+}
+
+func TestEscapeFilterUsesEnvironmentEscapeFunc(t *testing.T) {
+	env := NewEnvironment()
+	env.SetEscapeFunc(func(value string) string {
+		return "[" + value + "]"
+	})
+
+	out, err := ExecuteToStringWithEnvironment(env, "{{ value|e }}|{{ value|forceescape }}", map[string]interface{}{"value": "<x>"})
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if out != "[<x>]|[<x>]" {
+		t.Fatalf("expected custom escaper output, got %q", out)
+	}
+
+	env.SetAutoescape(true)
+	out, err = ExecuteToStringWithEnvironment(env, "{{ value|e }}|{{ value }}", map[string]interface{}{"value": "<x>"})
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if out != "[<x>]|[<x>]" {
+		t.Fatalf("expected escape filter result not to be escaped again, got %q", out)
+	}
+
+	out, err = ExecuteToStringWithEnvironment(env, "{{ '<b>'|safe + value }}|{{ value + '<b>'|safe }}|{{ '<b>'|safe|replace('b'|safe, value) }}", map[string]interface{}{"value": "<x>"})
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if out != "<b>[<x>]|[<x>]<b>|<[<x>]>" {
+		t.Fatalf("expected markup operations to use the custom escaper, got %q", out)
+	}
+
+	env.SetEscapeFunc(nil)
+	out, err = ExecuteToStringWithEnvironment(env, "{{ value|e }}", map[string]interface{}{"value": "<x>"})
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if out != "&lt;x&gt;" {
+		t.Fatalf("expected default escaping after reset, got %q", out)
+	}
+}
+
+func TestEscapeFilterWithoutEnvironment(t *testing.T) {
+	out, err := filterEscape(nil, "<x>")
+	if err != nil {
+		t.Fatalf("escape error: %v", err)
+	}
+	if out != Markup("&lt;x&gt;") {
+		t.Fatalf("expected default HTML escaping, got %q", out)
+	}
+}
+
+func TestTemplateSetAutoescapeOverridesName(t *testing.T) {
+	env := NewEnvironment()
+	tmpl, err := env.NewTemplateWithName("{{ value }}|{{ value|safe }}", "notes.txt")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if tmpl.Autoescape() {
+		t.Fatal("expected .txt template to disable autoescape")
+	}
+
+	tmpl.SetAutoescape(true)
+	out, err := tmpl.ExecuteToString(map[string]interface{}{"value": "<b>"})
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	if out != "&lt;b&gt;|<b>" {
+		t.Fatalf("expected forced escaping, got %q", out)
+	}
+
+	tmpl.SetAutoescape(false)
+	out, err = tmpl.ExecuteToString(map[string]interface{}{"value": "<b>"})
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	if out != "<b>|<b>" {
+		t.Fatalf("expected unescaped output, got %q", out)
+	}
+}
+
+func TestTemplateSetAutoescapeThroughEnvironment(t *testing.T) {
+	vars := map[string]interface{}{"value": "<b>"}
+	for _, sandboxed := range []bool{false, true} {
+		env := NewEnvironment()
+		env.SetSandboxed(sandboxed)
+		tmpl, err := env.NewTemplateWithName("{{ value }}", "notes.txt")
+		if err != nil {
+			t.Fatalf("parse error: %v", err)
+		}
+		tmpl.SetAutoescape(true)
+
+		out, err := env.ExecuteToString(tmpl, vars)
+		if err != nil {
+			t.Fatalf("sandboxed=%t: execute error: %v", sandboxed, err)
+		}
+		if out != "&lt;b&gt;" {
+			t.Fatalf("sandboxed=%t: expected escaped output from ExecuteToString, got %q", sandboxed, out)
+		}
+
+		var buf strings.Builder
+		if err := env.ExecuteTemplate(tmpl, vars, &buf); err != nil {
+			t.Fatalf("sandboxed=%t: execute error: %v", sandboxed, err)
+		}
+		if buf.String() != "&lt;b&gt;" {
+			t.Fatalf("sandboxed=%t: expected escaped output from ExecuteTemplate, got %q", sandboxed, buf.String())
+		}
+	}
+}
+
+func TestTemplateSetAutoescapeConcurrentWithRender(t *testing.T) {
+	env := NewEnvironment()
+	tmpl, err := env.NewTemplateWithName("{{ value }}", "notes.txt")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				tmpl.SetAutoescape((i+j)%2 == 0)
+				out, err := env.ExecuteToString(tmpl, map[string]interface{}{"value": "<b>"})
+				if err != nil || (out != "<b>" && out != "&lt;b&gt;") {
+					t.Errorf("unexpected render %q (%v)", out, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
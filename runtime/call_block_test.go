@@ -113,3 +113,74 @@ func TestCallBlockMissingKeywordOnlyArgument(t *testing.T) {
 		t.Fatalf("expected execution error for missing keyword-only argument")
 	}
 }
+
+func TestCallBlockCaptureIntoVariable(t *testing.T) {
+	env := NewEnvironment()
+	env.AddGlobal("sum_caller", GlobalFunc(func(ctx *Context, args ...interface{}) (interface{}, error) {
+		caller, _ := ctx.Get("caller")
+		total := 0
+		for _, arg := range args {
+			out, err := caller.(GlobalFunc)(ctx, arg)
+			if err != nil {
+				return nil, err
+			}
+			total += len(strings.TrimSpace(string(out.(Markup))))
+		}
+		return total, nil
+	}))
+
+	source := `{% macro total() %}{{ caller(2) }}{% endmacro %}` +
+		`{% set x = call(n) total() %}{{ n * 21 }}{% endcall %}` +
+		`{% set width = call(word) sum_caller("ab", "cde") %}{{ word }}{% endcall %}` +
+		`[{{ x }}|{{ width + 1 }}]`
+	out, err := ExecuteToStringWithEnvironment(env, source, nil)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	if out != "[42|6]" {
+		t.Fatalf("expected %q, got %q", "[42|6]", out)
+	}
+}
+
+func TestSetWithCallExpressionIsNotCallBlock(t *testing.T) {
+	env := NewEnvironment()
+	env.AddGlobal("call", GlobalFunc(func(ctx *Context, args ...interface{}) (interface{}, error) {
+		return args[0], nil
+	}))
+
+	source := `{% set x = call(1) if true else 2 %}{% set y = call(3) and call(4) %}` +
+		`{% set z = call(5) in [5] %}{{ x }}|{{ y }}|{{ z }}`
+	out, err := ExecuteToStringWithEnvironment(env, source, nil)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	if out != "1|4|true" {
+		t.Fatalf("expected %q, got %q", "1|4|true", out)
+	}
+}
+
+func TestCallBlockSpreadsDynamicArguments(t *testing.T) {
+	source := `{% macro join(a, b) %}{{ caller(a ~ b) }}{% endmacro %}` +
+		`{% call(pair) join(*words) %}[{{ pair }}]{% endcall %}`
+	out, err := ExecuteToString(source, map[string]interface{}{"words": []string{"x", "y"}})
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	if out != "[xy]" {
+		t.Fatalf("expected %q, got %q", "[xy]", out)
+	}
+}
+
+func TestCallBlockSpreadsDynamicKeywordArguments(t *testing.T) {
+	source := `{% macro greet(name, punct='.') %}{{ caller(name ~ punct) }}{% endmacro %}` +
+		`{% call(text) greet(**opts) %}<{{ text }}>{% endcall %}`
+	out, err := ExecuteToString(source, map[string]interface{}{
+		"opts": map[string]interface{}{"name": "ann", "punct": "!"},
+	})
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	if out != "<ann!>" {
+		t.Fatalf("expected %q, got %q", "<ann!>", out)
+	}
+}
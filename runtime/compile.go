@@ -0,0 +1,91 @@
+package runtime
+
+import (
+	"sort"
+
+	"github.com/deicod/gojinja/nodes"
+)
+
+// CompiledTemplate is a parsed template together with metadata collected
+// from its AST. It is intended for tooling and caching layers that need to
+// inspect a template without rendering it.
+type CompiledTemplate struct {
+	Template *Template
+	Name     string
+	// Blocks lists the names of blocks defined in the template.
+	Blocks []string
+	// Macros lists the names of macros defined in the template.
+	Macros []string
+	// Globals lists the globals the template references, including the
+	// built-in helpers such as range and environment globals.
+	Globals []string
+	// Extends reports whether the template extends a parent.
+	Extends bool
+	// Parent holds the parent template name when it is a constant string.
+	Parent string
+}
+
+// Compile parses source into a template and gathers its metadata without
+// rendering it. The template is built like NewTemplateFromSource, so parent
+// templates are resolved through the loader and the result is cached under
+// name.
+func (env *Environment) Compile(source, name string) (*CompiledTemplate, error) {
+	if name == "" {
+		name = "template"
+	}
+
+	ast, _, err := env.parseSource(source, name)
+	if err != nil {
+		return nil, err
+	}
+
+	compiled := &CompiledTemplate{Name: name}
+
+	globals := NewContextWithEnvironment(env, nil).scope.All()
+	blocks := make(map[string]bool)
+	macros := make(map[string]bool)
+	used := make(map[string]bool)
+	nodes.Walk(nodes.NodeVisitorFunc(func(node nodes.Node) interface{} {
+		switch n := node.(type) {
+		case *nodes.Block:
+			blocks[n.Name] = true
+		case *nodes.Macro:
+			macros[n.Name] = true
+		case *nodes.Extends:
+			compiled.Extends = true
+			if c, ok := n.Template.(*nodes.Const); ok {
+				if parent, ok := c.Value.(string); ok {
+					compiled.Parent = parent
+				}
+			}
+		case *nodes.Name:
+			if n.Ctx == "store" || n.Ctx == "param" {
+				return nil
+			}
+			if _, ok := globals[n.Name]; ok {
+				used[n.Name] = true
+			}
+		}
+		return nil
+	}), ast)
+	compiled.Blocks = sortedNames(blocks)
+	compiled.Macros = sortedNames(macros)
+	compiled.Globals = sortedNames(used)
+
+	tmpl, err := env.buildTemplate(ast, name)
+	if err != nil {
+		return nil, err
+	}
+	compiled.Template = tmpl
+
+	return compiled, nil
+}
+
+func sortedNames(set map[string]bool) []string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
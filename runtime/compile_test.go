@@ -0,0 +1,65 @@
+package runtime
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEnvironmentCompileMetadata(t *testing.T) {
+	env := NewEnvironment()
+	env.SetLoader(NewMapLoader(map[string]string{
+		"base.html": "<title>{% block title %}{% endblock %}</title>{% block body %}{% endblock %}",
+	}))
+	env.AddGlobal("site_name", func(ctx *Context, args ...interface{}) (interface{}, error) {
+		return "Example", nil
+	})
+
+	source := `{% extends "base.html" %}
+{% block title %}{{ site_name() }}{% endblock %}
+{% block body %}{% macro card(item) %}<div>{{ item }}</div>{% endmacro %}{% for i in range(2) %}{{ card(i) }}{% endfor %}{% endblock %}`
+
+	compiled, err := env.Compile(source, "page.html")
+	if err != nil {
+		t.Fatalf("compile error: %v", err)
+	}
+
+	if !compiled.Extends || compiled.Parent != "base.html" {
+		t.Fatalf("expected template to extend base.html, got extends=%v parent=%q", compiled.Extends, compiled.Parent)
+	}
+	if !reflect.DeepEqual(compiled.Blocks, []string{"body", "title"}) {
+		t.Fatalf("unexpected blocks: %v", compiled.Blocks)
+	}
+	if !reflect.DeepEqual(compiled.Macros, []string{"card"}) {
+		t.Fatalf("unexpected macros: %v", compiled.Macros)
+	}
+	if !reflect.DeepEqual(compiled.Globals, []string{"range", "site_name"}) {
+		t.Fatalf("unexpected globals: %v", compiled.Globals)
+	}
+
+	out, err := compiled.Template.ExecuteToString(nil)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if out != "<title>Example</title><div>0</div><div>1</div>" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+}
+
+func TestEnvironmentCompileStandalone(t *testing.T) {
+	env := NewEnvironment()
+
+	compiled, err := env.Compile("{% set x = 1 %}{{ x }}", "plain")
+	if err != nil {
+		t.Fatalf("compile error: %v", err)
+	}
+	if compiled.Extends || compiled.Parent != "" {
+		t.Fatalf("expected standalone template, got extends=%v parent=%q", compiled.Extends, compiled.Parent)
+	}
+	if len(compiled.Blocks) != 0 || len(compiled.Macros) != 0 || len(compiled.Globals) != 0 {
+		t.Fatalf("expected no metadata, got %+v", compiled)
+	}
+
+	if _, err := env.Compile("{% if %}", "broken"); err == nil {
+		t.Fatal("expected syntax error to be reported")
+	}
+}
@@ -1,11 +1,16 @@
 package runtime
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/deicod/gojinja/nodes"
 )
@@ -174,6 +179,8 @@ type Context struct {
 	scope           *Scope
 	autoescape      bool
 	writer          io.Writer
+	writeErr        error
+	errorLogged     bool
 	securityContext *SecurityContext
 
 	// Loop handling
@@ -195,6 +202,15 @@ type Context struct {
 	// Import handling
 	importManager *ImportManager
 
+	// Random number generation shared by filters during a render
+	random *rand.Rand
+
+	// Globals scoped to a single render
+	renderGlobals map[string]interface{}
+
+	// Filters scoped to a single render, consulted before the environment's
+	localFilters map[string]FilterFunc
+
 	// Concurrency safety
 	mu sync.RWMutex
 }
@@ -233,6 +249,78 @@ func NewContextWithEnvironment(env *Environment, vars map[string]interface{}) *C
 	return ctx
 }
 
+// Derived creates a child context that shares the environment, writer,
+// autoescape mode, and template state of ctx but resolves variables from a
+// snapshot of the current scopes overlaid with overrides. Assignments made
+// while rendering with the derived context never reach ctx.
+func (ctx *Context) Derived(overrides map[string]interface{}) *Context {
+	ctx.mu.RLock()
+	vars := ctx.scope.All()
+	derived := &Context{
+		environment:     ctx.environment,
+		autoescape:      ctx.autoescape,
+		writer:          ctx.writer,
+		securityContext: ctx.securityContext,
+		parent:          ctx.parent,
+		current:         ctx.current,
+		importManager:   ctx.importManager,
+		blocks:          make(map[string]*nodes.Block, len(ctx.blocks)),
+	}
+	for name, block := range ctx.blocks {
+		derived.blocks[name] = block
+	}
+	if ctx.renderGlobals != nil {
+		derived.renderGlobals = make(map[string]interface{}, len(ctx.renderGlobals))
+		for name, value := range ctx.renderGlobals {
+			derived.renderGlobals[name] = value
+		}
+	}
+	if ctx.localFilters != nil {
+		derived.localFilters = make(map[string]FilterFunc, len(ctx.localFilters))
+		for name, filter := range ctx.localFilters {
+			derived.localFilters[name] = filter
+		}
+	}
+	ctx.mu.RUnlock()
+
+	for k, v := range overrides {
+		vars[k] = v
+	}
+	derived.scope = NewScope()
+	for k, v := range vars {
+		derived.scope.Set(k, v)
+	}
+	derived.loopStack = make([]*LoopContext, 0)
+	derived.macroStack = make([]*Macro, 0)
+	derived.callerStack = make([]*MacroCaller, 0)
+	derived.errors = make([]error, 0)
+
+	return derived
+}
+
+// RenderString parses source with the context's environment and renders it
+// against a derived copy of the context, returning the output. This lets
+// globals and extensions render snippets without mutating the caller's state.
+func (ctx *Context) RenderString(source string) (string, error) {
+	if ctx.environment == nil {
+		return "", NewError(ErrorTypeTemplate, "cannot render without an environment", nodes.Position{}, nil)
+	}
+
+	tmpl, err := ctx.environment.ParseString(source, "template")
+	if err != nil {
+		return "", err
+	}
+
+	derived := ctx.Derived(nil)
+	var buf strings.Builder
+	derived.writer = &buf
+	derived.current = tmpl
+	if err := tmpl.ExecuteWithContext(derived); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
 // addGlobals adds global variables from the environment
 func (ctx *Context) addGlobals() {
 	if ctx.environment == nil {
@@ -256,18 +344,106 @@ func (ctx *Context) addGlobals() {
 		return c.joinerFunc(args...)
 	}
 
-	ctx.scope.Set("range", GlobalFunc(rangeWrapper))
-	ctx.scope.Set("lipsum", GlobalFunc(lipsumWrapper))
-	ctx.scope.Set("dict", GlobalFunc(dictWrapper))
-	ctx.scope.Set("cycler", GlobalFunc(cyclerWrapper))
-	ctx.scope.Set("joiner", GlobalFunc(joinerWrapper))
+	// Globals never shadow variables passed to the render
+	setGlobal := func(name string, value interface{}) {
+		if _, exists := ctx.scope.vars[name]; exists {
+			return
+		}
+		ctx.scope.Set(name, value)
+	}
+
+	// Default variables are data, so they rank above every global
+	ctx.environment.mu.RLock()
+	defaults := ctx.environment.defaultVars
+	ctx.environment.mu.RUnlock()
+	for name, value := range defaults {
+		setGlobal(name, value)
+	}
+
+	setGlobal("range", GlobalFunc(rangeWrapper))
+	setGlobal("lipsum", GlobalFunc(lipsumWrapper))
+	setGlobal("dict", GlobalFunc(dictWrapper))
+	setGlobal("cycler", GlobalFunc(cyclerWrapper))
+	setGlobal("joiner", GlobalFunc(joinerWrapper))
 
 	// Add custom globals from environment
 	for name, globalFunc := range ctx.environment.globals {
-		ctx.scope.Set(name, globalFunc)
+		setGlobal(name, globalFunc)
+	}
+}
+
+// setRenderGlobals installs globals that only apply to the current render.
+// They take precedence over environment globals but never over variables
+// passed to the render, giving the order: render vars > render globals >
+// environment globals. The globals are remembered so that contexts created
+// for includes and imports see them too.
+func (ctx *Context) setRenderGlobals(globals map[string]interface{}, vars map[string]interface{}) {
+	if len(globals) == 0 {
+		return
+	}
+
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	ctx.renderGlobals = make(map[string]interface{}, len(globals))
+	root := ctx.rootScope()
+	for name, value := range globals {
+		ctx.renderGlobals[name] = value
+		if _, isVar := vars[name]; isVar {
+			continue
+		}
+		root.Set(name, value)
 	}
 }
 
+// RenderGlobals returns a copy of the per-render globals for this context.
+func (ctx *Context) RenderGlobals() map[string]interface{} {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+	if len(ctx.renderGlobals) == 0 {
+		return nil
+	}
+	result := make(map[string]interface{}, len(ctx.renderGlobals))
+	for k, v := range ctx.renderGlobals {
+		result[k] = v
+	}
+	return result
+}
+
+// SetWriter sets the writer that Template.ExecuteWithContext renders into.
+func (ctx *Context) SetWriter(w io.Writer) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.writer = w
+}
+
+// AddLocalFilter registers a filter for renders using this context only. It
+// shadows an environment filter of the same name without modifying the
+// environment, and is visible to included templates.
+func (ctx *Context) AddLocalFilter(name string, filter FilterFunc) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.localFilters == nil {
+		ctx.localFilters = make(map[string]FilterFunc)
+	}
+	ctx.localFilters[name] = filter
+}
+
+// lookupFilter resolves a filter by name, preferring local filters.
+func (ctx *Context) lookupFilter(name string) (FilterFunc, bool) {
+	ctx.mu.RLock()
+	filter, ok := ctx.localFilters[name]
+	env := ctx.environment
+	ctx.mu.RUnlock()
+	if ok {
+		return filter, true
+	}
+	if env == nil {
+		return nil, false
+	}
+	return env.GetFilter(name)
+}
+
 func (ctx *Context) rootScope() *Scope {
 	scope := ctx.scope
 	for scope.parent != nil {
@@ -308,6 +484,40 @@ func (ctx *Context) Get(name string) (interface{}, bool) {
 	return ctx.scope.Get(name)
 }
 
+// GetVar looks up name in the active scopes, then in the per-render globals
+// and finally in the environment globals. Unlike Resolve it reports missing
+// names instead of returning an undefined value.
+func (ctx *Context) GetVar(name string) (interface{}, bool) {
+	ctx.mu.RLock()
+	if name == "loop" && ctx.currentLoop != nil {
+		loop := ctx.currentLoop
+		ctx.mu.RUnlock()
+		return loop, true
+	}
+	value, ok := ctx.scope.Get(name)
+	if !ok {
+		value, ok = ctx.renderGlobals[name]
+	}
+	env := ctx.environment
+	ctx.mu.RUnlock()
+
+	if !ok && env != nil {
+		var global GlobalFunc
+		if global, ok = env.GetGlobal(name); ok {
+			value = global
+		}
+	}
+	return value, ok
+}
+
+// Vars returns a snapshot of the variables visible from the current scope.
+// The map is a copy, so changing it does not affect the context.
+func (ctx *Context) Vars() map[string]interface{} {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+	return ctx.scope.All()
+}
+
 // Exports returns a copy of all exported variables from the root scope
 func (ctx *Context) Exports() map[string]interface{} {
 	ctx.mu.RLock()
@@ -428,20 +638,38 @@ func (ctx *Context) PopLoop() {
 
 // cycle returns the next value in the provided argument list based on the current index.
 // This mirrors Jinja's loop.cycle helper which expects at least one argument and rotates
-// values using the loop's zero-based index.
+// values using the loop's zero-based index. A single list argument is treated as the
+// values to cycle through, so loop.cycle(classes) behaves like loop.cycle(*classes).
 func (loop *LoopContext) cycle(args ...interface{}) (interface{}, error) {
+	items, err := cycleItems(args)
+	if err != nil {
+		return nil, err
+	}
+	return cycleValue(items, loop.Index0), nil
+}
+
+// cycleItems normalises the arguments of loop.cycle and cycler(): a single
+// list argument supplies the items, otherwise each argument is one item.
+func cycleItems(args []interface{}) ([]interface{}, error) {
+	if len(args) == 1 {
+		if items, ok := sliceValues(args[0]); ok {
+			args = items
+		}
+	}
 	if len(args) == 0 {
 		return nil, fmt.Errorf("no items for cycling given")
 	}
+	return args, nil
+}
 
-	length := len(args)
-	// Guard against unexpected negative indexes even though Index0 should never be negative.
-	idx := loop.Index0 % length
+// cycleValue selects the item for position index, wrapping around the end.
+func cycleValue(items []interface{}, index int) interface{} {
+	// Guard against unexpected negative indexes even though positions never are.
+	idx := index % len(items)
 	if idx < 0 {
-		idx += length
+		idx += len(items)
 	}
-
-	return args[idx], nil
+	return items[idx]
 }
 
 // changed reports whether the provided values differ from the values supplied on the previous
@@ -469,6 +697,25 @@ func cloneArgs(args []interface{}) []interface{} {
 	return cloned
 }
 
+// Random returns the random number generator used by filters such as random
+// and shuffle. The generator is created lazily on first use and seeded from
+// the environment's random seed when configured, otherwise from the clock.
+func (ctx *Context) Random() *rand.Rand {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if ctx.random == nil {
+		seed := time.Now().UnixNano()
+		if ctx.environment != nil {
+			if envSeed, ok := ctx.environment.RandomSeed(); ok {
+				seed = envSeed
+			}
+		}
+		ctx.random = rand.New(rand.NewSource(seed))
+	}
+	return ctx.random
+}
+
 // CurrentLoop returns the current loop context
 func (ctx *Context) CurrentLoop() *LoopContext {
 	ctx.mu.RLock()
@@ -556,11 +803,50 @@ func (ctx *Context) ResolveAttribute(obj interface{}, attr string) (interface{},
 	}
 
 	if ctx.environment != nil {
-		return ctx.environment.resolveValue(obj, attr)
+		if resolver := ctx.environment.AttributeResolver(); resolver != nil {
+			if value, ok, err := resolver(obj, attr); err != nil || ok {
+				return value, err
+			}
+		}
 	}
 
-	// Fallback implementation using reflection
-	return resolveAttributeFallback(obj, attr)
+	var value interface{}
+	var err error
+	if ctx.environment != nil {
+		value, err = ctx.environment.resolveValue(obj, attr)
+	} else {
+		// Fallback implementation using reflection
+		value, err = resolveAttributeFallback(obj, attr)
+	}
+
+	// Like Jinja, fall back to item access when no attribute matches so that
+	// a numeric attribute such as attr('0') reaches list elements. A lenient
+	// environment reports the miss as an undefined value rather than an error.
+	_, missing := value.(undefinedType)
+	if missing || (err != nil && IsUndefinedError(err)) {
+		if idx, convErr := strconv.Atoi(attr); convErr == nil {
+			if item, itemErr := ctx.ResolveIndex(obj, idx); itemErr == nil && !isUndefinedValue(item) {
+				return item, nil
+			}
+		}
+	}
+	if err != nil && IsUndefinedError(err) {
+		if undef, ok := ctx.chainableUndefined(attr); ok {
+			return undef, nil
+		}
+	}
+	return value, err
+}
+
+// chainableUndefined returns the environment's undefined value for a missing
+// attribute or item when it is ChainableUndefined, so that a chain such as
+// a.b.c renders empty instead of failing at the first missing link.
+func (ctx *Context) chainableUndefined(name string) (interface{}, bool) {
+	if ctx.environment == nil {
+		return nil, false
+	}
+	undef, ok := ctx.environment.newUndefined(name).(ChainableUndefined)
+	return undef, ok
 }
 
 func buildAttributePath(obj interface{}, attr string) string {
@@ -602,12 +888,46 @@ func (ctx *Context) ResolveIndex(obj interface{}, index interface{}) (interface{
 		return undef, nil
 	}
 
+	var value interface{}
+	var err error
 	if ctx.environment != nil {
-		return ctx.environment.resolveIndex(obj, index)
+		value, err = ctx.environment.resolveIndex(obj, index)
+	} else {
+		// Fallback implementation using reflection
+		value, err = resolveIndexFallback(obj, index)
+	}
+
+	// foo['name'] falls back to attribute lookup for values that do not
+	// support item access, such as structs. ResolveAttribute applies the
+	// sandbox attribute checks.
+	if err != nil {
+		if name, ok := index.(string); ok && !supportsItemAccess(obj) {
+			return ctx.ResolveAttribute(obj, name)
+		}
+		if IsUndefinedError(err) {
+			if undef, ok := ctx.chainableUndefined(fmt.Sprintf("%v", index)); ok {
+				return undef, nil
+			}
+		}
 	}
+	return value, err
+}
 
-	// Fallback implementation using reflection
-	return resolveIndexFallback(obj, index)
+// supportsItemAccess reports whether obj is a map, sequence or string, the
+// values that resolve string indexes as items rather than attributes.
+func supportsItemAccess(obj interface{}) bool {
+	val := reflect.ValueOf(obj)
+	for val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface {
+		if val.IsNil() {
+			return false
+		}
+		val = val.Elem()
+	}
+	switch val.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.String:
+		return true
+	}
+	return false
 }
 
 // AddError adds an error to the context
@@ -794,6 +1114,13 @@ func resolveAttributeFallback(obj interface{}, attr string) (interface{}, error)
 
 // resolveIndexFallback is a fallback for index resolution
 func resolveIndexFallback(obj interface{}, index interface{}) (interface{}, error) {
+	if group, ok := obj.(*groupbyGroup); ok {
+		obj = group.tuple()
+	}
+	if spec, ok := index.(sliceIndex); ok {
+		return sliceValue(obj, spec)
+	}
+
 	val := reflect.ValueOf(obj)
 
 	// Handle pointers
@@ -844,35 +1171,7 @@ func resolveIndexFallback(obj interface{}, index interface{}) (interface{}, erro
 
 		return val.Index(idx).Interface(), nil
 	case reflect.String:
-		// Handle string indexing to return characters
-		str := val.String()
-		var idx int
-		switch i := index.(type) {
-		case int:
-			idx = i
-		case int64:
-			idx = int(i)
-		case float64:
-			idx = int(i)
-		default:
-			return nil, NewError(ErrorTypeTemplate,
-				fmt.Sprintf("invalid index type: %T", index),
-				nodes.Position{}, nil)
-		}
-
-		// Handle negative indices
-		if idx < 0 {
-			idx = len(str) + idx
-		}
-
-		if idx < 0 || idx >= len(str) {
-			return nil, NewError(ErrorTypeRange,
-				fmt.Sprintf("index %d out of range", idx),
-				nodes.Position{}, nil)
-		}
-
-		// Return character as string, not rune/byte
-		return string(str[idx]), nil
+		return indexString(val.String(), index)
 	}
 
 	return nil, NewError(ErrorTypeTemplate,
@@ -936,42 +1235,97 @@ func (ctx *Context) lipsumFunc(args ...interface{}) (interface{}, error) {
 	return lorem, nil
 }
 
+// dictFunc implements dict(). Arguments are applied in order with later keys
+// winning: mappings are merged, sequences of [key, value] pairs are added, a
+// string is a key followed by its value, and keyword arguments come last. The
+// result is a map[interface{}]interface{} like a dict literal.
 func (ctx *Context) dictFunc(args ...interface{}) (interface{}, error) {
-	result := make(map[string]interface{})
+	result := make(map[interface{}]interface{})
 
-	remaining := args
-	if len(remaining) > 0 {
-		if kwargMap, ok := toStringInterfaceMap(remaining[len(remaining)-1]); ok {
-			for k, v := range kwargMap {
-				result[k] = v
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if key, ok := arg.(string); ok {
+			if i+1 >= len(args) {
+				return nil, NewError(ErrorTypeTemplate, "dict() requires name/value pairs", nodes.Position{}, nil)
 			}
-			remaining = remaining[:len(remaining)-1]
+			result[key] = args[i+1]
+			i++
+			continue
+		}
+		if copyMapEntries(result, arg) {
+			continue
+		}
+		if !isFlattenableSequence(arg) {
+			return nil, NewError(ErrorTypeTemplate, fmt.Sprintf("dict() cannot build a mapping from %T", arg), nodes.Position{}, nil)
+		}
+		pairs, err := sequenceToSlice(arg)
+		if err != nil {
+			return nil, err
+		}
+		for _, pair := range pairs {
+			if !isFlattenableSequence(pair) {
+				return nil, NewError(ErrorTypeTemplate, "dict() sequence items must be [key, value] pairs", nodes.Position{}, nil)
+			}
+			entry, err := sequenceToSlice(pair)
+			if err != nil {
+				return nil, err
+			}
+			if len(entry) != 2 {
+				return nil, NewError(ErrorTypeTemplate, "dict() sequence items must be [key, value] pairs", nodes.Position{}, nil)
+			}
+			result[entry[0]] = entry[1]
 		}
 	}
 
-	if len(remaining)%2 != 0 {
-		return nil, NewError(ErrorTypeTemplate, "dict() requires name/value pairs", nodes.Position{}, nil)
+	return result, nil
+}
+
+// templateExistsFunc implements template_exists(name).
+func (ctx *Context) templateExistsFunc(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, NewError(ErrorTypeTemplate, "template_exists() requires a template name", nodes.Position{}, nil)
 	}
+	return testTemplateExists(ctx, args[0])
+}
 
-	for i := 0; i < len(remaining); i += 2 {
-		key, ok := remaining[i].(string)
-		if !ok {
-			return nil, NewError(ErrorTypeTemplate, "dict() keys must be strings", nodes.Position{}, nil)
-		}
-		result[key] = remaining[i+1]
+// getattrFunc implements getattr(obj, name[, default]) for attribute access
+// by a computed name. Lookups go through ResolveAttribute so sandbox checks
+// apply; the default is returned only when the attribute is missing.
+func (ctx *Context) getattrFunc(args ...interface{}) (interface{}, error) {
+	kwargs, args := extractKwargs(args)
+	if len(args) < 2 || len(args) > 3 {
+		return nil, NewError(ErrorTypeTemplate, "getattr() requires an object, an attribute name and an optional default", nodes.Position{}, nil)
 	}
 
-	return result, nil
+	fallback, hasDefault := kwargs["default"]
+	if len(args) == 3 {
+		fallback, hasDefault = args[2], true
+	}
+
+	value, err := ctx.ResolveAttribute(args[0], toString(args[1]))
+	if err != nil {
+		if hasDefault && IsUndefinedError(err) {
+			return fallback, nil
+		}
+		return nil, err
+	}
+	if _, ok := value.(undefinedType); ok && hasDefault {
+		return fallback, nil
+	}
+	return value, nil
 }
 
 func (ctx *Context) cyclerFunc(args ...interface{}) (interface{}, error) {
-	// Simple cycler implementation
 	if len(args) == 0 {
 		return nil, NewError(ErrorTypeTemplate, "cycler() requires at least one argument", nodes.Position{}, nil)
 	}
+	items, err := cycleItems(args)
+	if err != nil {
+		return nil, NewError(ErrorTypeTemplate, err.Error(), nodes.Position{}, nil)
+	}
 
 	return &cycler{
-		items: args,
+		items: items,
 		index: 0,
 	}, nil
 }
@@ -1066,8 +1420,96 @@ func (ctx *Context) classFunc(args ...interface{}) (interface{}, error) {
 	return NewNamespace(result), nil
 }
 
+// debugFunc returns a readable dump of the template name, the variables in
+// scope and the registered filter and test names. Global names are listed
+// only outside the sandbox so restricted templates cannot enumerate them.
 func (ctx *Context) debugFunc(args ...interface{}) (interface{}, error) {
-	return fmt.Sprintf("%v", ctx.scope.All()), nil
+	var b strings.Builder
+
+	templateName := ""
+	ctx.mu.RLock()
+	if ctx.current != nil {
+		templateName = ctx.current.name
+	}
+	ctx.mu.RUnlock()
+	fmt.Fprintf(&b, "template: %s\n", templateName)
+
+	vars := ctx.scope.All()
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	b.WriteString("variables:\n")
+	for _, name := range names {
+		value := vars[name]
+		if str, ok := value.(string); ok {
+			fmt.Fprintf(&b, "  %s = %q\n", name, str)
+		} else {
+			fmt.Fprintf(&b, "  %s = %s\n", name, toString(value))
+		}
+	}
+
+	env := ctx.environment
+	if env == nil {
+		return strings.TrimSuffix(b.String(), "\n"), nil
+	}
+	sandboxed := env.IsSandboxed() || ctx.securityContext != nil
+
+	env.mu.RLock()
+	filters := make([]string, 0, len(env.filters))
+	for name := range env.filters {
+		filters = append(filters, name)
+	}
+	tests := make([]string, 0, len(env.tests))
+	for name := range env.tests {
+		tests = append(tests, name)
+	}
+	var globals []string
+	if !sandboxed {
+		for name := range env.globals {
+			globals = append(globals, name)
+		}
+	}
+	env.mu.RUnlock()
+
+	sort.Strings(filters)
+	sort.Strings(tests)
+	sort.Strings(globals)
+	fmt.Fprintf(&b, "filters: %s\n", strings.Join(filters, ", "))
+	fmt.Fprintf(&b, "tests: %s", strings.Join(tests, ", "))
+	if !sandboxed {
+		fmt.Fprintf(&b, "\nglobals: %s", strings.Join(globals, ", "))
+	}
+	return b.String(), nil
+}
+
+// raiseFunc aborts rendering with the given message. The evaluator wraps the
+// returned error with the position of the call.
+func (ctx *Context) raiseFunc(args ...interface{}) (interface{}, error) {
+	_, args = extractKwargs(args)
+	message := "template raised an error"
+	if len(args) > 0 {
+		message = toString(args[0])
+	}
+	return nil, errors.New(message)
+}
+
+// assertFunc raises when its first argument is falsy and otherwise renders
+// nothing, so templates can state their input contracts inline.
+func (ctx *Context) assertFunc(args ...interface{}) (interface{}, error) {
+	_, args = extractKwargs(args)
+	if len(args) == 0 {
+		return nil, NewError(ErrorTypeTemplate, "assert() requires a condition", nodes.Position{}, nil)
+	}
+	if isTruthyValue(args[0]) {
+		return "", nil
+	}
+	message := "assertion failed"
+	if len(args) > 1 {
+		message = "assertion failed: " + toString(args[1])
+	}
+	return nil, errors.New(message)
 }
 
 func (ctx *Context) selfFunc(args ...interface{}) (interface{}, error) {
@@ -1203,14 +1645,15 @@ type cycler struct {
 	index int
 }
 
+// Next returns the current item and advances the cycler.
 func (c *cycler) Next() interface{} {
-	item := c.items[c.index]
+	item := cycleValue(c.items, c.index)
 	c.index = (c.index + 1) % len(c.items)
 	return item
 }
 
 func (c *cycler) Current() interface{} {
-	return c.items[c.index]
+	return cycleValue(c.items, c.index)
 }
 
 func (c *cycler) Reset() {
@@ -0,0 +1,271 @@
+package runtime
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestContextDerivedRenderString(t *testing.T) {
+	env := NewEnvironment()
+	env.AddGlobal("greet", func(ctx *Context, args ...interface{}) (interface{}, error) {
+		derived := ctx.Derived(map[string]interface{}{"name": args[0]})
+		return derived.RenderString("Hi {{ name }} from {{ site }}{% set leaked = 'yes' %}")
+	})
+
+	out, err := ExecuteToStringWithEnvironment(env, "{{ greet('Ann') }}|{{ name }}|{{ leaked is defined }}", map[string]interface{}{
+		"name": "Bob",
+		"site": "example",
+	})
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if out != "Hi Ann from example|Bob|false" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+}
+
+func TestContextDerivedDoesNotLeakAssignments(t *testing.T) {
+	env := NewEnvironment()
+	parent := NewContextWithEnvironment(env, map[string]interface{}{"a": 1})
+
+	derived := parent.Derived(map[string]interface{}{"b": 2})
+	derived.Set("a", 10)
+	derived.Set("c", 3)
+
+	if v, _ := parent.Get("a"); v != 1 {
+		t.Fatalf("expected parent value to stay 1, got %v", v)
+	}
+	if parent.Has("b") || parent.Has("c") {
+		t.Fatal("expected derived variables not to leak into the parent")
+	}
+	if v, _ := derived.Get("b"); v != 2 {
+		t.Fatalf("expected override to be visible in derived context, got %v", v)
+	}
+	if derived.environment != env {
+		t.Fatal("expected derived context to share the environment")
+	}
+}
+
+func TestContextDerivedDoesNotLeakLocalFilters(t *testing.T) {
+	env := NewEnvironment()
+	parent := NewContextWithEnvironment(env, nil)
+	parent.AddLocalFilter("shout", func(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+		return fmt.Sprintf("%v!", value), nil
+	})
+
+	derived := parent.Derived(nil)
+	derived.AddLocalFilter("whisper", func(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+		return fmt.Sprintf("%v...", value), nil
+	})
+
+	if _, ok := derived.lookupFilter("shout"); !ok {
+		t.Fatal("expected derived context to inherit local filters")
+	}
+	if _, ok := parent.lookupFilter("whisper"); ok {
+		t.Fatal("expected derived local filters not to leak into the parent")
+	}
+}
+
+func TestRenderGlobalsPrecedence(t *testing.T) {
+	env := NewEnvironment()
+	env.AddGlobal("site", "env-site")
+	env.AddGlobal("user", "env-user")
+
+	tmpl, err := env.ParseString("{{ site }}|{{ user }}|{{ token }}", "page")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	var buf strings.Builder
+	err = env.ExecuteTemplateWithGlobals(tmpl,
+		map[string]interface{}{"site": "var-site"},
+		map[string]interface{}{"site": "render-site", "user": "render-user", "token": "abc"},
+		&buf)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if got := buf.String(); got != "var-site|render-user|abc" {
+		t.Fatalf("unexpected output: %q", got)
+	}
+
+	out, err := ExecuteToStringWithEnvironment(env, "{{ token is defined }}", nil)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if out != "false" {
+		t.Fatalf("expected render globals not to persist, got %q", out)
+	}
+}
+
+func TestRenderGlobalsConcurrentRenders(t *testing.T) {
+	env := NewEnvironment()
+	env.SetLoader(NewMapLoader(map[string]string{
+		"page":    "{{ request }}:{% include 'partial' without context %}:{% import 'helpers' as h %}{{ h.show() }}",
+		"partial": "{{ request }}",
+		"helpers": "{% macro show() %}{{ request }}{% endmacro %}",
+	}))
+
+	tmpl, err := env.GetTemplate("page")
+	if err != nil {
+		t.Fatalf("load error: %v", err)
+	}
+
+	const renders = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, renders)
+	for i := 0; i < renders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			request := fmt.Sprintf("req-%d", i)
+			var buf strings.Builder
+			if err := tmpl.ExecuteWithGlobals(nil, map[string]interface{}{"request": request}, &buf); err != nil {
+				errs <- err
+				return
+			}
+			want := request + ":" + request + ":" + request
+			if got := buf.String(); got != want {
+				errs <- fmt.Errorf("expected %q, got %q", want, got)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if out, err := tmpl.ExecuteToString(nil); err != nil || out != "::" {
+		t.Fatalf("expected render globals not to leak into the environment, got %q (%v)", out, err)
+	}
+}
+
+func TestContextGetVarFromGlobalFunction(t *testing.T) {
+	env := NewEnvironment()
+	env.AddGlobal("separator", func(ctx *Context, args ...interface{}) (interface{}, error) {
+		return ":", nil
+	})
+	env.AddGlobal("describe", func(ctx *Context, args ...interface{}) (interface{}, error) {
+		item, ok := ctx.GetVar("item")
+		if !ok {
+			return nil, fmt.Errorf("item not visible")
+		}
+		loop, ok := ctx.GetVar("loop")
+		if !ok {
+			return nil, fmt.Errorf("loop not visible")
+		}
+		tenant, _ := ctx.GetVar("tenant")
+		sep, ok := ctx.GetVar("separator")
+		if !ok {
+			return nil, fmt.Errorf("separator global not visible")
+		}
+		sepValue, err := sep.(GlobalFunc)(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := ctx.GetVar("missing"); ok {
+			return nil, fmt.Errorf("missing variable reported as present")
+		}
+
+		vars := ctx.Vars()
+		vars["item"] = "changed"
+		return fmt.Sprintf("%v%v%v@%v", loop.(*LoopContext).Index, sepValue, item, tenant), nil
+	})
+
+	tmpl, err := env.ParseString("{% for item in items %}{{ describe() }}={{ item }} {% endfor %}", "vars")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	var buf strings.Builder
+	err = env.ExecuteTemplateWithGlobals(tmpl,
+		map[string]interface{}{"items": []string{"a", "b"}},
+		map[string]interface{}{"tenant": "acme"},
+		&buf)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if got := buf.String(); got != "1:a@acme=a 2:b@acme=b " {
+		t.Fatalf("unexpected output: %q", got)
+	}
+}
+
+func TestContextLocalFilterShadowsBuiltin(t *testing.T) {
+	env := NewEnvironment()
+	env.SetLoader(NewMapLoader(map[string]string{
+		"page":    "{{ name|upper }}|{% include 'partial' %}",
+		"partial": "{{ name|stamp }}",
+	}))
+	tmpl, err := env.GetTemplate("page")
+	if err != nil {
+		t.Fatalf("load error: %v", err)
+	}
+
+	vars := map[string]interface{}{"name": "go"}
+	ctx := NewContextWithEnvironment(env, vars)
+	ctx.AddLocalFilter("upper", func(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+		return "<" + toString(value) + ">", nil
+	})
+	ctx.AddLocalFilter("stamp", func(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+		return toString(value) + "@req-1", nil
+	})
+	var buf strings.Builder
+	ctx.SetWriter(&buf)
+	if err := tmpl.ExecuteWithContext(ctx); err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if got := buf.String(); got != "<go>|go@req-1" {
+		t.Fatalf("unexpected output with local filters: %q", got)
+	}
+
+	if _, ok := env.GetFilter("stamp"); ok {
+		t.Fatalf("expected local filter not to leak into the environment")
+	}
+	out, err := ExecuteToStringWithEnvironment(env, "{{ name|upper }}", vars)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if out != "GO" {
+		t.Fatalf("expected built-in upper in a later render, got %q", out)
+	}
+}
+
+type virtualEntity struct {
+	Kind   string
+	fields map[string]interface{}
+}
+
+func TestAttributeResolverVirtualAttributes(t *testing.T) {
+	env := NewEnvironment()
+	env.SetAttributeResolver(func(obj interface{}, name string) (interface{}, bool, error) {
+		entity, ok := obj.(*virtualEntity)
+		if !ok {
+			return nil, false, nil
+		}
+		if name == "secret" {
+			return nil, false, fmt.Errorf("field %q is restricted", name)
+		}
+		value, ok := entity.fields[name]
+		return value, ok, nil
+	})
+
+	vars := map[string]interface{}{
+		"post":  &virtualEntity{Kind: "post", fields: map[string]interface{}{"title": "Hello"}},
+		"posts": []interface{}{&virtualEntity{fields: map[string]interface{}{"title": "A"}}, &virtualEntity{fields: map[string]interface{}{"title": "B"}}},
+		"plain": map[string]interface{}{"title": "map"},
+	}
+
+	out, err := ExecuteToStringWithEnvironment(env, "{{ post.title }}|{{ post.Kind }}|{{ post.missing|default('none') }}|{{ posts|map(attribute='title')|join(',') }}|{{ plain.title }}", vars)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if out != "Hello|post|none|A,B|map" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+
+	if _, err := ExecuteToStringWithEnvironment(env, "{{ post.secret }}", vars); err == nil || !strings.Contains(err.Error(), "restricted") {
+		t.Fatalf("expected resolver error, got %v", err)
+	}
+}
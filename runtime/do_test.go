@@ -58,3 +58,35 @@ func TestDoStatementDoesNotOutput(t *testing.T) {
 		t.Fatalf("expected 'Hello', got %q", strings.TrimSpace(result))
 	}
 }
+
+func TestDoNamespaceListAccumulation(t *testing.T) {
+	tpl := `{% set ns = namespace(items=[]) %}` +
+		`{% for x in values %}{% if x is odd %}{% do ns.items.append(x) %}{% endif %}{% endfor %}` +
+		`{% do ns.items.extend([10, 11]) %}{% do ns.items.insert(0, 'first') %}` +
+		`{{ ns.items|join(',') }}`
+
+	out, err := ExecuteToString(tpl, map[string]interface{}{"values": []int{1, 2, 3, 4, 5}})
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	if out != "first,1,3,5,10,11" {
+		t.Fatalf("expected accumulated list, got %q", out)
+	}
+
+	out, err = ExecuteToString(`{% set ns = namespace(append='kept', items=[]) %}{% do ns.items.append(1) %}{{ ns.append }}{{ ns.items|length }}`, nil)
+	if err != nil || out != "kept1" {
+		t.Fatalf("expected a key named append to stay a plain value, got %q (%v)", out, err)
+	}
+}
+
+func TestDoNamespaceAppendRejectsNonList(t *testing.T) {
+	_, err := ExecuteToString(`{% set ns = namespace(count=1) %}{% do ns.count.append(2) %}`, nil)
+	if err == nil || !strings.Contains(err.Error(), "has no attribute 'append'") {
+		t.Fatalf("expected error appending to a non-list attribute, got %v", err)
+	}
+
+	_, err = ExecuteToString(`{% set ns = namespace() %}{% do ns.missing.append(2) %}`, nil)
+	if err == nil || !strings.Contains(err.Error(), "no attribute 'missing'") {
+		t.Fatalf("expected missing attribute error, got %v", err)
+	}
+}
@@ -10,10 +10,13 @@ import (
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
+	"github.com/deicod/gojinja/lexer"
 	"github.com/deicod/gojinja/nodes"
 	"github.com/deicod/gojinja/parser"
 )
@@ -30,6 +33,45 @@ type GlobalFunc func(ctx *Context, args ...interface{}) (interface{}, error)
 // FinalizeFunc represents a finalize callable invoked before output
 type FinalizeFunc func(value interface{}) (interface{}, error)
 
+// FinalizeContextFunc is a finalize callable that also receives the active context
+type FinalizeContextFunc func(ctx *Context, value interface{}) (interface{}, error)
+
+// EscapeFunc escapes text for safe inclusion in the rendered output
+type EscapeFunc func(value string) string
+
+// YAMLMarshalFunc encodes a value as YAML, typically yaml.Marshal from a YAML library
+type YAMLMarshalFunc func(value interface{}) ([]byte, error)
+
+// YAMLUnmarshalFunc decodes YAML data into out, typically yaml.Unmarshal from a YAML library
+type YAMLUnmarshalFunc func(data []byte, out interface{}) error
+
+// NumberFormatFunc formats a number for the given locale, for example with golang.org/x/text/message
+type NumberFormatFunc func(value interface{}, locale string) (string, error)
+
+// CurrencyAmount is the value the currency filter passes to the number
+// formatter, asking for Amount in currency style for the ISO 4217 Code
+type CurrencyAmount struct {
+	Amount interface{}
+	Code   string
+}
+
+// AttributeResolver resolves obj.name for custom object models. It reports
+// false to fall back to the default lookup.
+type AttributeResolver func(obj interface{}, name string) (interface{}, bool, error)
+
+// DivideByZeroMode selects what /, // and % produce for a zero divisor
+type DivideByZeroMode int
+
+const (
+	// DivideByZeroError aborts the render with a template error.
+	DivideByZeroError DivideByZeroMode = iota
+	// DivideByZeroIEEE returns +inf, -inf or nan following IEEE 754; they
+	// render as inf, -inf and nan, like Python prints them.
+	DivideByZeroIEEE
+	// DivideByZeroDefault returns the value set with SetDivideByZeroDefault.
+	DivideByZeroDefault
+)
+
 // UndefinedFactory creates undefined values based on name
 type UndefinedFactory func(name string) undefinedType
 
@@ -242,16 +284,33 @@ type Environment struct {
 	cacheSize           int
 	trimBlocks          bool
 	lstripBlocks        bool
+	whitespaceDebug     bool
+	retainSource        bool
 	keepTrailingNewline bool
 	newlineSequence     string
 	lineStatementPrefix string
 	lineCommentPrefix   string
 	enableAsync         bool
 	finalize            FinalizeFunc
+	finalizeContext     FinalizeContextFunc
 	undefinedFactory    UndefinedFactory
+	randomSeed          *int64
+	escapeFunc          EscapeFunc
+	maxOutputBytes      int64
+	strictFilters       bool
+	yamlMarshal         YAMLMarshalFunc
+	yamlUnmarshal       YAMLUnmarshalFunc
+	numberFormatter     NumberFormatFunc
+	traceHook           TraceHook
+	errorLogger         ErrorLogger
+	autoNamespace       bool
+	attributeResolver   AttributeResolver
+	divideByZero        DivideByZeroMode
+	divideByZeroDefault interface{}
 
 	// Extensions
 	extensions []parser.Extension
+	parserEnv  *parser.Environment
 	policies   map[string]interface{}
 
 	// Security
@@ -262,8 +321,14 @@ type Environment struct {
 
 	// Built-ins
 	filters map[string]FilterFunc
-	tests   map[string]TestFunc
-	globals map[string]GlobalFunc
+	// undefinedFilters names the filters that receive undefined input
+	// instead of having it passed through.
+	undefinedFilters map[string]bool
+	tests            map[string]TestFunc
+	globals          map[string]GlobalFunc
+	// defaultVars is replaced, never mutated, by SetDefaultVars so clones
+	// and contexts can share it.
+	defaultVars map[string]interface{}
 
 	// Runtime state
 	compiledTemplates map[string]*Template
@@ -273,8 +338,17 @@ type Environment struct {
 	urlFor            GlobalFunc
 	mu                sync.RWMutex
 	loadingTemplates  map[string]bool // Guard against concurrent loading of the same template
+	missingTemplates  map[string]time.Time
 }
 
+// missingTemplateTTL is how long TemplateExists remembers that a template
+// could not be found before asking the loader again.
+const missingTemplateTTL = 5 * time.Second
+
+// maxMissingTemplates caps how many missing names TemplateExists remembers,
+// so checking many distinct names cannot grow the environment unboundedly.
+const maxMissingTemplates = 1024
+
 // NewEnvironment creates a new Jinja2 environment
 func NewEnvironment() *Environment {
 	env := &Environment{
@@ -294,6 +368,7 @@ func NewEnvironment() *Environment {
 		securityPolicy:      DefaultSecurityPolicy(),
 		securityManager:     GetGlobalSecurityManager(),
 		filters:             make(map[string]FilterFunc),
+		undefinedFilters:    map[string]bool{"default": true},
 		tests:               make(map[string]TestFunc),
 		globals:             make(map[string]GlobalFunc),
 		undefinedFactory:    func(name string) undefinedType { return DebugUndefined{name: name} },
@@ -301,6 +376,7 @@ func NewEnvironment() *Environment {
 		cache:               NewTemplateCache(0, 400), // No TTL by default
 		macroRegistry:       NewMacroRegistry(),
 		loadingTemplates:    make(map[string]bool),
+		missingTemplates:    make(map[string]time.Time),
 		newlineSequence:     "\n",
 	}
 
@@ -322,6 +398,92 @@ func NewEnvironment() *Environment {
 	return env
 }
 
+// Clone returns an independent copy of the environment for per-request
+// customisation. Filters, tests, globals, policies and global macros are
+// copied so that changes to the clone never affect env; the loader, security
+// policy and bytecode cache are shared by reference. Compiled templates are
+// not shared because they stay bound to the environment that loaded them.
+func (env *Environment) Clone() *Environment {
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+
+	clone := &Environment{
+		loader:              env.loader,
+		autoescape:          env.autoescape,
+		cacheSize:           env.cacheSize,
+		trimBlocks:          env.trimBlocks,
+		lstripBlocks:        env.lstripBlocks,
+		whitespaceDebug:     env.whitespaceDebug,
+		retainSource:        env.retainSource,
+		keepTrailingNewline: env.keepTrailingNewline,
+		newlineSequence:     env.newlineSequence,
+		lineStatementPrefix: env.lineStatementPrefix,
+		lineCommentPrefix:   env.lineCommentPrefix,
+		enableAsync:         env.enableAsync,
+		finalize:            env.finalize,
+		finalizeContext:     env.finalizeContext,
+		undefinedFactory:    env.undefinedFactory,
+		escapeFunc:          env.escapeFunc,
+		maxOutputBytes:      env.maxOutputBytes,
+		strictFilters:       env.strictFilters,
+		yamlMarshal:         env.yamlMarshal,
+		yamlUnmarshal:       env.yamlUnmarshal,
+		numberFormatter:     env.numberFormatter,
+		traceHook:           env.traceHook,
+		errorLogger:         env.errorLogger,
+		autoNamespace:       env.autoNamespace,
+		attributeResolver:   env.attributeResolver,
+		divideByZero:        env.divideByZero,
+		divideByZeroDefault: env.divideByZeroDefault,
+		extensions:          append([]parser.Extension{}, env.extensions...),
+		policies:            make(map[string]interface{}, len(env.policies)),
+		sandboxed:           env.sandboxed,
+		secureDefaults:      env.secureDefaults,
+		securityPolicy:      env.securityPolicy,
+		securityManager:     env.securityManager,
+		filters:             make(map[string]FilterFunc, len(env.filters)),
+		undefinedFilters:    make(map[string]bool, len(env.undefinedFilters)),
+		tests:               make(map[string]TestFunc, len(env.tests)),
+		globals:             make(map[string]GlobalFunc, len(env.globals)),
+		defaultVars:         env.defaultVars,
+		compiledTemplates:   make(map[string]*Template),
+		cache:               NewTemplateCache(env.cache.ttl, env.cacheSize),
+		macroRegistry:       NewMacroRegistry(),
+		bytecodeCache:       env.bytecodeCache,
+		urlFor:              env.urlFor,
+		loadingTemplates:    make(map[string]bool),
+		missingTemplates:    make(map[string]time.Time),
+	}
+
+	if env.randomSeed != nil {
+		seed := *env.randomSeed
+		clone.randomSeed = &seed
+	}
+	for key, value := range env.policies {
+		clone.policies[key] = value
+	}
+	for name, filter := range env.filters {
+		clone.filters[name] = filter
+	}
+	for name := range env.undefinedFilters {
+		clone.undefinedFilters[name] = true
+	}
+	for name, test := range env.tests {
+		clone.tests[name] = test
+	}
+	for name, global := range env.globals {
+		clone.globals[name] = global
+	}
+
+	env.macroRegistry.mu.RLock()
+	for name, macro := range env.macroRegistry.globals {
+		clone.macroRegistry.globals[name] = macro
+	}
+	env.macroRegistry.mu.RUnlock()
+
+	return clone
+}
+
 // SetSecurityPolicy sets the security policy for the environment
 func (env *Environment) SetSecurityPolicy(policy *SecurityPolicy) {
 	env.mu.Lock()
@@ -364,8 +526,23 @@ func (env *Environment) IsSandboxed() bool {
 	return env.sandboxed
 }
 
-// ExecuteTemplate executes a template with security controls
+// ExecuteTemplate executes a template with security controls. When an output
+// limit is configured via SetMaxOutputBytes, the bytes that fit are written to
+// writer and ErrOutputLimitExceeded is returned once the limit is crossed; the
+// limit applies to every render entry point.
 func (env *Environment) ExecuteTemplate(template *Template, vars map[string]interface{}, writer io.Writer) error {
+	return env.ExecuteTemplateWithGlobals(template, vars, nil, writer)
+}
+
+// ExecuteTemplateWithGlobals executes a template like ExecuteTemplate with an
+// additional layer of globals scoped to this render. Lookups resolve in the
+// order render vars, render globals, environment globals, so request-specific
+// values can be injected without calling AddGlobal on a shared environment.
+func (env *Environment) ExecuteTemplateWithGlobals(template *Template, vars, globals map[string]interface{}, writer io.Writer) error {
+	return env.executeTemplate(template, vars, globals, writer)
+}
+
+func (env *Environment) executeTemplate(template *Template, vars, globals map[string]interface{}, writer io.Writer) error {
 	if env.sandboxed {
 		policyName := "default"
 		if env.securityPolicy != nil {
@@ -385,7 +562,7 @@ func (env *Environment) ExecuteTemplate(template *Template, vars map[string]inte
 			policyName:      policyName,
 		}
 
-		return sandbox.ExecuteTemplate(template, vars, writer)
+		return sandbox.executeTemplate(template, vars, globals, writer)
 	}
 
 	// Create security context for monitoring
@@ -397,6 +574,8 @@ func (env *Environment) ExecuteTemplate(template *Template, vars map[string]inte
 
 	// Create context
 	ctx := NewContextWithEnvironment(env, vars)
+	ctx.setRenderGlobals(globals, vars)
+	ctx.SetAutoescape(template.Autoescape())
 	if writer != nil {
 		ctx.writer = writer
 	}
@@ -434,6 +613,7 @@ func (env *Environment) SetLoader(loader Loader) {
 	env.mu.Lock()
 	defer env.mu.Unlock()
 	env.loader = loader
+	env.missingTemplates = make(map[string]time.Time)
 }
 
 // SetAutoescape sets the autoescape mode
@@ -443,11 +623,13 @@ func (env *Environment) SetAutoescape(value interface{}) {
 	env.autoescape = normalizeAutoescapeValue(value)
 }
 
-// SetTrimBlocks sets whether to trim the first newline after a block tag
+// SetTrimBlocks sets whether to trim the first newline after a block or
+// comment tag. Exactly one "\n" or "\r\n" is removed; later blank lines stay.
 func (env *Environment) SetTrimBlocks(trim bool) {
 	env.mu.Lock()
 	defer env.mu.Unlock()
 	env.trimBlocks = trim
+	env.parserEnv = nil
 }
 
 // SetLstripBlocks sets whether to strip whitespace before blocks
@@ -455,6 +637,32 @@ func (env *Environment) SetLstripBlocks(strip bool) {
 	env.mu.Lock()
 	defer env.mu.Unlock()
 	env.lstripBlocks = strip
+	env.parserEnv = nil
+}
+
+// SetWhitespaceDebug enables recording of the whitespace removed by "-"
+// markers, lstrip_blocks and trim_blocks. Templates parsed while it is enabled
+// expose the record through Template.WhitespaceReport.
+func (env *Environment) SetWhitespaceDebug(debug bool) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.whitespaceDebug = debug
+	env.parserEnv = nil
+}
+
+// SetRetainSource controls whether templates parsed from now on keep their
+// source text, available through Template.Source.
+func (env *Environment) SetRetainSource(retain bool) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.retainSource = retain
+}
+
+// RetainSource reports whether parsed templates keep their source text.
+func (env *Environment) RetainSource() bool {
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+	return env.retainSource
 }
 
 // SetKeepTrailingNewline sets whether to preserve trailing newlines
@@ -462,6 +670,7 @@ func (env *Environment) SetKeepTrailingNewline(keep bool) {
 	env.mu.Lock()
 	defer env.mu.Unlock()
 	env.keepTrailingNewline = keep
+	env.parserEnv = nil
 }
 
 // ShouldKeepTrailingNewline returns whether trailing newlines should be preserved.
@@ -494,6 +703,7 @@ func (env *Environment) SetEnableAsync(enabled bool) {
 	env.mu.Lock()
 	defer env.mu.Unlock()
 	env.enableAsync = enabled
+	env.parserEnv = nil
 }
 
 // IsAsyncEnabled reports whether async-aware syntax is permitted for templates parsed by this environment.
@@ -508,6 +718,7 @@ func (env *Environment) SetLineStatementPrefix(prefix string) {
 	env.mu.Lock()
 	defer env.mu.Unlock()
 	env.lineStatementPrefix = prefix
+	env.parserEnv = nil
 }
 
 // LineStatementPrefix returns the configured line statement prefix
@@ -522,6 +733,7 @@ func (env *Environment) SetLineCommentPrefix(prefix string) {
 	env.mu.Lock()
 	defer env.mu.Unlock()
 	env.lineCommentPrefix = prefix
+	env.parserEnv = nil
 }
 
 // LineCommentPrefix returns the configured line comment prefix
@@ -536,6 +748,139 @@ func (env *Environment) SetFinalize(f FinalizeFunc) {
 	env.mu.Lock()
 	defer env.mu.Unlock()
 	env.finalize = f
+	env.finalizeContext = nil
+}
+
+// SetFinalizeContext registers a finalize function that receives the active
+// render context, so output can depend on variables such as a locale. It
+// replaces any function set with SetFinalize.
+func (env *Environment) SetFinalizeContext(f FinalizeContextFunc) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.finalizeContext = f
+	env.finalize = nil
+}
+
+// SetEscapeFunc replaces the HTML escaper used by autoescaping and the
+// escape filter. Passing nil restores the default HTML escaping.
+func (env *Environment) SetEscapeFunc(fn EscapeFunc) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.escapeFunc = fn
+}
+
+// SetMaxOutputBytes caps the number of bytes ExecuteTemplate writes for a
+// single render. A limit of zero or less disables the cap.
+func (env *Environment) SetMaxOutputBytes(limit int64) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.maxOutputBytes = limit
+}
+
+// MaxOutputBytes returns the configured output cap, or zero when unlimited.
+func (env *Environment) MaxOutputBytes() int64 {
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+	return env.maxOutputBytes
+}
+
+// SetStrictFilters enables up-front validation of filter and test names.
+// When enabled, building a template fails with a positioned error if it
+// references a test that is not registered. Filters are checked when a render
+// starts, before any output is written, so that local filters added with
+// Context.AddLocalFilter are accepted. Names passed as strings to filters
+// such as map or select are resolved dynamically and are not checked.
+func (env *Environment) SetStrictFilters(strict bool) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.strictFilters = strict
+}
+
+// StrictFilters reports whether compile-time filter and test validation is enabled.
+func (env *Environment) StrictFilters() bool {
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+	return env.strictFilters
+}
+
+// SetAutoNamespace controls whether assigning to an attribute of an undefined
+// name, as in {% set ns.x = 1 %}, creates the namespace in the current scope
+// instead of failing. It is off by default.
+func (env *Environment) SetAutoNamespace(enabled bool) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.autoNamespace = enabled
+}
+
+// AutoNamespace reports whether namespaces are created on first assignment.
+func (env *Environment) AutoNamespace() bool {
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+	return env.autoNamespace
+}
+
+// SetRandomSeed fixes the seed used by the random and shuffle filters when no
+// explicit seed argument is passed. Each render derives a fresh generator from
+// the seed, so rendering the same template twice yields identical output,
+// which is useful for snapshot tests. Environments that never call
+// SetRandomSeed keep time-based randomness.
+func (env *Environment) SetRandomSeed(seed int64) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.randomSeed = &seed
+}
+
+// ClearRandomSeed removes a seed configured via SetRandomSeed and restores
+// time-based randomness.
+func (env *Environment) ClearRandomSeed() {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.randomSeed = nil
+}
+
+// RandomSeed returns the configured random seed and whether one is set.
+func (env *Environment) RandomSeed() (int64, bool) {
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+	if env.randomSeed == nil {
+		return 0, false
+	}
+	return *env.randomSeed, true
+}
+
+// SetYAMLCodec registers the functions used by the toyaml and fromyaml filters.
+// The runtime does not ship a YAML implementation, so callers plug in the
+// library of their choice (for example gopkg.in/yaml.v3). Passing nil for
+// either function disables the corresponding filter.
+func (env *Environment) SetYAMLCodec(marshal YAMLMarshalFunc, unmarshal YAMLUnmarshalFunc) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.yamlMarshal = marshal
+	env.yamlUnmarshal = unmarshal
+}
+
+// YAMLCodec returns the functions registered via SetYAMLCodec.
+func (env *Environment) YAMLCodec() (YAMLMarshalFunc, YAMLUnmarshalFunc) {
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+	return env.yamlMarshal, env.yamlUnmarshal
+}
+
+// SetNumberFormatter registers the function used by the number and currency
+// filters; the currency filter passes a CurrencyAmount. Like the YAML codec,
+// localization is left to the caller so the runtime does not depend on a
+// particular library.
+func (env *Environment) SetNumberFormatter(formatter NumberFormatFunc) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.numberFormatter = formatter
+}
+
+// NumberFormatter returns the function registered via SetNumberFormatter.
+func (env *Environment) NumberFormatter() NumberFormatFunc {
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+	return env.numberFormatter
 }
 
 // SetUndefinedFactory configures how undefined values are created
@@ -545,6 +890,45 @@ func (env *Environment) SetUndefinedFactory(factory UndefinedFactory) {
 	env.undefinedFactory = factory
 }
 
+// SetAttributeResolver installs a resolver consulted for attribute access
+// before the default map, struct and method lookup. Sandbox checks still
+// apply first. Pass nil to remove it.
+func (env *Environment) SetAttributeResolver(resolver AttributeResolver) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.attributeResolver = resolver
+}
+
+// AttributeResolver returns the resolver installed with SetAttributeResolver.
+func (env *Environment) AttributeResolver() AttributeResolver {
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+	return env.attributeResolver
+}
+
+// SetDivideByZero controls how division and modulo by zero are handled. The
+// default, DivideByZeroError, fails the render.
+func (env *Environment) SetDivideByZero(mode DivideByZeroMode) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.divideByZero = mode
+}
+
+// SetDivideByZeroDefault sets the value returned for a zero divisor in
+// DivideByZeroDefault mode.
+func (env *Environment) SetDivideByZeroDefault(value interface{}) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.divideByZeroDefault = value
+}
+
+// DivideByZero returns the configured mode and default value.
+func (env *Environment) DivideByZero() (DivideByZeroMode, interface{}) {
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+	return env.divideByZero, env.divideByZeroDefault
+}
+
 // AddExtension registers a parser extension with the environment. Extensions are
 // invoked during parsing to handle custom tags. If the same extension instance
 // is added multiple times it will be ignored to preserve registration order.
@@ -563,6 +947,7 @@ func (env *Environment) AddExtension(ext parser.Extension) {
 	}
 
 	env.extensions = append(env.extensions, ext)
+	env.parserEnv = nil
 }
 
 // ClearExtensions removes all registered parser extensions from the environment.
@@ -573,6 +958,7 @@ func (env *Environment) ClearExtensions() {
 		return
 	}
 	env.extensions = nil
+	env.parserEnv = nil
 }
 
 // RemoveExtension unregisters a previously added parser extension. It returns
@@ -588,6 +974,7 @@ func (env *Environment) RemoveExtension(ext parser.Extension) bool {
 	for i, existing := range env.extensions {
 		if extensionEqual(existing, ext) {
 			env.extensions = append(env.extensions[:i], env.extensions[i+1:]...)
+			env.parserEnv = nil
 			return true
 		}
 	}
@@ -637,11 +1024,29 @@ func extensionEqual(a, b parser.Extension) bool {
 	return false
 }
 
-// AddFilter adds a custom filter
+// AddFilter adds a custom filter. Undefined input is passed through without
+// calling the filter; see AddUndefinedFilter.
 func (env *Environment) AddFilter(name string, filter FilterFunc) {
 	env.mu.Lock()
 	defer env.mu.Unlock()
 	env.filters[name] = filter
+	delete(env.undefinedFilters, name)
+}
+
+// AddUndefinedFilter adds a custom filter that, like default, is called with
+// undefined input so it can substitute a value.
+func (env *Environment) AddUndefinedFilter(name string, filter FilterFunc) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.filters[name] = filter
+	env.undefinedFilters[name] = true
+}
+
+// filterAcceptsUndefined reports whether the named filter receives undefined input.
+func (env *Environment) filterAcceptsUndefined(name string) bool {
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+	return env.undefinedFilters[name]
 }
 
 // AddTest adds a custom test
@@ -674,12 +1079,90 @@ func (env *Environment) AddGlobal(name string, value interface{}) {
 			return fn(args...), nil
 		}
 	default:
+		if reflect.ValueOf(value).Kind() == reflect.Func {
+			// Other function signatures are called through reflection like
+			// functions passed in the render context.
+			env.globals[name] = func(ctx *Context, args ...interface{}) (interface{}, error) {
+				result := NewEvaluator(ctx).callFunction(value, args, nil, nil)
+				if err, ok := result.(error); ok {
+					return nil, err
+				}
+				return result, nil
+			}
+			return
+		}
 		env.globals[name] = func(ctx *Context, args ...interface{}) (interface{}, error) {
 			return value, nil
 		}
 	}
 }
 
+// SetGlobalsFromStruct registers the exported fields of a struct, or a
+// pointer to one, as globals. Fields are named after their `jinja` tag when
+// present, otherwise after the field name; a tag of "-" skips the field.
+// Function fields are wrapped exactly as AddGlobal would wrap them.
+func (env *Environment) SetGlobalsFromStruct(s interface{}) error {
+	val := reflect.ValueOf(s)
+	for val.Kind() == reflect.Ptr {
+		if val.IsNil() {
+			return fmt.Errorf("SetGlobalsFromStruct requires a non-nil struct, got %T", s)
+		}
+		val = val.Elem()
+	}
+	if val.Kind() != reflect.Struct {
+		return fmt.Errorf("SetGlobalsFromStruct requires a struct, got %T", s)
+	}
+
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := field.Name
+		if tag, ok := field.Tag.Lookup("jinja"); ok {
+			tag = strings.Split(tag, ",")[0]
+			if tag == "-" {
+				continue
+			}
+			if tag != "" {
+				name = tag
+			}
+		}
+		fieldValue := val.Field(i)
+		if fieldValue.Kind() == reflect.Func && fieldValue.IsNil() {
+			continue
+		}
+		env.AddGlobal(name, fieldValue.Interface())
+	}
+	return nil
+}
+
+// SetDefaultVars sets plain data variables, such as a site name, that are
+// available in every render. Variables passed to a render take precedence
+// over them, and they take precedence over globals. The map is copied.
+func (env *Environment) SetDefaultVars(vars map[string]interface{}) {
+	defaults := make(map[string]interface{}, len(vars))
+	for name, value := range vars {
+		defaults[name] = value
+	}
+
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.defaultVars = defaults
+}
+
+// DefaultVars returns a copy of the variables set with SetDefaultVars.
+func (env *Environment) DefaultVars() map[string]interface{} {
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+	defaults := make(map[string]interface{}, len(env.defaultVars))
+	for name, value := range env.defaultVars {
+		defaults[name] = value
+	}
+	return defaults
+}
+
 // GetFilter returns a filter function by name
 func (env *Environment) GetFilter(name string) (FilterFunc, bool) {
 	env.mu.RLock()
@@ -827,11 +1310,15 @@ func normalizeExtensionList(exts []string) []string {
 	return normalized
 }
 
-func (env *Environment) applyFinalize(value interface{}) (interface{}, error) {
+func (env *Environment) applyFinalize(ctx *Context, value interface{}) (interface{}, error) {
 	env.mu.RLock()
 	f := env.finalize
+	fctx := env.finalizeContext
 	env.mu.RUnlock()
 
+	if fctx != nil {
+		return fctx(ctx, value)
+	}
 	if f == nil {
 		return value, nil
 	}
@@ -872,6 +1359,13 @@ func (env *Environment) escape(value interface{}) string {
 		return ""
 	}
 
+	env.mu.RLock()
+	custom := env.escapeFunc
+	env.mu.RUnlock()
+	if custom != nil {
+		return custom(toString(value))
+	}
+
 	switch v := value.(type) {
 	case string:
 		return template.HTMLEscapeString(v)
@@ -910,8 +1404,16 @@ func (env *Environment) resolveValue(value interface{}, attr string) (interface{
 		case "length":
 			return loopCtx.Length, nil
 		case "previtem":
+			// There is no previous item on the first iteration, so expose
+			// undefined rather than nil to keep `is defined` and `default` working.
+			if loopCtx.First {
+				return env.newUndefined("previtem"), nil
+			}
 			return loopCtx.Previtem, nil
 		case "nextitem":
+			if loopCtx.Last {
+				return env.newUndefined("nextitem"), nil
+			}
 			return loopCtx.Nextitem, nil
 		case "depth":
 			return loopCtx.Depth, nil
@@ -932,6 +1434,11 @@ func (env *Environment) resolveValue(value interface{}, attr string) (interface{
 		}
 	}
 
+	// cycler.current is a property in Jinja, not a method
+	if c, ok := value.(*cycler); ok && attr == "current" {
+		return c.Current(), nil
+	}
+
 	if ns, ok := value.(*Namespace); ok {
 		if v, exists := ns.Get(attr); exists {
 			return v, nil
@@ -958,7 +1465,12 @@ func (env *Environment) resolveValue(value interface{}, attr string) (interface{
 				if len(str) == 0 {
 					return str
 				}
-				return strings.ToUpper(str[:1]) + strings.ToLower(str[1:])
+				runes := []rune(str)
+				return strings.ToUpper(string(runes[0])) + strings.ToLower(string(runes[1:]))
+			}, nil
+		case "center", "ljust", "rjust":
+			return func(args ...interface{}) (interface{}, error) {
+				return justifyFilter(attr, str, args)
 			}, nil
 		}
 	}
@@ -986,9 +1498,8 @@ func (env *Environment) resolveValue(value interface{}, attr string) (interface{
 					return result.Interface(), nil
 				}
 			}
-		} else {
+		} else if keyVal := reflect.ValueOf(attr); keyVal.Type().AssignableTo(val.Type().Key()) {
 			// Try to get the value directly from the map
-			keyVal := reflect.ValueOf(attr)
 			if result := val.MapIndex(keyVal); result.IsValid() {
 				return result.Interface(), nil
 			}
@@ -1018,6 +1529,10 @@ func (env *Environment) resolveValue(value interface{}, attr string) (interface{
 			return method.Interface(), nil
 		}
 	case reflect.Slice, reflect.Array:
+		// Numeric attributes are item lookups, resolved by the caller
+		if _, err := strconv.Atoi(attr); err == nil {
+			break
+		}
 		// Try to convert to []interface{} first
 		if val.Type().ConvertibleTo(reflect.TypeOf([]interface{}{})) {
 			sliceVal := val.Convert(reflect.TypeOf([]interface{}{}))
@@ -1040,6 +1555,13 @@ func (env *Environment) resolveIndex(value interface{}, index interface{}) (inte
 		return undef, nil
 	}
 
+	if group, ok := value.(*groupbyGroup); ok {
+		value = group.tuple()
+	}
+	if spec, ok := index.(sliceIndex); ok {
+		return sliceValue(value, spec)
+	}
+
 	val := reflect.ValueOf(value)
 
 	// Handle pointers
@@ -1101,35 +1623,7 @@ func (env *Environment) resolveIndex(value interface{}, index interface{}) (inte
 
 		return val.Index(idx).Interface(), nil
 	case reflect.String:
-		// Handle string indexing to return characters
-		str := val.String()
-		var idx int
-		switch i := index.(type) {
-		case int:
-			idx = i
-		case int64:
-			idx = int(i)
-		case float64:
-			idx = int(i)
-		default:
-			return nil, NewError(ErrorTypeTemplate,
-				fmt.Sprintf("invalid index type: %T", index),
-				nodes.Position{}, nil)
-		}
-
-		// Handle negative indices
-		if idx < 0 {
-			idx = len(str) + idx
-		}
-
-		if idx < 0 || idx >= len(str) {
-			return nil, NewError(ErrorTypeRange,
-				fmt.Sprintf("index %d out of range", idx),
-				nodes.Position{}, nil)
-		}
-
-		// Return character as string, not rune/byte
-		return string(str[idx]), nil
+		return indexString(val.String(), index)
 	case reflect.Interface:
 		return env.resolveIndex(val.Interface(), index)
 	}
@@ -1139,6 +1633,58 @@ func (env *Environment) resolveIndex(value interface{}, index interface{}) (inte
 		nodes.Position{}, nil)
 }
 
+// indexString returns the character at index, counting characters rather
+// than bytes and supporting negative indexes. ASCII strings keep the cheaper
+// byte indexing since every byte is a character.
+func indexString(str string, index interface{}) (interface{}, error) {
+	var idx int
+	switch i := index.(type) {
+	case int:
+		idx = i
+	case int64:
+		idx = int(i)
+	case float64:
+		idx = int(i)
+	default:
+		return nil, NewError(ErrorTypeTemplate,
+			fmt.Sprintf("invalid index type: %T", index),
+			nodes.Position{}, nil)
+	}
+
+	length := len(str)
+	ascii := isASCII(str)
+	if !ascii {
+		length = utf8.RuneCountInString(str)
+	}
+
+	// Handle negative indices
+	if idx < 0 {
+		idx = length + idx
+	}
+
+	if idx < 0 || idx >= length {
+		return nil, NewError(ErrorTypeRange,
+			fmt.Sprintf("index %d out of range", idx),
+			nodes.Position{}, nil)
+	}
+
+	// Return character as string, not rune/byte
+	if ascii {
+		return str[idx : idx+1], nil
+	}
+	return string([]rune(str)[idx]), nil
+}
+
+// isASCII reports whether s contains only single-byte characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
 // NewTemplate creates a new template from the given template string
 func (env *Environment) NewTemplate(templateString string) (*Template, error) {
 	return env.NewTemplateWithName(templateString, "template")
@@ -1155,18 +1701,33 @@ func (env *Environment) NewTemplateWithName(templateString, name string) (*Templ
 
 // NewTemplateFromAST creates a template from an existing AST
 func (env *Environment) NewTemplateFromAST(ast *nodes.Template, name string) (*Template, error) {
+	return env.newTemplateFromAST(ast, name, "")
+}
+
+func (env *Environment) newTemplateFromAST(ast *nodes.Template, name, parentPath string) (*Template, error) {
 	if ast == nil {
 		return nil, NewError(ErrorTypeTemplate, "AST cannot be nil", nodes.Position{}, nil)
 	}
 
+	var unknownFilters []*nodes.Filter
+	if env.StrictFilters() {
+		var err error
+		if unknownFilters, err = env.validateFilterNames(ast); err != nil {
+			return nil, err
+		}
+	}
+
 	template := &Template{
 		name:        name,
 		environment: env,
 		ast:         ast,
-		autoescape:  env.shouldAutoescape(name),
+		autoescape:  boolToUint32(env.shouldAutoescape(name)),
 		blocks:      make(map[string]*nodes.Block),
 		macros:      make(map[string]*nodes.Macro),
 		imports:     make(map[string]*Template),
+		parentPath:  parentPath,
+
+		unknownFilters: unknownFilters,
 	}
 
 	// Set the macro registry reference
@@ -1240,6 +1801,66 @@ func (env *Environment) GetTemplate(name string) (*Template, error) {
 	return env.LoadTemplate(name)
 }
 
+// TemplateExists reports whether the loader can provide the named template.
+// The source is not compiled, and templates that were not found are
+// remembered briefly so repeated checks do not hit the loader each time.
+func (env *Environment) TemplateExists(name string) bool {
+	if name == "" {
+		return false
+	}
+	env.mu.RLock()
+	loader := env.loader
+	missingSince, missing := env.missingTemplates[name]
+	env.mu.RUnlock()
+	if _, ok := env.cache.Get(name, loader); ok {
+		return true
+	}
+	if loader == nil {
+		return false
+	}
+	if missing && time.Since(missingSince) < missingTemplateTTL {
+		return false
+	}
+
+	if _, err := loader.Load(name); err != nil {
+		if isTemplateNotFoundError(err) {
+			env.rememberMissingTemplate(name)
+		}
+		return false
+	}
+	if missing {
+		env.mu.Lock()
+		delete(env.missingTemplates, name)
+		env.mu.Unlock()
+	}
+	return true
+}
+
+// rememberMissingTemplate records that name was not found. Expired entries
+// are evicted first, and the oldest entry makes room once the cache is full.
+func (env *Environment) rememberMissingTemplate(name string) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+
+	now := time.Now()
+	if len(env.missingTemplates) >= maxMissingTemplates {
+		oldest := ""
+		for missingName, since := range env.missingTemplates {
+			if now.Sub(since) >= missingTemplateTTL {
+				delete(env.missingTemplates, missingName)
+				continue
+			}
+			if oldest == "" || since.Before(env.missingTemplates[oldest]) {
+				oldest = missingName
+			}
+		}
+		if len(env.missingTemplates) >= maxMissingTemplates {
+			delete(env.missingTemplates, oldest)
+		}
+	}
+	env.missingTemplates[name] = now
+}
+
 // SelectTemplate iterates over the provided template names and returns the
 // first one that can be successfully loaded. If none of the candidates can be
 // located a TemplatesNotFoundError mirroring Jinja2's behaviour is returned.
@@ -1511,6 +2132,47 @@ func (env *Environment) FromString(source string) (*Template, error) {
 	return env.ParseString(source, "from_string")
 }
 
+// FromStringWithContext is like FromString but treats the template as if it
+// were loaded from parent, a virtual path such as "pages/index.html". Relative
+// references like {% include "./partial.html" %} then resolve against the
+// directory of parent through the loader.
+func (env *Environment) FromStringWithContext(source, parent string) (*Template, error) {
+	ast, trims, err := env.parseSource(source, "from_string")
+	if err != nil {
+		return nil, err
+	}
+
+	parentBlocks := make(map[string]*nodes.Block)
+	processedAST, err := env.processInheritanceWithContext(ast, parent, make(map[string]bool), parentBlocks)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := env.newTemplateFromAST(processedAST, "from_string", parent)
+	if err != nil {
+		return nil, err
+	}
+	if tmpl.inheritanceCtx != nil {
+		for blockName, parentBlock := range parentBlocks {
+			tmpl.inheritanceCtx.SetParentBlock(blockName, parentBlock)
+		}
+	}
+	env.attachSourceInfo(tmpl, source, trims)
+	return tmpl, nil
+}
+
+// resolveRelativeName joins template names starting with "./" or "../" with
+// parent using JoinPath. Other names are returned unchanged.
+func (env *Environment) resolveRelativeName(name, parent string) string {
+	if parent == "" || !(strings.HasPrefix(name, "./") || strings.HasPrefix(name, "../")) {
+		return name
+	}
+	joined, err := env.JoinPath(name, parent)
+	if err != nil {
+		return name
+	}
+	return joined
+}
+
 // JoinPath combines a template path with its parent template path. If the
 // active loader provides custom join semantics they are used, mirroring
 // Jinja2's 'join_path' hook, otherwise the runtime falls back to the default
@@ -1563,6 +2225,7 @@ func (env *Environment) ClearCache() {
 	env.mu.Lock()
 	defer env.mu.Unlock()
 	env.compiledTemplates = make(map[string]*Template)
+	env.missingTemplates = make(map[string]time.Time)
 	env.cache.Clear()
 }
 
@@ -1790,23 +2453,81 @@ func (env *Environment) GetMacroStats() map[string]int {
 
 // parseTemplateFromString parses a template from a string
 func (env *Environment) parseTemplateFromString(source, name string) (*Template, error) {
-	// Create parser environment using the environment configuration
-	parserEnv := &parser.Environment{
-		TrimBlocks:          env.trimBlocks,
-		LstripBlocks:        env.lstripBlocks,
-		KeepTrailingNewline: env.keepTrailingNewline,
-		LineStatementPrefix: env.lineStatementPrefix,
-		LineCommentPrefix:   env.lineCommentPrefix,
-		Extensions:          env.Extensions(),
-		EnableAsync:         env.IsAsyncEnabled(),
-	}
-
-	// Parse the template
-	ast, err := parser.ParseTemplateWithEnv(parserEnv, source, name, name)
+	ast, trims, err := env.parseSource(source, name)
 	if err != nil {
-		return nil, WrapError(err, nodes.Position{}, nil)
+		return nil, err
+	}
+	tmpl, err := env.buildTemplate(ast, name)
+	if err != nil {
+		return nil, err
 	}
+	env.attachSourceInfo(tmpl, source, trims)
+	return tmpl, nil
+}
+
+// attachSourceInfo records parse-time details on a template built from
+// source: the whitespace trims and, when retention is enabled, the source.
+func (env *Environment) attachSourceInfo(tmpl *Template, source string, trims []lexer.WhitespaceTrim) {
+	tmpl.whitespaceTrims = trims
+	if env.RetainSource() {
+		tmpl.source = source
+		tmpl.hasSource = true
+	}
+}
 
+// parserConfig returns the parser configuration derived from the environment.
+// The configuration is built once and shared by every parse until a setter
+// that affects lexing or parsing (whitespace control, line prefixes, async
+// support or extensions) invalidates it. The parser only reads the returned
+// value, so it must never be modified after it is published.
+func (env *Environment) parserConfig() *parser.Environment {
+	env.mu.RLock()
+	cfg := env.parserEnv
+	env.mu.RUnlock()
+	if cfg != nil {
+		return cfg
+	}
+
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	if env.parserEnv == nil {
+		var extensions []parser.Extension
+		if len(env.extensions) > 0 {
+			extensions = make([]parser.Extension, len(env.extensions))
+			copy(extensions, env.extensions)
+		}
+		env.parserEnv = &parser.Environment{
+			TrimBlocks:          env.trimBlocks,
+			LstripBlocks:        env.lstripBlocks,
+			KeepTrailingNewline: env.keepTrailingNewline,
+			LineStatementPrefix: env.lineStatementPrefix,
+			LineCommentPrefix:   env.lineCommentPrefix,
+			Extensions:          extensions,
+			EnableAsync:         env.enableAsync,
+			WhitespaceDebug:     env.whitespaceDebug,
+		}
+	}
+	return env.parserEnv
+}
+
+// parseSource parses template source into an AST using the environment's
+// lexer and extension configuration. The whitespace trims are only recorded
+// when whitespace debugging is enabled.
+func (env *Environment) parseSource(source, name string) (*nodes.Template, []lexer.WhitespaceTrim, error) {
+	p, err := parser.NewParser(env.parserConfig(), source, name, name, "")
+	if err != nil {
+		return nil, nil, WrapError(err, nodes.Position{}, nil)
+	}
+	ast, err := p.Parse()
+	if err != nil {
+		return nil, nil, WrapError(err, nodes.Position{}, nil)
+	}
+	return ast, p.WhitespaceTrims(), nil
+}
+
+// buildTemplate resolves inheritance for a parsed AST, creates the template
+// and stores it in the template and bytecode caches.
+func (env *Environment) buildTemplate(ast *nodes.Template, name string) (*Template, error) {
 	// Collect parent blocks during inheritance processing
 	parentBlocks := make(map[string]*nodes.Block)
 
@@ -1913,6 +2634,7 @@ func (env *Environment) processInheritanceWithContext(ast *nodes.Template, name
 	if !ok {
 		return nil, NewError(ErrorTypeTemplate, "extends template name must be a string", extendsNode.GetPosition(), extendsNode)
 	}
+	parentName = env.resolveRelativeName(parentName, name)
 
 	// Check for circular dependencies BEFORE loading the parent template
 	if visited[parentName] {
@@ -2203,11 +2925,21 @@ func (env *Environment) RenderTemplateToWriter(name string, vars map[string]inte
 // rendered fragments as they are produced. The stream honours the
 // environment's trailing newline policy, matching Template.Generate.
 func (env *Environment) Generate(name string, vars map[string]interface{}) (*TemplateStream, error) {
+	return env.GenerateWithOptions(name, vars, GenerateOptions{})
+}
+
+// GenerateWithOptions behaves like Generate but lets the caller override the
+// trailing newline policy and the stream buffer size for this call only.
+func (env *Environment) GenerateWithOptions(name string, vars map[string]interface{}, opts GenerateOptions) (*TemplateStream, error) {
 	tmpl, err := env.GetTemplate(name)
 	if err != nil {
 		return nil, err
 	}
-	stream := newTemplateStream(!env.ShouldKeepTrailingNewline())
+	keep := env.ShouldKeepTrailingNewline()
+	if opts.KeepTrailingNewline != nil {
+		keep = *opts.KeepTrailingNewline
+	}
+	stream := newTemplateStream(!keep, opts.BufferSize)
 
 	go func() {
 		err := env.ExecuteTemplate(tmpl, vars, &streamWriter{stream: stream})
@@ -2257,6 +2989,12 @@ func (env *Environment) registerBuiltinGlobals() {
 	env.AddGlobal("dict", GlobalFunc(func(ctx *Context, args ...interface{}) (interface{}, error) {
 		return ctx.dictFunc(args...)
 	}))
+	env.AddGlobal("template_exists", GlobalFunc(func(ctx *Context, args ...interface{}) (interface{}, error) {
+		return ctx.templateExistsFunc(args...)
+	}))
+	env.AddGlobal("getattr", GlobalFunc(func(ctx *Context, args ...interface{}) (interface{}, error) {
+		return ctx.getattrFunc(args...)
+	}))
 	env.AddGlobal("cycler", GlobalFunc(func(ctx *Context, args ...interface{}) (interface{}, error) {
 		return ctx.cyclerFunc(args...)
 	}))
@@ -2287,6 +3025,15 @@ func (env *Environment) registerBuiltinGlobals() {
 	env.AddGlobal("debug", GlobalFunc(func(ctx *Context, args ...interface{}) (interface{}, error) {
 		return ctx.debugFunc(args...)
 	}))
+	env.AddGlobal("raise", GlobalFunc(func(ctx *Context, args ...interface{}) (interface{}, error) {
+		return ctx.raiseFunc(args...)
+	}))
+	env.AddGlobal("error", GlobalFunc(func(ctx *Context, args ...interface{}) (interface{}, error) {
+		return ctx.raiseFunc(args...)
+	}))
+	env.AddGlobal("assert", GlobalFunc(func(ctx *Context, args ...interface{}) (interface{}, error) {
+		return ctx.assertFunc(args...)
+	}))
 	env.AddGlobal("self", GlobalFunc(func(ctx *Context, args ...interface{}) (interface{}, error) {
 		return ctx.selfFunc(args...)
 	}))
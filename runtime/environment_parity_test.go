@@ -344,3 +344,184 @@ func (l *trackingJoinLoader) JoinPath(template, parent string) (string, error) {
 	}
 	return "loader:" + parent + ":" + template, nil
 }
+
+func TestEnvironmentCloneIsIndependent(t *testing.T) {
+	base := NewEnvironment()
+	base.SetLoader(NewMapLoader(map[string]string{
+		"page.txt": "{{ greeting() if greeting is defined else 'none' }} {{ name|shout }}",
+	}))
+	base.AddFilter("shout", func(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+		return strings.ToUpper(toString(value)) + "!", nil
+	})
+
+	clone := base.Clone()
+	clone.AddGlobal("greeting", func(args ...interface{}) interface{} { return "hi" })
+	clone.AddFilter("shout", func(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+		return strings.ToLower(toString(value)), nil
+	})
+	clone.SetAutoescape(true)
+
+	vars := map[string]interface{}{"name": "<Go>"}
+	cloneTmpl, err := clone.GetTemplate("page.txt")
+	if err != nil {
+		t.Fatalf("clone load error: %v", err)
+	}
+	out, err := cloneTmpl.ExecuteToString(vars)
+	if err != nil {
+		t.Fatalf("clone render error: %v", err)
+	}
+	if out != "hi &lt;go&gt;" {
+		t.Fatalf("unexpected clone output: %q", out)
+	}
+
+	baseTmpl, err := base.GetTemplate("page.txt")
+	if err != nil {
+		t.Fatalf("base load error: %v", err)
+	}
+	out, err = baseTmpl.ExecuteToString(vars)
+	if err != nil {
+		t.Fatalf("base render error: %v", err)
+	}
+	if out != "none <GO>!" {
+		t.Fatalf("base environment was modified by clone: %q", out)
+	}
+	if _, ok := base.GetGlobal("greeting"); ok {
+		t.Fatalf("expected global added to clone to be absent from base")
+	}
+}
+
+func TestTemplateNameAndRetainedSource(t *testing.T) {
+	const source = "Hello {{ name }}!"
+	env := NewEnvironment()
+	env.SetLoader(NewMapLoader(map[string]string{"greet.txt": source}))
+
+	tmpl, err := env.GetTemplate("greet.txt")
+	if err != nil {
+		t.Fatalf("load error: %v", err)
+	}
+	if tmpl.Name() != "greet.txt" {
+		t.Fatalf("unexpected name %q", tmpl.Name())
+	}
+	if src, ok := tmpl.Source(); ok || src != "" {
+		t.Fatalf("expected source not to be retained by default, got %q", src)
+	}
+
+	env.SetRetainSource(true)
+	env.ClearCache()
+	tmpl, err = env.GetTemplate("greet.txt")
+	if err != nil {
+		t.Fatalf("load error: %v", err)
+	}
+	if src, ok := tmpl.Source(); !ok || src != source {
+		t.Fatalf("expected loaded source to round-trip, got %q (%v)", src, ok)
+	}
+
+	parsed, err := env.ParseString("{{ 1 + 1 }}", "inline")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if src, ok := parsed.Source(); !ok || src != "{{ 1 + 1 }}" || parsed.Name() != "inline" {
+		t.Fatalf("unexpected parsed template info: %q %q (%v)", parsed.Name(), src, ok)
+	}
+}
+
+func TestSetGlobalsFromStruct(t *testing.T) {
+	type siteConfig struct {
+		Name     string
+		BaseURL  string `jinja:"base_url"`
+		MaxItems int    `jinja:"max_items"`
+		Secret   string `jinja:"-"`
+		Shout    func(string) string
+		internal string
+	}
+
+	env := NewEnvironment()
+	cfg := siteConfig{
+		Name:     "Blog",
+		BaseURL:  "https://example.com",
+		MaxItems: 3,
+		Secret:   "hidden",
+		Shout:    strings.ToUpper,
+		internal: "x",
+	}
+	if err := env.SetGlobalsFromStruct(&cfg); err != nil {
+		t.Fatalf("SetGlobalsFromStruct error: %v", err)
+	}
+
+	out, err := ExecuteToStringWithEnvironment(env, "{{ Name() }}|{{ base_url() }}|{{ max_items() + 1 }}|{{ Shout('hi') }}|{{ Secret is defined }}|{{ internal is defined }}", nil)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if out != "Blog|https://example.com|4|HI|false|false" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+
+	if err := env.SetGlobalsFromStruct("not a struct"); err == nil {
+		t.Fatalf("expected error for non-struct value")
+	}
+}
+
+func TestSetDefaultVars(t *testing.T) {
+	env := NewEnvironment()
+	env.AddGlobal("year", 1999)
+	defaults := map[string]interface{}{"site": "Blog", "year": 2024}
+	env.SetDefaultVars(defaults)
+	defaults["site"] = "changed"
+
+	tests := []struct {
+		vars     map[string]interface{}
+		expected string
+	}{
+		{nil, "Blog 2024"},
+		{map[string]interface{}{"site": "Shop"}, "Shop 2024"},
+	}
+	for _, tt := range tests {
+		out, err := ExecuteToStringWithEnvironment(env, "{{ site }} {{ year }}", tt.vars)
+		if err != nil {
+			t.Fatalf("execution error: %v", err)
+		}
+		if out != tt.expected {
+			t.Fatalf("expected %q, got %q", tt.expected, out)
+		}
+	}
+
+	if got := env.Clone().DefaultVars()["site"]; got != "Blog" {
+		t.Fatalf("expected clone to keep default vars, got %v", got)
+	}
+}
+
+func TestSetDivideByZero(t *testing.T) {
+	source := "{{ 1 / 0 }}|{{ -4 // 0 }}|{{ 0 / 0.0 }}|{{ 5 % 0 }}"
+
+	env := NewEnvironment()
+	if _, err := ExecuteToStringWithEnvironment(env, "{{ 1 / 0 }}", nil); err == nil || !strings.Contains(err.Error(), "division by zero") {
+		t.Fatalf("expected division by zero error by default, got %v", err)
+	}
+	if _, err := ExecuteToStringWithEnvironment(env, "{{ 1 % 0 }}", nil); err == nil || !strings.Contains(err.Error(), "modulo by zero") {
+		t.Fatalf("expected modulo by zero error by default, got %v", err)
+	}
+
+	env.SetDivideByZero(DivideByZeroIEEE)
+	out, err := ExecuteToStringWithEnvironment(env, source, nil)
+	if err != nil {
+		t.Fatalf("ieee mode: %v", err)
+	}
+	if out != "inf|-inf|nan|nan" {
+		t.Fatalf("ieee mode: got %q", out)
+	}
+
+	env.SetDivideByZero(DivideByZeroDefault)
+	env.SetDivideByZeroDefault(0)
+	out, err = ExecuteToStringWithEnvironment(env, source+"|{{ (10000000000000000000 // 0) + 1 }}", nil)
+	if err != nil {
+		t.Fatalf("default mode: %v", err)
+	}
+	if out != "0|0|0|0|1" {
+		t.Fatalf("default mode: got %q", out)
+	}
+
+	env.SetDivideByZero(DivideByZeroError)
+	if _, err := ExecuteToStringWithEnvironment(env, "{{ 1 // 0 }}", nil); err == nil {
+		t.Fatal("expected error after restoring DivideByZeroError")
+	}
+}
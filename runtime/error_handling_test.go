@@ -1,7 +1,9 @@
 package runtime
 
 import (
+	"bytes"
 	"errors"
+	"strings"
 	"testing"
 )
 
@@ -63,3 +65,68 @@ func TestIncludeTemplatesNotFoundAggregates(t *testing.T) {
 		t.Fatalf("expected aggregated error to retain underlying cause")
 	}
 }
+
+func TestStrictFiltersRejectUnknownNamesBeforeRendering(t *testing.T) {
+	env := NewEnvironment()
+	env.SetStrictFilters(true)
+
+	if _, err := env.ParseString("{% if value is odder %}x{% endif %}", "strict"); err == nil {
+		t.Fatal("expected compile-time error for unknown test")
+	}
+
+	tmpl, err := env.ParseString("line one\n{{ name|uper }}", "typo")
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	var buf bytes.Buffer
+	ctx := NewContextWithEnvironment(env, nil)
+	ctx.SetWriter(&buf)
+	err = tmpl.ExecuteWithContext(ctx)
+	var filterErr *FilterError
+	if !errors.As(err, &filterErr) {
+		t.Fatalf("expected FilterError, got %T: %v", err, err)
+	}
+	if filterErr.FilterName != "uper" || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected unknown filter 'uper' at line 2, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("expected no output before the unknown filter was reported, got %q", buf.String())
+	}
+
+	for _, source := range []string{
+		"{% filter shout %}x{% endfilter %}",
+		"{% set v %}x{% endset %}{% set w | trim | shout %}y{% endset %}",
+		"{% macro m() %}{{ 1|nope }}{% endmacro %}",
+	} {
+		tmpl, err := env.ParseString(source, "strict")
+		if err != nil {
+			t.Fatalf("unexpected parse error for %q: %v", source, err)
+		}
+		if _, err := tmpl.ExecuteToString(nil); err == nil || !strings.Contains(err.Error(), "unknown filter") {
+			t.Fatalf("expected unknown filter error for %q, got %v", source, err)
+		}
+	}
+
+	local, err := env.ParseString("{{ name|shout }}", "local")
+	if err != nil {
+		t.Fatalf("unexpected parse error for local filter: %v", err)
+	}
+	buf.Reset()
+	ctx = NewContextWithEnvironment(env, map[string]interface{}{"name": "ann"})
+	ctx.SetWriter(&buf)
+	ctx.AddLocalFilter("shout", func(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+		return strings.ToUpper(toString(value)) + "!", nil
+	})
+	if err := local.ExecuteWithContext(ctx); err != nil || buf.String() != "ANN!" {
+		t.Fatalf("expected local filter to satisfy strict filters, got %q (%v)", buf.String(), err)
+	}
+
+	if _, err := env.ParseString("{{ items|map('upper')|join(',') }}{% if 3 is odd %}{% endif %}", "valid"); err != nil {
+		t.Fatalf("unexpected error for known filters: %v", err)
+	}
+
+	env.SetStrictFilters(false)
+	if _, err := env.ParseString("{{ name|uper }}", "lenient"); err != nil {
+		t.Fatalf("expected unknown filter to be deferred to render time, got %v", err)
+	}
+}
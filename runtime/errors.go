@@ -1,6 +1,7 @@
 package runtime
 
 import (
+	"errors"
 	"fmt"
 	"runtime"
 	"strings"
@@ -117,6 +118,48 @@ func WrapError(err error, position nodes.Position, node nodes.Node) error {
 	}
 }
 
+// ErrorPosition returns the template position recorded on err, looking
+// through the typed wrappers and causes. It returns the zero position when
+// err carries none.
+func ErrorPosition(err error) nodes.Position {
+	for err != nil {
+		switch e := err.(type) {
+		case *Error:
+			if e.Position.Line > 0 {
+				return e.Position
+			}
+			err = e.Cause
+			continue
+		case *UndefinedError:
+			err = e.error
+			continue
+		case *SecurityError:
+			err = e.error
+			continue
+		case *FilterError:
+			err = e.error
+			continue
+		case *TestError:
+			err = e.error
+			continue
+		case *AssignmentError:
+			err = e.error
+			continue
+		case *ContextError:
+			err = e.error
+			continue
+		case *MacroError:
+			err = e.error
+			continue
+		case *ImportError:
+			err = e.error
+			continue
+		}
+		err = errors.Unwrap(err)
+	}
+	return nodes.Position{}
+}
+
 // UndefinedError represents an undefined variable error
 type UndefinedError struct {
 	error
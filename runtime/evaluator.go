@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"math/big"
 	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"unicode"
 
@@ -38,15 +41,15 @@ func controlName(signal interface{}) string {
 	}
 }
 
-// Markup represents a string that should not be HTML-escaped
-type Markup string
-
 // Evaluator implements the visitor pattern for evaluating AST nodes
 type Evaluator struct {
 	ctx            *Context
 	securityCtx    *SecurityContext
 	securityChecks bool
 	suspendAwait   bool
+	// hook is the environment's trace hook when the evaluator was created,
+	// so untraced calls skip building trace events altogether.
+	hook TraceHook
 }
 
 var (
@@ -56,7 +59,7 @@ var (
 
 // NewEvaluator creates a new evaluator
 func NewEvaluator(ctx *Context) *Evaluator {
-	return &Evaluator{ctx: ctx}
+	return &Evaluator{ctx: ctx, hook: contextTraceHook(ctx)}
 }
 
 // NewSecureEvaluator creates a new evaluator with security checks
@@ -65,6 +68,7 @@ func NewSecureEvaluator(ctx *Context, secCtx *SecurityContext) *Evaluator {
 		ctx:            ctx,
 		securityCtx:    secCtx,
 		securityChecks: true,
+		hook:           contextTraceHook(ctx),
 	}
 }
 
@@ -170,10 +174,13 @@ func (e *Evaluator) extractFunctionName(call *nodes.Call) string {
 	return "unknown"
 }
 
-// Write writes content to the output writer
+// Write writes content to the output writer. The first write error is kept
+// so output nodes can abort rendering, e.g. when a stream consumer goes away.
 func (e *Evaluator) Write(content string) {
 	if e.ctx.writer != nil {
-		io.WriteString(e.ctx.writer, content)
+		if _, err := io.WriteString(e.ctx.writer, content); err != nil && e.ctx.writeErr == nil {
+			e.ctx.writeErr = err
+		}
 	}
 }
 
@@ -329,6 +336,9 @@ func (e *Evaluator) visitOutput(node *nodes.Output) interface{} {
 		} else if markup, ok := value.(Markup); ok {
 			// Markup strings are safe and should not be escaped
 			e.Write(string(markup))
+		} else if trusted, ok := trustedTemplateString(value); ok {
+			// html/template typed strings are already safe, just like Markup
+			e.Write(trusted)
 		} else {
 			// Convert other values to string and apply autoescaping
 			str := e.toString(value, node.GetPosition())
@@ -337,6 +347,9 @@ func (e *Evaluator) visitOutput(node *nodes.Output) interface{} {
 			}
 			e.Write(str)
 		}
+		if e.ctx.writeErr != nil {
+			return e.ctx.writeErr
+		}
 	}
 	return nil
 }
@@ -354,9 +367,12 @@ func (e *Evaluator) visitFor(node *nodes.For) interface{} {
 		return err
 	}
 
-	// Handle empty iteration
+	// Handle empty iteration. The else body gets its own scope so that
+	// assignments made there do not leak, matching the non-empty path.
 	if len(items) == 0 {
 		if len(node.Else) > 0 {
+			e.ctx.PushScope()
+			defer e.ctx.PopScope()
 			for _, stmt := range node.Else {
 				if result := e.Evaluate(stmt); result != nil {
 					if err, ok := result.(error); ok {
@@ -371,7 +387,9 @@ func (e *Evaluator) visitFor(node *nodes.For) interface{} {
 		return nil
 	}
 
-	// Create new scope for the loop
+	// Create new scope for the loop. As in Jinja, assignments made in the
+	// body persist across iterations but never escape the loop; templates
+	// that need to carry state out of a loop use a namespace.
 	e.ctx.PushScope()
 	defer e.ctx.PopScope()
 
@@ -543,6 +561,9 @@ func (e *Evaluator) visitInclude(node *nodes.Include) interface{} {
 	}
 
 	if len(templateNames) == 0 {
+		if len(node.Else) > 0 {
+			return e.visitIncludeElse(node)
+		}
 		if node.IgnoreMissing {
 			return nil
 		}
@@ -550,7 +571,9 @@ func (e *Evaluator) visitInclude(node *nodes.Include) interface{} {
 	}
 
 	var lastErr error
-	for _, name := range templateNames {
+	for i, name := range templateNames {
+		name = e.relativeTemplateName(name)
+		templateNames[i] = name
 		tmpl, loadErr := e.ctx.environment.LoadTemplate(name)
 		if loadErr != nil {
 			if isTemplateNotFoundError(loadErr) {
@@ -560,13 +583,16 @@ func (e *Evaluator) visitInclude(node *nodes.Include) interface{} {
 			return loadErr
 		}
 
-		if renderErr := e.renderIncludedTemplate(tmpl, node.WithContext); renderErr != nil {
+		if renderErr := e.renderIncludedTemplate(tmpl, node); renderErr != nil {
 			return renderErr
 		}
 
 		return nil
 	}
 
+	if len(node.Else) > 0 {
+		return e.visitIncludeElse(node)
+	}
 	if node.IgnoreMissing {
 		return nil
 	}
@@ -581,6 +607,31 @@ func (e *Evaluator) visitInclude(node *nodes.Include) interface{} {
 	return NewError(ErrorTypeTemplate, "no templates found for include", node.GetPosition(), node)
 }
 
+// visitIncludeElse renders the fallback body of an include whose templates
+// were not found.
+func (e *Evaluator) visitIncludeElse(node *nodes.Include) interface{} {
+	for _, stmt := range node.Else {
+		if result := e.Evaluate(stmt); result != nil {
+			if err, ok := result.(error); ok {
+				return err
+			}
+			if signal, ok := isControlSignal(result); ok {
+				return signal
+			}
+		}
+	}
+	return nil
+}
+
+// relativeTemplateName resolves "./" and "../" template references against
+// the template currently being rendered.
+func (e *Evaluator) relativeTemplateName(name string) string {
+	if e.ctx.current == nil {
+		return name
+	}
+	return e.ctx.environment.resolveRelativeName(name, e.ctx.current.loadPath())
+}
+
 func (e *Evaluator) evaluateIncludeTargets(expr nodes.Expr) ([]string, interface{}) {
 	value := e.Evaluate(expr)
 	if err, ok := value.(error); ok {
@@ -610,8 +661,8 @@ func (e *Evaluator) evaluateIncludeTargets(expr nodes.Expr) ([]string, interface
 	}
 }
 
-func (e *Evaluator) renderIncludedTemplate(tmpl *Template, withContext bool) error {
-	if withContext {
+func (e *Evaluator) renderIncludedTemplate(tmpl *Template, node *nodes.Include) error {
+	if node.WithContext && len(node.Only) == 0 {
 		oldCurrent := e.ctx.current
 		oldAutoescape := e.ctx.ShouldAutoescape()
 		e.ctx.current = tmpl
@@ -625,11 +676,35 @@ func (e *Evaluator) renderIncludedTemplate(tmpl *Template, withContext bool) err
 		return tmpl.ExecuteWithContext(e.ctx)
 	}
 
-	includeCtx := NewContextWithEnvironment(e.ctx.environment, nil)
+	var vars map[string]interface{}
+	if len(node.Only) > 0 {
+		vars = make(map[string]interface{}, len(node.Only))
+		for _, kw := range node.Only {
+			if kw.Value == nil {
+				if value, ok := e.ctx.GetVar(kw.Key); ok {
+					vars[kw.Key] = value
+				}
+				continue
+			}
+			value := e.Evaluate(kw.Value)
+			if err, ok := value.(error); ok {
+				return err
+			}
+			vars[kw.Key] = value
+		}
+	}
+
+	includeCtx := NewContextWithEnvironment(e.ctx.environment, vars)
+	includeCtx.setRenderGlobals(e.ctx.RenderGlobals(), vars)
+	includeCtx.localFilters = e.ctx.localFilters
 	includeCtx.SetAutoescape(tmpl.Autoescape())
 	includeCtx.writer = e.ctx.writer
 	includeCtx.current = tmpl
-	return tmpl.ExecuteWithContext(includeCtx)
+	err := tmpl.ExecuteWithContext(includeCtx)
+	if includeCtx.errorLogged {
+		e.ctx.errorLogged = true
+	}
+	return err
 }
 
 func isTemplateNotFoundError(err error) bool {
@@ -661,6 +736,7 @@ func (e *Evaluator) visitImport(node *nodes.Import) interface{} {
 	if !ok {
 		return NewError(ErrorTypeTemplate, "import template name must be a string", node.GetPosition(), node)
 	}
+	templateName = e.relativeTemplateName(templateName)
 
 	// Import the template
 	if e.ctx.environment == nil {
@@ -698,6 +774,7 @@ func (e *Evaluator) visitFromImport(node *nodes.FromImport) interface{} {
 	if !ok {
 		return NewError(ErrorTypeTemplate, "from import template name must be a string", node.GetPosition(), node)
 	}
+	templateName = e.relativeTemplateName(templateName)
 
 	// Import the template
 	if e.ctx.environment == nil {
@@ -824,26 +901,20 @@ func (e *Evaluator) visitCallBlock(node *nodes.CallBlock) interface{} {
 	}
 
 	if callNode.DynArgs != nil {
-		dynArgs := e.Evaluate(callNode.DynArgs)
-		if err, ok := dynArgs.(error); ok {
+		dynArgs, err := e.evaluateDynArgs(callNode.DynArgs, callNode.GetPosition())
+		if err != nil {
 			return err
 		}
-		if slice, ok := dynArgs.([]interface{}); ok {
-			args = append(args, slice...)
-		}
+		args = append(args, dynArgs...)
 	}
 
 	if callNode.DynKwargs != nil {
-		dynKwargs := e.Evaluate(callNode.DynKwargs)
-		if err, ok := dynKwargs.(error); ok {
+		dynKwargs, err := e.evaluateDynKwargs(callNode.DynKwargs, callNode.GetPosition(), callNode)
+		if err != nil {
 			return err
 		}
-		if dict, ok := dynKwargs.(map[interface{}]interface{}); ok {
-			for k, v := range dict {
-				if key, ok := k.(string); ok {
-					kwargs[key] = v
-				}
-			}
+		for k, v := range dynKwargs {
+			kwargs[k] = v
 		}
 	}
 
@@ -1074,7 +1145,6 @@ func (e *Evaluator) visitCallBlock(node *nodes.CallBlock) interface{} {
 
 	e.ctx.PushScope()
 	e.ctx.Set("caller", callerFunc)
-	defer e.ctx.PopScope()
 
 	if m, ok := callable.(*Macro); ok {
 		m.callerFunc = callerFunc
@@ -1084,6 +1154,7 @@ func (e *Evaluator) visitCallBlock(node *nodes.CallBlock) interface{} {
 	}
 
 	result := e.callFunction(callable, args, kwargs, node)
+	e.ctx.PopScope()
 	if err, ok := result.(error); ok {
 		return err
 	}
@@ -1091,6 +1162,12 @@ func (e *Evaluator) visitCallBlock(node *nodes.CallBlock) interface{} {
 		return signal
 	}
 
+	if node.Target != nil {
+		// Captured results keep their type so callables returning computed
+		// values (not just rendered markup) can be used in expressions.
+		return e.assignTarget(node.Target, result, node.GetPosition())
+	}
+
 	if result != nil {
 		finalized, err := e.finalizeValue(result)
 		if err != nil {
@@ -1203,7 +1280,7 @@ func (e *Evaluator) finalizeValue(value interface{}) (interface{}, error) {
 	if e.ctx == nil || e.ctx.environment == nil {
 		return value, nil
 	}
-	return e.ctx.environment.applyFinalize(value)
+	return e.ctx.environment.applyFinalize(e.ctx, value)
 }
 
 func (e *Evaluator) visitWith(node *nodes.With) interface{} {
@@ -1270,9 +1347,16 @@ func (e *Evaluator) visitAssignBlock(node *nodes.AssignBlock) interface{} {
 
 	e.ctx.writer = oldWriter
 
+	// Captured output was already escaped while rendering the body, so under
+	// autoescape it must be marked safe to avoid escaping it a second time.
 	value := interface{}(buf.String())
+	if e.ctx.ShouldAutoescape() {
+		value = Markup(buf.String())
+	}
 	if node.Filter != nil {
-		baseValue := &nodes.Const{Value: buf.String()}
+		// Filters apply innermost first, exactly as in the expression form
+		// `{% set x = body|a|b %}`.
+		baseValue := &nodes.Const{Value: value}
 		cloned := cloneFilterChain(node.Filter, baseValue)
 		filtered := e.visitFilter(cloned)
 		if err, ok := filtered.(error); ok {
@@ -1927,6 +2011,16 @@ func (e *Evaluator) visitBinExpr(node *nodes.BinExpr) interface{} {
 		return err
 	}
 
+	// Arithmetic needs defined operands. An undefined value passed through a
+	// filter, as in (missing|length) + 1, reports the missing name.
+	if node.Operator != "and" && node.Operator != "or" {
+		for _, operand := range []interface{}{left, right} {
+			if undef, ok := operand.(undefinedType); ok {
+				return NewUndefinedError(undefinedName(undef), node.GetPosition(), node)
+			}
+		}
+	}
+
 	switch node.Operator {
 	case "+":
 		return e.add(left, right, node.GetPosition())
@@ -2164,7 +2258,7 @@ func (e *Evaluator) callAwaitFunction(fn reflect.Value, node nodes.Node) interfa
 
 func (e *Evaluator) visitCall(node *nodes.Call) interface{} {
 	// Evaluate the callable
-	callable := e.Evaluate(node.Node)
+	callable := e.evaluateCallee(node.Node)
 	if err, ok := callable.(error); ok {
 		return err
 	}
@@ -2191,38 +2285,113 @@ func (e *Evaluator) visitCall(node *nodes.Call) interface{} {
 
 	// Handle dynamic arguments
 	if node.DynArgs != nil {
-		dynArgs := e.Evaluate(node.DynArgs)
-		if err, ok := dynArgs.(error); ok {
+		dynArgs, err := e.evaluateDynArgs(node.DynArgs, node.GetPosition())
+		if err != nil {
 			return err
 		}
-		if slice, ok := dynArgs.([]interface{}); ok {
-			args = append(args, slice...)
-		}
+		args = append(args, dynArgs...)
 	}
 
 	if node.DynKwargs != nil {
-		dynKwargs := e.Evaluate(node.DynKwargs)
-		if err, ok := dynKwargs.(error); ok {
+		dynKwargs, err := e.evaluateDynKwargs(node.DynKwargs, node.GetPosition(), node)
+		if err != nil {
 			return err
 		}
-		if dict, ok := dynKwargs.(map[interface{}]interface{}); ok {
-			for k, v := range dict {
-				if key, ok := k.(string); ok {
-					kwargs[key] = v
-				}
-			}
+		for k, v := range dynKwargs {
+			kwargs[k] = v
 		}
 	}
 
 	return e.callFunction(callable, args, kwargs, node)
 }
 
+// evaluateDynArgs evaluates the *args expression of a call and returns the
+// values to spread into the positional arguments. Any iterable is accepted.
+func (e *Evaluator) evaluateDynArgs(expr nodes.Expr, pos nodes.Position) ([]interface{}, error) {
+	value := e.Evaluate(expr)
+	if err, ok := value.(error); ok {
+		return nil, err
+	}
+	if value == nil {
+		return nil, nil
+	}
+	return e.toSlice(value, pos)
+}
+
+// evaluateDynKwargs evaluates the **kwargs expression of a call and returns
+// the keyword arguments it holds. Any mapping with string keys is accepted.
+func (e *Evaluator) evaluateDynKwargs(expr nodes.Expr, pos nodes.Position, node nodes.Node) (map[string]interface{}, error) {
+	value := e.Evaluate(expr)
+	if err, ok := value.(error); ok {
+		return nil, err
+	}
+	if value == nil {
+		return nil, nil
+	}
+	dict, ok := toStringInterfaceMap(value)
+	if !ok {
+		return nil, NewError(ErrorTypeTemplate, "dynamic keyword arguments must be a mapping", pos, node)
+	}
+	return dict, nil
+}
+
+// evaluateCallee evaluates the callable of a call expression. Two attribute
+// calls need the receiver rather than the attribute value: cycler.current is
+// a property that still supports the older current() form, and list methods
+// on a namespace attribute, as in ns.items.append(x), store the updated list
+// back into the namespace.
+func (e *Evaluator) evaluateCallee(expr nodes.Expr) interface{} {
+	getattr, ok := expr.(*nodes.Getattr)
+	if !ok || (getattr.Attr != "current" && !isListMethod(getattr.Attr)) {
+		return e.Evaluate(expr)
+	}
+	if err := e.checkGetattrSecurity(getattr); err != nil {
+		return err
+	}
+
+	var obj interface{}
+	if field, ok := getattr.Node.(*nodes.Getattr); ok && isListMethod(getattr.Attr) {
+		if err := e.checkGetattrSecurity(field); err != nil {
+			return err
+		}
+		container := e.Evaluate(field.Node)
+		if err, ok := container.(error); ok {
+			return err
+		}
+		if ns, ok := container.(*Namespace); ok {
+			return ns.listMethod(field.Attr, getattr.Attr)
+		}
+		obj = e.resolveGetattr(container, field)
+	} else {
+		obj = e.Evaluate(getattr.Node)
+	}
+	if err, ok := obj.(error); ok {
+		return err
+	}
+	if c, ok := obj.(*cycler); ok && getattr.Attr == "current" {
+		return func() interface{} { return c.Current() }
+	}
+	return e.resolveGetattr(obj, getattr)
+}
+
+// checkGetattrSecurity applies the per-node security checks Evaluate would
+// run for an attribute node that is resolved without being evaluated.
+func (e *Evaluator) checkGetattrSecurity(node *nodes.Getattr) error {
+	if e.securityChecks && e.securityCtx != nil && !e.performSecurityChecks(node) {
+		return fmt.Errorf("security violation during evaluation")
+	}
+	return nil
+}
+
 func (e *Evaluator) visitGetattr(node *nodes.Getattr) interface{} {
 	obj := e.Evaluate(node.Node)
 	if err, ok := obj.(error); ok {
 		return err
 	}
+	return e.resolveGetattr(obj, node)
+}
 
+func (e *Evaluator) resolveGetattr(obj interface{}, node *nodes.Getattr) interface{} {
 	value, err := e.ctx.ResolveAttribute(obj, node.Attr)
 	if err != nil {
 		return err
@@ -2268,21 +2437,48 @@ func (e *Evaluator) visitSlice(node *nodes.Slice) interface{} {
 	return e.createSlice(start, stop, step, node.GetPosition())
 }
 
+// positionUndefinedError attaches the filter's position to an undefined
+// error raised without one.
+func (e *Evaluator) positionUndefinedError(err *UndefinedError, node nodes.Node) error {
+	if base, ok := err.error.(*Error); ok && base.Position.Line == 0 {
+		return NewUndefinedError(err.Name, node.GetPosition(), node)
+	}
+	return err
+}
+
 func (e *Evaluator) visitFilter(node *nodes.Filter) interface{} {
+	// Resolve the filter first so unknown names fail even for undefined input
+	filterFunc, ok := e.ctx.lookupFilter(node.Name)
+	if !ok {
+		return NewFilterError(node.Name, "unknown filter", node.GetPosition(), node, nil)
+	}
+	acceptsUndefined := e.filterAcceptsUndefined(node.Name)
+
 	// Evaluate the input value
 	input := e.Evaluate(node.Node)
 	if err, ok := input.(error); ok {
 		if IsUndefinedError(err) {
-			if strings.EqualFold(node.Name, "default") {
+			if acceptsUndefined {
 				input = undefinedSentinel
 			} else {
-				return err
+				return e.positionUndefinedError(err.(*UndefinedError), node)
 			}
 		} else {
 			return err
 		}
 	}
 
+	// Only default and filters added with AddUndefinedFilter inspect
+	// undefined input. Every other filter raises for strict undefined and
+	// otherwise passes the undefined value through, so `{{ missing|upper }}`
+	// renders empty and a later default still applies.
+	if undef, ok := input.(undefinedType); ok && !acceptsUndefined {
+		if strict, ok := undef.(StrictUndefined); ok {
+			return NewUndefinedError(strict.name, node.GetPosition(), node)
+		}
+		return undef
+	}
+
 	// Evaluate filter arguments
 	args := make([]interface{}, len(node.Args))
 	for i, arg := range node.Args {
@@ -2293,6 +2489,14 @@ func (e *Evaluator) visitFilter(node *nodes.Filter) interface{} {
 		args[i] = value
 	}
 
+	if node.DynArgs != nil {
+		dynArgs, err := e.evaluateDynArgs(node.DynArgs, node.GetPosition())
+		if err != nil {
+			return err
+		}
+		args = append(args, dynArgs...)
+	}
+
 	if len(node.Kwargs) > 0 || node.DynKwargs != nil {
 		kwargs := make(map[string]interface{})
 		for _, kwarg := range node.Kwargs {
@@ -2311,16 +2515,12 @@ func (e *Evaluator) visitFilter(node *nodes.Filter) interface{} {
 			kwargs[keyStr] = value
 		}
 		if node.DynKwargs != nil {
-			value := e.Evaluate(node.DynKwargs)
-			if err, ok := value.(error); ok {
+			dynKwargs, err := e.evaluateDynKwargs(node.DynKwargs, node.GetPosition(), node)
+			if err != nil {
 				return err
 			}
-			if dict, ok := value.(map[interface{}]interface{}); ok {
-				for k, v := range dict {
-					if key, ok := k.(string); ok {
-						kwargs[key] = v
-					}
-				}
+			for k, v := range dynKwargs {
+				kwargs[k] = v
 			}
 		}
 		if len(kwargs) > 0 {
@@ -2328,14 +2528,10 @@ func (e *Evaluator) visitFilter(node *nodes.Filter) interface{} {
 		}
 	}
 
-	// Get filter function
-	filterFunc, ok := e.ctx.environment.GetFilter(node.Name)
-	if !ok {
-		return NewFilterError(node.Name, "unknown filter", node.GetPosition(), node, nil)
-	}
-
 	// Apply filter
-	result, err := filterFunc(e.ctx, input, args...)
+	result, err := e.traceCall("filter", node.Name, input, args, nil, func() (interface{}, error) {
+		return filterFunc(e.ctx, input, args...)
+	})
 	if err != nil {
 		return NewFilterError(node.Name, err.Error(), node.GetPosition(), node, err)
 	}
@@ -2386,7 +2582,9 @@ func (e *Evaluator) visitTest(node *nodes.Test) interface{} {
 	}
 
 	// Apply test
-	result, err := testFunc(e.ctx, input, args...)
+	result, err := e.traceCall("test", node.Name, input, args, nil, func() (interface{}, error) {
+		return testFunc(e.ctx, input, args...)
+	})
 	if err != nil {
 		return NewTestError(node.Name, err.Error(), node.GetPosition(), node, err)
 	}
@@ -2402,7 +2600,13 @@ func (e *Evaluator) visitTest(node *nodes.Test) interface{} {
 func (e *Evaluator) visitCompare(node *nodes.Compare) interface{} {
 	left := e.Evaluate(node.Expr)
 	if err, ok := left.(error); ok {
-		return err
+		// "a.b.c is defined" answers false when any link of the chain is
+		// missing, as the standalone Test node does.
+		undefErr, isUndefined := err.(*UndefinedError)
+		if !isUndefined || !testsDefinedness(node) {
+			return err
+		}
+		left = e.ctx.environment.newUndefined(undefErr.Name)
 	}
 
 	for _, op := range node.Ops {
@@ -2437,6 +2641,23 @@ func (e *Evaluator) visitCompare(node *nodes.Compare) interface{} {
 	return true
 }
 
+// testsDefinedness reports whether a comparison starts with an "is defined"
+// or "is undefined" test.
+func testsDefinedness(node *nodes.Compare) bool {
+	if len(node.Ops) == 0 || (node.Ops[0].Op != "is" && node.Ops[0].Op != "isnot") {
+		return false
+	}
+	name, ok := node.Ops[0].Expr.(*nodes.Name)
+	if !ok {
+		return false
+	}
+	switch strings.ToLower(name.Name) {
+	case "defined", "undefined":
+		return true
+	}
+	return false
+}
+
 func (e *Evaluator) visitCondExpr(node *nodes.CondExpr) interface{} {
 	test := e.Evaluate(node.Test)
 	if err, ok := test.(error); ok {
@@ -2451,12 +2672,39 @@ func (e *Evaluator) visitCondExpr(node *nodes.CondExpr) interface{} {
 }
 
 func (e *Evaluator) visitConcat(node *nodes.Concat) interface{} {
-	var result strings.Builder
+	values := make([]interface{}, 0, len(node.Nodes))
+	hasMarkup := false
 	for _, n := range node.Nodes {
 		value := e.Evaluate(n)
 		if err, ok := value.(error); ok {
 			return err
 		}
+		if _, ok := value.(Markup); ok {
+			hasMarkup = true
+		} else if _, ok := trustedTemplateString(value); ok {
+			hasMarkup = true
+		}
+		values = append(values, value)
+	}
+
+	// With autoescape active, joining safe fragments must keep them safe while
+	// escaping the plain operands, mirroring Jinja's markup-aware `~`.
+	if hasMarkup && e.ctx.ShouldAutoescape() {
+		var result Markup
+		for _, value := range values {
+			if markup, ok := value.(Markup); ok {
+				result += markup
+			} else if trusted, ok := trustedTemplateString(value); ok {
+				result += Markup(trusted)
+			} else {
+				result += Markup(e.escape(e.toString(value, node.GetPosition())))
+			}
+		}
+		return result
+	}
+
+	var result strings.Builder
+	for _, value := range values {
 		result.WriteString(e.toString(value, node.GetPosition()))
 	}
 	return result.String()
@@ -2544,10 +2792,8 @@ func (e *Evaluator) toString(value interface{}, pos nodes.Position) string {
 			return e.handleUndefinedStringError(err, pos)
 		}
 		return str
-	case fmt.Stringer:
-		return v.String()
 	default:
-		return fmt.Sprintf("%v", value)
+		return toString(value)
 	}
 }
 
@@ -2595,6 +2841,8 @@ func (e *Evaluator) isTruthy(value interface{}) bool {
 	}
 
 	switch v := value.(type) {
+	case undefinedType:
+		return false
 	case bool:
 		return v
 	case int:
@@ -2616,6 +2864,15 @@ func (e *Evaluator) isTruthy(value interface{}) bool {
 	}
 }
 
+// stringCharacters splits a string into its characters.
+func stringCharacters(s string) []interface{} {
+	result := make([]interface{}, 0, len(s))
+	for _, r := range s {
+		result = append(result, string(r))
+	}
+	return result
+}
+
 func (e *Evaluator) toSlice(value interface{}, pos nodes.Position) ([]interface{}, error) {
 	if value == nil {
 		return nil, nil
@@ -2637,22 +2894,31 @@ func (e *Evaluator) toSlice(value interface{}, pos nodes.Position) ([]interface{
 		}
 		return result, nil
 	case map[interface{}]interface{}:
-		result := make([]interface{}, 0, len(v))
-		for _, item := range v {
-			result = append(result, item)
+		// Visit values in key order so iterating a dict is deterministic.
+		keys := make([]interface{}, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.SliceStable(keys, func(i, j int) bool {
+			return compareValues(keys[i], keys[j], true) < 0
+		})
+		result := make([]interface{}, len(keys))
+		for i, key := range keys {
+			result[i] = v[key]
 		}
 		return result, nil
+	case *groupbyGroup:
+		return v.tuple(), nil
 	case string:
-		// Convert string to slice of characters
-		result := make([]interface{}, len(v))
-		for i, r := range v {
-			result[i] = string(r)
-		}
-		return result, nil
+		return stringCharacters(v), nil
+	case Markup:
+		return stringCharacters(string(v)), nil
 	default:
 		// Use reflection to handle other types
 		val := reflect.ValueOf(value)
 		switch val.Kind() {
+		case reflect.String:
+			return stringCharacters(val.String()), nil
 		case reflect.Slice, reflect.Array:
 			result := make([]interface{}, val.Len())
 			for i := 0; i < val.Len(); i++ {
@@ -2698,6 +2964,14 @@ func (e *Evaluator) assignTarget(target nodes.Expr, value interface{}, pos nodes
 		if err, ok := container.(error); ok {
 			return err
 		}
+		if name, ok := t.Node.(*nodes.Name); ok && isUndefinedValue(container) {
+			if !e.autoNamespace() {
+				return NewAssignmentError(target.String(), fmt.Sprintf("namespace '%s' is undefined", name.Name), pos, target)
+			}
+			ns := NewNamespace(nil)
+			e.ctx.Set(name.Name, ns)
+			container = ns
+		}
 		return assignAttributeValue(container, t.Attr, value, pos, target)
 	case *nodes.Getitem:
 		container := e.Evaluate(t.Node)
@@ -2711,6 +2985,11 @@ func (e *Evaluator) assignTarget(target nodes.Expr, value interface{}, pos nodes
 		return assignIndexValue(container, idx, value, pos, target)
 	case *nodes.NSRef:
 		namespaceValue, exists := e.ctx.Get(t.Name)
+		if !exists && e.autoNamespace() {
+			namespaceValue = NewNamespace(nil)
+			e.ctx.Set(t.Name, namespaceValue)
+			exists = true
+		}
 		if !exists {
 			return NewAssignmentError(target.String(), fmt.Sprintf("namespace '%s' is undefined", t.Name), pos, target)
 		}
@@ -2733,6 +3012,21 @@ func (e *Evaluator) assignTarget(target nodes.Expr, value interface{}, pos nodes
 	}
 }
 
+// filterAcceptsUndefined reports whether the named filter is called with
+// undefined input rather than passing it through.
+func (e *Evaluator) filterAcceptsUndefined(name string) bool {
+	if strings.EqualFold(name, "default") {
+		return true
+	}
+	return e.ctx.environment != nil && e.ctx.environment.filterAcceptsUndefined(name)
+}
+
+// autoNamespace reports whether assigning to an attribute of an undefined
+// name should create a namespace for it.
+func (e *Evaluator) autoNamespace() bool {
+	return e.ctx.environment != nil && e.ctx.environment.AutoNamespace()
+}
+
 func (e *Evaluator) callFunction(callable interface{}, args []interface{}, kwargs map[string]interface{}, node nodes.Node) interface{} {
 	pos := nodes.Position{}
 	if node != nil {
@@ -2752,7 +3046,9 @@ func (e *Evaluator) callFunction(callable interface{}, args []interface{}, kwarg
 				fn.callerFunc = gf
 			}
 		}
-		result, err := fn.Execute(e.ctx, args, kwargs)
+		result, err := e.traceCall("macro", fn.Name, nil, args, kwargs, func() (interface{}, error) {
+			return fn.Execute(e.ctx, args, kwargs)
+		})
 		fn.callerFunc = nil
 		if err != nil {
 			return NewMacroError(fn.Name, err.Error(), pos, fn)
@@ -2802,67 +3098,71 @@ func (e *Evaluator) callFunction(callable interface{}, args []interface{}, kwarg
 			callArgs := make([]reflect.Value, 0)
 
 			// Check if it needs a context parameter
-			hasContext := false
 			if funcType.NumIn() > 0 {
 				firstParamType := funcType.In(0)
 				if firstParamType == reflect.TypeOf((*Context)(nil)) {
 					// Add context as first parameter
 					callArgs = append(callArgs, reflect.ValueOf(e.ctx))
-					hasContext = true
 				}
 			}
 
-			// For variadic functions, we need to check expected params
+			// Template values are converted to the declared parameter
+			// types; variadic arguments are converted to the element type.
+			firstParam := len(callArgs)
+			numFixed := funcType.NumIn() - firstParam
 			if isVariadic {
-				// Get the expected number of non-variadic params
-				numFixed := funcType.NumIn()
-				if hasContext {
-					numFixed-- // Context is already added
-				}
-				numFixed-- // One param is variadic
-
-				// Add fixed args
-				for i := 0; i < numFixed && i < len(argsWithKw); i++ {
-					callArgs = append(callArgs, reflect.ValueOf(argsWithKw[i]))
+				numFixed--
+			}
+			if len(argsWithKw) < numFixed || (!isVariadic && len(argsWithKw) > numFixed) {
+				expected := fmt.Sprintf("%d", numFixed)
+				if isVariadic {
+					expected = "at least " + expected
 				}
-
-				// Add remaining args as variadic
-				for i := numFixed; i < len(argsWithKw); i++ {
-					callArgs = append(callArgs, reflect.ValueOf(argsWithKw[i]))
+				return NewError(ErrorTypeTemplate, fmt.Sprintf("%s expects %s arguments, got %d", funcType, expected, len(argsWithKw)), pos, node)
+			}
+			for i, arg := range argsWithKw {
+				var paramType reflect.Type
+				if i < numFixed {
+					paramType = funcType.In(firstParam + i)
+				} else {
+					paramType = funcType.In(funcType.NumIn() - 1).Elem()
 				}
-			} else {
-				// Non-variadic: add all args
-				for _, arg := range argsWithKw {
-					callArgs = append(callArgs, reflect.ValueOf(arg))
+				argVal, err := coerceArgument(arg, paramType)
+				if err != nil {
+					return NewError(ErrorTypeTemplate, fmt.Sprintf("argument %d: %v", i+1, err), pos, node)
 				}
+				callArgs = append(callArgs, argVal)
 			}
 
-			// Call the function
-			var results []reflect.Value
-			if isVariadic {
-				results = val.CallSlice(callArgs)
-			} else {
-				results = val.Call(callArgs)
+			// Call converts the trailing arguments into the variadic slice
+			results, err := callReflected(val, callArgs)
+			if err != nil {
+				return NewError(ErrorTypeTemplate, err.Error(), pos, node)
 			}
 
-			// Handle return values
+			// Handle return values. A trailing error result is reported and
+			// multiple remaining results are returned as a tuple so they
+			// can be unpacked with {% set a, b = fn() %}.
 			if len(results) == 0 {
 				return nil
-			} else if len(results) == 1 {
-				return autoResult(results[0].Interface())
-			} else if len(results) == 2 {
-				// Assume (result, error) pattern
-				if !results[1].IsNil() {
-					err, ok := results[1].Interface().(error)
-					if ok {
-						return NewError(ErrorTypeTemplate, err.Error(), pos, node)
-					}
+			}
+			if last := results[len(results)-1]; last.Type() == errorType {
+				if !last.IsNil() {
+					return NewError(ErrorTypeTemplate, last.Interface().(error).Error(), pos, node)
 				}
+				results = results[:len(results)-1]
+			}
+			switch len(results) {
+			case 0:
+				return nil
+			case 1:
 				return autoResult(results[0].Interface())
 			}
-
-			// Return first result if multiple
-			return autoResult(results[0].Interface())
+			tuple := make([]interface{}, len(results))
+			for i, result := range results {
+				tuple[i] = result.Interface()
+			}
+			return tuple
 		}
 
 		// Check if it's a macro-like callable
@@ -2877,6 +3177,17 @@ func (e *Evaluator) callFunction(callable interface{}, args []interface{}, kwarg
 	}
 }
 
+// callReflected invokes fn and reports a panic raised by the call as an
+// error so a misbehaving Go function cannot crash the host process.
+func callReflected(fn reflect.Value, args []reflect.Value) (results []reflect.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("call to %s panicked: %v", fn.Type(), r)
+		}
+	}()
+	return fn.Call(args), nil
+}
+
 func appendCallArgs(args []interface{}, kwargs map[string]interface{}) []interface{} {
 	if len(kwargs) == 0 {
 		return args
@@ -2895,48 +3206,70 @@ func (e *Evaluator) evaluateOptionalExpr(expr nodes.Expr) interface{} {
 }
 
 func (e *Evaluator) createSlice(start, stop, step interface{}, pos nodes.Position) interface{} {
-	// Convert to integers with defaults
-	startInt := 0
-	stopInt := 0
-	stepInt := 1
-
-	if start != nil {
-		if s, ok := toInt(start); ok {
-			startInt = s
+	var spec sliceIndex
+	bounds := []struct {
+		value  interface{}
+		target **int
+	}{
+		{start, &spec.start},
+		{stop, &spec.stop},
+		{step, &spec.step},
+	}
+
+	// Omitted bounds and none stay nil so resolveIndex can apply Python's
+	// defaults, which depend on the sequence length and step direction.
+	for _, bound := range bounds {
+		if err, ok := bound.value.(error); ok {
+			return err
 		}
-	}
-
-	if stop != nil {
-		if s, ok := toInt(stop); ok {
-			stopInt = s
+		if bound.value == nil || isUndefinedValue(bound.value) {
+			continue
 		}
-	}
-
-	if step != nil {
-		if s, ok := toInt(step); ok {
-			stepInt = s
+		n, ok := toInt(bound.value)
+		if !ok {
+			return NewError(ErrorTypeTemplate, fmt.Sprintf("slice indices must be integers or none, not %T", bound.value), pos, nil)
 		}
+		*bound.target = &n
 	}
 
-	return map[string]interface{}{
-		"start": startInt,
-		"stop":  stopInt,
-		"step":  stepInt,
+	if spec.step != nil && *spec.step == 0 {
+		return NewError(ErrorTypeTemplate, "slice step cannot be zero", pos, nil)
 	}
+
+	return spec
 }
 
 // Arithmetic operations
 
 func (e *Evaluator) add(left, right interface{}, pos nodes.Position) interface{} {
+	if l, r, ok := bigIntegerOperands(left, right); ok {
+		return bigIntegerArithmetic("+", l, r)
+	}
 	if leftNum, ok := classifyNumber(left); ok {
 		if rightNum, ok := classifyNumber(right); ok {
 			if leftNum.isFloat() || rightNum.isFloat() {
 				return leftNum.asFloat64() + rightNum.asFloat64()
 			}
-			return leftNum.intValue + rightNum.intValue
+			if sum, ok := addInt(leftNum.intValue, rightNum.intValue); ok {
+				return sum
+			}
+			return bigIntegerArithmetic("+", big.NewInt(leftNum.intValue), big.NewInt(rightNum.intValue))
 		}
 	}
 
+	if l, ok := left.(Markup); ok {
+		if isStringOperand(right) {
+			return l + escapeMarkup(e.ctx, right)
+		}
+		return NewError(ErrorTypeTemplate, fmt.Sprintf("unsupported operand types for +: %T and %T", left, right), pos, nil)
+	}
+	if r, ok := right.(Markup); ok {
+		if isStringOperand(left) {
+			return escapeMarkup(e.ctx, left) + r
+		}
+		return NewError(ErrorTypeTemplate, fmt.Sprintf("unsupported operand types for +: %T and %T", left, right), pos, nil)
+	}
+
 	if l, ok := left.(string); ok {
 		if r, ok := right.(string); ok {
 			return l + r
@@ -2948,12 +3281,18 @@ func (e *Evaluator) add(left, right interface{}, pos nodes.Position) interface{}
 }
 
 func (e *Evaluator) subtract(left, right interface{}, pos nodes.Position) interface{} {
+	if l, r, ok := bigIntegerOperands(left, right); ok {
+		return bigIntegerArithmetic("-", l, r)
+	}
 	if leftNum, ok := classifyNumber(left); ok {
 		if rightNum, ok := classifyNumber(right); ok {
 			if leftNum.isFloat() || rightNum.isFloat() {
 				return leftNum.asFloat64() - rightNum.asFloat64()
 			}
-			return leftNum.intValue - rightNum.intValue
+			if diff, ok := subtractInt(leftNum.intValue, rightNum.intValue); ok {
+				return diff
+			}
+			return bigIntegerArithmetic("-", big.NewInt(leftNum.intValue), big.NewInt(rightNum.intValue))
 		}
 	}
 
@@ -2961,12 +3300,18 @@ func (e *Evaluator) subtract(left, right interface{}, pos nodes.Position) interf
 }
 
 func (e *Evaluator) multiply(left, right interface{}, pos nodes.Position) interface{} {
+	if l, r, ok := bigIntegerOperands(left, right); ok {
+		return bigIntegerArithmetic("*", l, r)
+	}
 	if leftNum, ok := classifyNumber(left); ok {
 		if rightNum, ok := classifyNumber(right); ok {
 			if leftNum.isFloat() || rightNum.isFloat() {
 				return leftNum.asFloat64() * rightNum.asFloat64()
 			}
-			return leftNum.intValue * rightNum.intValue
+			if product, ok := multiplyInt(leftNum.intValue, rightNum.intValue); ok {
+				return product
+			}
+			return bigIntegerArithmetic("*", big.NewInt(leftNum.intValue), big.NewInt(rightNum.intValue))
 		}
 	}
 
@@ -2984,12 +3329,19 @@ func (e *Evaluator) multiply(left, right interface{}, pos nodes.Position) interf
 	return NewError(ErrorTypeTemplate, fmt.Sprintf("unsupported operand types for *: %T and %T", left, right), pos, nil)
 }
 
+// divide implements true division: like Python 3 the result is always a
+// float, even for evenly divisible integers. Use // for integer results.
+// Infinite divisors follow IEEE 754, so x / inf is 0 and NaN propagates.
 func (e *Evaluator) divide(left, right interface{}, pos nodes.Position) interface{} {
 	leftNum, leftOk := classifyNumber(left)
 	rightNum, rightOk := classifyNumber(right)
 	if leftOk && rightOk {
 		if rightNum.asFloat64() == 0 {
-			return NewError(ErrorTypeTemplate, "division by zero", pos, nil)
+			return e.zeroDivisor("division by zero", leftNum.asFloat64(), pos)
+		}
+		if !leftNum.isFloat() && !rightNum.isFloat() && rightNum.intValue != -1 && leftNum.intValue%rightNum.intValue == 0 {
+			// Divide exactly before converting so large integers keep their precision.
+			return float64(leftNum.intValue / rightNum.intValue)
 		}
 		return leftNum.asFloat64() / rightNum.asFloat64()
 	}
@@ -2998,11 +3350,17 @@ func (e *Evaluator) divide(left, right interface{}, pos nodes.Position) interfac
 }
 
 func (e *Evaluator) floorDivide(left, right interface{}, pos nodes.Position) interface{} {
+	if l, r, ok := bigIntegerOperands(left, right); ok {
+		if r.Sign() == 0 {
+			return e.zeroDivisor("division by zero", float64(l.Sign()), pos)
+		}
+		return bigIntegerArithmetic("//", l, r)
+	}
 	leftNum, leftOk := classifyNumber(left)
 	rightNum, rightOk := classifyNumber(right)
 	if leftOk && rightOk {
 		if rightNum.isZero() {
-			return NewError(ErrorTypeTemplate, "division by zero", pos, nil)
+			return e.zeroDivisor("division by zero", leftNum.asFloat64(), pos)
 		}
 
 		if leftNum.isFloat() || rightNum.isFloat() {
@@ -3015,6 +3373,29 @@ func (e *Evaluator) floorDivide(left, right interface{}, pos nodes.Position) int
 	return NewError(ErrorTypeTemplate, fmt.Sprintf("unsupported operand types for //: %T and %T", left, right), pos, nil)
 }
 
+// zeroDivisor applies the environment's divide-by-zero mode. In IEEE mode
+// the result is inf with the sign of dividend, or nan for a zero or nan
+// dividend; modulo passes nan as dividend so it always yields nan.
+func (e *Evaluator) zeroDivisor(message string, dividend float64, pos nodes.Position) interface{} {
+	if e.ctx.environment == nil {
+		return NewError(ErrorTypeTemplate, message, pos, nil)
+	}
+	mode, fallback := e.ctx.environment.DivideByZero()
+	switch mode {
+	case DivideByZeroIEEE:
+		switch {
+		case dividend > 0:
+			return math.Inf(1)
+		case dividend < 0:
+			return math.Inf(-1)
+		}
+		return math.NaN()
+	case DivideByZeroDefault:
+		return fallback
+	}
+	return NewError(ErrorTypeTemplate, message, pos, nil)
+}
+
 func floorDivideIntegers(left, right int64) int64 {
 	q := left / right
 	rem := left % right
@@ -3025,11 +3406,17 @@ func floorDivideIntegers(left, right int64) int64 {
 }
 
 func (e *Evaluator) modulo(left, right interface{}, pos nodes.Position) interface{} {
+	if l, r, ok := bigIntegerOperands(left, right); ok {
+		if r.Sign() == 0 {
+			return e.zeroDivisor("modulo by zero", math.NaN(), pos)
+		}
+		return bigIntegerArithmetic("%", l, r)
+	}
 	leftNum, leftOk := classifyNumber(left)
 	rightNum, rightOk := classifyNumber(right)
 	if leftOk && rightOk {
 		if rightNum.isZero() {
-			return NewError(ErrorTypeTemplate, "modulo by zero", pos, nil)
+			return e.zeroDivisor("modulo by zero", math.NaN(), pos)
 		}
 
 		if leftNum.isFloat() || rightNum.isFloat() {
@@ -3059,23 +3446,77 @@ func pythonModuloInt(left, right int64) int64 {
 	return rem
 }
 
+// maxPowerBits bounds the size of integer powers so a template cannot
+// exhaust memory with an expression such as 2 ** 10 ** 9.
+const maxPowerBits = 1 << 16
+
 func (e *Evaluator) power(left, right interface{}, pos nodes.Position) interface{} {
+	if l, r, ok := bigIntegerOperands(left, right); ok && r.Sign() >= 0 {
+		return e.powerBig(l, r, pos)
+	}
 	leftNum, leftOk := classifyNumber(left)
 	rightNum, rightOk := classifyNumber(right)
 	if leftOk && rightOk {
-		base := leftNum.asFloat64()
-		exponent := rightNum.asFloat64()
-
-		if leftNum.isFloat() || rightNum.isFloat() || exponent < 0 {
-			return math.Pow(base, exponent)
+		if leftNum.isFloat() || rightNum.isFloat() || rightNum.intValue < 0 {
+			return math.Pow(leftNum.asFloat64(), rightNum.asFloat64())
 		}
 
-		return int64(math.Pow(base, exponent))
+		if result, ok := powerInt(leftNum.intValue, rightNum.intValue); ok {
+			return result
+		}
+		return e.powerBig(big.NewInt(leftNum.intValue), big.NewInt(rightNum.intValue), pos)
 	}
 
 	return NewError(ErrorTypeTemplate, fmt.Sprintf("unsupported operand types for **: %T and %T", left, right), pos, nil)
 }
 
+// powerBig raises base to a non-negative exponent exactly, refusing results
+// larger than maxPowerBits.
+func (e *Evaluator) powerBig(base, exponent *big.Int, pos nodes.Position) interface{} {
+	if base.CmpAbs(big.NewInt(1)) > 0 {
+		if exponent.Cmp(big.NewInt(maxPowerBits)) > 0 || int64(base.BitLen())*exponent.Int64() > maxPowerBits {
+			return NewError(ErrorTypeTemplate, fmt.Sprintf("integer overflow in %s ** %s", base, exponent), pos, nil)
+		}
+	}
+	return normalizeBigInt(new(big.Int).Exp(base, exponent, nil))
+}
+
+// powerInt raises base to a non-negative exponent by repeated squaring and
+// reports false when the result does not fit in an int64.
+func powerInt(base, exponent int64) (int64, bool) {
+	result := int64(1)
+	for exponent > 0 {
+		if exponent&1 == 1 {
+			next, ok := multiplyInt(result, base)
+			if !ok {
+				return 0, false
+			}
+			result = next
+		}
+		exponent >>= 1
+		if exponent > 0 {
+			next, ok := multiplyInt(base, base)
+			if !ok {
+				return 0, false
+			}
+			base = next
+		}
+	}
+	return result, true
+}
+
+// multiplyInt multiplies two int64 values, reporting false on overflow.
+func multiplyInt(a, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	product := a * b
+	if product/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+		return 0, false
+	}
+	return product, true
+}
+
 func (e *Evaluator) logicalAnd(left, right interface{}) interface{} {
 	if !e.isTruthy(left) {
 		return left
@@ -3095,10 +3536,18 @@ func (e *Evaluator) logicalNot(operand interface{}) interface{} {
 }
 
 func (e *Evaluator) negate(operand interface{}, pos nodes.Position) interface{} {
+	if needsBigInt(operand) {
+		if v, ok := toBigInt(operand); ok {
+			return normalizeBigInt(v.Neg(v))
+		}
+	}
 	if num, ok := classifyNumber(operand); ok {
 		if num.isFloat() {
 			return -num.asFloat64()
 		}
+		if num.intValue == math.MinInt64 {
+			return new(big.Int).Neg(big.NewInt(num.intValue))
+		}
 		return -num.intValue
 	}
 	return NewError(ErrorTypeTemplate, fmt.Sprintf("bad operand type for unary -: %T", operand), pos, nil)
@@ -3134,6 +3583,9 @@ func (e *Evaluator) compare(op string, left, right interface{}, pos nodes.Positi
 }
 
 func (e *Evaluator) compareValues(left, right interface{}) int {
+	if l, r, ok := bigIntegerOperands(left, right); ok {
+		return l.Cmp(r)
+	}
 	leftVal, leftOk := toFloat64(left)
 	rightVal, rightOk := toFloat64(right)
 
@@ -3287,9 +3739,88 @@ func assignIndexValue(container interface{}, index interface{}, value interface{
 	}
 }
 
+func isNumericKind(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func parseNumericString(str string) (interface{}, error) {
+	str = strings.TrimSpace(str)
+	if i, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return i, nil
+	}
+	return strconv.ParseFloat(str, 64)
+}
+
+// convertNumber converts a numeric value to another numeric type, refusing
+// conversions that would overflow or drop a fractional part.
+func convertNumber(val reflect.Value, target reflect.Type) (reflect.Value, error) {
+	result := reflect.New(target).Elem()
+	fail := func() (reflect.Value, error) {
+		return reflect.Value{}, fmt.Errorf("cannot convert %v to %s without losing precision", val.Interface(), target)
+	}
+
+	switch target.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return val.Convert(target), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		switch val.Kind() {
+		case reflect.Float32, reflect.Float64:
+			f := val.Float()
+			if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+				return fail()
+			}
+			n = int64(f)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if val.Uint() > math.MaxInt64 {
+				return fail()
+			}
+			n = int64(val.Uint())
+		default:
+			n = val.Int()
+		}
+		if result.OverflowInt(n) {
+			return fail()
+		}
+		result.SetInt(n)
+	default:
+		var n uint64
+		switch val.Kind() {
+		case reflect.Float32, reflect.Float64:
+			f := val.Float()
+			if f != math.Trunc(f) || f < 0 || f >= math.MaxUint64 {
+				return fail()
+			}
+			n = uint64(f)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if val.Int() < 0 {
+				return fail()
+			}
+			n = uint64(val.Int())
+		default:
+			n = val.Uint()
+		}
+		if result.OverflowUint(n) {
+			return fail()
+		}
+		result.SetUint(n)
+	}
+	return result, nil
+}
+
 func convertToType(src interface{}, targetType reflect.Type, pos nodes.Position, node nodes.Node) (reflect.Value, error) {
+	targetName := "value"
+	if node != nil {
+		targetName = node.String()
+	}
 	if targetType == nil {
-		return reflect.Value{}, NewAssignmentError(node.String(), "invalid assignment target type", pos, node)
+		return reflect.Value{}, NewAssignmentError(targetName, "invalid assignment target type", pos, node)
 	}
 
 	if targetType.Kind() == reflect.Interface {
@@ -3312,7 +3843,7 @@ func convertToType(src interface{}, targetType reflect.Type, pos nodes.Position,
 		if val.Type().ConvertibleTo(targetType) {
 			return val.Convert(targetType), nil
 		}
-		return reflect.Value{}, NewAssignmentError(node.String(), fmt.Sprintf("cannot convert %T to %s", src, targetType), pos, node)
+		return reflect.Value{}, NewAssignmentError(targetName, fmt.Sprintf("cannot convert %T to %s", src, targetType), pos, node)
 	}
 
 	if src == nil {
@@ -3320,7 +3851,7 @@ func convertToType(src interface{}, targetType reflect.Type, pos nodes.Position,
 		case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
 			return reflect.Zero(targetType), nil
 		default:
-			return reflect.Value{}, NewAssignmentError(node.String(), fmt.Sprintf("cannot assign nil to %s", targetType), pos, node)
+			return reflect.Value{}, NewAssignmentError(targetName, fmt.Sprintf("cannot assign nil to %s", targetType), pos, node)
 		}
 	}
 
@@ -3335,7 +3866,7 @@ func convertToType(src interface{}, targetType reflect.Type, pos nodes.Position,
 		return val.Convert(targetType), nil
 	}
 
-	return reflect.Value{}, NewAssignmentError(node.String(), fmt.Sprintf("cannot convert %T to %s", src, targetType), pos, node)
+	return reflect.Value{}, NewAssignmentError(targetName, fmt.Sprintf("cannot convert %T to %s", src, targetType), pos, node)
 }
 
 func normalizeIndex(index interface{}, length int, pos nodes.Position, node nodes.Node) (int, error) {
@@ -3365,6 +3896,9 @@ func normalizeIndex(index interface{}, length int, pos nodes.Position, node node
 }
 
 func numericEqual(left, right interface{}) (bool, bool) {
+	if l, r, ok := bigIntegerOperands(left, right); ok {
+		return l.Cmp(r) == 0, true
+	}
 	leftVal, leftOk := toFloat64(left)
 	rightVal, rightOk := toFloat64(right)
 	if leftOk && rightOk {
@@ -3481,7 +4015,9 @@ func (e *Evaluator) evaluateTestOperator(op *nodes.Operand, value interface{}) i
 		args = append(args, kwargs)
 	}
 
-	result, err := testFunc(e.ctx, value, args...)
+	result, err := e.traceCall("test", testName, value, args, nil, func() (interface{}, error) {
+		return testFunc(e.ctx, value, args...)
+	})
 	if err != nil {
 		return NewTestError(testName, err.Error(), op.GetPosition(), op.Expr, err)
 	}
@@ -3500,25 +4036,5 @@ func (e *Evaluator) evaluateTestOperator(op *nodes.Operand, value interface{}) i
 }
 
 func (e *Evaluator) isInCollection(item, collection interface{}) bool {
-	switch coll := collection.(type) {
-	case []interface{}:
-		for _, v := range coll {
-			if v == item {
-				return true
-			}
-		}
-	case map[interface{}]interface{}:
-		_, exists := coll[item]
-		return exists
-	case map[string]interface{}:
-		if str, ok := item.(string); ok {
-			_, exists := coll[str]
-			return exists
-		}
-	case string:
-		if str, ok := item.(string); ok {
-			return strings.Contains(coll, str)
-		}
-	}
-	return false
+	return containsValue(collection, item)
 }
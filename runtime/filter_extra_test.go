@@ -1,6 +1,12 @@
 package runtime
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
 	"strings"
 	"testing"
 )
@@ -150,6 +156,69 @@ func TestToJSONFilter(t *testing.T) {
 	}
 }
 
+func TestToJSONSortsKeys(t *testing.T) {
+	source := `{% set d = {'b': 1, 'a': {'z': 2, 1: [3, {'y': none, 'x': true}]}, 'c': 'v'} %}{{ d|tojson }}`
+	expected := `{"a":{"1":[3,{"x":true,"y":null}],"z":2},"b":1,"c":"v"}`
+	for i := 0; i < 5; i++ {
+		out, err := ExecuteToString(source, nil)
+		if err != nil {
+			t.Fatalf("execution error: %v", err)
+		}
+		if out != expected {
+			t.Fatalf("expected %q, got %q", expected, out)
+		}
+	}
+
+	out, err := ExecuteToString(`{{ {'b': 1, 'a': 2}|tojson(indent=2) }}`, nil)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if out != "{\n  \"a\": 2,\n  \"b\": 1\n}" {
+		t.Fatalf("unexpected indented output: %q", out)
+	}
+
+	out, err = ExecuteToString(`{{ {'only': 1}|tojson(sort_keys=false) }}`, nil)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if out != `{"only":1}` {
+		t.Fatalf("unexpected unsorted output: %q", out)
+	}
+
+	_, err = ExecuteToString("{{ data|tojson }}", map[string]interface{}{
+		"data": map[interface{}]interface{}{1: "int", "1": "string"},
+	})
+	if err == nil || !strings.Contains(err.Error(), `duplicate key "1"`) {
+		t.Fatalf("expected duplicate key error, got %v", err)
+	}
+}
+
+type jsonCounts map[string]int
+
+func (c jsonCounts) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`{"total":%d}`, len(c))), nil
+}
+
+type jsonTags []string
+
+func (t *jsonTags) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strings.Join(*t, ","))
+}
+
+func TestToJSONUsesMarshalers(t *testing.T) {
+	vars := map[string]interface{}{
+		"counts": jsonCounts{"a": 1, "b": 2},
+		"tags":   &jsonTags{"go", "jinja"},
+	}
+	out, err := ExecuteToString(`{{ {'c': counts, 't': tags}|tojson }}`, vars)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if out != `{"c":{"total":2},"t":"go,jinja"}` {
+		t.Fatalf("unexpected json output: %q", out)
+	}
+}
+
 func TestFromJSONFilter(t *testing.T) {
 	env := NewEnvironment()
 	tmpl, err := env.ParseString("{{ (data|fromjson).name }}", "test")
@@ -165,6 +234,43 @@ func TestFromJSONFilter(t *testing.T) {
 	}
 }
 
+func TestFromJSONUseNumberAndDefault(t *testing.T) {
+	vars := map[string]interface{}{
+		"data": `{"n": 5, "f": 2.5, "big": 123456789012345678901234, "items": [1, 2]}`,
+		"bad":  `{"n": `,
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{% set d = data|fromjson(use_number=true) %}{{ d.n is integer }}|{{ d.n }}|{{ d.f is float }}|{{ d.big + 1 }}|{{ d['items'][1] is integer }}", "true|5|true|123456789012345678901235|true"},
+		{"{% set d = data|fromjson %}{{ d.n is integer }}|{{ d.n is float }}", "false|true"},
+		{"{{ bad|fromjson(default='n/a') }}", "n/a"},
+		{"{{ (bad|fromjson(default={}))|length }}", "0"},
+		{"{{ (data|fromjson(default=none)).n }}", "5"},
+		{"{{ '{\"a\": 1} trailing'|fromjson(default='bad') }}", "bad"},
+		{"{{ '{\"a\": 1}]'|fromjson(default='bad') }}", "bad"},
+		{"{{ '[1]}'|fromjson(default='bad') }}", "bad"},
+		{"{{ '1 2'|fromjson(default='bad') }}", "bad"},
+		{"{{ '[1] '|fromjson|length }}", "1"},
+	}
+
+	for _, tt := range tests {
+		out, err := ExecuteToString(tt.template, vars)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if out != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, out)
+		}
+	}
+
+	if _, err := ExecuteToString("{{ bad|fromjson }}", vars); err == nil {
+		t.Fatalf("expected malformed JSON without default to fail")
+	}
+}
+
 func TestRandomFilterWithSeed(t *testing.T) {
 	env := NewEnvironment()
 	tmpl, err := env.ParseString("{{ items|random(1) }}", "test")
@@ -234,6 +340,35 @@ func TestWordwrapRespectsEnvironmentNewline(t *testing.T) {
 	}
 }
 
+func TestFillFilterIndents(t *testing.T) {
+	vars := map[string]interface{}{
+		"text":  "The quick brown fox jumps over the lazy dog and keeps running",
+		"order": "Dear customer,\nyour order number 12345 has shipped today.",
+	}
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{ text|fill(20, initial_indent='* ', subsequent_indent='  ') }}", "* The quick brown\n  fox jumps over the\n  lazy dog and keeps\n  running"},
+		{"{{ order|fill(24, '> ', '>   ') }}", "> Dear customer, your\n>   order number 12345\n>   has shipped today."},
+		{"{{ text|fill(width=40) }}", "The quick brown fox jumps over the lazy\ndog and keeps running"},
+		{"{{ '   '|fill(10) }}", ""},
+	}
+	for _, tt := range tests {
+		out, err := ExecuteToString(tt.template, vars)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if out != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, out)
+		}
+	}
+
+	if _, err := ExecuteToString("{{ text|fill(4, initial_indent='>>>>') }}", vars); err == nil {
+		t.Fatal("expected error when the indent leaves no room for text")
+	}
+}
+
 func TestWordwrapWidthValidation(t *testing.T) {
 	_, err := ExecuteToString("{{ 'hello'|wordwrap(0) }}", nil)
 	if err == nil {
@@ -244,6 +379,64 @@ func TestWordwrapWidthValidation(t *testing.T) {
 	}
 }
 
+func TestIndentFilter(t *testing.T) {
+	vars := map[string]interface{}{"text": "a:\n  b: 1\n\nc: 2\n"}
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{ text|indent(2) }}", "a:\n    b: 1\n\n  c: 2\n"},
+		{"{{ text|indent(2, blank=true) }}", "a:\n    b: 1\n  \n  c: 2\n  "},
+		{"{{ text|indent(2, true) }}", "  a:\n    b: 1\n\n  c: 2\n"},
+		{"{{ text|indent(2, first=true, blank=true) }}", "  a:\n    b: 1\n  \n  c: 2\n  "},
+		{"{{ text|indent('\t') }}", "a:\n\t  b: 1\n\n\tc: 2\n"},
+		{"{{ 'x\ny'|indent }}", "x\n    y"},
+		{"{{ 'x\ny'|indent(width='> ', first=true) }}", "> x\n> y"},
+	}
+	// Keep the trailing newline of the rendered text so it can be checked.
+	env := NewEnvironment()
+	env.SetKeepTrailingNewline(true)
+	for _, tt := range tests {
+		out, err := ExecuteToStringWithEnvironment(env, tt.template, vars)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if out != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, out)
+		}
+	}
+}
+
+func TestJustifyFilters(t *testing.T) {
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"[{{ 'ab'|ljust(5) }}]", "[ab   ]"},
+		{"[{{ 'ab'|rjust(5) }}]", "[   ab]"},
+		{"[{{ 'ab'|center(6) }}]", "[  ab  ]"},
+		{"[{{ 'ab'|center(5, '*') }}]", "[*ab**]"},
+		{"[{{ 'héé'|ljust(5, '.') }}]", "[héé..]"},
+		{"[{{ '日本'|rjust(4, '・') }}]", "[・・日本]"},
+		{"[{{ 'toolong'|ljust(3) }}]", "[toolong]"},
+		{"[{{ 42|rjust(5, fillchar='0') }}]", "[00042]"},
+		{"[{{ 'ab'.ljust(4, '-') }}|{{ 'ab'.rjust(4) }}|{{ 'ab'.center(4, '=') }}]", "[ab--|  ab|=ab=]"},
+	}
+	for _, tt := range tests {
+		out, err := ExecuteToString(tt.template, nil)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if out != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, out)
+		}
+	}
+
+	if _, err := ExecuteToString("{{ 'ab'|ljust(5, '--') }}", nil); err == nil {
+		t.Fatal("expected error for multi-character fill")
+	}
+}
+
 func TestFloatformat(t *testing.T) {
 	tpl := "{{ value|floatformat(2) }}"
 	res, err := ExecuteToString(tpl, map[string]interface{}{"value": 3.14159})
@@ -289,6 +482,30 @@ func TestFormatFilter(t *testing.T) {
 	if res != "Go scored 42" {
 		t.Fatalf("expected 'Go scored 42', got %q", res)
 	}
+
+	res, err = ExecuteToString("{{ '%s|%5.1f|%03d|%x|100%%'|format(7, 2, 4.9, 255) }}", nil)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if res != "7|  2.0|004|ff|100%" {
+		t.Fatalf("unexpected python-style formatting %q", res)
+	}
+
+	failures := map[string]string{
+		`{{ "%d"|format("x") }}`:                       "%d requires a number",
+		`{{ "%s %s"|format("x") }}`:                    "not enough arguments",
+		`{{ "%s"|format("x", "y") }}`:                  "not all arguments converted",
+		`{{ "%(name)s %(age)d"|format({"name": 1}) }}`: `missing key "age"`,
+	}
+	for source, want := range failures {
+		_, err := ExecuteToString(source, nil)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("%s: expected error containing %q, got %v", source, want, err)
+		}
+		if strings.Contains(err.Error(), "%!") {
+			t.Fatalf("%s: error leaked Go formatting markers: %v", source, err)
+		}
+	}
 }
 
 func TestUrlize(t *testing.T) {
@@ -403,6 +620,52 @@ func TestBatchFilter(t *testing.T) {
 	}
 }
 
+func TestPaginateFilter(t *testing.T) {
+	items := make([]interface{}, 25)
+	for i := range items {
+		items[i] = i + 1
+	}
+	vars := map[string]interface{}{"items": items}
+
+	tmpl := "{% set p = items|paginate(10, page=3) %}" +
+		"{{ p.items|join(',') }}|{{ p.page }}/{{ p.pages }}|{{ p.total }}|{{ p.has_prev }}|{{ p.has_next }}"
+	res, err := ExecuteToString(tmpl, vars)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if res != "21,22,23,24,25|3/3|25|true|false" {
+		t.Fatalf("unexpected last page: %q", res)
+	}
+
+	res, err = ExecuteToString("{% set p = items|paginate(10) %}{{ p.items|length }}|{{ p.page }}|{{ p.has_prev }}|{{ p.has_next }}", vars)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if res != "10|1|false|true" {
+		t.Fatalf("unexpected first page: %q", res)
+	}
+
+	res, err = ExecuteToString("{{ (items|paginate(10, 9)).page }}-{{ (items|paginate(10, 0)).page }}", vars)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if res != "3-1" {
+		t.Fatalf("expected out-of-range pages to clamp, got %q", res)
+	}
+
+	res, err = ExecuteToString("{% set p = []|paginate(10) %}{{ p.items|length }}|{{ p.page }}/{{ p.pages }}", nil)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if res != "0|1/1" {
+		t.Fatalf("unexpected empty pagination: %q", res)
+	}
+
+	if _, err := ExecuteToString("{{ items|paginate(0) }}", vars); err == nil {
+		t.Fatal("expected error for non-positive per_page")
+	}
+}
+
 func TestSliceFilterColumns(t *testing.T) {
 	items := []interface{}{"a", "b", "c", "d", "e", "f"}
 	res, err := filterSlice(nil, items, 3)
@@ -469,6 +732,32 @@ func TestDictsortByValue(t *testing.T) {
 	}
 }
 
+func TestDictsortAsObjects(t *testing.T) {
+	vars := map[string]interface{}{
+		"data": map[string]interface{}{"b": 1, "A": 2, "c": 3},
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{% for item in data|dictsort(as_objects=true) %}{{ item.key }}={{ item.value }} {% endfor %}", "A=2 b=1 c=3 "},
+		{"{% for item in data|dictsortreversed(as_objects=true) %}{{ item['key'] }}{% endfor %}", "cbA"},
+		{"{{ (data|dictsort(by='value', as_objects=true)|first).key }}", "b"},
+		{"{% for key, value in data|dictsort %}{{ key }}{{ value }}{% endfor %}", "A2b1c3"},
+	}
+
+	for _, tt := range tests {
+		out, err := ExecuteToString(tt.template, vars)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if out != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, out)
+		}
+	}
+}
+
 func TestDictsortReversedAlias(t *testing.T) {
 	out, err := ExecuteToString("{{ data|dictsortreversed|tojson }}", map[string]interface{}{
 		"data": map[string]interface{}{"one": 1, "two": 2},
@@ -529,3 +818,970 @@ func TestDictsortInvalidByOption(t *testing.T) {
 		t.Fatalf("unexpected error message: %v", err)
 	}
 }
+
+func TestShuffleFilterEnvironmentSeed(t *testing.T) {
+	env := NewEnvironment()
+	env.SetRandomSeed(7)
+
+	items := map[string]interface{}{"items": []interface{}{1, 2, 3, 4, 5, 6, 7, 8}}
+	first, err := ExecuteToStringWithEnvironment(env, "{{ items|shuffle|join(',') }} {{ items|random }}", items)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	second, err := ExecuteToStringWithEnvironment(env, "{{ items|shuffle|join(',') }} {{ items|random }}", items)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if first != second {
+		t.Fatalf("expected seeded renders to match, got %q and %q", first, second)
+	}
+
+	env.ClearRandomSeed()
+	if _, ok := env.RandomSeed(); ok {
+		t.Fatal("expected random seed to be cleared")
+	}
+}
+
+func TestYAMLFiltersWithCodec(t *testing.T) {
+	env := NewEnvironment()
+	env.SetYAMLCodec(
+		func(value interface{}) ([]byte, error) {
+			return json.Marshal(value)
+		},
+		func(data []byte, out interface{}) error {
+			return json.Unmarshal(data, out)
+		},
+	)
+
+	vars := map[string]interface{}{"data": map[string]interface{}{"name": "go"}}
+	out, err := ExecuteToStringWithEnvironment(env, "{{ data|toyaml }}|{{ (data|toyaml|fromyaml).name }}", vars)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if out != `{"name":"go"}|go` {
+		t.Fatalf("unexpected yaml round trip output: %q", out)
+	}
+
+	// toyaml returns plain text, so autoescape still applies to it.
+	env.SetAutoescape(true)
+	out, err = ExecuteToStringWithEnvironment(env, "{{ data|toyaml }}", vars)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if out != "{&#34;name&#34;:&#34;go&#34;}" {
+		t.Fatalf("expected toyaml output to be escaped, got %q", out)
+	}
+}
+
+func TestYAMLFiltersWithoutCodec(t *testing.T) {
+	for _, tpl := range []string{"{{ data|toyaml }}", "{{ 'a: 1'|fromyaml }}"} {
+		_, err := ExecuteToString(tpl, map[string]interface{}{"data": 1})
+		if err == nil {
+			t.Fatalf("expected error for %q without a codec", tpl)
+		}
+		if !strings.Contains(err.Error(), "SetYAMLCodec") {
+			t.Fatalf("unexpected error for %q: %v", tpl, err)
+		}
+	}
+}
+
+func TestNumberFilterWithFormatter(t *testing.T) {
+	env := NewEnvironment()
+	env.SetNumberFormatter(func(value interface{}, locale string) (string, error) {
+		if locale == "xx" {
+			return "", errors.New("unknown locale")
+		}
+		return fmt.Sprintf("%v@%s", value, locale), nil
+	})
+
+	tests := []struct {
+		template string
+		vars     map[string]interface{}
+		expected string
+	}{
+		{"{{ 1234.5|number('de-DE') }}", nil, "1234.5@de-DE"},
+		{"{{ 42|number(locale='fr') }}", nil, "42@fr"},
+		{"{{ amount|number }}", map[string]interface{}{"amount": 7, "locale": "en-US"}, "7@en-US"},
+		{"{{ amount|number('ja') }}", map[string]interface{}{"amount": 7, "locale": "en-US"}, "7@ja"},
+		{"{{ 3|number }}", nil, "3@"},
+	}
+	for _, tt := range tests {
+		out, err := ExecuteToStringWithEnvironment(env, tt.template, tt.vars)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if out != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, out)
+		}
+	}
+
+	if _, err := ExecuteToStringWithEnvironment(env, "{{ 1|number('xx') }}", nil); err == nil || !strings.Contains(err.Error(), "unknown locale") {
+		t.Fatalf("expected formatter error, got %v", err)
+	}
+	if _, err := ExecuteToStringWithEnvironment(env, "{{ 'abc'|number }}", nil); err == nil {
+		t.Fatal("expected error for non-numeric value")
+	}
+}
+
+func TestNumberFilterWithoutFormatter(t *testing.T) {
+	_, err := ExecuteToString("{{ 1|number('en') }}", nil)
+	if err == nil || !strings.Contains(err.Error(), "SetNumberFormatter") {
+		t.Fatalf("expected missing formatter error, got %v", err)
+	}
+}
+
+func TestCurrencyFilterDefaultFormat(t *testing.T) {
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{ 1234.5|currency }}", "$1234.50"},
+		{"{{ 9.999|currency('USD') }}", "$10.00"},
+		{"{{ -12.5|currency('EUR') }}", "-€12.50"},
+		{"{{ 3|currency(code='gbp') }}", "£3.00"},
+		{"{{ 3|currency('CHF') }}", "CHF 3.00"},
+		{"{{ -0.001|currency }}", "$0.00"},
+		{"{{ 5|currency('USD', symbol='US$') }}", "US$5.00"},
+	}
+	for _, tt := range tests {
+		out, err := ExecuteToString(tt.template, nil)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if out != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, out)
+		}
+	}
+
+	if _, err := ExecuteToString("{{ 'ten'|currency }}", nil); err == nil {
+		t.Fatal("expected error for non-numeric amount")
+	}
+}
+
+func TestCurrencyFilterWithFormatter(t *testing.T) {
+	env := NewEnvironment()
+	env.SetNumberFormatter(func(value interface{}, locale string) (string, error) {
+		if amount, ok := value.(CurrencyAmount); ok {
+			return fmt.Sprintf("%v %s [%s]", amount.Amount, amount.Code, locale), nil
+		}
+		return fmt.Sprintf("%v [%s]", value, locale), nil
+	})
+
+	vars := map[string]interface{}{"price": -4.25, "locale": "de-DE"}
+	out, err := ExecuteToStringWithEnvironment(env, "{{ price|currency('eur') }}|{{ price|currency(locale='en') }}|{{ price|currency(symbol='€') }}|{{ price|number }}", vars)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if out != "-4.25 EUR [de-DE]|-4.25 USD [en]|-€4.25|-4.25 [de-DE]" {
+		t.Fatalf("unexpected currency output: %q", out)
+	}
+}
+
+func TestCSVQuoteFilter(t *testing.T) {
+	out, err := ExecuteToString("{{ value|csvquote }}", map[string]interface{}{"value": "say \"hi\",\nbye"})
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if out != "\"say \"\"hi\"\",\nbye\"" {
+		t.Fatalf("unexpected csvquote output: %q", out)
+	}
+}
+
+func TestToCSVFilter(t *testing.T) {
+	rows := [][]interface{}{
+		{"name", "note"},
+		{"a,b", "say \"hi\""},
+		{"multi\nline", 3},
+	}
+	out, err := ExecuteToString("{{ rows|tocsv }}", map[string]interface{}{"rows": rows})
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	expected := "name,note\n\"a,b\",\"say \"\"hi\"\"\"\n\"multi\nline\",3"
+	if out != expected {
+		t.Fatalf("expected %q, got %q", expected, out)
+	}
+
+	out, err = ExecuteToString("{{ rows|tocsv(delimiter=';') }}", map[string]interface{}{
+		"rows": [][]string{{"a", "b;c"}, {"d", "e"}},
+	})
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if out != "a;\"b;c\"\nd;e" {
+		t.Fatalf("unexpected delimited output: %q", out)
+	}
+
+	if _, err := ExecuteToString("{{ rows|tocsv('::') }}", map[string]interface{}{"rows": rows}); err == nil {
+		t.Fatal("expected error for multi-character delimiter")
+	}
+}
+
+func TestXMLEscapeFilter(t *testing.T) {
+	vars := map[string]interface{}{"value": `<a href="x">Tom & 'Jerry'</a>`}
+
+	out, err := ExecuteToString("{{ value|xmlescape }}", vars)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	expected := "&lt;a href=&quot;x&quot;&gt;Tom &amp; &apos;Jerry&apos;&lt;/a&gt;"
+	if out != expected {
+		t.Fatalf("expected %q, got %q", expected, out)
+	}
+
+	htmlOut, err := ExecuteToString("{{ value|e }}", vars)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if htmlOut == out {
+		t.Fatalf("expected xmlescape to differ from HTML escaping for quotes, both gave %q", out)
+	}
+
+	env := NewEnvironment()
+	env.SetAutoescape(true)
+	out, err = ExecuteToStringWithEnvironment(env, "{{ value|xmlescape }}", vars)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if out != expected {
+		t.Fatalf("expected xmlescape output not to be escaped twice under autoescape, got %q", out)
+	}
+}
+
+func TestEscapeJSModes(t *testing.T) {
+	vars := map[string]interface{}{"value": "<b title=\"x\">café</b>"}
+
+	out, err := ExecuteToString("{{ value|escapejs }}", vars)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	expected := "\\u003cb title\\u003d\\\"x\\\"\\u003ecaf\\u00e9\\u003c/b\\u003e"
+	if out != expected {
+		t.Fatalf("expected html mode %q, got %q", expected, out)
+	}
+
+	out, err = ExecuteToString("{{ value|escapejs(mode='json') }}", vars)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	expected = "<b title=\\\"x\\\">café</b>"
+	if out != expected {
+		t.Fatalf("expected json mode %q, got %q", expected, out)
+	}
+
+	var decoded string
+	if err := json.Unmarshal([]byte(`"`+out+`"`), &decoded); err != nil {
+		t.Fatalf("json mode output is not a valid JSON string body: %v", err)
+	}
+	if decoded != vars["value"] {
+		t.Fatalf("expected json round trip to match input, got %q", decoded)
+	}
+
+	if _, err := ExecuteToString("{{ value|escapejs(mode='xml') }}", vars); err == nil {
+		t.Fatal("expected error for unknown escapejs mode")
+	}
+}
+
+func TestStringFiltersAreRuneAware(t *testing.T) {
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{`{{ "日本語"|first }}`, "日"},
+		{`{{ "日本語"|last }}`, "語"},
+		{`{{ "日本語"|random in "日本語" }}`, "true"},
+		{`{{ "日本語"|random|length }}`, "1"},
+		{`{{ "ééééé ééé"|truncate(7, true, "…") }}`, "ééééé …"},
+		{`{{ "ééééé ééé"|truncate(7) }}`, "ééééé..."},
+		{`{{ "élan".capitalize() }}`, "Élan"},
+	}
+
+	for _, tt := range tests {
+		out, err := ExecuteToString(tt.template, nil)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if out != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, out)
+		}
+	}
+}
+
+func TestTruncateRejectsNegativeLength(t *testing.T) {
+	for _, source := range []string{
+		"{{ 'abcdef'|truncate(-1) }}",
+		"{{ 'abcdef'|truncate(length=-3) }}",
+	} {
+		if _, err := ExecuteToString(source, nil); err == nil || !strings.Contains(err.Error(), "must not be negative") {
+			t.Fatalf("%s: expected negative length error, got %v", source, err)
+		}
+	}
+}
+
+func TestIntFilterKeepsLargeIntegersExact(t *testing.T) {
+	ctx := map[string]interface{}{
+		"big":  new(big.Int).Lsh(big.NewInt(1), 70),
+		"max":  uint64(math.MaxUint64),
+		"huge": 1e20,
+	}
+	source := "{{ big|int }}|{{ max|int }}|{{ huge|int }}|{{ '123456789012345678901234'|int }}|{{ (max|int) > 0 }}"
+	out, err := ExecuteToString(source, ctx)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	expected := "1180591620717411303424|18446744073709551615|100000000000000000000|123456789012345678901234|true"
+	if out != expected {
+		t.Fatalf("expected %q, got %q", expected, out)
+	}
+}
+
+func TestFilterArgumentSpreading(t *testing.T) {
+	env := NewEnvironment()
+	env.AddFilter("describe", func(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+		kwargs, positional := extractKwargs(args)
+		keys := make([]string, 0, len(kwargs))
+		for k := range kwargs {
+			keys = append(keys, fmt.Sprintf("%s=%v", k, kwargs[k]))
+		}
+		sort.Strings(keys)
+		return fmt.Sprintf("%v %v %v", value, positional, keys), nil
+	})
+
+	vars := map[string]interface{}{
+		"names":  []string{"a", "b"},
+		"counts": []int{1, 2},
+		"opts":   map[string]interface{}{"sep": "-"},
+		"flags":  map[string]bool{"upper": true},
+	}
+	tests := map[string]string{
+		`{{ 0|describe(*names) }}`:                "0 [a b] []",
+		`{{ 0|describe(*counts, **opts) }}`:       "0 [1 2] [sep=-]",
+		`{{ 0|describe("x", *names, **flags) }}`:  "0 [x a b] [upper=true]",
+		`{{ 0|describe(extra=1, **opts) }}`:       "0 [] [extra=1 sep=-]",
+		`{{ ["a", "b"]|join(*names[1:], **{}) }}`: "abb",
+	}
+	for source, want := range tests {
+		tmpl, err := env.ParseString(source, "spread")
+		if err != nil {
+			t.Fatalf("%s: parse error: %v", source, err)
+		}
+		out, err := tmpl.ExecuteToString(vars)
+		if err != nil {
+			t.Fatalf("%s: execute error: %v", source, err)
+		}
+		if out != want {
+			t.Fatalf("%s: expected %q, got %q", source, want, out)
+		}
+	}
+
+	tmpl, err := env.ParseString(`{{ 0|describe(**names) }}`, "spread_error")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if _, err := tmpl.ExecuteToString(vars); err == nil || !strings.Contains(err.Error(), "must be a mapping") {
+		t.Fatalf("expected mapping error, got %v", err)
+	}
+}
+
+func TestFilterChainsApplyLeftToRight(t *testing.T) {
+	env := NewEnvironment()
+	env.SetAutoescape(true)
+
+	tests := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{"default then upper", "{{ missing|default('n/a')|upper }}", "N/A"},
+		{"default then upper with spacing", "{{ missing | default('n/a') | upper }}", "N/A"},
+		{"each filter feeds the next", "{{ ' a '|trim|upper|replace('A', 'b') }}", "b"},
+		{"safe then upper", "{{ '<b>a</b>'|safe|upper }}", "<B>A</B>"},
+		{"safe then trim", "{{ '  <i>x</i> '|safe|trim }}", "<i>x</i>"},
+		{"safe then replace escapes replacement", "{{ '<b>a</b>'|safe|replace('a', '<i>') }}", "<b>&lt;i&gt;</b>"},
+		{"unsafe then upper", "{{ '<b>'|upper }}", "&lt;B&gt;"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := ExecuteToStringWithEnvironment(env, tt.template, nil)
+			if err != nil {
+				t.Fatalf("execute error: %v", err)
+			}
+			if out != tt.expected {
+				t.Fatalf("expected %q, got %q", tt.expected, out)
+			}
+		})
+	}
+}
+
+func TestReplaceFilterCount(t *testing.T) {
+	vars := map[string]interface{}{"s": "aaaa", "n64": int64(2), "n": 2}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{ s|replace('a', 'b', 2) }}", "bbaa"},
+		{"{{ s|replace('a', 'b', n) }}", "bbaa"},
+		{"{{ s|replace('a', 'b', n64) }}", "bbaa"},
+		{"{{ s|replace('a', 'b', 3.0) }}", "bbba"},
+		{"{{ s|replace('a', 'b', -1) }}", "bbbb"},
+		{"{{ s|replace('a', 'b', none) }}", "bbbb"},
+		{"{{ s|replace('a', 'b', count=2) }}", "bbaa"},
+		{"{{ s|replace('a', 'b', count=n64) }}", "bbaa"},
+	}
+	for _, tt := range tests {
+		out, err := ExecuteToString(tt.template, vars)
+		if err != nil {
+			t.Fatalf("%s: execute error: %v", tt.template, err)
+		}
+		if out != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, out)
+		}
+	}
+
+	if _, err := ExecuteToString("{{ s|replace('a', 'b', -2) }}", vars); err == nil || !strings.Contains(err.Error(), "non-negative") {
+		t.Fatalf("expected negative count error, got %v", err)
+	}
+	if _, err := ExecuteToString("{{ s|replace('a', 'b', 2.7) }}", vars); err == nil || !strings.Contains(err.Error(), "must be an integer") {
+		t.Fatalf("expected fractional count error, got %v", err)
+	}
+}
+
+func TestMinMaxFilters(t *testing.T) {
+	ctx := map[string]interface{}{
+		"ints":   []int{4, 1, 8},
+		"scores": map[string]int{"bob": 3, "alice": 9, "carol": 1},
+		"words":  []string{"B", "a", "c"},
+		"users": []map[string]interface{}{
+			{"name": "ann", "age": 31},
+			{"name": "bo", "age": 25},
+		},
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{ range(3, 10)|min }}|{{ range(3, 10)|max }}", "3|9"},
+		{"{{ ints|min }}|{{ ints|max }}", "1|8"},
+		{"{{ scores|min }}|{{ scores|max }}", "alice|carol"},
+		{"{{ {'b': 1, 'a': 2}|min }}", "a"},
+		{"{{ words|min }}|{{ words|min(case_sensitive=false) }}", "B|a"},
+		{"{{ words|max }}|{{ 'hello'|max }}", "c|o"},
+		{"{{ (users|min(attribute='age')).name }}|{{ (users|max(attribute='age')).name }}", "bo|ann"},
+		{"{{ [] | max is none }}", "true"},
+	}
+
+	for _, tt := range tests {
+		out, err := ExecuteToString(tt.template, ctx)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if out != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, out)
+		}
+	}
+
+	if _, err := ExecuteToString("{{ 5|min }}", nil); err == nil {
+		t.Fatal("expected error for non-sequence input")
+	}
+	if _, err := ExecuteToString("{{ stream|max }}", map[string]interface{}{"stream": make(chan int)}); err == nil {
+		t.Fatal("expected channels to be rejected rather than drained")
+	}
+}
+
+func TestSortByKeyFilter(t *testing.T) {
+	env := NewEnvironment()
+	env.AddFilter("vowels", func(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+		count := 0
+		for _, r := range strings.ToLower(toString(value)) {
+			if strings.ContainsRune("aeiou", r) {
+				count++
+			}
+		}
+		return count, nil
+	})
+
+	vars := map[string]interface{}{
+		"words": []string{"banana", "fig", "kiwi", "apple"},
+		"users": []interface{}{
+			map[string]interface{}{"name": "Christina"},
+			map[string]interface{}{"name": "Bo"},
+			map[string]interface{}{"name": "Ann"},
+		},
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{ words|sort(by='length')|join(',') }}", "fig,kiwi,apple,banana"},
+		{"{{ words|sort(true, by='length')|join(',') }}", "banana,apple,kiwi,fig"},
+		{"{{ words|sort(by='vowels')|join(',') }}", "fig,kiwi,apple,banana"},
+		{"{{ users|sort(false, false, 'name', by='length')|map(attribute='name')|join(',') }}", "Bo,Ann,Christina"},
+		{"{{ words|sort|join(',') }}", "apple,banana,fig,kiwi"},
+	}
+
+	for _, tt := range tests {
+		out, err := ExecuteToStringWithEnvironment(env, tt.template, vars)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if out != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, out)
+		}
+	}
+
+	if _, err := ExecuteToStringWithEnvironment(env, "{{ words|sort(by='nope') }}", vars); err == nil || !strings.Contains(err.Error(), `unknown key filter "nope"`) {
+		t.Fatalf("expected unknown key filter error, got %v", err)
+	}
+}
+
+type groupedProduct struct {
+	Name     string
+	Category string
+}
+
+func TestGroupIntoDictFilter(t *testing.T) {
+	vars := map[string]interface{}{
+		"products": []groupedProduct{
+			{Name: "apple", Category: "fruit"},
+			{Name: "carrot", Category: "veg"},
+			{Name: "pear", Category: "fruit"},
+		},
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{% set groups = products|group_into_dict('Category') %}{{ groups['fruit']|map(attribute='Name')|join(',') }}", "apple,pear"},
+		{"{% set groups = products|group_into_dict(attribute='Category') %}{{ groups.veg|length }}|{{ groups|length }}", "1|2"},
+		{"{% for items in products|group_into_dict('Category') %}{{ items|length }};{% endfor %}", "2;1;"},
+		{"{% for key, items in products|group_into_dict('Category')|dictsort %}{{ key }}={{ items|length }} {% endfor %}", "fruit=2 veg=1 "},
+	}
+
+	for _, tt := range tests {
+		out, err := ExecuteToString(tt.template, vars)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if out != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, out)
+		}
+	}
+
+	if _, err := ExecuteToString("{{ products|group_into_dict }}", vars); err == nil {
+		t.Fatal("expected error without an attribute")
+	}
+}
+
+func TestReverseKeywordAcrossSortingFilters(t *testing.T) {
+	vars := map[string]interface{}{
+		"nums":  []interface{}{3, 1, 2},
+		"prefs": map[string]interface{}{"b": 2, "a": 1, "c": 3},
+		"people": []interface{}{
+			map[string]interface{}{"name": "ann", "team": "red"},
+			map[string]interface{}{"name": "bo", "team": "blue"},
+			map[string]interface{}{"name": "cy", "team": "red"},
+		},
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{ nums|sort(reverse=true)|join(',') }}", "3,2,1"},
+		{"{{ nums|sort(reverse=false)|join(',') }}", "1,2,3"},
+		{"{{ people|sort(attribute='name', reverse=true)|map(attribute='name')|join(',') }}", "cy,bo,ann"},
+		{"{{ nums|desc|join(',') }}|{{ nums|asc|join(',') }}", "3,2,1|1,2,3"},
+		{"{{ people|desc(attribute='name')|map(attribute='name')|join(',') }}", "cy,bo,ann"},
+		{"{% for k, v in prefs|dictsort(reverse=true) %}{{ k }}{% endfor %}", "cba"},
+		{"{% for g in people|groupby('team') %}{{ g.grouper }}:{{ g.list|length }} {% endfor %}", "blue:1 red:2 "},
+		{"{% for g in people|groupby('team', reverse=true) %}{{ g.grouper }}:{{ g.list|map(attribute='name')|join('+') }} {% endfor %}", "red:ann+cy blue:bo "},
+		{"{% for g in people|groupby(attribute='size', default='n/a') %}{{ g.grouper }}={{ g.list|length }}{% endfor %}", "n/a=3"},
+		{"{% for grouper, items in people|groupby('team') %}{{ grouper }}={{ items|length }} {% endfor %}", "blue=1 red=2 "},
+		{"{{ people|groupby('team')|map(attribute='grouper')|join(',') }}", "blue,red"},
+		{"{% set g = people|groupby('team')|first %}{{ g[0] }}|{{ g[1]|length }}|{{ g|length }}|{{ g|last|length }}|{{ g[-2] }}", "blue|1|2|1|blue"},
+		{"{{ people|groupby('team')|first }}", "(blue, [map[name:bo team:blue]])"},
+	}
+
+	for _, tt := range tests {
+		out, err := ExecuteToString(tt.template, vars)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if out != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, out)
+		}
+	}
+}
+
+type methodMember struct {
+	Name   string
+	active bool
+}
+
+func (m methodMember) IsActive() bool {
+	return m.active
+}
+
+func (m *methodMember) Label() string {
+	return "@" + m.Name
+}
+
+func TestAttributeFiltersCallZeroArgMethods(t *testing.T) {
+	vars := map[string]interface{}{
+		"members": []interface{}{
+			&methodMember{Name: "ann", active: true},
+			&methodMember{Name: "bo"},
+			&methodMember{Name: "cy", active: true},
+		},
+		"values": []methodMember{{Name: "dee", active: true}, {Name: "ed"}},
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{ members|selectattr('IsActive()')|map(attribute='Name')|join(',') }}", "ann,cy"},
+		{"{{ members|rejectattr('IsActive()')|map(attribute='Name')|join(',') }}", "bo"},
+		{"{{ members|map(attribute='Label()')|join(',') }}", "@ann,@bo,@cy"},
+		{"{{ members|selectattr('IsActive()', 'false')|map(attribute='Name')|join(',') }}", "bo"},
+		{"{{ values|selectattr('IsActive()')|map(attribute='Name')|join(',') }}", "dee"},
+		{"{{ values|selectattr('IsActive')|list|length }}", "2"},
+	}
+
+	for _, tt := range tests {
+		out, err := ExecuteToString(tt.template, vars)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if out != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, out)
+		}
+	}
+
+	if _, err := ExecuteToString("{{ members|map(attribute='Name()')|list }}", vars); err == nil {
+		t.Fatal("expected error calling a non-callable attribute")
+	}
+}
+
+func TestUniqueFilterNumericEquality(t *testing.T) {
+	vars := map[string]interface{}{
+		"mixed": []interface{}{1, 1.0, "1", int64(1), 2.5, float32(2.5), 3},
+		"lists": []interface{}{[]interface{}{1}, []interface{}{1}, []interface{}{2}},
+		"large": []interface{}{
+			uint64(1 << 63), uint64(1<<63 + 1), float64(1 << 63),
+			new(big.Int).SetUint64(1<<63 + 1), new(big.Int).Lsh(big.NewInt(1), 80), new(big.Int).Lsh(big.NewInt(1), 80),
+		},
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{ [1, 1.0, '1']|unique|list|tojson }}", `[1,"1"]`},
+		{"{{ large|unique|join(',') }}", "9223372036854775808,9223372036854775809,1208925819614629174706176"},
+		{"{{ mixed|unique|list|tojson }}", `[1,"1",2.5,3]`},
+		{"{{ ['a', 'b', 'a']|unique|join(',') }}", "a,b"},
+		{"{{ lists|unique|list|length }}", "2"},
+	}
+
+	for _, tt := range tests {
+		out, err := ExecuteToString(tt.template, vars)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if out != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, out)
+		}
+	}
+}
+
+func TestFlattenFilter(t *testing.T) {
+	vars := map[string]interface{}{
+		"nested": []interface{}{[]interface{}{1, 2}, []interface{}{3, []interface{}{4}}},
+		"typed":  []interface{}{[]string{"a", "b"}, [2]int{5, 6}, "cd"},
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{ nested|flatten|tojson }}", "[1,2,3,4]"},
+		{"{{ nested|flatten(depth=1)|tojson }}", "[1,2,3,[4]]"},
+		{"{{ nested|flatten(0)|tojson }}", "[[1,2],[3,[4]]]"},
+		{"{{ typed|flatten|join(',') }}", "a,b,5,6,cd"},
+		{"{{ [[1, 2], 3, [[4]]]|flatten|join(',') }}", "1,2,3,4"},
+	}
+
+	for _, tt := range tests {
+		out, err := ExecuteToString(tt.template, vars)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if out != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, out)
+		}
+	}
+}
+
+func TestGroupbyAggregate(t *testing.T) {
+	vars := map[string]interface{}{
+		"orders": []interface{}{
+			map[string]interface{}{"customer": "bob", "amount": 10},
+			map[string]interface{}{"customer": "ann", "amount": 5},
+			map[string]interface{}{"customer": "bob", "amount": 2.5},
+			map[string]interface{}{"customer": "ann", "amount": 7},
+			map[string]interface{}{"customer": "cy", "amount": 1},
+		},
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{% for g in orders|groupby('customer', aggregate='sum', aggregate_attribute='amount') %}{{ g.grouper }}:{{ g.count }}:{{ g.aggregate }} {% endfor %}", "ann:2:12 bob:2:12.5 cy:1:1 "},
+		{"{% for g in orders|groupby('customer', aggregate='max', aggregate_attribute='amount') %}{{ g.grouper }}={{ g.aggregate }} {% endfor %}", "ann=7 bob=10 cy=1 "},
+		{"{% for g in orders|groupby('customer', aggregate='count') %}{{ g.aggregate }}{% endfor %}", "221"},
+		{"{% for g in orders|groupby('customer') %}{{ g.count }}{{ g.aggregate is none }} {% endfor %}", "2true 2true 1true "},
+	}
+
+	for _, tt := range tests {
+		out, err := ExecuteToString(tt.template, vars)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if out != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, out)
+		}
+	}
+
+	if _, err := ExecuteToString("{{ orders|groupby('customer', aggregate='median') }}", vars); err == nil {
+		t.Fatalf("expected unknown aggregate to fail")
+	}
+}
+
+func TestPathJoinFilter(t *testing.T) {
+	vars := map[string]interface{}{
+		"base":  "/srv/static/",
+		"parts": []string{"css", "//site.css"},
+		"name":  "../../etc/passwd",
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{ [base, 'img', 'logo.png']|pathjoin }}", "/srv/static/img/logo.png"},
+		{"{{ parts|pathjoin }}", "css/site.css"},
+		{"{{ base|pathjoin('js', 'app.js') }}", "/srv/static/js/app.js"},
+		{"{{ ['https://example.com/', '/docs/', 'intro'] | pathjoin }}", "https://example.com/docs/intro"},
+		{"{{ ['a', 'b/../c']|pathjoin }}", "a/c"},
+		{"{{ [base, 'img']|safe_join }}", "/srv/static/img"},
+	}
+
+	for _, tt := range tests {
+		out, err := ExecuteToString(tt.template, vars)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if out != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, out)
+		}
+	}
+
+	for _, tmpl := range []string{
+		"{{ [base, name]|pathjoin(safe=true) }}",
+		"{{ [base, 'a/../../b']|safe_join }}",
+	} {
+		_, err := ExecuteToString(tmpl, vars)
+		if err == nil || !strings.Contains(err.Error(), "path traversal") {
+			t.Fatalf("%s: expected traversal error, got %v", tmpl, err)
+		}
+	}
+}
+
+func TestJSONPathFilter(t *testing.T) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(`{
+		"store": {
+			"name": "corner",
+			"books": [
+				{"title": "Go", "tags": ["lang", "google"], "price": 30},
+				{"title": "Jinja", "tags": ["templates"], "price": 12.5}
+			],
+			"owner": {"first-name": "Ann"}
+		}
+	}`), &doc); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	vars := map[string]interface{}{"doc": doc}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{ doc|jsonpath('$.store.name') }}", "corner"},
+		{"{{ doc|jsonpath('$.store.books[1].title') }}", "Jinja"},
+		{"{{ doc|jsonpath('$.store.books[-1].tags[0]') }}", "templates"},
+		{"{{ doc|jsonpath(\"$.store.owner['first-name']\") }}", "Ann"},
+		{"{{ doc|jsonpath('$.store.books[*].title')|join(',') }}", "Go,Jinja"},
+		{"{{ doc|jsonpath('$.store.books[*].price')|sum }}", "42.5"},
+		{"{{ doc|jsonpath('store.books[0].tags[*]')|length }}", "2"},
+		{"{{ doc|jsonpath('$.store.owner.*')|first }}", "Ann"},
+		{"{{ doc|jsonpath('$.store.missing') is undefined }}", "true"},
+		{"{{ doc|jsonpath('$.store.books[5]') is defined }}", "false"},
+		{"{{ doc|jsonpath('$.store.books[*].isbn') is undefined }}", "true"},
+	}
+
+	for _, tt := range tests {
+		out, err := ExecuteToString(tt.template, vars)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if out != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, out)
+		}
+	}
+
+	if _, err := ExecuteToString("{{ doc|jsonpath('$.store[') }}", vars); err == nil {
+		t.Fatalf("expected malformed path to fail")
+	}
+}
+
+func TestBatchAndSliceRowObjects(t *testing.T) {
+	vars := map[string]interface{}{"items": []interface{}{"a", "b", "c", "d", "e"}}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{% for row in items|batch(3, '-', as_objects=true) %}{{ row.index }}:{% for cell in row.cells %}{{ cell.value }}{{ '*' if cell.is_fill }}{% endfor %};{% endfor %}", "1:abc;2:de-*;"},
+		{"{% for row in items|batch(2, fill_with=0, as_objects=true) %}{{ row.index0 }}{{ row.cells|selectattr('is_fill')|list|length }}{% endfor %}", "001021"},
+		{"{% for col in items|slice(2, 'x', as_objects=true) %}{{ col.index }}={{ col.cells|rejectattr('is_fill')|map(attribute='value')|join }}/{{ col.cells|length }} {% endfor %}", "1=abc/3 2=de/3 "},
+		{"{{ items|batch(2, fill_with='z')|last|join }}", "ez"},
+	}
+
+	for _, tt := range tests {
+		out, err := ExecuteToString(tt.template, vars)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if out != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, out)
+		}
+	}
+}
+
+func TestCRLFThroughIndentAndTruncate(t *testing.T) {
+	env := NewEnvironment()
+	env.SetNewlineSequence("\n")
+	vars := map[string]interface{}{
+		"text":  "one\r\n\r\ntwo",
+		"short": "ab\r\ncd",
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{ text|indent(2) }}", "one\r\n\r\n  two"},
+		{"{{ text|indent(2, blank=true) }}", "one\r\n  \r\n  two"},
+		{"{{ text|indent(2, normalize_newlines=true) }}", "one\n\n  two"},
+		{"{{ short|truncate(5, true, '|') }}", "ab\r\n|"},
+		{"{{ short|truncate(3, killwords=true, end='') }}", "ab"},
+		{"{{ short|truncate(4, true, '.') }}", "ab."},
+		{"{{ text|truncate(6, true, '', normalize_newlines=true) }}", "one\n\nt"},
+	}
+
+	for _, tt := range tests {
+		tmpl, err := env.ParseString(tt.template, "crlf")
+		if err != nil {
+			t.Fatalf("%s: parse error: %v", tt.template, err)
+		}
+		out, err := tmpl.ExecuteToString(vars)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if out != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, out)
+		}
+	}
+}
+
+func TestMergeFilter(t *testing.T) {
+	base := map[string]interface{}{
+		"title": "Site",
+		"theme": map[string]interface{}{"color": "blue", "font": "serif"},
+	}
+	vars := map[string]interface{}{"base": base}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{ base|merge({'title': 'Blog'})|tojson }}", `{"theme":{"color":"blue","font":"serif"},"title":"Blog"}`},
+		{"{{ base|merge({'theme': {'color': 'red'} })|tojson }}", `{"theme":{"color":"red"},"title":"Site"}`},
+		{"{{ base|merge({'theme': {'color': 'red'} }, deep=true)|tojson }}", `{"theme":{"color":"red","font":"serif"},"title":"Site"}`},
+		{"{{ base|update({'a': 1}, {'a': 2})|tojson }}", `{"a":2,"theme":{"color":"blue","font":"serif"},"title":"Site"}`},
+		{"{{ base|merge({'theme': {'color': 'red'} }, deep=true) and base.theme.color }}", "blue"},
+	}
+
+	for _, tt := range tests {
+		out, err := ExecuteToString(tt.template, vars)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if out != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, out)
+		}
+	}
+
+	if _, err := ExecuteToString("{{ base|merge(1) }}", vars); err == nil {
+		t.Fatalf("expected error for non-mapping override")
+	}
+}
+
+func TestKeysValuesItemsFilters(t *testing.T) {
+	vars := map[string]interface{}{
+		"config": map[string]interface{}{"b": 2, "a": 1, "c": 3},
+		"codes":  map[int]string{404: "missing", 200: "ok", 500: "error"},
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{ config|keys|join(',') }}", "a,b,c"},
+		{"{{ config|values|join(',') }}", "1,2,3"},
+		{"{% for k, v in config|items %}{{ k }}={{ v }};{% endfor %}", "a=1;b=2;c=3;"},
+		{"{{ codes|keys|join(',') }}", "200,404,500"},
+		{"{{ codes|values|join(',') }}", "ok,missing,error"},
+		{"{{ codes|items|first|join(':') }}", "200:ok"},
+		{"{{ none|keys|length }}|{{ none|values|length }}|{{ none|items|length }}", "0|0|0"},
+	}
+
+	for _, tt := range tests {
+		out, err := ExecuteToString(tt.template, vars)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if out != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, out)
+		}
+	}
+
+	undefined := NewEnvironment().newUndefined("missing")
+	for _, filter := range []FilterFunc{filterKeys, filterValues, filterItems} {
+		result, err := filter(nil, undefined)
+		if err != nil {
+			t.Fatalf("unexpected error for undefined input: %v", err)
+		}
+		if list, ok := result.([]interface{}); !ok || len(list) != 0 {
+			t.Fatalf("expected empty list for undefined input, got %#v", result)
+		}
+	}
+}
@@ -1,11 +1,17 @@
 package runtime
 
 import (
+	"bytes"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"html"
+	"html/template"
+	"io"
 	"math"
+	"math/big"
 	"math/rand"
+	"path"
 	"reflect"
 	"regexp"
 	"sort"
@@ -43,8 +49,11 @@ func (env *Environment) registerBuiltinFilters() {
 	env.AddFilter("wordcount", filterWordcount)
 	env.AddFilter("reverse", filterReverse)
 	env.AddFilter("center", filterCenter)
+	env.AddFilter("ljust", filterLjust)
+	env.AddFilter("rjust", filterRjust)
 	env.AddFilter("indent", filterIndent)
 	env.AddFilter("wordwrap", filterWordwrap)
+	env.AddFilter("fill", filterFill)
 
 	// Number filters
 	env.AddFilter("round", filterRound)
@@ -55,6 +64,7 @@ func (env *Environment) registerBuiltinFilters() {
 
 	// List filters
 	env.AddFilter("length", filterLength)
+	env.AddFilter("count", filterLength)
 	env.AddFilter("first", filterFirst)
 	env.AddFilter("last", filterLast)
 	env.AddFilter("join", filterJoin)
@@ -66,27 +76,47 @@ func (env *Environment) registerBuiltinFilters() {
 	env.AddFilter("list", filterList)
 	env.AddFilter("slice", filterSlice)
 	env.AddFilter("batch", filterBatch)
+	env.AddFilter("flatten", filterFlatten)
+	env.AddFilter("paginate", filterPaginate)
 	env.AddFilter("groupby", filterGroupby)
+	env.AddFilter("group_into_dict", filterGroupIntoDict)
+	env.AddFilter("asc", filterSortAsc)
+	env.AddFilter("desc", filterSortDesc)
 	env.AddFilter("dictsort", filterDictsort)
 	env.AddFilter("dictsortcasesensitive", filterDictsortCaseSensitive)
 	env.AddFilter("dictsortreversed", filterDictsortReversed)
+	env.AddFilter("merge", filterMerge)
+	env.AddFilter("update", filterMerge)
+	env.AddFilter("keys", filterKeys)
+	env.AddFilter("values", filterValues)
+	env.AddFilter("items", filterItems)
 
 	// Utility filters
 	env.AddFilter("safe", filterSafe)
 	env.AddFilter("escape", filterEscape)
 	env.AddFilter("e", filterEscape)
 	env.AddFilter("urlencode", filterUrlencode)
+	env.AddFilter("pathjoin", filterPathJoin)
+	env.AddFilter("safe_join", filterSafeJoin)
 	env.AddFilter("escapejs", filterEscapeJS)
 	env.AddFilter("filesizeformat", filterFilesizeformat)
 	env.AddFilter("floatformat", filterFloatformat)
+	env.AddFilter("number", filterNumber)
+	env.AddFilter("currency", filterCurrency)
 	env.AddFilter("pprint", filterPprint)
 	env.AddFilter("format", filterFormat)
 	env.AddFilter("urlize", filterUrlize)
 	env.AddFilter("xmlattr", filterXMLAttr)
+	env.AddFilter("xmlescape", filterXMLEscape)
 	env.AddFilter("forceescape", filterForceEscape)
 	env.AddFilter("shuffle", filterShuffle)
 	env.AddFilter("tojson", filterToJSON)
 	env.AddFilter("fromjson", filterFromJSON)
+	env.AddFilter("jsonpath", filterJSONPath)
+	env.AddFilter("toyaml", filterToYAML)
+	env.AddFilter("csvquote", filterCSVQuote)
+	env.AddFilter("tocsv", filterToCSV)
+	env.AddFilter("fromyaml", filterFromYAML)
 	env.AddFilter("random", filterRandom)
 	env.AddFilter("attr", filterAttr)
 	env.AddFilter("map", filterMap)
@@ -118,6 +148,7 @@ func (env *Environment) registerBuiltinTests() {
 	env.AddTest("sameas", testSameas)
 	env.AddTest("escaped", testEscaped)
 	env.AddTest("module", testModule)
+	env.AddTest("template_exists", testTemplateExists)
 	env.AddTest("list", testList)
 	env.AddTest("tuple", testTuple)
 	env.AddTest("dict", testDict)
@@ -151,35 +182,55 @@ func (env *Environment) registerBuiltinTests() {
 	env.AddTest("infinite", testInfinite)
 	env.AddTest("nan", testNan)
 	env.AddTest("finite", testFinite)
+	env.AddTest("has", testHas)
+	env.AddTest("hasattr", testHas)
+	env.AddTest("empty", testEmpty)
+	env.AddTest("one", testOne)
 }
 
 // String filters
 
 func filterUpper(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
 	str := toString(value)
-	return strings.ToUpper(str), nil
+	return keepMarkup(value, strings.ToUpper(str)), nil
 }
 
 func filterLower(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
 	str := toString(value)
-	return strings.ToLower(str), nil
+	return keepMarkup(value, strings.ToLower(str)), nil
 }
 
 func filterCapitalize(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
 	str := toString(value)
 	if str == "" {
-		return str, nil
+		return keepMarkup(value, str), nil
 	}
 	runes := []rune(str)
-	return strings.ToUpper(string(runes[0])) + strings.ToLower(string(runes[1:])), nil
+	return keepMarkup(value, strings.ToUpper(string(runes[0]))+strings.ToLower(string(runes[1:]))), nil
 }
 
 func filterTitle(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
 	str := toString(value)
 	if str == "" {
-		return str, nil
+		return keepMarkup(value, str), nil
+	}
+	var b strings.Builder
+	b.Grow(len(str))
+	wordStart := true
+	for _, r := range str {
+		switch {
+		case unicode.IsSpace(r) || strings.ContainsRune("-({[<", r):
+			// Words start after the same delimiters as Jinja's title.
+			wordStart = true
+		case wordStart:
+			r = unicode.ToTitle(r)
+			wordStart = false
+		default:
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
 	}
-	return strings.Title(str), nil
+	return keepMarkup(value, b.String()), nil
 }
 
 func filterTrim(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
@@ -189,9 +240,9 @@ func filterTrim(ctx *Context, value interface{}, args ...interface{}) (interface
 		chars = toString(args[0])
 	}
 	if chars != "" {
-		return strings.Trim(str, chars), nil
+		return keepMarkup(value, strings.Trim(str, chars)), nil
 	}
-	return strings.TrimSpace(str), nil
+	return keepMarkup(value, strings.TrimSpace(str)), nil
 }
 
 func filterLtrim(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
@@ -201,9 +252,9 @@ func filterLtrim(ctx *Context, value interface{}, args ...interface{}) (interfac
 		chars = toString(args[0])
 	}
 	if chars != "" {
-		return strings.TrimLeft(str, chars), nil
+		return keepMarkup(value, strings.TrimLeft(str, chars)), nil
 	}
-	return strings.TrimLeftFunc(str, unicode.IsSpace), nil
+	return keepMarkup(value, strings.TrimLeftFunc(str, unicode.IsSpace)), nil
 }
 
 func filterRtrim(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
@@ -213,9 +264,9 @@ func filterRtrim(ctx *Context, value interface{}, args ...interface{}) (interfac
 		chars = toString(args[0])
 	}
 	if chars != "" {
-		return strings.TrimRight(str, chars), nil
+		return keepMarkup(value, strings.TrimRight(str, chars)), nil
 	}
-	return strings.TrimRightFunc(str, unicode.IsSpace), nil
+	return keepMarkup(value, strings.TrimRightFunc(str, unicode.IsSpace)), nil
 }
 
 func filterStriptags(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
@@ -237,6 +288,7 @@ func filterStriptags(ctx *Context, value interface{}, args ...interface{}) (inte
 }
 
 func filterReplace(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	kwargs, args := extractKwargs(args)
 	if len(args) < 2 {
 		return nil, fmt.Errorf("replace filter requires at least 2 arguments")
 	}
@@ -246,52 +298,119 @@ func filterReplace(ctx *Context, value interface{}, args ...interface{}) (interf
 	new := toString(args[1])
 	count := -1
 
+	var rawCount interface{}
 	if len(args) > 2 {
-		if c, ok := args[2].(int); ok {
-			count = c
+		rawCount = args[2]
+	}
+	if val, ok := kwargs["count"]; ok {
+		rawCount = val
+	}
+	if rawCount != nil {
+		if num, ok := classifyNumber(rawCount); ok && num.isFloat() && num.asFloat64() != math.Trunc(num.asFloat64()) {
+			return nil, fmt.Errorf("replace count must be an integer, got %v", rawCount)
+		}
+		c, ok := toInt(rawCount)
+		if !ok {
+			return nil, fmt.Errorf("replace count must be an integer, got %T", rawCount)
 		}
+		if c < -1 {
+			return nil, fmt.Errorf("replace count must be non-negative or -1, got %d", c)
+		}
+		count = c
+	}
+
+	if _, ok := value.(Markup); ok {
+		// Replacing inside markup escapes the unsafe search and replacement
+		// strings so the result can stay safe.
+		old = escapeUnlessMarkup(ctx, args[0])
+		new = escapeUnlessMarkup(ctx, args[1])
+		return Markup(strings.Replace(str, old, new, count)), nil
 	}
 
 	return strings.Replace(str, old, new, count), nil
 }
 
+// keepMarkup returns result as Markup when the filter input was Markup, so
+// string transformations applied after `safe` are not escaped again.
+func keepMarkup(value interface{}, result string) interface{} {
+	if _, ok := value.(Markup); ok {
+		return Markup(result)
+	}
+	return result
+}
+
+func escapeUnlessMarkup(ctx *Context, value interface{}) string {
+	return string(escapeMarkup(ctx, value))
+}
+
 func filterTruncate(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	kwargs, args := extractKwargs(args)
 	str := toString(value)
 	length := 255
 	killwords := false
 	end := "..."
 
 	if len(args) > 0 {
-		if l, ok := args[0].(int); ok {
+		if l, ok := toInt(args[0]); ok {
 			length = l
 		}
 	}
+	if val, ok := kwargs["length"]; ok {
+		if l, ok := toInt(val); ok {
+			length = l
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("truncate length must not be negative, got %d", length)
+	}
 
 	if len(args) > 1 {
 		if kw, ok := args[1].(bool); ok {
 			killwords = kw
 		}
 	}
+	if val, ok := kwargs["killwords"]; ok {
+		killwords = isTruthyValue(val)
+	}
 
 	if len(args) > 2 {
 		end = toString(args[2])
 	}
+	if val, ok := kwargs["end"]; ok {
+		end = toString(val)
+	}
+
+	if isTruthyValue(kwargs["normalize_newlines"]) {
+		str = strings.ReplaceAll(normalizeNewlines(str), "\n", lineEnding(ctx, str, true))
+	}
 
-	if len(str) <= length {
+	// Lengths count characters, not bytes, so multibyte text is never cut
+	// in the middle of a rune.
+	runes := []rune(str)
+	if len(runes) <= length {
 		return str, nil
 	}
 
+	cut := length - utf8.RuneCountInString(end)
+	if cut < 0 {
+		cut = 0
+	}
+	// A cut between "\r" and "\n" must not leave a lone carriage return.
+	trimCR := func(head string) string {
+		return strings.TrimSuffix(head, "\r")
+	}
 	if killwords {
-		return str[:length-len(end)] + end, nil
+		return trimCR(string(runes[:cut])) + end, nil
 	}
 
 	// Find last space within length limit
-	lastSpace := strings.LastIndex(str[:length], " ")
+	head := string(runes[:length])
+	lastSpace := strings.LastIndex(head, " ")
 	if lastSpace == -1 {
-		return str[:length-len(end)] + end, nil
+		return trimCR(string(runes[:cut])) + end, nil
 	}
 
-	return str[:lastSpace] + end, nil
+	return trimCR(head[:lastSpace]) + end, nil
 }
 
 func filterWordcount(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
@@ -331,58 +450,164 @@ func filterReverse(ctx *Context, value interface{}, args ...interface{}) (interf
 	}
 }
 
+// filterCenter centers a string in the given width, like Python's str.center.
 func filterCenter(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
-	str := toString(value)
-	width := 80
+	return justifyFilter("center", value, args)
+}
+
+// filterLjust pads a string on the right to the given width, like Python's
+// str.ljust.
+func filterLjust(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	return justifyFilter("ljust", value, args)
+}
 
+// filterRjust pads a string on the left to the given width, like Python's
+// str.rjust.
+func filterRjust(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	return justifyFilter("rjust", value, args)
+}
+
+func justifyFilter(mode string, value interface{}, args []interface{}) (interface{}, error) {
+	kwargs, args := extractKwargs(args)
+
+	width := 80
+	fill := " "
 	if len(args) > 0 {
-		if w, ok := args[0].(int); ok {
-			width = w
+		w, ok := toInt(args[0])
+		if !ok {
+			return nil, fmt.Errorf("%s width must be an integer", mode)
+		}
+		width = w
+	}
+	if val, ok := kwargs["width"]; ok {
+		w, ok := toInt(val)
+		if !ok {
+			return nil, fmt.Errorf("%s width must be an integer", mode)
 		}
+		width = w
+	}
+	if len(args) > 1 {
+		fill = toString(args[1])
+	}
+	if val, ok := kwargs["fillchar"]; ok {
+		fill = toString(val)
+	}
+	if utf8.RuneCountInString(fill) != 1 {
+		return nil, fmt.Errorf("%s fill character must be exactly one character", mode)
 	}
 
-	if len(str) >= width {
-		return str, nil
+	return justifyString(mode, toString(value), width, fill), nil
+}
+
+// justifyString pads str with fill to width characters. Strings that are
+// already wide enough are returned unchanged.
+func justifyString(mode, str string, width int, fill string) string {
+	padding := width - utf8.RuneCountInString(str)
+	if padding <= 0 {
+		return str
 	}
 
-	padding := width - len(str)
-	leftPadding := padding / 2
-	rightPadding := padding - leftPadding
+	switch mode {
+	case "ljust":
+		return str + strings.Repeat(fill, padding)
+	case "rjust":
+		return strings.Repeat(fill, padding) + str
+	default:
+		left := padding / 2
+		return strings.Repeat(fill, left) + str + strings.Repeat(fill, padding-left)
+	}
+}
+
+// normalizeNewlines converts "\r\n" and lone "\r" line endings to "\n".
+func normalizeNewlines(text string) string {
+	if !strings.Contains(text, "\r") {
+		return text
+	}
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.ReplaceAll(text, "\r", "\n")
+}
 
-	return strings.Repeat(" ", leftPadding) + str + strings.Repeat(" ", rightPadding), nil
+// lineEnding picks the newline a line-based filter writes. With normalize
+// set it is the environment's NewlineSequence; otherwise text keeps its own
+// style, "\r\n" when it contains one and "\n" otherwise.
+func lineEnding(ctx *Context, text string, normalize bool) string {
+	if normalize {
+		if ctx != nil && ctx.environment != nil {
+			return ctx.environment.NewlineSequence()
+		}
+		return "\n"
+	}
+	if strings.Contains(text, "\r\n") {
+		return "\r\n"
+	}
+	return "\n"
 }
 
+// filterIndent indents every line but the first by width spaces, or by width
+// itself when it is a string. first also indents the first line and blank
+// indents empty lines, which are left empty by default.
 func filterIndent(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	kwargs, args := extractKwargs(args)
 	str := toString(value)
-	width := 4
+
+	var widthArg interface{} = 4
 	indentFirst := false
+	indentBlank := false
 
 	if len(args) > 0 {
-		if w, ok := args[0].(int); ok {
-			width = w
-		}
+		widthArg = args[0]
 	}
-
 	if len(args) > 1 {
-		if ifirst, ok := args[1].(bool); ok {
-			indentFirst = ifirst
+		indentFirst = isTruthyValue(args[1])
+	}
+	if len(args) > 2 {
+		indentBlank = isTruthyValue(args[2])
+	}
+	if val, ok := kwargs["width"]; ok {
+		widthArg = val
+	}
+	for _, name := range []string{"first", "indentfirst"} {
+		if val, ok := kwargs[name]; ok {
+			indentFirst = isTruthyValue(val)
 		}
 	}
+	if val, ok := kwargs["blank"]; ok {
+		indentBlank = isTruthyValue(val)
+	}
 
-	prefix := strings.Repeat(" ", width)
-	lines := strings.Split(str, "\n")
+	var prefix string
+	switch w := widthArg.(type) {
+	case string:
+		prefix = w
+	case Markup:
+		prefix = string(w)
+	default:
+		width, ok := toInt(widthArg)
+		if !ok {
+			return nil, fmt.Errorf("indent width must be an integer or a string")
+		}
+		if width > 0 {
+			prefix = strings.Repeat(" ", width)
+		}
+	}
 
-	if indentFirst {
-		for i := range lines {
-			lines[i] = prefix + lines[i]
+	newline := lineEnding(ctx, str, isTruthyValue(kwargs["normalize_newlines"]))
+	lines := strings.Split(normalizeNewlines(str), "\n")
+	for i := range lines {
+		if i == 0 && !indentFirst {
+			continue
 		}
-	} else {
-		for i := 1; i < len(lines); i++ {
-			lines[i] = prefix + lines[i]
+		if lines[i] == "" && !indentBlank && (i > 0 || !indentFirst) {
+			continue
 		}
+		lines[i] = prefix + lines[i]
 	}
 
-	return strings.Join(lines, "\n"), nil
+	result := strings.Join(lines, newline)
+	if _, ok := value.(Markup); ok {
+		return Markup(result), nil
+	}
+	return result, nil
 }
 
 func filterWordwrap(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
@@ -442,8 +667,7 @@ func filterWordwrap(ctx *Context, value interface{}, args ...interface{}) (inter
 		}
 	}
 
-	normalized := strings.ReplaceAll(text, "\r\n", "\n")
-	normalized = strings.ReplaceAll(normalized, "\r", "\n")
+	normalized := normalizeNewlines(text)
 
 	lines := strings.Split(normalized, "\n")
 	if len(lines) > 0 && strings.HasSuffix(normalized, "\n") {
@@ -463,6 +687,74 @@ func filterWordwrap(ctx *Context, value interface{}, args ...interface{}) (inter
 	return strings.Join(wrapped, wrapString), nil
 }
 
+// filterFill wraps text into a single paragraph like Python's textwrap.fill.
+// initial_indent is prepended to the first line and subsequent_indent to the
+// others; both count towards the width.
+func filterFill(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	kwargs, args := extractKwargs(args)
+
+	width := 70
+	initialIndent := ""
+	subsequentIndent := ""
+	breakLongWords := true
+	breakOnHyphens := true
+
+	if len(args) > 0 {
+		if w, ok := toInt(args[0]); ok {
+			width = w
+		}
+	}
+	if len(args) > 1 {
+		initialIndent = toString(args[1])
+	}
+	if len(args) > 2 {
+		subsequentIndent = toString(args[2])
+	}
+	if val, ok := kwargs["width"]; ok {
+		if w, ok := toInt(val); ok {
+			width = w
+		}
+	}
+	if val, ok := kwargs["initial_indent"]; ok {
+		initialIndent = toString(val)
+	}
+	if val, ok := kwargs["subsequent_indent"]; ok {
+		subsequentIndent = toString(val)
+	}
+	if val, ok := kwargs["break_long_words"]; ok {
+		breakLongWords = isTruthyValue(val)
+	}
+	if val, ok := kwargs["break_on_hyphens"]; ok {
+		breakOnHyphens = isTruthyValue(val)
+	}
+
+	firstWidth := width - utf8.RuneCountInString(initialIndent)
+	restWidth := width - utf8.RuneCountInString(subsequentIndent)
+	if firstWidth <= 0 || restWidth <= 0 {
+		return nil, fmt.Errorf("fill filter requires width greater than the indents")
+	}
+
+	newline := "\n"
+	if ctx != nil && ctx.environment != nil && ctx.environment.NewlineSequence() != "" {
+		newline = ctx.environment.NewlineSequence()
+	}
+
+	text := toString(value)
+	if strings.TrimSpace(text) == "" {
+		return "", nil
+	}
+
+	lines := wrapParagraphWidths(text, firstWidth, restWidth, breakLongWords, breakOnHyphens)
+	for i := range lines {
+		if i == 0 {
+			lines[i] = initialIndent + lines[i]
+		} else {
+			lines[i] = subsequentIndent + lines[i]
+		}
+	}
+	return strings.Join(lines, newline), nil
+}
+
 // Number filters
 
 func filterRound(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
@@ -480,7 +772,7 @@ func filterRound(ctx *Context, value interface{}, args ...interface{}) (interfac
 		num = v
 		ok = true
 	case float32:
-		num = float64(v)
+		num = widenFloat32(v)
 		ok = true
 	default:
 		if s := toString(value); s != "" {
@@ -566,22 +858,50 @@ func filterInt(ctx *Context, value interface{}, args ...interface{}) (interface{
 	case int64:
 		return int(v), nil
 	case float64:
-		return int(v), nil
+		return truncateFloat(v), nil
 	case float32:
-		return int(v), nil
+		return truncateFloat(float64(v)), nil
 	case string:
 		if i, err := strconv.Atoi(v); err == nil {
 			return i, nil
 		}
+		if b, ok := new(big.Int).SetString(v, 10); ok {
+			return b, nil
+		}
 		if f, err := strconv.ParseFloat(v, 64); err == nil {
-			return int(f), nil
+			return truncateFloat(f), nil
 		}
 		return nil, fmt.Errorf("cannot convert '%s' to int", v)
 	default:
+		// Integers that do not fit in an int stay exact as *big.Int.
+		if needsBigInt(value) {
+			b, _ := toBigInt(value)
+			return b, nil
+		}
+		if num, ok := classifyNumber(value); ok {
+			if num.isFloat() {
+				return truncateFloat(num.asFloat64()), nil
+			}
+			return int(num.intValue), nil
+		}
 		return nil, fmt.Errorf("int filter requires a number or string")
 	}
 }
 
+// truncateFloat drops the fractional part of f, returning a *big.Int when
+// the result does not fit in an int. NaN and infinities become 0, as in
+// Jinja.
+func truncateFloat(f float64) interface{} {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0
+	}
+	if f >= math.MinInt64 && f < math.MaxInt64 {
+		return int(f)
+	}
+	b, _ := big.NewFloat(f).Int(nil)
+	return b
+}
+
 func filterFloat(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
 	switch v := value.(type) {
 	case int:
@@ -591,18 +911,36 @@ func filterFloat(ctx *Context, value interface{}, args ...interface{}) (interfac
 	case float64:
 		return v, nil
 	case float32:
-		return float64(v), nil
+		return widenFloat32(v), nil
 	case string:
 		if f, err := strconv.ParseFloat(v, 64); err == nil {
 			return f, nil
 		}
 		return nil, fmt.Errorf("cannot convert '%s' to float", v)
 	default:
+		if num, ok := classifyNumber(value); ok {
+			return num.asFloat64(), nil
+		}
 		return nil, fmt.Errorf("float filter requires a number or string")
 	}
 }
 
+// filterDefault substitutes a default value. Undefined values are always
+// replaced. With only_none=true, None is replaced as well but other falsy
+// values such as 0 or "" are kept. With the boolean second argument set,
+// every falsy value is replaced, None included.
 func filterDefault(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	kwargs, positional := extractKwargs(args)
+	// A trailing mapping is a positional argument unless it only carries
+	// the filter's own keyword arguments.
+	for key := range kwargs {
+		if key != "boolean" && key != "only_none" {
+			kwargs, positional = nil, args
+			break
+		}
+	}
+	args = positional
+
 	var defaultValue interface{} = ""
 	if len(args) > 0 {
 		defaultValue = args[0]
@@ -610,20 +948,24 @@ func filterDefault(ctx *Context, value interface{}, args ...interface{}) (interf
 
 	applyOnFalsy := false
 	if len(args) > 1 {
-		switch v := args[1].(type) {
-		case bool:
-			applyOnFalsy = v
-		case int:
-			applyOnFalsy = v != 0
-		case string:
-			applyOnFalsy = strings.EqualFold(v, "true")
-		}
+		applyOnFalsy = defaultFlag(args[1])
+	}
+	if val, ok := kwargs["boolean"]; ok {
+		applyOnFalsy = defaultFlag(val)
+	}
+	onlyNone := false
+	if val, ok := kwargs["only_none"]; ok {
+		onlyNone = defaultFlag(val)
 	}
 
 	if isUndefinedValue(value) {
 		return defaultValue, nil
 	}
 
+	if onlyNone && value == nil {
+		return defaultValue, nil
+	}
+
 	if applyOnFalsy && !isTruthyValue(value) {
 		return defaultValue, nil
 	}
@@ -631,12 +973,28 @@ func filterDefault(ctx *Context, value interface{}, args ...interface{}) (interf
 	return value, nil
 }
 
+func defaultFlag(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case string:
+		return strings.EqualFold(v, "true")
+	}
+	if n, ok := toInt(value); ok {
+		return n != 0
+	}
+	return false
+}
+
 // List filters
 
 func filterLength(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	if group, ok := value.(*groupbyGroup); ok {
+		value = group.tuple()
+	}
 	switch v := value.(type) {
 	case string:
-		return len(v), nil
+		return utf8.RuneCountInString(v), nil
 	case []interface{}:
 		return len(v), nil
 	case map[interface{}]interface{}:
@@ -647,7 +1005,9 @@ func filterLength(ctx *Context, value interface{}, args ...interface{}) (interfa
 		// Try reflection
 		val := reflect.ValueOf(value)
 		switch val.Kind() {
-		case reflect.Slice, reflect.Array, reflect.Map, reflect.String:
+		case reflect.String:
+			return utf8.RuneCountInString(val.String()), nil
+		case reflect.Slice, reflect.Array, reflect.Map:
 			return val.Len(), nil
 		default:
 			return 0, fmt.Errorf("length filter requires a sequence or mapping")
@@ -656,12 +1016,16 @@ func filterLength(ctx *Context, value interface{}, args ...interface{}) (interfa
 }
 
 func filterFirst(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	if group, ok := value.(*groupbyGroup); ok {
+		value = group.tuple()
+	}
 	switch v := value.(type) {
 	case string:
 		if len(v) == 0 {
 			return "", nil
 		}
-		return string(v[0]), nil
+		first, _ := utf8.DecodeRuneInString(v)
+		return string(first), nil
 	case []interface{}:
 		if len(v) == 0 {
 			return nil, nil
@@ -681,6 +1045,9 @@ func filterFirst(ctx *Context, value interface{}, args ...interface{}) (interfac
 }
 
 func filterLast(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	if group, ok := value.(*groupbyGroup); ok {
+		value = group.tuple()
+	}
 	switch v := value.(type) {
 	case string:
 		if len(v) == 0 {
@@ -736,6 +1103,7 @@ func filterJoin(ctx *Context, value interface{}, args ...interface{}) (interface
 }
 
 func filterSort(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	kwargs, args := extractKwargs(args)
 	reverse := false
 	caseSensitive := true
 	attribute := ""
@@ -756,62 +1124,108 @@ func filterSort(ctx *Context, value interface{}, args ...interface{}) (interface
 		attribute = toString(args[2])
 	}
 
-	switch v := value.(type) {
-	case []interface{}:
-		// Make a copy to avoid modifying original
-		result := make([]interface{}, len(v))
-		copy(result, v)
+	if val, ok := kwargs["reverse"]; ok {
+		reverse = isTruthyValue(val)
+	}
+	if val, ok := kwargs["case_sensitive"]; ok {
+		caseSensitive = isTruthyValue(val)
+	}
+	if val, ok := kwargs["attribute"]; ok && val != nil {
+		attribute = toString(val)
+	}
 
-		if attribute != "" {
-			// Sort by attribute
-			sort.Slice(result, func(i, j int) bool {
-				attrI, _ := getAttribute(result[i], attribute)
-				attrJ, _ := getAttribute(result[j], attribute)
-				cmp := compareValues(attrI, attrJ, caseSensitive)
-				if reverse {
-					return cmp > 0
-				}
-				return cmp < 0
-			})
-		} else {
-			// Sort by value
-			sort.Slice(result, func(i, j int) bool {
-				cmp := compareValues(result[i], result[j], caseSensitive)
-				if reverse {
-					return cmp > 0
-				}
-				return cmp < 0
-			})
+	// `by` names a filter applied to each element (after attribute lookup)
+	// to derive its sort key, e.g. sort(by='length').
+	var keyFilter FilterFunc
+	if by, ok := kwargs["by"]; ok && by != nil {
+		name := toString(by)
+		if err := checkFilterAccess(ctx, name, "filter_sort"); err != nil {
+			return nil, err
 		}
+		if ctx != nil {
+			keyFilter, _ = ctx.lookupFilter(name)
+		}
+		if keyFilter == nil {
+			return nil, fmt.Errorf("sort filter: unknown key filter %q", name)
+		}
+	}
 
-		return result, nil
+	var items []interface{}
+	switch v := value.(type) {
+	case []interface{}:
+		items = v
 	case []string:
-		// Make a copy
-		result := make([]string, len(v))
-		copy(result, v)
+		items = make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = item
+		}
+	default:
+		return nil, fmt.Errorf("sort filter requires a sequence")
+	}
 
-		sort.Slice(result, func(i, j int) bool {
-			cmp := compareValues(result[i], result[j], caseSensitive)
-			if reverse {
-				return cmp > 0
+	keys := make([]interface{}, len(items))
+	for i, item := range items {
+		key := item
+		if attribute != "" {
+			key, _ = getAttribute(item, attribute)
+		}
+		if keyFilter != nil {
+			derived, err := keyFilter(ctx, key)
+			if err != nil {
+				return nil, err
 			}
-			return cmp < 0
-		})
+			key = derived
+		}
+		keys[i] = key
+	}
+
+	order := make([]int, len(items))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		cmp := compareValues(keys[order[i]], keys[order[j]], caseSensitive)
+		if reverse {
+			return cmp > 0
+		}
+		return cmp < 0
+	})
 
+	if _, ok := value.([]string); ok {
+		result := make([]string, len(order))
+		for i, idx := range order {
+			result[i] = items[idx].(string)
+		}
 		return result, nil
-	default:
-		return nil, fmt.Errorf("sort filter requires a sequence")
 	}
+	result := make([]interface{}, len(order))
+	for i, idx := range order {
+		result[i] = items[idx]
+	}
+	return result, nil
 }
 
 func filterUnique(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
 	switch v := value.(type) {
 	case []interface{}:
 		seen := make(map[interface{}]bool)
+		var uncomparable []interface{}
 		result := make([]interface{}, 0)
+	items:
 		for _, item := range v {
-			if !seen[item] {
-				seen[item] = true
+			if item != nil && !reflect.TypeOf(item).Comparable() {
+				for _, prev := range uncomparable {
+					if reflect.DeepEqual(prev, item) {
+						continue items
+					}
+				}
+				uncomparable = append(uncomparable, item)
+				result = append(result, item)
+				continue
+			}
+			key := uniqueKey(item)
+			if !seen[key] {
+				seen[key] = true
 				result = append(result, item)
 			}
 		}
@@ -831,62 +1245,124 @@ func filterUnique(ctx *Context, value interface{}, args ...interface{}) (interfa
 	}
 }
 
-func filterMin(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
-	switch v := value.(type) {
-	case []interface{}:
-		if len(v) == 0 {
-			return nil, nil
-		}
-		min := v[0]
-		for _, item := range v[1:] {
-			if compareValues(item, min, true) < 0 {
-				min = item
-			}
-		}
-		return min, nil
-	case []string:
-		if len(v) == 0 {
-			return "", nil
-		}
-		min := v[0]
-		for _, item := range v[1:] {
-			if compareValues(item, min, true) < 0 {
-				min = item
-			}
-		}
-		return min, nil
-	default:
-		return nil, fmt.Errorf("min filter requires a sequence")
-	}
-}
+// integerKey is the unique key of an integral number: its exact decimal
+// form, so large integers never collapse through float64.
+type integerKey string
 
-func filterMax(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
-	switch v := value.(type) {
-	case []interface{}:
-		if len(v) == 0 {
-			return nil, nil
-		}
-		max := v[0]
-		for _, item := range v[1:] {
-			if compareValues(item, max, true) > 0 {
-				max = item
-			}
-		}
-		return max, nil
-	case []string:
-		if len(v) == 0 {
-			return "", nil
-		}
-		max := v[0]
-		for _, item := range v[1:] {
-			if compareValues(item, max, true) > 0 {
-				max = item
-			}
+// uniqueKey canonicalises numbers so that values Jinja considers equal, such
+// as 1, 1.0 and int64(1), deduplicate together. Other values are their own key.
+func uniqueKey(item interface{}) interface{} {
+	if needsBigInt(item) {
+		if n, ok := toBigInt(item); ok {
+			return integerKey(n.String())
 		}
-		return max, nil
-	default:
-		return nil, fmt.Errorf("max filter requires a sequence")
 	}
+	num, ok := classifyNumber(item)
+	if !ok {
+		return item
+	}
+	if !num.isFloat() {
+		return integerKey(strconv.FormatInt(num.intValue, 10))
+	}
+	f := num.asFloat64()
+	if f == math.Trunc(f) && !math.IsInf(f, 0) {
+		n, _ := big.NewFloat(f).Int(nil)
+		return integerKey(n.String())
+	}
+	return f
+}
+
+func filterMin(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	return selectExtreme("min", value, args, -1)
+}
+
+func filterMax(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	return selectExtreme("max", value, args, 1)
+}
+
+// selectExtreme implements min and max. Like Jinja, mappings contribute their
+// keys. Items are compared as they are visited, so ranges are never copied.
+// An empty input yields none.
+func selectExtreme(name string, value interface{}, args []interface{}, want int) (interface{}, error) {
+	kwargs, args := extractKwargs(args)
+	caseSensitive := true
+	if len(args) > 0 {
+		caseSensitive = isTruthyValue(args[0])
+	}
+	if val, ok := kwargs["case_sensitive"]; ok {
+		caseSensitive = isTruthyValue(val)
+	}
+	attribute := ""
+	if len(args) > 1 {
+		attribute = toString(args[1])
+	}
+	if val, ok := kwargs["attribute"]; ok && val != nil {
+		attribute = toString(val)
+	}
+
+	var best, bestKey interface{}
+	found := false
+	err := iterateItems(value, func(item interface{}) {
+		key := item
+		if attribute != "" {
+			key, _ = getAttribute(item, attribute)
+		}
+		if !found || compareValues(key, bestKey, caseSensitive)*want > 0 {
+			best, bestKey, found = item, key, true
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s filter requires a sequence", name)
+	}
+	return best, nil
+}
+
+// iterateItems calls fn for each element of a sequence, each key of a mapping
+// and each rune of a string without materialising the collection.
+func iterateItems(value interface{}, fn func(interface{})) error {
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			fn(item)
+		}
+		return nil
+	case map[interface{}]interface{}:
+		for key := range v {
+			fn(key)
+		}
+		return nil
+	case map[string]interface{}:
+		for key := range v {
+			fn(key)
+		}
+		return nil
+	case string:
+		for _, r := range v {
+			fn(string(r))
+		}
+		return nil
+	}
+
+	val := reflect.ValueOf(value)
+	switch val.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < val.Len(); i++ {
+			fn(val.Index(i).Interface())
+		}
+		return nil
+	case reflect.Map:
+		iter := val.MapRange()
+		for iter.Next() {
+			fn(iter.Key().Interface())
+		}
+		return nil
+	case reflect.String:
+		for _, r := range val.String() {
+			fn(string(r))
+		}
+		return nil
+	}
+	return fmt.Errorf("sequence expected")
 }
 
 func filterSum(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
@@ -1002,6 +1478,7 @@ func filterList(ctx *Context, value interface{}, args ...interface{}) (interface
 }
 
 func filterSlice(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	kwargs, args := extractKwargs(args)
 	if len(args) < 1 {
 		return nil, fmt.Errorf("slice filter requires the number of slices")
 	}
@@ -1018,6 +1495,9 @@ func filterSlice(ctx *Context, value interface{}, args ...interface{}) (interfac
 	if len(args) > 1 {
 		fillWith = args[1]
 	}
+	if val, ok := kwargs["fill_with"]; ok {
+		fillWith = val
+	}
 
 	length := len(items)
 	itemsPerSlice := 0
@@ -1030,6 +1510,7 @@ func filterSlice(ctx *Context, value interface{}, args ...interface{}) (interfac
 	}
 	offset := 0
 	result := make([][]interface{}, 0, slices)
+	filled := make([]int, 0, slices)
 
 	for sliceNumber := 0; sliceNumber < slices; sliceNumber++ {
 		start := offset + sliceNumber*itemsPerSlice
@@ -1048,31 +1529,123 @@ func filterSlice(ctx *Context, value interface{}, args ...interface{}) (interfac
 			tmp = append(tmp, fillWith)
 		}
 		result = append(result, tmp)
+		filled = append(filled, end-start)
+	}
+	if isTruthyValue(kwargs["as_objects"]) {
+		return rowObjects(result, filled), nil
 	}
 	return result, nil
 }
 
+// groupbyGroup is one group produced by groupby. Like Jinja's namedtuple it
+// unpacks, indexes and measures as (grouper, list); count and aggregate are
+// attributes only.
+type groupbyGroup struct {
+	Grouper   interface{}   `json:"grouper"`
+	List      []interface{} `json:"list"`
+	Count     int           `json:"count"`
+	Aggregate interface{}   `json:"aggregate,omitempty"`
+}
+
+// tuple returns the group as the (grouper, list) pair it unpacks to.
+func (g *groupbyGroup) tuple() []interface{} {
+	return []interface{}{g.Grouper, g.List}
+}
+
+// String renders the group as its (grouper, list) pair.
+func (g *groupbyGroup) String() string {
+	return fmt.Sprintf("(%s, %s)", toString(g.Grouper), toString(g.List))
+}
+
 func filterGroupby(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
-	if len(args) < 1 {
+	kwargs, args := extractKwargs(args)
+	attribute := ""
+	if len(args) > 0 {
+		attribute = toString(args[0])
+	}
+	if val, ok := kwargs["attribute"]; ok && val != nil {
+		attribute = toString(val)
+	}
+	if attribute == "" {
 		return nil, fmt.Errorf("groupby filter requires 1 argument (attribute)")
 	}
-
-	attribute := toString(args[0])
+	var fallback interface{}
+	if len(args) > 1 {
+		fallback = args[1]
+	}
+	if val, ok := kwargs["default"]; ok {
+		fallback = val
+	}
+	reverse := false
+	if val, ok := kwargs["reverse"]; ok {
+		reverse = isTruthyValue(val)
+	}
+	aggregate := ""
+	if val, ok := kwargs["aggregate"]; ok && val != nil {
+		aggregate = toString(val)
+	}
+	aggregateAttribute := ""
+	if val, ok := kwargs["aggregate_attribute"]; ok && val != nil {
+		aggregateAttribute = toString(val)
+	}
+	var aggregateFn FilterFunc
+	switch aggregate {
+	case "", "count":
+	case "sum":
+		aggregateFn = filterSum
+	case "min":
+		aggregateFn = filterMin
+	case "max":
+		aggregateFn = filterMax
+	default:
+		return nil, fmt.Errorf("groupby aggregate must be one of count, sum, min or max, got %q", aggregate)
+	}
 
 	switch v := value.(type) {
 	case []interface{}:
 		groups := make(map[interface{}][]interface{})
+		var keys []interface{}
 		for _, item := range v {
 			key, _ := getAttribute(item, attribute)
+			if key == nil || isUndefinedValue(key) {
+				key = fallback
+			}
+			if _, seen := groups[key]; !seen {
+				keys = append(keys, key)
+			}
 			groups[key] = append(groups[key], item)
 		}
 
-		result := make([]interface{}, 0, len(groups))
-		for key, items := range groups {
-			result = append(result, map[string]interface{}{
-				"grouper": key,
-				"list":    items,
-			})
+		// Groups are ordered by grouper, as in Jinja.
+		sort.SliceStable(keys, func(i, j int) bool {
+			cmp := compareValues(keys[i], keys[j], true)
+			if reverse {
+				return cmp > 0
+			}
+			return cmp < 0
+		})
+
+		result := make([]interface{}, 0, len(keys))
+		for _, key := range keys {
+			group := &groupbyGroup{Grouper: key, List: groups[key], Count: len(groups[key])}
+			switch {
+			case aggregate == "count":
+				group.Aggregate = len(groups[key])
+			case aggregateFn != nil:
+				values := groups[key]
+				if aggregateAttribute != "" {
+					values = make([]interface{}, len(groups[key]))
+					for i, item := range groups[key] {
+						values[i], _ = getAttribute(item, aggregateAttribute)
+					}
+				}
+				agg, err := aggregateFn(ctx, values)
+				if err != nil {
+					return nil, fmt.Errorf("groupby aggregate %s: %w", aggregate, err)
+				}
+				group.Aggregate = agg
+			}
+			result = append(result, group)
 		}
 		return result, nil
 	default:
@@ -1080,6 +1653,60 @@ func filterGroupby(ctx *Context, value interface{}, args ...interface{}) (interf
 	}
 }
 
+// filterSortAsc and filterSortDesc are shorthands for sort and
+// sort(reverse=true); other sort arguments such as attribute pass through.
+func filterSortAsc(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	return filterSort(ctx, value, withKwarg(args, "reverse", false)...)
+}
+
+func filterSortDesc(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	return filterSort(ctx, value, withKwarg(args, "reverse", true)...)
+}
+
+// withKwarg returns args with name set in the trailing kwargs map, adding
+// one when absent.
+func withKwarg(args []interface{}, name string, value interface{}) []interface{} {
+	kwargs, positional := extractKwargs(args)
+	merged := make(map[string]interface{}, len(kwargs)+1)
+	for k, v := range kwargs {
+		merged[k] = v
+	}
+	merged[name] = value
+	return append(append([]interface{}{}, positional...), merged)
+}
+
+// filterGroupIntoDict groups a sequence by attribute into a mapping from each
+// grouper value to the items sharing it, in their original order.
+func filterGroupIntoDict(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	kwargs, args := extractKwargs(args)
+	attribute := ""
+	if len(args) > 0 {
+		attribute = toString(args[0])
+	}
+	if val, ok := kwargs["attribute"]; ok && val != nil {
+		attribute = toString(val)
+	}
+	if attribute == "" {
+		return nil, fmt.Errorf("group_into_dict filter requires an attribute")
+	}
+
+	items, err := sequenceToSlice(value)
+	if err != nil {
+		return nil, fmt.Errorf("group_into_dict filter requires a sequence")
+	}
+
+	groups := make(map[interface{}]interface{})
+	for _, item := range items {
+		key, _ := getAttribute(item, attribute)
+		if key != nil && !reflect.TypeOf(key).Comparable() {
+			return nil, fmt.Errorf("group_into_dict: grouper value of type %T cannot be used as a key", key)
+		}
+		existing, _ := groups[key].([]interface{})
+		groups[key] = append(existing, item)
+	}
+	return groups, nil
+}
+
 func filterDictsort(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
 	return dictsortWithDefaults(value, args, dictsortDefaults{})
 }
@@ -1092,12 +1719,131 @@ func filterDictsortReversed(ctx *Context, value interface{}, args ...interface{}
 	return dictsortWithDefaults(value, args, dictsortDefaults{reverse: true})
 }
 
+// filterMerge returns a new mapping with each argument mapping applied over
+// value in turn. With deep=true, nested mappings present on both sides are
+// merged instead of replaced. Neither input is modified. Because overrides
+// are mappings too, a trailing mapping is read as keyword arguments only when
+// its sole key is "deep".
+func filterMerge(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	deep := false
+	if len(args) > 0 {
+		if kw, ok := args[len(args)-1].(map[string]interface{}); ok && len(kw) == 1 {
+			if val, ok := kw["deep"]; ok {
+				deep = isTruthyValue(val)
+				args = args[:len(args)-1]
+			}
+		}
+	}
+
+	result := make(map[interface{}]interface{})
+	if value != nil && !isUndefinedValue(value) && !copyMapEntries(result, value) {
+		return nil, fmt.Errorf("merge filter expects a mapping, got %T", value)
+	}
+	for _, override := range args {
+		if err := mergeMapInto(result, override, deep); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func mergeMapInto(dst map[interface{}]interface{}, override interface{}, deep bool) error {
+	entries := make(map[interface{}]interface{})
+	if override == nil || isUndefinedValue(override) {
+		return nil
+	}
+	if !copyMapEntries(entries, override) {
+		return fmt.Errorf("merge filter expects mapping arguments, got %T", override)
+	}
+	for key, val := range entries {
+		if deep {
+			if existing, ok := dst[key]; ok && isMapValue(existing) && isMapValue(val) {
+				nested := make(map[interface{}]interface{})
+				copyMapEntries(nested, existing)
+				if err := mergeMapInto(nested, val, true); err != nil {
+					return err
+				}
+				dst[key] = nested
+				continue
+			}
+		}
+		dst[key] = val
+	}
+	return nil
+}
+
+func isMapValue(value interface{}) bool {
+	if value == nil {
+		return false
+	}
+	return reflect.TypeOf(value).Kind() == reflect.Map
+}
+
+// filterKeys returns the keys of a mapping in sorted order.
+func filterKeys(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	pairs, err := sortedMapPairs("keys", value)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]interface{}, len(pairs))
+	for i, pair := range pairs {
+		result[i] = pair.key
+	}
+	return result, nil
+}
+
+// filterValues returns the values of a mapping ordered by their keys.
+func filterValues(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	pairs, err := sortedMapPairs("values", value)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]interface{}, len(pairs))
+	for i, pair := range pairs {
+		result[i] = pair.value
+	}
+	return result, nil
+}
+
+// filterItems returns the [key, value] pairs of a mapping ordered by key.
+func filterItems(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	pairs, err := sortedMapPairs("items", value)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]interface{}, len(pairs))
+	for i, pair := range pairs {
+		result[i] = []interface{}{pair.key, pair.value}
+	}
+	return result, nil
+}
+
+// sortedMapPairs collects the entries of any map, sorted case-sensitively by
+// key. Undefined and nil values have no entries.
+func sortedMapPairs(filter string, value interface{}) ([]dictsortPair, error) {
+	if value == nil || isUndefinedValue(value) {
+		return []dictsortPair{}, nil
+	}
+	if !isMapValue(value) {
+		return nil, fmt.Errorf("%s filter expects a mapping, got %T", filter, value)
+	}
+	pairs, err := collectDictsortPairs(value)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return compareValues(pairs[i].key, pairs[j].key, true) < 0
+	})
+	return pairs, nil
+}
+
 // Utility filters
 
 func filterSafe(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
-	// In a full implementation, this would wrap the value in a Markup type
-	// For now, just return the value
-	return value, nil
+	if markup, ok := value.(Markup); ok {
+		return markup, nil
+	}
+	return Markup(toString(value)), nil
 }
 
 func filterDo(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
@@ -1108,8 +1854,8 @@ func filterDo(ctx *Context, value interface{}, args ...interface{}) (interface{}
 }
 
 func filterEscape(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
-	str := toString(value)
-	return html.EscapeString(str), nil
+	// Markup is already safe; escaping it again would double-escape entities.
+	return escapeMarkup(ctx, value), nil
 }
 
 func filterUrlencode(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
@@ -1127,8 +1873,80 @@ func filterUrlencode(ctx *Context, value interface{}, args ...interface{}) (inte
 	return result.String(), nil
 }
 
+// filterPathJoin joins path segments with "/" using path.Join semantics. The
+// value is either a sequence of segments or the first segment, with further
+// segments passed as arguments. A leading "scheme://" is preserved so URLs can
+// be built too. With safe=true any ".." segment is rejected.
+func filterPathJoin(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	kwargs, positional := extractKwargs(args)
+	safe := false
+	if val, ok := kwargs["safe"]; ok {
+		safe = isTruthyValue(val)
+	}
+
+	var segments []interface{}
+	switch value.(type) {
+	case string, Markup:
+		segments = append([]interface{}{value}, positional...)
+	default:
+		items, err := sequenceToSlice(value)
+		if err != nil {
+			return nil, fmt.Errorf("pathjoin filter requires a sequence of path segments")
+		}
+		segments = append(items, positional...)
+	}
+
+	parts := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		if segment == nil || isUndefinedValue(segment) {
+			continue
+		}
+		part := toString(segment)
+		if safe {
+			for _, elem := range strings.Split(part, "/") {
+				if elem == ".." {
+					return nil, fmt.Errorf("pathjoin filter rejected path traversal in segment %q", part)
+				}
+			}
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return "", nil
+	}
+
+	prefix := ""
+	if idx := strings.Index(parts[0], "://"); idx > 0 {
+		prefix = parts[0][:idx+3]
+		parts[0] = parts[0][idx+3:]
+	}
+	return prefix + path.Join(parts...), nil
+}
+
+// filterSafeJoin is pathjoin with the traversal guard always enabled.
+func filterSafeJoin(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	return filterPathJoin(ctx, value, withKwarg(args, "safe", true)...)
+}
+
 func filterEscapeJS(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	kwargs, positional := extractKwargs(args)
+	mode := "html"
+	if len(positional) > 0 {
+		mode = toString(positional[0])
+	}
+	if val, ok := kwargs["mode"]; ok {
+		mode = toString(val)
+	}
+
 	s := toString(value)
+	switch strings.ToLower(mode) {
+	case "html", "":
+	case "json":
+		return escapeJSONString(s), nil
+	default:
+		return nil, fmt.Errorf("escapejs mode must be 'html' or 'json', got %q", mode)
+	}
+
 	if s == "" {
 		return "", nil
 	}
@@ -1182,6 +2000,38 @@ func filterEscapeJS(ctx *Context, value interface{}, args ...interface{}) (inter
 	return b.String(), nil
 }
 
+// escapeJSONString escapes only what a JSON string literal requires: quotes,
+// backslashes, and control characters. Non-ASCII text is left untouched.
+func escapeJSONString(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		switch r {
+		case '\\':
+			b.WriteString("\\\\")
+		case '"':
+			b.WriteString("\\\"")
+		case '\n':
+			b.WriteString("\\n")
+		case '\r':
+			b.WriteString("\\r")
+		case '\t':
+			b.WriteString("\\t")
+		case '\b':
+			b.WriteString("\\b")
+		case '\f':
+			b.WriteString("\\f")
+		default:
+			if r < 0x20 {
+				b.WriteString(fmt.Sprintf("\\u%04x", r))
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	return b.String()
+}
+
 func filterFilesizeformat(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
 	kwargs, positional := extractKwargs(args)
 	args = positional
@@ -1319,6 +2169,110 @@ func filterFloatformat(ctx *Context, value interface{}, args ...interface{}) (in
 	return result, nil
 }
 
+// filterNumber formats a number for a locale using the formatter registered
+// with SetNumberFormatter. The locale comes from the first argument or the
+// locale keyword, falling back to a "locale" variable in the render context.
+func filterNumber(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	if ctx == nil || ctx.environment == nil {
+		return nil, fmt.Errorf("number requires a number formatter; configure one with SetNumberFormatter")
+	}
+	formatter := ctx.environment.NumberFormatter()
+	if formatter == nil {
+		return nil, fmt.Errorf("number requires a number formatter; configure one with SetNumberFormatter")
+	}
+
+	kwargs, positional := extractKwargs(args)
+	var locale interface{}
+	if len(positional) > 0 {
+		locale = positional[0]
+	}
+	if val, ok := kwargs["locale"]; ok {
+		locale = val
+	}
+
+	if !isNumberValue(value) {
+		return nil, fmt.Errorf("number filter expects a number, got %T", value)
+	}
+
+	return formatter(value, renderLocale(ctx, locale))
+}
+
+// filterCurrency formats an amount in a currency, given by the first argument
+// or the code keyword and defaulting to USD. It hands a CurrencyAmount to the
+// formatter registered with SetNumberFormatter and otherwise prints the
+// currency symbol followed by the amount with two decimals. A symbol keyword
+// always selects this built-in format with the given symbol.
+func filterCurrency(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	kwargs, positional := extractKwargs(args)
+
+	code := "USD"
+	if len(positional) > 0 {
+		code = toString(positional[0])
+	}
+	if val, ok := kwargs["code"]; ok {
+		code = toString(val)
+	}
+	code = strings.ToUpper(code)
+
+	if !isNumberValue(value) {
+		return nil, fmt.Errorf("currency filter expects a number, got %T", value)
+	}
+
+	_, hasSymbol := kwargs["symbol"]
+	if ctx != nil && ctx.environment != nil && !hasSymbol {
+		if formatter := ctx.environment.NumberFormatter(); formatter != nil {
+			return formatter(CurrencyAmount{Amount: value, Code: code}, renderLocale(ctx, kwargs["locale"]))
+		}
+	}
+
+	symbol, ok := currencySymbols[code]
+	if !ok {
+		symbol = code + " "
+	}
+	if hasSymbol {
+		symbol = toString(kwargs["symbol"])
+	}
+
+	amount, _ := toFloat64(value)
+	formatted := strconv.FormatFloat(math.Abs(amount), 'f', 2, 64)
+	if amount < 0 && formatted != "0.00" {
+		return "-" + symbol + formatted, nil
+	}
+	return symbol + formatted, nil
+}
+
+var currencySymbols = map[string]string{
+	"USD": "$",
+	"EUR": "€",
+	"GBP": "£",
+	"JPY": "¥",
+	"CNY": "¥",
+	"INR": "₹",
+}
+
+// renderLocale returns the explicit locale if one was given and otherwise the
+// "locale" variable of the render context.
+func renderLocale(ctx *Context, explicit interface{}) string {
+	if explicit == nil || isUndefinedValue(explicit) {
+		if ctx == nil {
+			return ""
+		}
+		explicit, _ = ctx.Get("locale")
+	}
+	if explicit == nil || isUndefinedValue(explicit) {
+		return ""
+	}
+	return toString(explicit)
+}
+
+func isNumberValue(value interface{}) bool {
+	if _, isBool := value.(bool); isBool {
+		return false
+	}
+	_, ok := classifyNumber(value)
+	return ok
+}
+
 func filterPprint(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
 	indent := "  "
 	if len(args) > 0 {
@@ -1339,14 +2293,21 @@ func filterFormat(ctx *Context, value interface{}, args ...interface{}) (interfa
 	if len(args) == 1 {
 		switch m := args[0].(type) {
 		case map[string]interface{}:
-			placeholderRE := regexp.MustCompile(`%\(([^)]+)\)[sd]`)
+			var missing string
 			ordered := make([]interface{}, 0)
-			converted := placeholderRE.ReplaceAllStringFunc(format, func(match string) string {
-				name := placeholderRE.FindStringSubmatch(match)[1]
-				ordered = append(ordered, m[name])
-				return "%v"
+			converted := formatMappingRE.ReplaceAllStringFunc(format, func(match string) string {
+				groups := formatMappingRE.FindStringSubmatch(match)
+				item, ok := m[groups[1]]
+				if !ok && missing == "" {
+					missing = groups[1]
+				}
+				ordered = append(ordered, item)
+				return "%" + groups[2]
 			})
-			return fmt.Sprintf(converted, ordered...), nil
+			if missing != "" {
+				return nil, fmt.Errorf("format: missing key %q in mapping", missing)
+			}
+			return formatPercent(converted, ordered)
 		case map[interface{}]interface{}:
 			pm := make(map[string]interface{}, len(m))
 			for k, v := range m {
@@ -1357,11 +2318,98 @@ func filterFormat(ctx *Context, value interface{}, args ...interface{}) (interfa
 			return filterFormat(ctx, value, pm)
 		}
 	}
-	return fmt.Sprintf(format, args...), nil
+	return formatPercent(format, args)
+}
+
+var (
+	formatMappingRE = regexp.MustCompile(`%\(([^)]+)\)([-+ #0]*\d*(?:\.\d+)?[a-zA-Z])`)
+	formatVerbRE    = regexp.MustCompile(`%[-+ #0]*\d*(?:\.\d+)?[a-zA-Z%]`)
+)
+
+// formatPercent applies printf-style formatting with Python's conversion
+// rules: %s accepts any value, numeric verbs require numbers, and argument
+// count mismatches are reported as errors instead of Go's %! markers.
+func formatPercent(format string, args []interface{}) (string, error) {
+	var builder strings.Builder
+	next := 0
+	last := 0
+	for _, loc := range formatVerbRE.FindAllStringIndex(format, -1) {
+		builder.WriteString(format[last:loc[0]])
+		last = loc[1]
+		spec := format[loc[0]:loc[1]]
+		verb := spec[len(spec)-1]
+		if verb == '%' {
+			builder.WriteByte('%')
+			continue
+		}
+		if next >= len(args) {
+			return "", fmt.Errorf("format: not enough arguments for format string")
+		}
+		arg := args[next]
+		next++
+
+		flags := spec[:len(spec)-1]
+		switch verb {
+		case 's', 'r':
+			builder.WriteString(fmt.Sprintf(flags+"s", toString(arg)))
+		case 'd', 'i', 'u', 'x', 'X', 'o':
+			num, ok := classifyNumber(arg)
+			if !ok {
+				return "", fmt.Errorf("format: %%%c requires a number, not %T", verb, arg)
+			}
+			n := num.intValue
+			if num.isFloat() {
+				n = int64(num.floatValue)
+			}
+			if verb == 'i' || verb == 'u' {
+				verb = 'd'
+			}
+			builder.WriteString(fmt.Sprintf(flags+string(verb), n))
+		case 'f', 'F', 'e', 'E', 'g', 'G':
+			num, ok := classifyNumber(arg)
+			if !ok {
+				return "", fmt.Errorf("format: %%%c requires a number, not %T", verb, arg)
+			}
+			if verb == 'F' {
+				verb = 'f'
+			}
+			builder.WriteString(fmt.Sprintf(flags+string(verb), num.asFloat64()))
+		default:
+			formatted := fmt.Sprintf(spec, arg)
+			if strings.Contains(formatted, "%!") {
+				return "", fmt.Errorf("format: unsupported format verb %q for %T", spec, arg)
+			}
+			builder.WriteString(formatted)
+		}
+	}
+	builder.WriteString(format[last:])
+
+	if next < len(args) {
+		return "", fmt.Errorf("format: not all arguments converted during string formatting")
+	}
+	return builder.String(), nil
+}
+
+var xmlEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	`"`, "&quot;",
+	"'", "&apos;",
+)
+
+// filterXMLEscape escapes text for XML element and attribute contexts using
+// only the five predefined XML entities.
+func filterXMLEscape(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	escaped := xmlEscaper.Replace(toString(value))
+	if ctx != nil && ctx.ShouldAutoescape() {
+		return Markup(escaped), nil
+	}
+	return escaped, nil
 }
 
 func filterForceEscape(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
-	return Markup(html.EscapeString(toString(value))), nil
+	return escapeMarkup(ctx, toString(value)), nil
 }
 
 func filterShuffle(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
@@ -1371,13 +2419,15 @@ func filterShuffle(ctx *Context, value interface{}, args ...interface{}) (interf
 	}
 
 	cpy := append([]interface{}(nil), items...)
-	seed := time.Now().UnixNano()
+	var rnd *rand.Rand
 	if len(args) > 0 {
 		if s, ok := toInt(args[0]); ok {
-			seed = int64(s)
+			rnd = rand.New(rand.NewSource(int64(s)))
 		}
 	}
-	rnd := rand.New(rand.NewSource(seed))
+	if rnd == nil {
+		rnd = filterRandomSource(ctx)
+	}
 	rnd.Shuffle(len(cpy), func(i, j int) {
 		cpy[i], cpy[j] = cpy[j], cpy[i]
 	})
@@ -1385,6 +2435,7 @@ func filterShuffle(ctx *Context, value interface{}, args ...interface{}) (interf
 }
 
 func filterBatch(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	kwargs, args := extractKwargs(args)
 	items, err := sequenceToSlice(value)
 	if err != nil {
 		return nil, err
@@ -1400,54 +2451,489 @@ func filterBatch(ctx *Context, value interface{}, args ...interface{}) (interfac
 	if len(args) > 1 {
 		filler = args[1]
 	}
+	if val, ok := kwargs["fill_with"]; ok {
+		filler = val
+	}
 
 	batches := make([][]interface{}, 0, (len(items)+size-1)/size)
+	filled := make([]int, 0, cap(batches))
 	current := make([]interface{}, 0, size)
 	for _, item := range items {
 		current = append(current, item)
 		if len(current) == size {
 			batches = append(batches, append([]interface{}(nil), current...))
+			filled = append(filled, size)
 			current = current[:0]
 		}
 	}
-	if len(current) > 0 {
-		if filler != nil && len(current) < size {
-			current = append(current, repeatValue(filler, size-len(current))...)
+	if len(current) > 0 {
+		filled = append(filled, len(current))
+		if filler != nil && len(current) < size {
+			current = append(current, repeatValue(filler, size-len(current))...)
+		}
+		batches = append(batches, append([]interface{}(nil), current...))
+	}
+	if isTruthyValue(kwargs["as_objects"]) {
+		return rowObjects(batches, filled), nil
+	}
+	return batches, nil
+}
+
+// rowObjects wraps the rows produced by batch and slice for as_objects=true:
+// each row exposes index (from 1), index0 and cells, and each cell exposes
+// value and is_fill, which is true for fill_with padding. filled holds the
+// number of real items at the start of each row.
+func rowObjects(rows [][]interface{}, filled []int) []interface{} {
+	result := make([]interface{}, len(rows))
+	for i, row := range rows {
+		cells := make([]interface{}, len(row))
+		for j, item := range row {
+			cells[j] = map[string]interface{}{"value": item, "is_fill": j >= filled[i]}
+		}
+		result[i] = map[string]interface{}{"index": i + 1, "index0": i, "cells": cells}
+	}
+	return result
+}
+
+// filterFlatten flattens nested lists into a single list. The optional depth
+// argument limits how many levels are unpacked; by default nesting is removed
+// entirely. Strings, maps and other non-sequence items are kept as-is.
+func filterFlatten(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	kwargs, positional := extractKwargs(args)
+	items, err := sequenceToSlice(value)
+	if err != nil {
+		return nil, err
+	}
+	depth := -1
+	var rawDepth interface{}
+	if len(positional) > 0 {
+		rawDepth = positional[0]
+	}
+	if v, ok := kwargs["depth"]; ok {
+		rawDepth = v
+	}
+	if rawDepth != nil {
+		d, ok := toInt(rawDepth)
+		if !ok || d < 0 {
+			return nil, fmt.Errorf("flatten depth must be a non-negative integer")
+		}
+		depth = d
+	}
+	return flattenItems(make([]interface{}, 0, len(items)), items, depth), nil
+}
+
+func flattenItems(result []interface{}, items []interface{}, depth int) []interface{} {
+	for _, item := range items {
+		if depth == 0 || !isFlattenableSequence(item) {
+			result = append(result, item)
+			continue
+		}
+		val := reflect.ValueOf(item)
+		nested := make([]interface{}, val.Len())
+		for i := range nested {
+			nested[i] = val.Index(i).Interface()
+		}
+		result = flattenItems(result, nested, depth-1)
+	}
+	return result
+}
+
+func isFlattenableSequence(item interface{}) bool {
+	if item == nil {
+		return false
+	}
+	switch item.(type) {
+	case []byte, Markup:
+		return false
+	}
+	kind := reflect.TypeOf(item).Kind()
+	return kind == reflect.Slice || kind == reflect.Array
+}
+
+// filterPaginate returns one page of a sequence together with the metadata
+// needed to render pagination controls. Pages are numbered from 1 and an
+// out-of-range page is clamped to the first or last page.
+func filterPaginate(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	kwargs, positional := extractKwargs(args)
+
+	items, err := sequenceToSlice(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var perPageArg, pageArg interface{}
+	if len(positional) > 0 {
+		perPageArg = positional[0]
+	}
+	if len(positional) > 1 {
+		pageArg = positional[1]
+	}
+	if val, ok := kwargs["per_page"]; ok {
+		perPageArg = val
+	}
+	if val, ok := kwargs["page"]; ok {
+		pageArg = val
+	}
+
+	if perPageArg == nil {
+		return nil, fmt.Errorf("paginate filter requires a per_page argument")
+	}
+	perPage, ok := toInt(perPageArg)
+	if !ok || perPage <= 0 {
+		return nil, fmt.Errorf("paginate per_page must be a positive integer")
+	}
+	page := 1
+	if pageArg != nil {
+		if page, ok = toInt(pageArg); !ok {
+			return nil, fmt.Errorf("paginate page must be an integer")
+		}
+	}
+
+	total := len(items)
+	pages := (total + perPage - 1) / perPage
+	if pages == 0 {
+		pages = 1
+	}
+	if page < 1 {
+		page = 1
+	} else if page > pages {
+		page = pages
+	}
+
+	start := (page - 1) * perPage
+	end := start + perPage
+	if end > total {
+		end = total
+	}
+
+	return map[string]interface{}{
+		"items":    append([]interface{}(nil), items[start:end]...),
+		"page":     page,
+		"pages":    pages,
+		"total":    total,
+		"per_page": perPage,
+		"has_prev": page > 1,
+		"has_next": page < pages,
+	}, nil
+}
+
+func filterToJSON(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	kwargs, args := extractKwargs(args)
+
+	var indent interface{}
+	if len(args) > 0 {
+		indent = args[0]
+	}
+	if val, ok := kwargs["indent"]; ok {
+		indent = val
+	}
+	sortKeys := true
+	if val, ok := kwargs["sort_keys"]; ok {
+		sortKeys = isTruthyValue(val)
+	}
+
+	var buf bytes.Buffer
+	if err := encodeJSON(&buf, reflect.ValueOf(value), sortKeys); err != nil {
+		return nil, err
+	}
+
+	prefix := ""
+	switch v := indent.(type) {
+	case string:
+		prefix = v
+	case int, int64:
+		if n, ok := toInt(v); ok && n > 0 {
+			prefix = strings.Repeat(" ", n)
+		}
+	}
+	if prefix != "" {
+		var out bytes.Buffer
+		if err := json.Indent(&out, buf.Bytes(), "", prefix); err != nil {
+			return nil, err
+		}
+		return out.String(), nil
+	}
+	return buf.String(), nil
+}
+
+// encodeJSON writes value as compact JSON. Values implementing json.Marshaler
+// encode themselves. Other mappings of any key type are supported: keys are
+// stringified and, when sortKeys is set, emitted in sorted order so the
+// output is stable across renders. Without sortKeys they follow Go's map
+// iteration order, which differs between renders.
+func encodeJSON(buf *bytes.Buffer, value reflect.Value, sortKeys bool) error {
+	for value.IsValid() && (value.Kind() == reflect.Interface || value.Kind() == reflect.Ptr) {
+		if value.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		if value.Type().Implements(jsonMarshalerType) {
+			break
+		}
+		if value.Kind() == reflect.Ptr && value.Elem().Kind() != reflect.Map && value.Elem().Kind() != reflect.Slice {
+			break
+		}
+		value = value.Elem()
+	}
+	if !value.IsValid() {
+		buf.WriteString("null")
+		return nil
+	}
+	if value.Type().Implements(jsonMarshalerType) {
+		encoded, err := json.Marshal(value.Interface())
+		if err != nil {
+			return err
+		}
+		buf.Write(encoded)
+		return nil
+	}
+
+	switch value.Kind() {
+	case reflect.Map:
+		if value.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		keys := make([]string, 0, value.Len())
+		entries := make(map[string]reflect.Value, value.Len())
+		iter := value.MapRange()
+		for iter.Next() {
+			key := toString(iter.Key().Interface())
+			if _, exists := entries[key]; exists {
+				return fmt.Errorf("tojson: duplicate key %q", key)
+			}
+			keys = append(keys, key)
+			entries[key] = iter.Value()
+		}
+		if sortKeys {
+			sort.Strings(keys)
+		}
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			encoded, err := json.Marshal(key)
+			if err != nil {
+				return err
+			}
+			buf.Write(encoded)
+			buf.WriteByte(':')
+			if err := encodeJSON(buf, entries[key], sortKeys); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		return nil
+	case reflect.Slice, reflect.Array:
+		if value.Kind() == reflect.Slice && value.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			break
+		}
+		buf.WriteByte('[')
+		for i := 0; i < value.Len(); i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encodeJSON(buf, value.Index(i), sortKeys); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+	}
+
+	encoded, err := json.Marshal(value.Interface())
+	if err != nil {
+		return err
+	}
+	buf.Write(encoded)
+	return nil
+}
+
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// filterFromJSON decodes a JSON string. With use_number=true integral
+// numbers decode to int64 (or *big.Int when too large) instead of float64.
+// When default is given it is returned for malformed input instead of an
+// error.
+func filterFromJSON(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	kwargs, _ := extractKwargs(args)
+	useNumber := false
+	if val, ok := kwargs["use_number"]; ok {
+		useNumber = isTruthyValue(val)
+	}
+	fallback, hasFallback := kwargs["default"]
+
+	str := toString(value)
+	if str == "" {
+		return nil, nil
+	}
+	decoder := json.NewDecoder(strings.NewReader(str))
+	if useNumber {
+		decoder.UseNumber()
+	}
+	var result interface{}
+	err := decoder.Decode(&result)
+	if err == nil {
+		if extra := decoder.Decode(&struct{}{}); extra != io.EOF {
+			err = fmt.Errorf("invalid character after top-level value")
+		}
+	}
+	if err != nil {
+		if hasFallback {
+			return fallback, nil
+		}
+		return nil, err
+	}
+	if useNumber {
+		result = convertJSONNumbers(result)
+	}
+	return result, nil
+}
+
+// convertJSONNumbers replaces json.Number values produced by UseNumber with
+// int64, *big.Int or float64 values.
+func convertJSONNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if !strings.ContainsAny(v.String(), ".eE") {
+			if i, ok := new(big.Int).SetString(v.String(), 10); ok {
+				return i
+			}
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = convertJSONNumbers(item)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = convertJSONNumbers(item)
+		}
+		return v
+	}
+	return value
+}
+
+// filterJSONPath queries decoded JSON with a JSONPath subset such as
+// $.a.b[0].c or $.items[*].name. Paths with a wildcard return a list of
+// matches; other paths return the single match. No match yields undefined.
+func filterJSONPath(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	_, positional := extractKwargs(args)
+	if len(positional) < 1 {
+		return nil, fmt.Errorf("jsonpath filter requires a path argument")
+	}
+	path := toString(positional[0])
+	steps, wildcard, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := queryJSONPath(value, steps)
+	if len(matches) == 0 {
+		if ctx != nil && ctx.environment != nil {
+			return ctx.environment.newUndefined(path), nil
 		}
-		batches = append(batches, append([]interface{}(nil), current...))
+		return DebugUndefined{name: path}, nil
 	}
-	return batches, nil
+	if wildcard {
+		return matches, nil
+	}
+	return matches[0], nil
 }
 
-func filterToJSON(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
-	if len(args) > 0 {
-		if indentStr, ok := args[0].(string); ok && indentStr != "" {
-			data, err := json.MarshalIndent(value, "", indentStr)
-			if err != nil {
-				return nil, err
-			}
-			return string(data), nil
-		}
+func filterToYAML(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	if ctx == nil || ctx.environment == nil {
+		return nil, fmt.Errorf("toyaml requires a YAML codec; configure one with SetYAMLCodec")
 	}
-	data, err := json.Marshal(value)
+	marshal, _ := ctx.environment.YAMLCodec()
+	if marshal == nil {
+		return nil, fmt.Errorf("toyaml requires a YAML codec; configure one with SetYAMLCodec")
+	}
+	data, err := marshal(value)
 	if err != nil {
 		return nil, err
 	}
 	return string(data), nil
 }
 
-func filterFromJSON(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+func filterFromYAML(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	if ctx == nil || ctx.environment == nil {
+		return nil, fmt.Errorf("fromyaml requires a YAML codec; configure one with SetYAMLCodec")
+	}
+	_, unmarshal := ctx.environment.YAMLCodec()
+	if unmarshal == nil {
+		return nil, fmt.Errorf("fromyaml requires a YAML codec; configure one with SetYAMLCodec")
+	}
 	str := toString(value)
 	if str == "" {
 		return nil, nil
 	}
 	var result interface{}
-	if err := json.Unmarshal([]byte(str), &result); err != nil {
+	if err := unmarshal([]byte(str), &result); err != nil {
 		return nil, err
 	}
 	return result, nil
 }
 
+// filterCSVQuote quotes a single field per RFC 4180, doubling embedded quotes.
+func filterCSVQuote(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	return `"` + strings.ReplaceAll(toString(value), `"`, `""`) + `"`, nil
+}
+
+// filterToCSV renders a sequence of rows as CSV text. Fields are quoted only
+// when they contain the delimiter, quotes, or line breaks.
+func filterToCSV(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	kwargs, positional := extractKwargs(args)
+
+	delimiter := ","
+	if len(positional) > 0 {
+		delimiter = toString(positional[0])
+	}
+	if val, ok := kwargs["delimiter"]; ok {
+		delimiter = toString(val)
+	}
+	if utf8.RuneCountInString(delimiter) != 1 {
+		return nil, fmt.Errorf("tocsv delimiter must be a single character")
+	}
+
+	rows, err := sequenceToSlice(value)
+	if err != nil {
+		return nil, fmt.Errorf("tocsv expects a sequence of rows")
+	}
+
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Comma, _ = utf8.DecodeRuneInString(delimiter)
+	for _, row := range rows {
+		cells, err := sequenceToSlice(row)
+		if err != nil {
+			return nil, fmt.Errorf("tocsv expects each row to be a sequence, got %T", row)
+		}
+		record := make([]string, len(cells))
+		for i, cell := range cells {
+			record[i] = toString(cell)
+		}
+		if err := writer.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return nil, err
+	}
+	return buf.String(), nil
+}
+
 func filterRandom(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
 	items, err := sequenceToSlice(value)
 	if err != nil {
@@ -1464,13 +2950,22 @@ func filterRandom(ctx *Context, value interface{}, args ...interface{}) (interfa
 		}
 	}
 	if rnd == nil {
-		rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+		rnd = filterRandomSource(ctx)
 	}
 
 	choice := items[rnd.Intn(len(items))]
 	return choice, nil
 }
 
+// filterRandomSource returns the render-scoped generator when a context is
+// available so an environment seed applies, falling back to a clock-seeded one.
+func filterRandomSource(ctx *Context) *rand.Rand {
+	if ctx != nil {
+		return ctx.Random()
+	}
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
 func filterUrlize(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
 	text := toString(value)
 	if text == "" {
@@ -1649,7 +3144,16 @@ func filterAttr(ctx *Context, value interface{}, args ...interface{}) (interface
 	}
 
 	attrName := toString(args[0])
-	return getAttribute(value, attrName)
+	if ctx == nil {
+		return getAttribute(value, attrName)
+	}
+	result, err := ctx.ResolveAttribute(value, attrName)
+	if err != nil && IsUndefinedError(err) && ctx.environment != nil {
+		if undef := ctx.environment.newUndefined(attrName); !isStrictUndefined(undef) {
+			return undef, nil
+		}
+	}
+	return result, err
 }
 
 func filterMap(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
@@ -1672,7 +3176,10 @@ func filterMap(ctx *Context, value interface{}, args ...interface{}) (interface{
 	}
 	result := make([]interface{}, len(items))
 	for i, item := range items {
-		attr, _ := getAttribute(item, attrName)
+		attr, err := filterAttribute(ctx, item, attrName)
+		if err != nil {
+			return nil, err
+		}
 		result[i] = attr
 	}
 	return result, nil
@@ -1792,7 +3299,10 @@ func filterSelectattr(ctx *Context, value interface{}, args ...interface{}) (int
 	result := make([]interface{}, 0, len(items))
 	evaluator := NewEvaluator(ctx)
 	for _, item := range items {
-		attr, _ := getAttribute(item, attrName)
+		attr, err := filterAttribute(ctx, item, attrName)
+		if err != nil {
+			return nil, err
+		}
 
 		if testName == "" {
 			if isTruthyValue(attr) {
@@ -1859,7 +3369,10 @@ func filterRejectattr(ctx *Context, value interface{}, args ...interface{}) (int
 	result := make([]interface{}, 0, len(items))
 	evaluator := NewEvaluator(ctx)
 	for _, item := range items {
-		attr, _ := getAttribute(item, attrName)
+		attr, err := filterAttribute(ctx, item, attrName)
+		if err != nil {
+			return nil, err
+		}
 
 		if testName == "" {
 			if !isTruthyValue(attr) {
@@ -1947,12 +3460,7 @@ func testFalse(ctx *Context, value interface{}, args ...interface{}) (interface{
 }
 
 func testNumber(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
-	switch value.(type) {
-	case int, int64, float64, float32:
-		return true, nil
-	default:
-		return false, nil
-	}
+	return isNumberValue(value), nil
 }
 
 func testString(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
@@ -1964,8 +3472,11 @@ func testInteger(ctx *Context, value interface{}, args ...interface{}) (interfac
 	if value == nil {
 		return false, nil
 	}
-	if _, ok := value.(bool); ok {
+	switch v := value.(type) {
+	case bool:
 		return false, nil
+	case *big.Int:
+		return v != nil, nil
 	}
 
 	val := reflect.ValueOf(value)
@@ -1978,12 +3489,11 @@ func testInteger(ctx *Context, value interface{}, args ...interface{}) (interfac
 }
 
 func testFloat(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
-	switch value.(type) {
-	case float32, float64:
-		return true, nil
-	default:
-		return false, nil
+	if v, ok := value.(*big.Float); ok {
+		return v != nil, nil
 	}
+	kind := reflect.ValueOf(value).Kind()
+	return kind == reflect.Float32 || kind == reflect.Float64, nil
 }
 
 func testSequence(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
@@ -2071,6 +3581,9 @@ func testEscaped(ctx *Context, value interface{}, args ...interface{}) (interfac
 	if _, ok := value.(Markup); ok {
 		return true, nil
 	}
+	if _, ok := trustedTemplateString(value); ok {
+		return true, nil
+	}
 
 	type htmlRenderer interface {
 		HTML() string
@@ -2090,6 +3603,19 @@ func testModule(ctx *Context, value interface{}, args ...interface{}) (interface
 	return ok, nil
 }
 
+// testTemplateExists reports whether the environment's loader can provide
+// the named template.
+func testTemplateExists(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	if ctx == nil || ctx.environment == nil {
+		return false, nil
+	}
+	name, ok := value.(string)
+	if !ok {
+		return false, nil
+	}
+	return ctx.environment.TemplateExists(name), nil
+}
+
 func testList(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
 	if value == nil {
 		return false, nil
@@ -2149,37 +3675,115 @@ func testInTest(ctx *Context, value interface{}, args ...interface{}) (interface
 	if len(args) < 1 {
 		return false, fmt.Errorf("in test requires 1 argument")
 	}
+	return containsValue(args[0], value), nil
+}
 
-	switch container := args[0].(type) {
-	case []interface{}:
-		for _, item := range container {
-			if item == value {
-				return true, nil
-			}
+// containsValue reports whether item is in container, following Python's in
+// operator: substrings for strings, keys for mappings and elements for any
+// other sequence. Numbers compare by value, so 5 is in a list of int64s.
+func containsValue(container, item interface{}) bool {
+	switch coll := container.(type) {
+	case string:
+		if str, ok := item.(string); ok {
+			return strings.Contains(coll, str)
 		}
-	case []string:
-		if str, ok := value.(string); ok {
-			for _, item := range container {
-				if item == str {
-					return true, nil
-				}
-			}
+		if str, ok := item.(Markup); ok {
+			return strings.Contains(coll, string(str))
 		}
-	case map[interface{}]interface{}:
-		_, exists := container[value]
-		return exists, nil
+		return false
+	case Markup:
+		return containsValue(string(coll), item)
 	case map[string]interface{}:
-		if str, ok := value.(string); ok {
-			_, exists := container[str]
-			return exists, nil
+		if str, ok := item.(string); ok {
+			_, exists := coll[str]
+			return exists
 		}
-	case string:
-		if str, ok := value.(string); ok {
-			return strings.Contains(container, str), nil
+		return false
+	}
+
+	val := reflect.ValueOf(container)
+	for val.Kind() == reflect.Ptr && !val.IsNil() {
+		val = val.Elem()
+	}
+	if val.Kind() == reflect.Map {
+		if key := reflect.ValueOf(item); item != nil && key.Type().AssignableTo(val.Type().Key()) && key.Type().Comparable() {
+			if val.MapIndex(key).IsValid() {
+				return true
+			}
+		}
+		for _, key := range val.MapKeys() {
+			if itemsEqual(key.Interface(), item) {
+				return true
+			}
 		}
+		return false
 	}
 
-	return false, nil
+	items, err := sequenceToSlice(container)
+	if err != nil {
+		return false
+	}
+	for _, candidate := range items {
+		if itemsEqual(candidate, item) {
+			return true
+		}
+	}
+	return false
+}
+
+func isListKind(kind reflect.Kind) bool {
+	return kind == reflect.Slice || kind == reflect.Array
+}
+
+// reflectedNumber converts numbers of named numeric types such as
+// "type ID int" to float64.
+func reflectedNumber(value interface{}) (float64, bool) {
+	val := reflect.ValueOf(value)
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(val.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(val.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return val.Float(), true
+	}
+	return 0, false
+}
+
+// itemsEqual compares two values like the == operator without panicking on
+// uncomparable types.
+func itemsEqual(a, b interface{}) bool {
+	if eq, ok := numericEqual(a, b); ok {
+		return eq
+	}
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if fa, ok := reflectedNumber(a); ok {
+		if fb, ok := reflectedNumber(b); ok {
+			return fa == fb
+		}
+	}
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if isListKind(va.Kind()) && isListKind(vb.Kind()) {
+		if va.Len() != vb.Len() {
+			return false
+		}
+		for i := 0; i < va.Len(); i++ {
+			if !itemsEqual(va.Index(i).Interface(), vb.Index(i).Interface()) {
+				return false
+			}
+		}
+		return true
+	}
+	ta, tb := va.Type(), vb.Type()
+	if ta != tb {
+		return false
+	}
+	if ta.Comparable() {
+		return a == b
+	}
+	return reflect.DeepEqual(a, b)
 }
 
 func testFilter(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
@@ -2202,7 +3806,7 @@ func testFilter(ctx *Context, value interface{}, args ...interface{}) (interface
 			return false, nil
 		}
 	}
-	_, ok := ctx.environment.GetFilter(name)
+	_, ok := ctx.lookupFilter(name)
 	return ok, nil
 }
 
@@ -2230,6 +3834,91 @@ func testTest(ctx *Context, value interface{}, args ...interface{}) (interface{}
 	return ok, nil
 }
 
+// filterAttribute resolves attr on item for map, selectattr and rejectattr.
+// A name written with a trailing "()" such as "IsActive()" calls the
+// zero-argument method or function it names and yields the result; without
+// the parentheses the method value itself is returned. Calls are subject to
+// the sandbox method policy.
+func filterAttribute(ctx *Context, item interface{}, attr string) (interface{}, error) {
+	name := strings.TrimSuffix(attr, "()")
+	if name == attr {
+		if ctx != nil && ctx.environment != nil {
+			if resolver := ctx.environment.AttributeResolver(); resolver != nil && item != nil {
+				if value, ok, err := resolver(item, attr); err != nil || ok {
+					return value, err
+				}
+			}
+		}
+		return getAttribute(item, attr)
+	}
+	if item == nil {
+		return nil, nil
+	}
+
+	fn := reflect.ValueOf(item).MethodByName(name)
+	if !fn.IsValid() {
+		value, err := getAttribute(item, name)
+		if err != nil || value == nil {
+			return nil, err
+		}
+		fn = reflect.ValueOf(value)
+	}
+	if fn.Kind() != reflect.Func {
+		return nil, fmt.Errorf("attribute '%s' is not callable", name)
+	}
+	if fn.Type().NumIn() != 0 {
+		return nil, fmt.Errorf("'%s' cannot be called without arguments", name)
+	}
+
+	if ctx != nil {
+		ctx.mu.RLock()
+		secCtx := ctx.securityContext
+		templateName := "unknown"
+		if ctx.current != nil {
+			templateName = ctx.current.name
+		}
+		ctx.mu.RUnlock()
+		if secCtx != nil && !secCtx.CheckMethodCall(name, templateName, "filter_attribute") {
+			return nil, NewSecurityError("method_call", fmt.Sprintf("method call '%s' blocked by security policy", name), nodes.Position{}, nil)
+		}
+	}
+
+	out := fn.Call(nil)
+	switch len(out) {
+	case 0:
+		return nil, nil
+	case 2:
+		if err, ok := out[1].Interface().(error); ok && err != nil {
+			return nil, err
+		}
+	}
+	return out[0].Interface(), nil
+}
+
+// checkFilterAccess verifies that a filter named by a template value, such as
+// the key filter of sort(by=...), is allowed by the sandbox policy.
+func checkFilterAccess(ctx *Context, filterName, context string) error {
+	if ctx == nil {
+		return nil
+	}
+
+	ctx.mu.RLock()
+	secCtx := ctx.securityContext
+	templateName := "unknown"
+	if ctx.current != nil {
+		templateName = ctx.current.name
+	}
+	ctx.mu.RUnlock()
+
+	if secCtx == nil {
+		return nil
+	}
+	if !secCtx.CheckFilterAccess(filterName, templateName, context) {
+		return NewSecurityError("filter_access", fmt.Sprintf("access to filter '%s' blocked by security policy", filterName), nodes.Position{}, nil)
+	}
+	return nil
+}
+
 func checkTestAccess(ctx *Context, testName, context string) error {
 	if ctx == nil {
 		return nil
@@ -2361,6 +4050,56 @@ func testContaining(ctx *Context, value interface{}, args ...interface{}) (inter
 	return strings.Contains(toString(value), toString(args[0])), nil
 }
 
+// testHas reports whether value has the named attribute, map key or method.
+// Missing or blocked attributes yield false instead of an error.
+func testHas(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	if len(args) < 1 {
+		return false, fmt.Errorf("has test requires an attribute name")
+	}
+	if value == nil || isUndefinedValue(value) {
+		return false, nil
+	}
+
+	name := toString(args[0])
+	var attr interface{}
+	var err error
+	if ctx != nil {
+		attr, err = ctx.ResolveAttribute(value, name)
+	} else {
+		attr, err = getAttribute(value, name)
+	}
+	if err != nil {
+		return false, nil
+	}
+	return !isUndefinedValue(attr), nil
+}
+
+// testEmpty reports whether value has no elements. Undefined and none count
+// as empty; values without a length fall back to their truthiness.
+func testEmpty(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	if value == nil || isUndefinedValue(value) {
+		return true, nil
+	}
+	length, err := filterLength(ctx, value)
+	if err != nil {
+		return !isTruthyValue(value), nil
+	}
+	return length == 0, nil
+}
+
+// testOne reports whether value is a string, sequence or mapping with exactly
+// one element.
+func testOne(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+	if value == nil || isUndefinedValue(value) {
+		return false, nil
+	}
+	length, err := filterLength(ctx, value)
+	if err != nil {
+		return false, nil
+	}
+	return length == 1, nil
+}
+
 func testInfinite(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
 	if f, ok := toFloat64(value); ok {
 		return math.IsInf(f, 0), nil
@@ -2408,6 +4147,7 @@ func dictsortWithDefaults(value interface{}, args []interface{}, defaults dictso
 	caseSensitive := defaults.caseSensitive
 	by := "key"
 	reverse := defaults.reverse
+	asObjects := false
 
 	if len(args) > 0 {
 		caseSensitive = isTruthyValue(args[0])
@@ -2429,6 +4169,9 @@ func dictsortWithDefaults(value interface{}, args []interface{}, defaults dictso
 		if val, ok := kwargs["reverse"]; ok {
 			reverse = isTruthyValue(val)
 		}
+		if val, ok := kwargs["as_objects"]; ok {
+			asObjects = isTruthyValue(val)
+		}
 	}
 
 	if by == "" {
@@ -2466,8 +4209,14 @@ func dictsortWithDefaults(value interface{}, args []interface{}, defaults dictso
 		return cmp < 0
 	})
 
+	// as_objects yields {key, value} mappings, like groupby's grouper/list
+	// entries, instead of positional pairs.
 	result := make([]interface{}, len(pairs))
 	for i, pair := range pairs {
+		if asObjects {
+			result[i] = map[string]interface{}{"key": pair.key, "value": pair.value}
+			continue
+		}
 		result[i] = []interface{}{pair.key, pair.value}
 	}
 	return result, nil
@@ -2636,6 +4385,32 @@ func extractKwargs(args []interface{}) (map[string]interface{}, []interface{}) {
 	}
 }
 
+// copyMapEntries copies every entry of the map value into dst and reports
+// whether value was a map.
+func copyMapEntries(dst map[interface{}]interface{}, value interface{}) bool {
+	switch m := value.(type) {
+	case map[interface{}]interface{}:
+		for k, v := range m {
+			dst[k] = v
+		}
+		return true
+	case map[string]interface{}:
+		for k, v := range m {
+			dst[k] = v
+		}
+		return true
+	}
+	val := reflect.ValueOf(value)
+	if !val.IsValid() || val.Kind() != reflect.Map {
+		return false
+	}
+	iter := val.MapRange()
+	for iter.Next() {
+		dst[iter.Key().Interface()] = iter.Value().Interface()
+	}
+	return true
+}
+
 func toStringInterfaceMap(value interface{}) (map[string]interface{}, bool) {
 	switch m := value.(type) {
 	case map[string]interface{}:
@@ -2700,6 +4475,12 @@ func splitPreserveWhitespace(s string) []string {
 }
 
 func wrapParagraph(line string, width int, breakLongWords, breakOnHyphens bool) []string {
+	return wrapParagraphWidths(line, width, width, breakLongWords, breakOnHyphens)
+}
+
+// wrapParagraphWidths wraps line to firstWidth characters for the first
+// output line and width characters for the following ones.
+func wrapParagraphWidths(line string, firstWidth, width int, breakLongWords, breakOnHyphens bool) []string {
 	if strings.TrimSpace(line) == "" {
 		return []string{""}
 	}
@@ -2748,6 +4529,11 @@ func wrapParagraph(line string, width int, breakLongWords, breakOnHyphens bool)
 			}
 		}
 
+		lineWidth := width
+		if len(lines) == 0 {
+			lineWidth = firstWidth
+		}
+
 		curLine := make([]string, 0)
 		curLen := 0
 
@@ -2755,7 +4541,7 @@ func wrapParagraph(line string, width int, breakLongWords, breakOnHyphens bool)
 			chunk := normalised[len(normalised)-1]
 			chunkLen := utf8.RuneCountInString(chunk)
 
-			if curLen+chunkLen <= width {
+			if curLen+chunkLen <= lineWidth {
 				curLine = append(curLine, chunk)
 				curLen += chunkLen
 				normalised = normalised[:len(normalised)-1]
@@ -2766,8 +4552,8 @@ func wrapParagraph(line string, width int, breakLongWords, breakOnHyphens bool)
 
 		if len(normalised) > 0 {
 			nextChunk := normalised[len(normalised)-1]
-			if utf8.RuneCountInString(nextChunk) > width {
-				handleLongWord(&normalised, &curLine, &curLen, width, breakLongWords, breakOnHyphens)
+			if utf8.RuneCountInString(nextChunk) > lineWidth {
+				handleLongWord(&normalised, &curLine, &curLen, lineWidth, breakLongWords, breakOnHyphens)
 			}
 		}
 
@@ -3186,6 +4972,29 @@ func xmlAttrValue(value interface{}) (string, bool) {
 	}
 }
 
+// trustedTemplateString reports whether value is one of html/template's typed
+// strings, which Go code uses to mark content as already safe, and returns its
+// underlying text.
+func trustedTemplateString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case template.HTML:
+		return string(v), true
+	case template.HTMLAttr:
+		return string(v), true
+	case template.JS:
+		return string(v), true
+	case template.JSStr:
+		return string(v), true
+	case template.CSS:
+		return string(v), true
+	case template.URL:
+		return string(v), true
+	case template.Srcset:
+		return string(v), true
+	}
+	return "", false
+}
+
 func toFloat64(val interface{}) (float64, bool) {
 	if num, ok := classifyNumber(val); ok {
 		return num.asFloat64(), true
@@ -3205,9 +5014,16 @@ func toFloat64(val interface{}) (float64, bool) {
 }
 
 func toInt(val interface{}) (int, bool) {
+	if needsBigInt(val) {
+		return 0, false
+	}
 	if num, ok := classifyNumber(val); ok {
 		if num.isFloat() {
-			return int(num.asFloat64()), true
+			f := num.asFloat64()
+			if math.IsNaN(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+				return 0, false
+			}
+			return int(f), true
 		}
 		return int(num.intValue), true
 	}
@@ -3241,11 +5057,29 @@ func toString(value interface{}) string {
 		return str
 	case fmt.Stringer:
 		return v.String()
+	case float64:
+		return formatFloat(v)
+	case float32:
+		return formatFloat(widenFloat32(v))
 	default:
 		return fmt.Sprintf("%v", value)
 	}
 }
 
+// formatFloat renders a float for template output. Infinities and NaN are
+// spelled the way Python prints them: inf, -inf and nan.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	return fmt.Sprintf("%v", f)
+}
+
 func isTruthyValue(value interface{}) bool {
 	if value == nil {
 		return false
@@ -3285,6 +5119,18 @@ func getAttribute(obj interface{}, attr string) (interface{}, error) {
 	if obj == nil {
 		return nil, nil
 	}
+	if group, ok := obj.(*groupbyGroup); ok {
+		switch attr {
+		case "grouper":
+			return group.Grouper, nil
+		case "list":
+			return group.List, nil
+		case "count":
+			return group.Count, nil
+		case "aggregate":
+			return group.Aggregate, nil
+		}
+	}
 
 	val := reflect.ValueOf(obj)
 
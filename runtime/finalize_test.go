@@ -2,6 +2,7 @@ package runtime
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 	"testing"
 )
@@ -81,3 +82,64 @@ func TestFinalizeErrorPropagates(t *testing.T) {
 		t.Fatalf("expected finalize error, got nil")
 	}
 }
+
+func TestFinalizeContextFormatsByLocale(t *testing.T) {
+	env := NewEnvironment()
+	env.SetLoader(NewMapLoader(map[string]string{
+		"main.html": `{{ price }} {{ name }}{% set locale = "en" %} {{ price }}`,
+	}))
+
+	env.SetFinalizeContext(func(ctx *Context, value interface{}) (interface{}, error) {
+		price, ok := value.(float64)
+		if !ok {
+			return value, nil
+		}
+		formatted := fmt.Sprintf("%.2f", price)
+		if locale, _ := ctx.Get("locale"); locale == "de" {
+			formatted = strings.Replace(formatted, ".", ",", 1)
+		}
+		return formatted, nil
+	})
+
+	tmpl, err := env.ParseFile("main.html")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	result, err := tmpl.ExecuteToString(map[string]interface{}{
+		"price":  1234.5,
+		"name":   "widget",
+		"locale": "de",
+	})
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+
+	if result != "1234,50 widget 1234.50" {
+		t.Fatalf("expected locale-aware finalize output, got %q", result)
+	}
+}
+
+func TestSetFinalizeReplacesContextFinalize(t *testing.T) {
+	env := NewEnvironment()
+	env.SetFinalizeContext(func(ctx *Context, value interface{}) (interface{}, error) {
+		return "context", nil
+	})
+	env.SetFinalize(func(value interface{}) (interface{}, error) {
+		return "plain", nil
+	})
+
+	tmpl, err := env.ParseString(`{{ value }}`, "main.html")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	result, err := tmpl.ExecuteToString(map[string]interface{}{"value": 1})
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+
+	if result != "plain" {
+		t.Fatalf("expected the most recent finalize to win, got %q", result)
+	}
+}
@@ -100,9 +100,12 @@ func (im *ImportManager) ImportMacros(ctx *Context, templateName string, macroNa
 
 // createNamespaceFromTemplate creates a macro namespace from a template
 func (im *ImportManager) createNamespaceFromTemplate(ctx *Context, templateName string, template *Template, withContext bool) (*MacroNamespace, error) {
-	var vars map[string]interface{}
-	if withContext && ctx != nil {
-		vars = ctx.scope.All()
+	var vars, globals map[string]interface{}
+	if ctx != nil {
+		globals = ctx.RenderGlobals()
+		if withContext {
+			vars = ctx.scope.All()
+		}
 	}
 
 	im.mu.Lock()
@@ -114,7 +117,7 @@ func (im *ImportManager) createNamespaceFromTemplate(ctx *Context, templateName
 		im.mu.Unlock()
 	}()
 
-	moduleCtx := template.newModuleContext(vars)
+	moduleCtx := template.newModuleContext(vars, globals)
 	moduleCtx.SetImportManager(im)
 
 	module, err := template.makeModuleFromContext(moduleCtx)
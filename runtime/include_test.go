@@ -1,6 +1,7 @@
 package runtime
 
 import (
+	"fmt"
 	"strings"
 	"testing"
 )
@@ -77,6 +78,42 @@ func TestIncludeIgnoreMissing(t *testing.T) {
 	}
 }
 
+func TestIncludeElseFallback(t *testing.T) {
+	env := NewEnvironment()
+	env.SetLoader(NewMapLoader(map[string]string{
+		"present.html": "present",
+	}))
+
+	tests := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{"present skips else", `{% include "present.html" ignore missing %}{% else %}default{% endinclude %}`, "present"},
+		{"missing renders else", `{% include "missing.html" ignore missing %}{% else %}default {{ who }}{% endinclude %}`, "default you"},
+		{"else without ignore missing", `{% include "missing.html" %}{% else %}default{% endinclude %}`, "default"},
+		{"list falls back to else", `{% include ["a.html", "b.html"] %}{% else %}none{% endinclude %}`, "none"},
+		{"inside if", `{% if true %}{% include "missing.html" ignore missing %}{% else %}inner{% endinclude %}{% endif %}`, "inner"},
+		{"else of enclosing if", `{% if false %}{% include "present.html" %}{% else %}outer{% endif %}`, "outer"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := env.ParseString(tt.source, "main.html")
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+			result, err := tmpl.ExecuteToString(map[string]interface{}{"who": "you"})
+			if err != nil {
+				t.Fatalf("execution error: %v", err)
+			}
+			if result != tt.expected {
+				t.Fatalf("expected %q, got %q", tt.expected, result)
+			}
+		})
+	}
+}
+
 func TestIncludeTemplateListFallback(t *testing.T) {
 	env := NewEnvironment()
 	templates := map[string]string{
@@ -99,3 +136,134 @@ func TestIncludeTemplateListFallback(t *testing.T) {
 		t.Fatalf("expected fallback include, got %q", result)
 	}
 }
+
+func TestFromStringWithContextResolvesRelativeIncludes(t *testing.T) {
+	env := NewEnvironment()
+	env.SetLoader(NewMapLoader(map[string]string{
+		"pages/partial.html": `[{{ name }}{% include "./nested.html" %}]`,
+		"pages/nested.html":  `!`,
+		"macros.html":        `{% macro hello(n) %}hi {{ n }}{% endmacro %}`,
+		"partial.html":       `wrong`,
+		"layouts/base.html":  `<{% block body %}{% endblock %}>`,
+	}))
+
+	tmpl, err := env.FromStringWithContext(`{% include "./partial.html" %}{% from "../macros.html" import hello %} {{ hello(name) }}`, "pages/index.html")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	out, err := tmpl.ExecuteToString(map[string]interface{}{"name": "Ada"})
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	if out != "[Ada!] hi Ada" {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	tmpl, err = env.FromStringWithContext(`{% extends "../layouts/base.html" %}{% block body %}{% include "./nested.html" %}{% endblock %}`, "pages/index.html")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	out, err = tmpl.ExecuteToString(nil)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	if out != "<!>" {
+		t.Fatalf("unexpected extends output %q", out)
+	}
+
+	tmpl, err = env.FromString(`{% include "./partial.html" %}`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	out, err = tmpl.ExecuteToString(nil)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	if out != "wrong" {
+		t.Fatalf("expected FromString to resolve against the loader root, got %q", out)
+	}
+}
+
+func TestIncludeWithContextOnly(t *testing.T) {
+	env := NewEnvironment()
+	env.SetLoader(NewMapLoader(map[string]string{
+		"partial.html": `{{ a }}|{{ b }}|{{ secret is defined }}|{{ item|default('none') }}`,
+		"main.html":    `{% for item in [1] %}{% include "partial.html" with context only a, b=a ~ "!" %}{% endfor %}`,
+		"loop.html":    `{% for item in [7] %}{% include "partial.html" only item %}{% endfor %}`,
+	}))
+
+	vars := map[string]interface{}{"a": "x", "b": "y", "secret": "s"}
+	tmpl, err := env.ParseFile("main.html")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	out, err := tmpl.ExecuteToString(vars)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	if out != "x|x!|false|none" {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	tmpl, err = env.ParseFile("loop.html")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	out, err = tmpl.ExecuteToString(vars)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	if out != "||false|7" {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	if _, err := env.ParseString(`{% include "partial.html" without context only a %}`, "bad"); err == nil {
+		t.Fatal("expected only to be rejected without context")
+	}
+}
+
+type countingMapLoader struct {
+	*MapLoader
+	loads int
+}
+
+func (l *countingMapLoader) Load(name string) (string, error) {
+	l.loads++
+	return l.MapLoader.Load(name)
+}
+
+func TestTemplateExists(t *testing.T) {
+	env := NewEnvironment()
+	loader := &countingMapLoader{MapLoader: NewMapLoader(map[string]string{"partial.html": "p"})}
+	env.SetLoader(loader)
+
+	source := `{% if 'partial.html' is template_exists %}yes{% endif %}|` +
+		`{% if 'missing.html' is template_exists %}yes{% else %}no{% endif %}|` +
+		`{{ template_exists('missing.html') }}|{{ template_exists('partial.html') }}`
+	out, err := ExecuteToStringWithEnvironment(env, source, nil)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if out != "yes|no|false|true" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+
+	// partial.html is loaded twice; the second missing.html check is cached.
+	if loader.loads != 3 {
+		t.Fatalf("expected 3 loader calls, got %d", loader.loads)
+	}
+	if _, err := env.GetTemplate("partial.html"); err != nil {
+		t.Fatalf("GetTemplate error: %v", err)
+	}
+	loads := loader.loads
+	if !env.TemplateExists("partial.html") || loader.loads != loads {
+		t.Fatalf("expected cached template to exist without loading")
+	}
+
+	for i := 0; i < maxMissingTemplates+10; i++ {
+		env.TemplateExists(fmt.Sprintf("missing-%d.html", i))
+	}
+	if n := len(env.missingTemplates); n > maxMissingTemplates {
+		t.Fatalf("expected at most %d remembered missing templates, got %d", maxMissingTemplates, n)
+	}
+}
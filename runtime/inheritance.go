@@ -79,7 +79,7 @@ func (ir *InheritanceResolver) ResolveInheritance(tmpl *Template) (*InheritanceC
 	context := NewInheritanceContext(tmpl)
 
 	// Walk through the inheritance chain to understand the structure
-	err := ir.resolveInheritanceChain(tmpl.AST(), context, make(map[string]bool))
+	err := ir.resolveInheritanceChain(tmpl.AST(), tmpl.loadPath(), context, make(map[string]bool))
 	if err != nil {
 		return nil, err
 	}
@@ -88,7 +88,7 @@ func (ir *InheritanceResolver) ResolveInheritance(tmpl *Template) (*InheritanceC
 }
 
 // resolveInheritanceChain recursively resolves the inheritance chain
-func (ir *InheritanceResolver) resolveInheritanceChain(ast *nodes.Template, context *InheritanceContext, visited map[string]bool) error {
+func (ir *InheritanceResolver) resolveInheritanceChain(ast *nodes.Template, name string, context *InheritanceContext, visited map[string]bool) error {
 	// Find extends statement
 	var extendsNode *nodes.Extends
 
@@ -114,6 +114,7 @@ func (ir *InheritanceResolver) resolveInheritanceChain(ast *nodes.Template, cont
 	if !ok {
 		return NewError(ErrorTypeTemplate, "extends template name must be a string", extendsNode.GetPosition(), extendsNode)
 	}
+	parentName = ir.environment.resolveRelativeName(parentName, name)
 
 	// Check for circular dependencies
 	if visited[parentName] {
@@ -128,7 +129,7 @@ func (ir *InheritanceResolver) resolveInheritanceChain(ast *nodes.Template, cont
 	}
 
 	// Recursively resolve parent inheritance
-	err = ir.resolveInheritanceChain(parent.AST(), context, visited)
+	err = ir.resolveInheritanceChain(parent.AST(), parentName, context, visited)
 	if err != nil {
 		return err
 	}
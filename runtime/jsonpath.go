@@ -0,0 +1,152 @@
+package runtime
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonPathStep is one segment of a parsed JSONPath expression: a member
+// name, an array index, or a wildcard matching every member or element.
+type jsonPathStep struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// parseJSONPath parses the supported JSONPath subset: a leading "$", dotted
+// members (.name), bracketed members (['name'] or ["name"]), array indexes
+// ([0], negative indexes count from the end) and wildcards (.* or [*]).
+// It reports whether any step is a wildcard.
+func parseJSONPath(path string) ([]jsonPathStep, bool, error) {
+	rest := strings.TrimSpace(path)
+	if strings.HasPrefix(rest, "$") {
+		rest = rest[1:]
+	} else if rest != "" && rest[0] != '.' && rest[0] != '[' {
+		rest = "." + rest
+	}
+
+	var steps []jsonPathStep
+	wildcard := false
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			name := rest[:end]
+			rest = rest[end:]
+			if name == "" {
+				return nil, false, fmt.Errorf("empty member name in JSONPath %q", path)
+			}
+			if name == "*" {
+				steps = append(steps, jsonPathStep{wildcard: true})
+				wildcard = true
+				continue
+			}
+			steps = append(steps, jsonPathStep{key: name})
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, false, fmt.Errorf("unterminated bracket in JSONPath %q", path)
+			}
+			inner := strings.TrimSpace(rest[1:end])
+			rest = rest[end+1:]
+			switch {
+			case inner == "*":
+				steps = append(steps, jsonPathStep{wildcard: true})
+				wildcard = true
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				steps = append(steps, jsonPathStep{key: inner[1 : len(inner)-1]})
+			default:
+				index, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, false, fmt.Errorf("invalid index %q in JSONPath %q", inner, path)
+				}
+				steps = append(steps, jsonPathStep{index: index, isIndex: true})
+			}
+		default:
+			return nil, false, fmt.Errorf("unexpected %q in JSONPath %q", rest[0], path)
+		}
+	}
+	return steps, wildcard, nil
+}
+
+// queryJSONPath applies steps to value and returns every match in document
+// order. Map members are visited in sorted key order for wildcards.
+func queryJSONPath(value interface{}, steps []jsonPathStep) []interface{} {
+	current := []interface{}{value}
+	for _, step := range steps {
+		var next []interface{}
+		for _, item := range current {
+			next = append(next, jsonPathChildren(item, step)...)
+		}
+		if len(next) == 0 {
+			return nil
+		}
+		current = next
+	}
+	return current
+}
+
+func jsonPathChildren(value interface{}, step jsonPathStep) []interface{} {
+	val := reflect.ValueOf(value)
+	for val.IsValid() && (val.Kind() == reflect.Interface || val.Kind() == reflect.Ptr) {
+		if val.IsNil() {
+			return nil
+		}
+		val = val.Elem()
+	}
+	if !val.IsValid() {
+		return nil
+	}
+
+	switch val.Kind() {
+	case reflect.Map:
+		if step.wildcard {
+			keys := val.MapKeys()
+			sort.SliceStable(keys, func(i, j int) bool {
+				return compareValues(keys[i].Interface(), keys[j].Interface(), true) < 0
+			})
+			children := make([]interface{}, len(keys))
+			for i, key := range keys {
+				children[i] = val.MapIndex(key).Interface()
+			}
+			return children
+		}
+		keyKind := val.Type().Key().Kind()
+		if step.isIndex || (keyKind != reflect.String && keyKind != reflect.Interface) {
+			return nil
+		}
+		entry := val.MapIndex(reflect.ValueOf(step.key).Convert(val.Type().Key()))
+		if !entry.IsValid() {
+			return nil
+		}
+		return []interface{}{entry.Interface()}
+	case reflect.Slice, reflect.Array:
+		if step.wildcard {
+			children := make([]interface{}, val.Len())
+			for i := range children {
+				children[i] = val.Index(i).Interface()
+			}
+			return children
+		}
+		if !step.isIndex {
+			return nil
+		}
+		index := step.index
+		if index < 0 {
+			index += val.Len()
+		}
+		if index < 0 || index >= val.Len() {
+			return nil
+		}
+		return []interface{}{val.Index(index).Interface()}
+	}
+	return nil
+}
@@ -144,6 +144,32 @@ func TestLoopCycle(t *testing.T) {
 	}
 }
 
+func TestLoopCycleListArgument(t *testing.T) {
+	env := NewEnvironment()
+	templates := map[string]string{
+		"loop.html": `{% for x in items %}{{ loop.cycle(classes) }}-{{ loop.cycle(*classes) }}-{{ loop.cycle('x', 'y') }}-{{ loop.cycle(classes) }} {% endfor %}`,
+	}
+	env.SetLoader(NewMapLoader(templates))
+
+	tmpl, err := env.ParseFile("loop.html")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	result, err := tmpl.ExecuteToString(map[string]interface{}{
+		"items":   []int{1, 2, 3, 4},
+		"classes": []string{"a", "b", "c"},
+	})
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+
+	expected := "a-a-x-a b-b-y-b c-c-x-c a-a-y-a"
+	if strings.TrimSpace(result) != expected {
+		t.Fatalf("expected %q, got %q", expected, strings.TrimSpace(result))
+	}
+}
+
 func TestLoopCycleRequiresArguments(t *testing.T) {
 	env := NewEnvironment()
 	templates := map[string]string{
@@ -165,6 +191,65 @@ func TestLoopCycleRequiresArguments(t *testing.T) {
 	}
 }
 
+func TestCyclerMatchesLoopCycle(t *testing.T) {
+	vars := map[string]interface{}{
+		"items":   []int{1, 2, 3, 4, 5},
+		"classes": []string{"a", "b", "c"},
+	}
+
+	tests := []struct {
+		loop   string
+		cycler string
+	}{
+		{
+			`{% for x in items %}{{ loop.cycle('odd', 'even') }} {% endfor %}`,
+			`{% set c = cycler('odd', 'even') %}{% for x in items %}{{ c.next() }} {% endfor %}`,
+		},
+		{
+			`{% for x in items %}{{ loop.cycle(classes) }} {% endfor %}`,
+			`{% set c = cycler(classes) %}{% for x in items %}{{ c.next() }} {% endfor %}`,
+		},
+	}
+
+	for _, tt := range tests {
+		fromLoop, err := ExecuteToString(tt.loop, vars)
+		if err != nil {
+			t.Fatalf("loop.cycle error: %v", err)
+		}
+		fromCycler, err := ExecuteToString(tt.cycler, vars)
+		if err != nil {
+			t.Fatalf("cycler error: %v", err)
+		}
+		if fromLoop != fromCycler {
+			t.Fatalf("cycler produced %q, loop.cycle produced %q", fromCycler, fromLoop)
+		}
+	}
+
+	out, err := ExecuteToString(`{% set c = cycler(classes) %}{{ c.current }}{{ c.next() }}{{ c.current }}{% do c.reset() %}{{ c.current }}`, vars)
+	if err != nil {
+		t.Fatalf("cycler error: %v", err)
+	}
+	if out != "aaba" {
+		t.Fatalf("expected cycler current to follow next and reset, got %q", out)
+	}
+
+	out, err = ExecuteToString(`{% set c = cycler(classes) %}{{ c.current() }}{% do c.next() %}{{ c.current() }}|{{ c.current == 'b' }}`, vars)
+	if err != nil {
+		t.Fatalf("cycler current() error: %v", err)
+	}
+	if out != "ab|true" {
+		t.Fatalf("expected current() call form to keep working, got %q", out)
+	}
+
+	out, err = ExecuteToString(`{% set c = cycler(classes) %}{{ c.current() }}{% do c.next() %}{{ c.current() }}|{% set cur = c.current %}{% do c.next() %}{{ cur }}`, vars)
+	if err != nil {
+		t.Fatalf("cycler current() error: %v", err)
+	}
+	if out != "ab|b" {
+		t.Fatalf("expected current() call form to keep working, got %q", out)
+	}
+}
+
 func TestLoopChanged(t *testing.T) {
 	env := NewEnvironment()
 	templates := map[string]string{
@@ -219,3 +304,96 @@ func TestLoopDepthInNestedLoops(t *testing.T) {
 		t.Fatalf("expected %q, got %q", expected, strings.TrimSpace(result))
 	}
 }
+
+func TestLoopPrevNextItemUndefinedAtBoundaries(t *testing.T) {
+	env := NewEnvironment()
+	templates := map[string]string{
+		"loop.html": `{% for x in items %}{{ loop.previtem is defined }}/{{ loop.previtem|default('^') }}/{{ loop.nextitem|default('$') }} {% endfor %}`,
+	}
+	env.SetLoader(NewMapLoader(templates))
+
+	tmpl, err := env.ParseFile("loop.html")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	result, err := tmpl.ExecuteToString(map[string]interface{}{"items": []int{1, 2, 3}})
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+
+	expected := "false/^/2 true/1/3 true/2/$"
+	if strings.TrimSpace(result) != expected {
+		t.Fatalf("expected %q, got %q", expected, strings.TrimSpace(result))
+	}
+}
+
+func TestLoopPrevItemStrictUndefined(t *testing.T) {
+	env := NewEnvironment()
+	env.SetUndefinedFactory(func(name string) undefinedType {
+		return StrictUndefined{name: name}
+	})
+
+	result, err := ExecuteToStringWithEnvironment(env, `{% for x in items %}{{ loop.previtem is defined }}{% endfor %}`, map[string]interface{}{"items": []int{1, 2}})
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	if result != "falsetrue" {
+		t.Fatalf("expected %q, got %q", "falsetrue", result)
+	}
+
+	if _, err := ExecuteToStringWithEnvironment(env, `{% for x in items %}{{ loop.previtem }}{% endfor %}`, map[string]interface{}{"items": []int{1}}); err == nil {
+		t.Fatal("expected strict undefined previtem to fail when rendered")
+	}
+}
+
+func TestForLoopAssignmentsDoNotLeak(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{
+			name:     "flag set inside loop",
+			template: `{% set found = false %}{% for x in items %}{% if x == 2 %}{% set found = true %}{% endif %}{% endfor %}{{ found }}`,
+			expected: "false",
+		},
+		{
+			name:     "new variable set inside loop",
+			template: `{% for x in items %}{% set inner = x %}{% endfor %}{{ inner is defined }}`,
+			expected: "false",
+		},
+		{
+			name:     "assignments persist across iterations",
+			template: `{% for x in items %}{{ acc is defined }},{% set acc = x %}{% endfor %}`,
+			expected: "false,true,true,",
+		},
+		{
+			name:     "loop target does not leak",
+			template: `{% for x in items %}{% endfor %}{{ x is defined }}`,
+			expected: "false",
+		},
+		{
+			name:     "else branch of empty loop",
+			template: `{% for x in [] %}{% else %}{% set y = 1 %}{% endfor %}{{ y is defined }}`,
+			expected: "false",
+		},
+		{
+			name:     "namespace carries state out",
+			template: `{% set ns = namespace(found=false) %}{% for x in items %}{% if x == 2 %}{% set ns.found = true %}{% endif %}{% endfor %}{{ ns.found }}`,
+			expected: "true",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ExecuteToString(tt.template, map[string]interface{}{"items": []int{1, 2, 3}})
+			if err != nil {
+				t.Fatalf("execute error: %v", err)
+			}
+			if result != tt.expected {
+				t.Fatalf("expected %q, got %q", tt.expected, result)
+			}
+		})
+	}
+}
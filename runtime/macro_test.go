@@ -760,3 +760,69 @@ func TestMacroComplexScenario(t *testing.T) {
 		t.Error("Expected output to contain Alice")
 	}
 }
+
+func TestTemplateMacrosAndCallMacro(t *testing.T) {
+	env := NewEnvironment()
+	env.SetAutoescape(true)
+
+	tmpl, err := env.ParseString(`{% macro button(label, kind='primary') %}<button class="{{ kind }}">{{ label }}</button>{% endmacro %}
+{% macro panel(title) %}<section><h2>{{ title }}</h2>{{ caller() }}</section>{% endmacro %}
+{% set not_a_macro = 1 %}`, "components.html")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	macros := tmpl.Macros()
+	if len(macros) != 2 || macros["button"] == nil || macros["panel"] == nil {
+		t.Fatalf("expected button and panel macros, got %v", macros)
+	}
+
+	out, err := tmpl.CallMacro("button", []interface{}{"<Save>"}, map[string]interface{}{"kind": "danger"})
+	if err != nil {
+		t.Fatalf("CallMacro error: %v", err)
+	}
+	if out != `<button class="danger">&lt;Save&gt;</button>` {
+		t.Fatalf("unexpected button output: %q", out)
+	}
+
+	out, err = tmpl.CallMacro("panel", []interface{}{"Info"}, map[string]interface{}{
+		"caller": Markup("<p>body</p>"),
+	})
+	if err != nil {
+		t.Fatalf("CallMacro with caller error: %v", err)
+	}
+	if out != `<section><h2>Info</h2><p>body</p></section>` {
+		t.Fatalf("unexpected panel output: %q", out)
+	}
+
+	out, err = tmpl.CallMacro("panel", []interface{}{"Dynamic"}, map[string]interface{}{
+		"caller": func(ctx *Context, args ...interface{}) (interface{}, error) {
+			return "a < b", nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("CallMacro with function caller error: %v", err)
+	}
+	if out != `<section><h2>Dynamic</h2>a &lt; b</section>` {
+		t.Fatalf("unexpected panel output: %q", out)
+	}
+
+	if _, err := tmpl.CallMacro("missing", nil, nil); err == nil || !strings.Contains(err.Error(), "macro 'missing' not found") {
+		t.Fatalf("expected missing macro error, got %v", err)
+	}
+
+	var logged error
+	env.SetErrorLogger(func(err error, templateName string, pos nodes.Position) {
+		logged = err
+	})
+	broken, err := env.ParseString(`{% macro ok() %}ok{% endmacro %}{{ raise('broken library') }}`, "broken.html")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if macros := broken.Macros(); macros != nil {
+		t.Fatalf("expected no macros from a failing module, got %v", macros)
+	}
+	if logged == nil || !strings.Contains(logged.Error(), "broken library") {
+		t.Fatalf("expected Macros to log the module error, got %v", logged)
+	}
+}
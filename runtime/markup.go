@@ -0,0 +1,85 @@
+package runtime
+
+import (
+	"html"
+	"html/template"
+	"strings"
+)
+
+// Markup represents a string that should not be HTML-escaped
+type Markup string
+
+// NewMarkup marks s as safe HTML without escaping it. Only use it for content
+// that is known to be trusted.
+func NewMarkup(s string) Markup {
+	return Markup(s)
+}
+
+// Escape converts value to Markup, HTML-escaping it unless it is already safe.
+// Markup and html/template typed strings are passed through unchanged, which
+// mirrors MarkupSafe's escape-once semantics.
+func Escape(value interface{}) Markup {
+	return escapeMarkup(nil, value)
+}
+
+// escapeMarkup is Escape using the escape function of ctx's environment (see
+// Environment.SetEscapeFunc). A nil ctx uses the default HTML escaping.
+func escapeMarkup(ctx *Context, value interface{}) Markup {
+	if markup, ok := value.(Markup); ok {
+		return markup
+	}
+	if trusted, ok := trustedTemplateString(value); ok {
+		return Markup(trusted)
+	}
+	if ctx != nil && ctx.environment != nil {
+		return Markup(ctx.environment.escape(value))
+	}
+	return Markup(template.HTMLEscapeString(toString(value)))
+}
+
+// Escape returns m unchanged. Markup is already safe, so escaping it again is a
+// no-op rather than double-escaping its entities.
+func (m Markup) Escape() Markup {
+	return m
+}
+
+// Unescape converts HTML entities back to their characters and returns plain text.
+func (m Markup) Unescape() string {
+	return html.UnescapeString(string(m))
+}
+
+// Striptags removes markup tags, unescapes entities, and collapses runs of
+// whitespace into single spaces, returning plain text.
+func (m Markup) Striptags() string {
+	var result strings.Builder
+	inTag := false
+	for _, r := range string(m) {
+		switch {
+		case r == '<':
+			inTag = true
+		case r == '>':
+			inTag = false
+		case !inTag:
+			result.WriteRune(r)
+		}
+	}
+	return strings.Join(strings.Fields(html.UnescapeString(result.String())), " ")
+}
+
+// Concat appends other to m. Plain values are escaped before being joined so
+// the result stays safe, matching MarkupSafe's Markup.__add__. Like Escape it
+// uses the default HTML escaping; `+` in templates uses the environment's
+// escape function.
+func (m Markup) Concat(other interface{}) Markup {
+	return m + Escape(other)
+}
+
+// isStringOperand reports whether value can take part in Markup concatenation.
+func isStringOperand(value interface{}) bool {
+	switch value.(type) {
+	case string, Markup:
+		return true
+	}
+	_, ok := trustedTemplateString(value)
+	return ok
+}
@@ -0,0 +1,95 @@
+package runtime
+
+import "testing"
+
+func TestMarkupHelpers(t *testing.T) {
+	if got := NewMarkup("<b>"); got != Markup("<b>") {
+		t.Fatalf("expected NewMarkup to wrap without escaping, got %q", got)
+	}
+	if got := Escape("<b>&"); got != Markup("&lt;b&gt;&amp;") {
+		t.Fatalf("unexpected escape output: %q", got)
+	}
+	if got := Escape(Markup("<b>")); got != Markup("<b>") {
+		t.Fatalf("expected Markup to pass through Escape, got %q", got)
+	}
+	if got := Markup("&lt;b&gt;").Escape(); got != Markup("&lt;b&gt;") {
+		t.Fatalf("expected Markup.Escape to be a no-op, got %q", got)
+	}
+	if got := Markup("&lt;b&gt;").Unescape(); got != "<b>" {
+		t.Fatalf("unexpected unescape output: %q", got)
+	}
+	if got := Markup("<p>Hello\n  <em>World</em> &amp; co</p>").Striptags(); got != "Hello World & co" {
+		t.Fatalf("unexpected striptags output: %q", got)
+	}
+	if got := Markup("<b>").Concat("<i>"); got != Markup("<b>&lt;i&gt;") {
+		t.Fatalf("unexpected concat output: %q", got)
+	}
+	if got := Markup("<b>").Concat(Markup("<i>")); got != Markup("<b><i>") {
+		t.Fatalf("expected Markup operands to stay unescaped, got %q", got)
+	}
+}
+
+func TestMarkupPlusOperatorUnderAutoescape(t *testing.T) {
+	env := NewEnvironment()
+	env.SetAutoescape(true)
+
+	vars := map[string]interface{}{
+		"safe":  Markup("<br>"),
+		"plain": "<i>",
+	}
+	cases := map[string]string{
+		"{{ safe + plain }}":     "<br>&lt;i&gt;",
+		"{{ plain + safe }}":     "&lt;i&gt;<br>",
+		"{{ safe + safe }}":      "<br><br>",
+		"{{ plain + plain }}":    "&lt;i&gt;&lt;i&gt;",
+		"{{ safe + 'a & b' }}":   "<br>a &amp; b",
+		"{{ (safe + plain)|e }}": "<br>&lt;i&gt;",
+	}
+	for tpl, want := range cases {
+		out, err := ExecuteToStringWithEnvironment(env, tpl, vars)
+		if err != nil {
+			t.Fatalf("execution error for %s: %v", tpl, err)
+		}
+		if out != want {
+			t.Fatalf("%s: expected %q, got %q", tpl, want, out)
+		}
+	}
+
+	if _, err := ExecuteToStringWithEnvironment(env, "{{ safe + 1 }}", vars); err == nil {
+		t.Fatal("expected error adding Markup and a number")
+	}
+}
+
+func TestConcatOperatorMarkupAware(t *testing.T) {
+	vars := map[string]interface{}{
+		"safe":  Markup("<br>"),
+		"plain": "<i>",
+	}
+
+	env := NewEnvironment()
+	env.SetAutoescape(true)
+	cases := map[string]string{
+		"{{ safe ~ plain ~ 1 }}":     "<br>&lt;i&gt;1",
+		"{{ plain ~ safe }}":         "&lt;i&gt;<br>",
+		"{{ plain ~ plain }}":        "&lt;i&gt;&lt;i&gt;",
+		"{{ (plain ~ safe)|e }}":     "&lt;i&gt;<br>",
+		"{{ 'a' ~ missing ~ safe }}": "a<br>",
+	}
+	for tpl, want := range cases {
+		out, err := ExecuteToStringWithEnvironment(env, tpl, vars)
+		if err != nil {
+			t.Fatalf("execution error for %s: %v", tpl, err)
+		}
+		if out != want {
+			t.Fatalf("%s: expected %q, got %q", tpl, want, out)
+		}
+	}
+
+	out, err := ExecuteToString("{{ safe ~ plain }}", vars)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if out != "<br><i>" {
+		t.Fatalf("expected plain concatenation without autoescape, got %q", out)
+	}
+}
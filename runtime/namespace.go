@@ -2,6 +2,7 @@ package runtime
 
 import (
 	"fmt"
+	"reflect"
 	"sync"
 )
 
@@ -53,6 +54,101 @@ func (ns *Namespace) Update(values interface{}) interface{} {
 	return nil
 }
 
+// listMethod returns a callable applying the Python list method (append,
+// extend or insert) to the list stored under name, so that
+// {% do ns.items.append(x) %} updates the namespace in place.
+func (ns *Namespace) listMethod(name, method string) func(args ...interface{}) (interface{}, error) {
+	return func(args ...interface{}) (interface{}, error) {
+		ns.mu.Lock()
+		defer ns.mu.Unlock()
+
+		current, ok := ns.values[name]
+		if !ok {
+			return nil, fmt.Errorf("namespace has no attribute '%s'", name)
+		}
+		items, ok := sliceValues(current)
+		if !ok {
+			return nil, fmt.Errorf("'%T' object has no attribute '%s'", current, method)
+		}
+		updated, err := applyListMethod(items, method, args)
+		if err != nil {
+			return nil, err
+		}
+		ns.values[name] = updated
+		return nil, nil
+	}
+}
+
+// isListMethod reports whether name is a list method that mutates a
+// namespace attribute.
+func isListMethod(name string) bool {
+	switch name {
+	case "append", "extend", "insert":
+		return true
+	}
+	return false
+}
+
+// applyListMethod returns items updated by the named list method. Insert
+// clamps out-of-range indexes and counts negative ones from the end, matching
+// Python's list.insert.
+func applyListMethod(items []interface{}, method string, args []interface{}) ([]interface{}, error) {
+	switch method {
+	case "append":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("append() takes exactly one argument (%d given)", len(args))
+		}
+		return append(items, args[0]), nil
+	case "extend":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("extend() takes exactly one argument (%d given)", len(args))
+		}
+		extra, ok := sliceValues(args[0])
+		if !ok {
+			return nil, fmt.Errorf("extend() expects a sequence, got %T", args[0])
+		}
+		return append(items, extra...), nil
+	case "insert":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("insert() takes exactly 2 arguments (%d given)", len(args))
+		}
+		idx, ok := toInt(args[0])
+		if !ok {
+			return nil, fmt.Errorf("insert() index must be an integer, got %T", args[0])
+		}
+		if idx < 0 {
+			idx += len(items)
+			if idx < 0 {
+				idx = 0
+			}
+		}
+		if idx > len(items) {
+			idx = len(items)
+		}
+		items = append(items, nil)
+		copy(items[idx+1:], items[idx:])
+		items[idx] = args[1]
+		return items, nil
+	}
+	return nil, fmt.Errorf("unknown list method '%s'", method)
+}
+
+// sliceValues copies the elements of a slice or array into a []interface{}.
+func sliceValues(value interface{}) ([]interface{}, bool) {
+	if value == nil {
+		return nil, false
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+	items := make([]interface{}, rv.Len())
+	for i := range items {
+		items[i] = rv.Index(i).Interface()
+	}
+	return items, true
+}
+
 // Items returns a shallow copy of the namespace values.
 func (ns *Namespace) Items() map[string]interface{} {
 	ns.mu.RLock()
@@ -2,6 +2,9 @@ package runtime
 
 import (
 	"math"
+	"math/big"
+	"reflect"
+	"strconv"
 )
 
 type numberKind int
@@ -42,7 +45,7 @@ func classifyNumber(value interface{}) (numberValue, bool) {
 	case uintptr:
 		return classifyUnsigned(uint64(v))
 	case float32:
-		return numberValue{kind: numberFloat, floatValue: float64(v)}, true
+		return numberValue{kind: numberFloat, floatValue: widenFloat32(v)}, true
 	case float64:
 		return numberValue{kind: numberFloat, floatValue: v}, true
 	case bool:
@@ -50,9 +53,55 @@ func classifyNumber(value interface{}) (numberValue, bool) {
 			return numberValue{kind: numberInteger, intValue: 1, floatValue: 1}, true
 		}
 		return numberValue{kind: numberInteger, intValue: 0, floatValue: 0}, true
-	default:
-		return numberValue{}, false
+	case *big.Int:
+		if v == nil {
+			return numberValue{}, false
+		}
+		if v.IsInt64() {
+			i := v.Int64()
+			return numberValue{kind: numberInteger, intValue: i, floatValue: float64(i)}, true
+		}
+		f, _ := new(big.Float).SetInt(v).Float64()
+		return numberValue{kind: numberFloat, floatValue: f}, true
+	case *big.Float:
+		if v == nil {
+			return numberValue{}, false
+		}
+		f, _ := v.Float64()
+		return numberValue{kind: numberFloat, floatValue: f}, true
+	case *big.Rat:
+		if v == nil {
+			return numberValue{}, false
+		}
+		f, _ := v.Float64()
+		return numberValue{kind: numberFloat, floatValue: f}, true
 	}
+
+	// Named numeric types such as `type Cents int64` are classified by kind.
+	val := reflect.ValueOf(value)
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := val.Int()
+		return numberValue{kind: numberInteger, intValue: i, floatValue: float64(i)}, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return classifyUnsigned(val.Uint())
+	case reflect.Float32:
+		return numberValue{kind: numberFloat, floatValue: widenFloat32(float32(val.Float()))}, true
+	case reflect.Float64:
+		return numberValue{kind: numberFloat, floatValue: val.Float()}, true
+	}
+	return numberValue{}, false
+}
+
+// widenFloat32 converts through the shortest decimal form of v, so a
+// float32 field holding 0.1 behaves like the literal 0.1 rather than
+// 0.10000000149011612.
+func widenFloat32(v float32) float64 {
+	f, err := strconv.ParseFloat(strconv.FormatFloat(float64(v), 'g', -1, 32), 64)
+	if err != nil {
+		return float64(v)
+	}
+	return f
 }
 
 func classifyUnsigned(v uint64) (numberValue, bool) {
@@ -80,3 +129,108 @@ func (n numberValue) isZero() bool {
 	}
 	return n.intValue == 0
 }
+
+// toBigInt converts an integral value to a *big.Int. Floats, bools and
+// non-numbers are rejected.
+func toBigInt(value interface{}) (*big.Int, bool) {
+	switch v := value.(type) {
+	case bool:
+		return nil, false
+	case *big.Int:
+		if v == nil {
+			return nil, false
+		}
+		return new(big.Int).Set(v), true
+	}
+	val := reflect.ValueOf(value)
+	switch val.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return new(big.Int).SetUint64(val.Uint()), true
+	}
+	if num, ok := classifyNumber(value); ok && !num.isFloat() {
+		return big.NewInt(num.intValue), true
+	}
+	return nil, false
+}
+
+// needsBigInt reports whether an integral value cannot be represented
+// exactly by classifyNumber's int64 form.
+func needsBigInt(value interface{}) bool {
+	switch v := value.(type) {
+	case *big.Int:
+		return v != nil
+	}
+	val := reflect.ValueOf(value)
+	switch val.Kind() {
+	case reflect.Uint, reflect.Uint64, reflect.Uintptr:
+		return val.Uint() > uint64(math.MaxInt64)
+	}
+	return false
+}
+
+// bigIntegerOperands returns both operands as big integers when both are
+// integral and at least one of them does not fit in an int64.
+func bigIntegerOperands(left, right interface{}) (*big.Int, *big.Int, bool) {
+	if !needsBigInt(left) && !needsBigInt(right) {
+		return nil, nil, false
+	}
+	l, ok := toBigInt(left)
+	if !ok {
+		return nil, nil, false
+	}
+	r, ok := toBigInt(right)
+	if !ok {
+		return nil, nil, false
+	}
+	return l, r, true
+}
+
+// normalizeBigInt returns v as an int64 when it fits, keeping integer
+// results in the same form as ordinary arithmetic.
+func normalizeBigInt(v *big.Int) interface{} {
+	if v.IsInt64() {
+		return v.Int64()
+	}
+	return v
+}
+
+// bigIntegerArithmetic applies an integer operator exactly. Division and
+// modulo floor towards negative infinity, as in Python.
+func bigIntegerArithmetic(op string, l, r *big.Int) interface{} {
+	switch op {
+	case "+":
+		return normalizeBigInt(new(big.Int).Add(l, r))
+	case "-":
+		return normalizeBigInt(new(big.Int).Sub(l, r))
+	case "*":
+		return normalizeBigInt(new(big.Int).Mul(l, r))
+	case "//", "%":
+		q, m := new(big.Int).QuoRem(l, r, new(big.Int))
+		if m.Sign() != 0 && m.Sign() != r.Sign() {
+			q.Sub(q, big.NewInt(1))
+			m.Add(m, r)
+		}
+		if op == "//" {
+			return normalizeBigInt(q)
+		}
+		return normalizeBigInt(m)
+	}
+	return nil
+}
+
+// addInt and subtractInt report false when the int64 result overflows.
+func addInt(a, b int64) (int64, bool) {
+	sum := a + b
+	if (b > 0 && sum < a) || (b < 0 && sum > a) {
+		return 0, false
+	}
+	return sum, true
+}
+
+func subtractInt(a, b int64) (int64, bool) {
+	diff := a - b
+	if (b > 0 && diff > a) || (b < 0 && diff < a) {
+		return 0, false
+	}
+	return diff, true
+}
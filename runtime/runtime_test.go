@@ -2,7 +2,10 @@ package runtime
 
 import (
 	"fmt"
+	"math"
+	"math/big"
 	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/deicod/gojinja/parser"
@@ -122,6 +125,48 @@ func TestBasicRendering(t *testing.T) {
 			},
 			expected: "12 12 2.5 9",
 		},
+		{
+			name:     "unsigned and float32 operands",
+			template: "{{ u + f }} {{ u - 2 }} {{ u * 2 }} {{ u // 3 }} {{ u % 3 }} {{ f * 2 }}",
+			ctx:      map[string]interface{}{"u": uint64(10), "f": float32(0.5)},
+			expected: "10.5 8 20 3 1 1",
+		},
+		{
+			name:     "big integer arithmetic stays exact",
+			template: "{{ max + 1 }} {{ big * 3 }} {{ big - big }} {{ -big // 7 }} {{ big % 7 }} {{ max > big }} {{ max + 1 == max }}",
+			ctx: map[string]interface{}{
+				"max": uint64(math.MaxUint64),
+				"big": new(big.Int).Lsh(big.NewInt(1), 70),
+			},
+			expected: "18446744073709551616 3541774862152233910272 0 -168655945816773043347 2 false false",
+		},
+		{
+			name:     "int64 overflow promotes to big integers",
+			template: "{{ n + 1 }} {{ n * 2 }} {{ -n - 2 }}",
+			ctx:      map[string]interface{}{"n": int64(math.MaxInt64)},
+			expected: "9223372036854775808 18446744073709551614 -9223372036854775809",
+		},
+		{
+			name:     "float32 struct fields",
+			template: "{{ item.Price + 0.2 }} {{ item.Price * 3 }} {{ -item.Price }} {{ item.Price == 0.1 }} {{ item.Price > 0.1 }} {{ [item.Price, item.Qty]|sum }} {{ item.Price|float }} {{ item.Qty|int }}",
+			ctx: map[string]interface{}{"item": struct {
+				Price float32
+				Qty   float32
+			}{Price: 0.1, Qty: 2.5}},
+			expected: "0.30000000000000004 0.30000000000000004 -0.1 true false 2.6 0.1 2",
+		},
+		{
+			name:     "float32 values print their shortest form",
+			template: "{{ p }} {{ item.Price }} {{ p ~ '' }} {{ inf }}",
+			ctx: map[string]interface{}{
+				"p":   float32(0.1),
+				"inf": float32(math.Inf(-1)),
+				"item": struct {
+					Price float32
+				}{Price: 19.99},
+			},
+			expected: "0.1 19.99 0.1 -inf",
+		},
 		{
 			name:     "string repetition with unsigned",
 			template: "{{ 'ha' * repeat }}",
@@ -134,6 +179,33 @@ func TestBasicRendering(t *testing.T) {
 			ctx:      nil,
 			expected: "0.5",
 		},
+		{
+			name:     "true division yields floats",
+			template: "{{ (4 / 2) is float }} {{ 4 / 2 }} {{ 5 / 2 }} {{ (4 // 2) is integer }}",
+			ctx:      nil,
+			expected: "true 2 2.5 true",
+		},
+		{
+			name:     "division by infinity",
+			template: "{{ 1 / inf }} {{ -1 / inf }} {{ (inf / 2) == inf }} {{ (1 / nan) == (1 / nan) }}",
+			ctx:      map[string]interface{}{"inf": math.Inf(1), "nan": math.NaN()},
+			expected: "0 -0 true false",
+		},
+		{
+			name:     "integer power",
+			template: "{{ 2 ** 10 }} {{ 2 ** 62 }} {{ (-3) ** 3 }} {{ 2 ** 0.5 }}",
+			ctx:      nil,
+			expected: "1024 4611686018427387904 -27 1.4142135623730951",
+		},
+		{
+			name:     "integer power promotes to big integers",
+			template: "{{ 2 ** 64 }} {{ big ** 2 }} {{ max ** 1 }} {{ (-2) ** 63 }} {{ 1 ** big }} {{ max ** -1 > 0 }}",
+			ctx: map[string]interface{}{
+				"max": uint64(math.MaxUint64),
+				"big": new(big.Int).Lsh(big.NewInt(1), 70),
+			},
+			expected: "18446744073709551616 1393796574908163946345982392040522594123776 18446744073709551615 -9223372036854775808 1 true",
+		},
 		{
 			name:     "string concatenation",
 			template: "{{ 'Hello' + ' ' + 'World' }}",
@@ -235,6 +307,24 @@ func TestFilters(t *testing.T) {
 			ctx:      nil,
 			expected: "Hello World",
 		},
+		{
+			name:     "title filter with apostrophe",
+			template: "{{ \"don't stop\"|title }}",
+			ctx:      nil,
+			expected: "Don't Stop",
+		},
+		{
+			name:     "title filter lowercases rest of word",
+			template: "{{ 'FOO  bar\tÉLAN'|title }}",
+			ctx:      nil,
+			expected: "Foo  Bar\tÉlan",
+		},
+		{
+			name:     "title filter after hyphens and brackets",
+			template: "{{ 'foo-bar (baz) [qUX] {x} <y>'|title }}",
+			ctx:      nil,
+			expected: "Foo-Bar (Baz) [Qux] {X} <Y>",
+		},
 		{
 			name:     "trim filter",
 			template: "{{ '  hello  '|trim }}",
@@ -467,6 +557,12 @@ func TestErrorHandling(t *testing.T) {
 			ctx:      nil,
 			contains: "division by zero",
 		},
+		{
+			name:     "integer power overflow",
+			template: "{{ 2 ** 100000 }}",
+			ctx:      nil,
+			contains: "integer overflow",
+		},
 		{
 			name:     "unknown filter",
 			template: "{{ 'hello'|unknown_filter }}",
@@ -1097,6 +1193,314 @@ func TestComplexTemplate(t *testing.T) {
 	}
 }
 
+func TestParserConfigInvalidatedBySettings(t *testing.T) {
+	env := NewEnvironment()
+
+	first := env.parserConfig()
+	if env.parserConfig() != first {
+		t.Fatal("expected parser config to be reused between parses")
+	}
+
+	out, err := ExecuteToStringWithEnvironment(env, "{% if true %}\nx{% endif %}", nil)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	if out != "\nx" {
+		t.Fatalf("expected untrimmed output, got %q", out)
+	}
+
+	env.SetTrimBlocks(true)
+	if env.parserConfig() == first {
+		t.Fatal("expected SetTrimBlocks to invalidate the parser config")
+	}
+
+	out, err = ExecuteToStringWithEnvironment(env, "{% if true %}\nx{% endif %}", nil)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	if out != "x" {
+		t.Fatalf("expected trimmed output after SetTrimBlocks, got %q", out)
+	}
+
+	cfg := env.parserConfig()
+	env.SetLineStatementPrefix("#")
+	if env.parserConfig() == cfg || env.parserConfig().LineStatementPrefix != "#" {
+		t.Fatal("expected SetLineStatementPrefix to refresh the parser config")
+	}
+}
+
+type coercionCalls struct{}
+
+func (coercionCalls) Add64(a, b int64) int64                  { return a + b }
+func (coercionCalls) Scale(f float64) float64                 { return f * 1.5 }
+func (coercionCalls) Greet(name string) string                { return "hi " + name }
+func (coercionCalls) Join(sep string, parts ...string) string { return strings.Join(parts, sep) }
+
+func TestCallFunctionCoercesArguments(t *testing.T) {
+	vars := map[string]interface{}{"c": coercionCalls{}, "two": 2.0, "half": 1.5}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{ c.Add64(1, 2) }}", "3"},
+		{"{{ c.Add64('40', 2) }}", "42"},
+		{"{{ c.Add64(two, 1) }}", "3"},
+		{"{{ c.Scale(2) }}", "3"},
+		{"{{ c.Greet('ann') }}", "hi ann"},
+		{"{{ c.Greet(1) }}", "hi 1"},
+		{"{{ c.Join('-', 'a', 'b') }}", "a-b"},
+	}
+	for _, tt := range tests {
+		result, err := ExecuteToString(tt.template, vars)
+		if err != nil {
+			t.Fatalf("%s: execute error: %v", tt.template, err)
+		}
+		if result != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, result)
+		}
+	}
+
+	failures := []struct {
+		template string
+		contains string
+	}{
+		{"{{ c.Add64('x', 2) }}", "cannot convert"},
+		{"{{ c.Add64(half, 1) }}", "losing precision"},
+		{"{{ c.Add64(1) }}", "arguments"},
+	}
+	for _, tt := range failures {
+		_, err := ExecuteToString(tt.template, vars)
+		if err == nil || !strings.Contains(err.Error(), tt.contains) {
+			t.Fatalf("%s: expected error containing %q, got %v", tt.template, tt.contains, err)
+		}
+	}
+}
+
+func TestCallFunctionReportsArityAndPanics(t *testing.T) {
+	vars := map[string]interface{}{
+		"pair":  func(a, b int) int { return a + b },
+		"boom":  func(s string) string { panic("exploded: " + s) },
+		"deref": func(p *lookupUser) string { return p.Name },
+	}
+
+	tests := []struct {
+		template string
+		contains string
+	}{
+		{"{{ pair(1) }}", "expects 2 arguments, got 1"},
+		{"{{ pair(1, 2, 3) }}", "expects 2 arguments, got 3"},
+		{"{{ boom('x') }}", "panicked: exploded: x"},
+		{"{{ deref(none) }}", "panicked"},
+	}
+	for _, tt := range tests {
+		_, err := ExecuteToString(tt.template, vars)
+		if err == nil || !strings.Contains(err.Error(), tt.contains) {
+			t.Fatalf("%s: expected error containing %q, got %v", tt.template, tt.contains, err)
+		}
+	}
+
+	if out, err := ExecuteToString("{{ pair(1, 2) }}", vars); err != nil || out != "3" {
+		t.Fatalf("expected 3, got %q (%v)", out, err)
+	}
+}
+
+type lookupUser struct {
+	Name     string
+	Password string
+}
+
+func TestAttributeAndItemLookupFallbacks(t *testing.T) {
+	vars := map[string]interface{}{
+		"list":   []string{"a", "b"},
+		"nested": [][]int{{1, 2}, {3, 4}},
+		"byID":   map[int]string{5: "five"},
+		"dict":   map[string]interface{}{"key": "value"},
+		"user":   lookupUser{Name: "ann"},
+		"ptr":    &lookupUser{Name: "bob"},
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{ list.0 }}{{ list[1] }}", "ab"},
+		{"{{ nested.1.0 }}", "3"},
+		{"{{ byID.5 }}", "five"},
+		{"{{ dict.key }}|{{ dict['key'] }}", "value|value"},
+		{"{{ user['Name'] }}|{{ user['name'] }}|{{ ptr['name'] }}", "ann|ann|bob"},
+		{"{{ list|attr('0') }}|{{ byID|attr('5') }}|{{ user|attr('Name') }}", "a|five|ann"},
+		{"{{ list|attr('missing')|default('none') }}", "none"},
+	}
+
+	for _, tt := range tests {
+		result, err := ExecuteToString(tt.template, vars)
+		if err != nil {
+			t.Fatalf("%s: execute error: %v", tt.template, err)
+		}
+		if result != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, result)
+		}
+	}
+}
+
+func TestItemLookupFallbackRespectsAttributePolicy(t *testing.T) {
+	manager := NewSecurityManager()
+	policy := NewSecurityPolicyBuilder("lookup", "Lookup policy").
+		SetAttributeWhitelistMode(false).
+		BlockAttributes("runtime.lookupUser.Password").
+		BlockOnViolation(true).
+		Build()
+	if err := manager.AddPolicy("lookup", policy); err != nil {
+		t.Fatalf("add policy: %v", err)
+	}
+	secCtx, err := manager.CreateSecurityContext("lookup", "template")
+	if err != nil {
+		t.Fatalf("create security context: %v", err)
+	}
+
+	ctx := NewContextWithEnvironment(NewEnvironment(), nil)
+	ctx.securityContext = secCtx
+	user := lookupUser{Name: "ann", Password: "secret"}
+
+	if value, err := ctx.ResolveIndex(user, "Name"); err != nil || value != "ann" {
+		t.Fatalf("expected item fallback to allowed attribute, got %v (%v)", value, err)
+	}
+	if _, err := ctx.ResolveIndex(user, "Password"); err == nil {
+		t.Fatal("expected item fallback to honour blocked attributes")
+	}
+}
+
+func TestGetattrGlobal(t *testing.T) {
+	vars := map[string]interface{}{
+		"user":    lookupUser{Name: "ann", Password: "secret"},
+		"field":   "Name",
+		"missing": "Email",
+	}
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{ getattr(user, field) }}", "ann"},
+		{"{{ getattr(user, missing, 'n/a') }}", "n/a"},
+		{"{{ getattr(user, missing, default='none') }}", "none"},
+		{"{{ getattr({'a': 1}, 'a', 0) }}", "1"},
+	}
+	for _, tt := range tests {
+		result, err := ExecuteToString(tt.template, vars)
+		if err != nil {
+			t.Fatalf("%s: execute error: %v", tt.template, err)
+		}
+		if result != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, result)
+		}
+	}
+
+	manager := NewSecurityManager()
+	policy := NewSecurityPolicyBuilder("getattr", "Getattr policy").
+		SetAttributeWhitelistMode(false).
+		BlockAttributes("runtime.lookupUser.Password").
+		BlockOnViolation(true).
+		Build()
+	if err := manager.AddPolicy("getattr", policy); err != nil {
+		t.Fatalf("add policy: %v", err)
+	}
+	secCtx, err := manager.CreateSecurityContext("getattr", "template")
+	if err != nil {
+		t.Fatalf("create security context: %v", err)
+	}
+	ctx := NewContextWithEnvironment(NewEnvironment(), nil)
+	ctx.securityContext = secCtx
+	if _, err := ctx.getattrFunc(vars["user"], "Password", "fallback"); err == nil {
+		t.Fatal("expected getattr to honour blocked attributes")
+	}
+}
+
+func TestStringIndexingIsRuneAware(t *testing.T) {
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{`{{ "日本語"[0] }}{{ "日本語"[1] }}{{ "日本語"[2] }}`, "日本語"},
+		{`{{ "日本語"[-1] }}{{ "日本語"[-3] }}`, "語日"},
+		{`{{ word[1] }}{{ word[-1] }}`, "éz"},
+		{`{{ "abc"[1] }}{{ "abc"[-1] }}`, "bc"},
+	}
+
+	for _, tt := range tests {
+		result, err := ExecuteToString(tt.template, map[string]interface{}{"word": "aéz"})
+		if err != nil {
+			t.Fatalf("%s: execute error: %v", tt.template, err)
+		}
+		if result != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, result)
+		}
+	}
+
+	if _, err := ExecuteToString(`{{ "日本語"[3] }}`, nil); err == nil {
+		t.Fatal("expected out of range error for index past the last character")
+	}
+}
+
+func TestSliceExpressions(t *testing.T) {
+	vars := map[string]interface{}{
+		"items":   []interface{}{1, 2, 3, 4, 5},
+		"strs":    []string{"a", "b", "c", "d"},
+		"numbers": []int{10, 20, 30},
+		"word":    "héllo",
+		"safe":    Markup("<b>bold</b>"),
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{`{{ items[1:3]|join(",") }}`, "2,3"},
+		{`{{ items[1:]|join(",") }}`, "2,3,4,5"},
+		{`{{ items[:2]|join(",") }}`, "1,2"},
+		{`{{ items[-2:]|join(",") }}`, "4,5"},
+		{`{{ items[:-2]|join(",") }}`, "1,2,3"},
+		{`{{ items[::2]|join(",") }}`, "1,3,5"},
+		{`{{ items[1::2]|join(",") }}`, "2,4"},
+		{`{{ items[::-1]|join(",") }}`, "5,4,3,2,1"},
+		{`{{ items[3:0:-1]|join(",") }}`, "4,3,2"},
+		{`{{ items[-1:-4:-2]|join(",") }}`, "5,3"},
+		{`{{ items[none:2]|join(",") }}`, "1,2"},
+		{`{{ items[-10:10]|join(",") }}`, "1,2,3,4,5"},
+		{`{{ items[10:]|length }}`, "0"},
+		{`{{ items[3:1]|length }}`, "0"},
+		{`{{ strs[1:3]|join(",") }}`, "b,c"},
+		{`{{ strs[::-1]|join(",") }}`, "d,c,b,a"},
+		{`{{ numbers[1:]|join(",") }}`, "20,30"},
+		{`{{ "abcdef"[1:4] }}`, "bcd"},
+		{`{{ "abcdef"[::2] }}`, "ace"},
+		{`{{ "abcdef"[::-1] }}`, "fedcba"},
+		{`{{ "abcdef"[-3:] }}`, "def"},
+		{`{{ "abcdef"[4:100] }}`, "ef"},
+		{`{{ word[1:3] }}`, "él"},
+		{`{{ word[::-1] }}`, "olléh"},
+		{`{{ "日本語"[:2] }}`, "日本"},
+		{`{{ safe[3:7] }}`, "bold"},
+	}
+
+	for _, tt := range tests {
+		result, err := ExecuteToString(tt.template, vars)
+		if err != nil {
+			t.Fatalf("%s: execute error: %v", tt.template, err)
+		}
+		if result != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, result)
+		}
+	}
+
+	if _, err := ExecuteToString(`{{ items[::0] }}`, vars); err == nil || !strings.Contains(err.Error(), "slice step cannot be zero") {
+		t.Fatalf("expected zero step error, got %v", err)
+	}
+	if _, err := ExecuteToString(`{{ items["a":] }}`, vars); err == nil {
+		t.Fatal("expected error for non-integer slice bound")
+	}
+}
+
 // Benchmark tests
 func BenchmarkSimpleTemplate(b *testing.B) {
 	template := "Hello {{ name }}!"
@@ -1136,3 +1540,20 @@ func BenchmarkFilters(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkParseDistinctTemplates(b *testing.B) {
+	env := NewEnvironment()
+	var counter atomic.Int64
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := counter.Add(1)
+			source := fmt.Sprintf("{%% for i in items %%}{{ i }}-%d{%% endfor %%}", n)
+			if _, err := env.ParseString(source, fmt.Sprintf("bench-%d", n)); err != nil {
+				b.Fatalf("Failed to parse template: %v", err)
+			}
+		}
+	})
+}
@@ -93,6 +93,10 @@ func (se *SandboxEnvironment) GetSecurityPolicy() string {
 
 // ExecuteTemplate executes a template with security controls
 func (se *SandboxEnvironment) ExecuteTemplate(template *Template, vars map[string]interface{}, writer io.Writer) error {
+	return se.executeTemplate(template, vars, nil, writer)
+}
+
+func (se *SandboxEnvironment) executeTemplate(template *Template, vars, globals map[string]interface{}, writer io.Writer) error {
 	// Create security context
 	secCtx, err := se.securityManager.CreateSecurityContext(se.policyName, template.name)
 	if err != nil {
@@ -102,6 +106,8 @@ func (se *SandboxEnvironment) ExecuteTemplate(template *Template, vars map[strin
 
 	// Create sandboxed context
 	ctx := NewSandboxedContext(secCtx, vars, se.Environment, writer)
+	ctx.setRenderGlobals(globals, vars)
+	ctx.SetAutoescape(template.Autoescape())
 
 	// Execute template with timeout
 	timeoutCtx, cancel := context.WithTimeout(context.Background(), secCtx.GetPolicy().MaxExecutionTime)
@@ -121,13 +127,18 @@ func (se *SandboxEnvironment) ExecuteTemplate(template *Template, vars map[strin
 		// Check for security violations
 		if secCtx.HasBlockedViolations() {
 			violations := secCtx.GetViolations()
-			return fmt.Errorf("template execution blocked due to %d security violations", len(violations))
+			err := fmt.Errorf("template execution blocked due to %d security violations", len(violations))
+			template.logError(ctx.Context, err)
+			return err
 		}
 
 		return nil
 
 	case <-timeoutCtx.Done():
-		return fmt.Errorf("template execution timed out after %s", secCtx.GetPolicy().MaxExecutionTime)
+		// The render is still running and owns ctx, so report directly.
+		err := fmt.Errorf("template execution timed out after %s", secCtx.GetPolicy().MaxExecutionTime)
+		template.reportError(err)
+		return err
 	}
 }
 
@@ -435,6 +435,26 @@ func TestSandboxBlocksDisallowedSelectTest(t *testing.T) {
 	}
 }
 
+func TestSandboxBlocksDisallowedSortKeyFilter(t *testing.T) {
+	env := NewEnvironment()
+	env.SetSandboxed(true)
+
+	policy := NewSecurityPolicyBuilder("blocked-sort-key", "Test policy").
+		AllowFilters("sort", "join").
+		BlockFilters("length").
+		Build()
+	env.SetSecurityPolicy(policy)
+
+	tmpl, err := env.ParseString("{{ ['bb', 'a']|sort(by='length')|join(',') }}", "blocked_sort_key")
+	if err != nil {
+		t.Fatalf("failed to parse template: %v", err)
+	}
+
+	if _, err := tmpl.ExecuteToString(nil); err == nil || !strings.Contains(err.Error(), "length") {
+		t.Fatalf("expected sandbox to block sort key filter 'length', got %v", err)
+	}
+}
+
 func TestDevelopmentSandboxExecutes(t *testing.T) {
 	sandbox := NewDevelopmentEnvironment()
 	tmpl, err := sandbox.NewTemplateFromSource("{{ 1 + 1 }}", "dev")
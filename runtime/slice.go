@@ -0,0 +1,159 @@
+package runtime
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/deicod/gojinja/nodes"
+)
+
+// sliceIndex is the value a slice expression such as items[1:5:2] evaluates
+// to. A nil bound means it was omitted, as in Python.
+type sliceIndex struct {
+	start *int
+	stop  *int
+	step  *int
+}
+
+// indices resolves the slice bounds against a sequence of the given length
+// following Python's slice.indices: bounds are clamped, negative bounds count
+// from the end and omitted bounds depend on the step direction.
+func (s sliceIndex) indices(length int) (start, stop, step int, err error) {
+	step = 1
+	if s.step != nil {
+		step = *s.step
+	}
+	if step == 0 {
+		return 0, 0, 0, fmt.Errorf("slice step cannot be zero")
+	}
+
+	lower, upper := 0, length
+	if step < 0 {
+		lower, upper = -1, length-1
+	}
+
+	clamp := func(bound *int, def int) int {
+		if bound == nil {
+			return def
+		}
+		value := *bound
+		if value < 0 {
+			value += length
+			if value < lower {
+				value = lower
+			}
+		} else if value > upper {
+			value = upper
+		}
+		return value
+	}
+
+	if step > 0 {
+		return clamp(s.start, lower), clamp(s.stop, upper), step, nil
+	}
+	return clamp(s.start, upper), clamp(s.stop, lower), step, nil
+}
+
+// positions returns the element positions selected by the slice.
+func (s sliceIndex) positions(length int) ([]int, error) {
+	start, stop, step, err := s.indices(length)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []int
+	for i := start; (step > 0 && i < stop) || (step < 0 && i > stop); i += step {
+		result = append(result, i)
+	}
+	return result, nil
+}
+
+// sliceValue returns the subsequence of value selected by spec. Strings are
+// sliced by character and keep their type, so Markup stays Markup; slices and
+// arrays produce a slice of the same element type.
+func sliceValue(value interface{}, spec sliceIndex) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return sliceString(v, spec)
+	case []interface{}:
+		positions, err := spec.positions(len(v))
+		if err != nil {
+			return nil, NewError(ErrorTypeTemplate, err.Error(), nodes.Position{}, nil)
+		}
+		result := make([]interface{}, len(positions))
+		for i, pos := range positions {
+			result[i] = v[pos]
+		}
+		return result, nil
+	case []string:
+		positions, err := spec.positions(len(v))
+		if err != nil {
+			return nil, NewError(ErrorTypeTemplate, err.Error(), nodes.Position{}, nil)
+		}
+		result := make([]string, len(positions))
+		for i, pos := range positions {
+			result[i] = v[pos]
+		}
+		return result, nil
+	}
+
+	val := reflect.ValueOf(value)
+	for val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface {
+		if val.IsNil() {
+			return nil, NewError(ErrorTypeTemplate, fmt.Sprintf("cannot slice %T", value), nodes.Position{}, nil)
+		}
+		val = val.Elem()
+	}
+
+	switch val.Kind() {
+	case reflect.String:
+		sliced, err := sliceString(val.String(), spec)
+		if err != nil {
+			return nil, err
+		}
+		return reflect.ValueOf(sliced).Convert(val.Type()).Interface(), nil
+	case reflect.Slice, reflect.Array:
+		positions, err := spec.positions(val.Len())
+		if err != nil {
+			return nil, NewError(ErrorTypeTemplate, err.Error(), nodes.Position{}, nil)
+		}
+		result := reflect.MakeSlice(reflect.SliceOf(val.Type().Elem()), len(positions), len(positions))
+		for i, pos := range positions {
+			result.Index(i).Set(val.Index(pos))
+		}
+		return result.Interface(), nil
+	}
+
+	return nil, NewError(ErrorTypeTemplate, fmt.Sprintf("cannot slice %T", value), nodes.Position{}, nil)
+}
+
+func sliceString(str string, spec sliceIndex) (string, error) {
+	if isASCII(str) {
+		positions, err := spec.positions(len(str))
+		if err != nil {
+			return "", NewError(ErrorTypeTemplate, err.Error(), nodes.Position{}, nil)
+		}
+		if spec.step == nil || *spec.step == 1 {
+			if len(positions) == 0 {
+				return "", nil
+			}
+			return str[positions[0] : positions[len(positions)-1]+1], nil
+		}
+		result := make([]byte, len(positions))
+		for i, pos := range positions {
+			result[i] = str[pos]
+		}
+		return string(result), nil
+	}
+
+	runes := []rune(str)
+	positions, err := spec.positions(len(runes))
+	if err != nil {
+		return "", NewError(ErrorTypeTemplate, err.Error(), nodes.Position{}, nil)
+	}
+	result := make([]rune, 0, len(positions))
+	for _, pos := range positions {
+		result = append(result, runes[pos])
+	}
+	return string(result), nil
+}
@@ -1,6 +1,7 @@
 package runtime
 
 import (
+	"errors"
 	"io"
 	"strings"
 	"sync"
@@ -10,44 +11,106 @@ import (
 // Jinja2's “Template.generate“ helper by yielding rendered fragments as they
 // are produced, while still honouring the environment's trailing newline
 // policy when the stream is written or collected.
+//
+// The stream holds at most a fixed number of pending fragments, so a slow
+// consumer blocks the renderer instead of letting output pile up in memory.
+// Consumers that stop reading early should call Close to release it.
+//
+// TemplateStream also implements io.Reader, so rendered output can be piped
+// into anything that consumes a reader, such as a gzip writer or an HTTP
+// response body.
 type TemplateStream struct {
-	chunks   chan streamChunk
-	trimLast bool
-	once     sync.Once
+	chunks    chan streamChunk
+	trimLast  bool
+	once      sync.Once
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Read state: bytes ready for the caller, a trailing newline held back
+	// until it is known not to end the output, and the terminal error.
+	readBuf  []byte
+	readHeld []byte
+	readErr  error
 }
 
+// ErrStreamClosed is reported to the renderer, and by Next, once the consumer
+// has closed a TemplateStream.
+var ErrStreamClosed = errors.New("template stream closed")
+
 type streamChunk struct {
 	text string
 	err  error
 }
 
-func newTemplateStream(trim bool) *TemplateStream {
+// GenerateOptions overrides per-call streaming behaviour for
+// Environment.GenerateWithOptions.
+type GenerateOptions struct {
+	// KeepTrailingNewline overrides the environment's trailing newline
+	// policy for the rendered stream when non-nil. A final newline in the
+	// template source is still removed at parse time unless the environment
+	// keeps trailing newlines.
+	KeepTrailingNewline *bool
+	// BufferSize is the number of fragments queued ahead of the reader.
+	// Values below one use a single-fragment buffer.
+	BufferSize int
+}
+
+func newTemplateStream(trim bool, bufferSize int) *TemplateStream {
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
 	return &TemplateStream{
-		chunks:   make(chan streamChunk, 1),
+		chunks:   make(chan streamChunk, bufferSize),
 		trimLast: trim,
+		done:     make(chan struct{}),
 	}
 }
 
-func (s *TemplateStream) emit(text string) {
+// emit blocks until the consumer has room for the fragment or closes the
+// stream, in which case ErrStreamClosed is returned to abort rendering.
+func (s *TemplateStream) emit(text string) error {
 	if text == "" {
-		return
+		return nil
+	}
+	select {
+	case s.chunks <- streamChunk{text: text}:
+		return nil
+	case <-s.done:
+		return ErrStreamClosed
 	}
-	s.chunks <- streamChunk{text: text}
 }
 
 func (s *TemplateStream) close(err error) {
 	s.once.Do(func() {
 		if err != nil {
-			s.chunks <- streamChunk{err: err}
+			select {
+			case s.chunks <- streamChunk{err: err}:
+			case <-s.done:
+			}
 		}
 		close(s.chunks)
 	})
 }
 
+// Close abandons the stream. A renderer blocked on a full buffer is released
+// and stops with ErrStreamClosed; subsequent calls to Next return
+// ErrStreamClosed. Close is safe to call more than once.
+func (s *TemplateStream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
+
 // Next returns the next rendered fragment from the stream. When the stream is
 // exhausted “io.EOF“ is returned. If rendering raised an error, that error is
 // returned and the stream is closed.
 func (s *TemplateStream) Next() (string, error) {
+	select {
+	case <-s.done:
+		return "", ErrStreamClosed
+	default:
+	}
 	chunk, ok := <-s.chunks
 	if !ok {
 		return "", io.EOF
@@ -58,6 +121,36 @@ func (s *TemplateStream) Next() (string, error) {
 	return chunk.text, nil
 }
 
+// Read implements io.Reader over the rendered output. The environment's
+// trailing newline policy is honoured as with Collect, and a rendering error
+// is returned once all output produced before it has been read.
+func (s *TemplateStream) Read(p []byte) (int, error) {
+	for len(s.readBuf) == 0 {
+		if s.readErr != nil {
+			return 0, s.readErr
+		}
+		chunk, err := s.Next()
+		if err != nil {
+			if err != io.EOF {
+				s.readBuf = s.readHeld
+			}
+			s.readHeld = nil
+			s.readErr = err
+			continue
+		}
+		data := append(s.readHeld, chunk...)
+		keep := 0
+		if s.trimLast {
+			keep = trailingNewlineLength(data)
+		}
+		s.readBuf = data[:len(data)-keep]
+		s.readHeld = append([]byte(nil), data[len(data)-keep:]...)
+	}
+	n := copy(p, s.readBuf)
+	s.readBuf = s.readBuf[n:]
+	return n, nil
+}
+
 // Collect concatenates all remaining fragments into a single string. The
 // environment's “keep_trailing_newline“ policy is honoured when producing the
 // final result. Errors raised during rendering are returned to the caller.
@@ -106,6 +199,7 @@ func (s *TemplateStream) WriteTo(w io.Writer) (int64, error) {
 		chunkWritten, writeErr := consumer.WriteChunk(chunk)
 		written += chunkWritten
 		if writeErr != nil {
+			s.Close()
 			return written, writeErr
 		}
 	}
@@ -252,6 +346,66 @@ func (w *streamWriter) Write(p []byte) (int, error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
-	w.stream.emit(string(p))
+	if err := w.stream.emit(string(p)); err != nil {
+		return 0, err
+	}
 	return len(p), nil
 }
+
+// ErrOutputLimitExceeded is returned when rendered output exceeds the byte
+// limit enforced by a LimitWriter.
+var ErrOutputLimitExceeded = errors.New("rendered output exceeds the configured size limit")
+
+// LimitWriter forwards writes to an underlying writer until a byte limit is
+// reached. Writes that cross the limit are truncated so everything that fits
+// is still delivered, and ErrOutputLimitExceeded is reported from then on.
+type LimitWriter struct {
+	writer   io.Writer
+	limit    int64
+	written  int64
+	exceeded bool
+	mu       sync.Mutex
+}
+
+// NewLimitWriter wraps w so that at most limit bytes are written to it.
+func NewLimitWriter(w io.Writer, limit int64) *LimitWriter {
+	return &LimitWriter{writer: w, limit: limit}
+}
+
+// Write writes as much of p as fits within the remaining budget.
+func (w *LimitWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	remaining := w.limit - w.written
+	if int64(len(p)) <= remaining {
+		n, err := w.writer.Write(p)
+		w.written += int64(n)
+		return n, err
+	}
+
+	w.exceeded = true
+	if remaining <= 0 {
+		return 0, ErrOutputLimitExceeded
+	}
+	n, err := w.writer.Write(p[:remaining])
+	w.written += int64(n)
+	if err != nil {
+		return n, err
+	}
+	return n, ErrOutputLimitExceeded
+}
+
+// Written returns the number of bytes delivered to the underlying writer.
+func (w *LimitWriter) Written() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.written
+}
+
+// Exceeded reports whether any write was truncated because of the limit.
+func (w *LimitWriter) Exceeded() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.exceeded
+}
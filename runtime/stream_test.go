@@ -4,8 +4,13 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"runtime"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/deicod/gojinja/nodes"
 )
 
 func TestTemplateGenerateStream(t *testing.T) {
@@ -87,6 +92,102 @@ func TestTemplateStreamKeepTrailingNewline(t *testing.T) {
 	}
 }
 
+func TestGenerateWithOptionsOverridesTrailingNewline(t *testing.T) {
+	env := NewEnvironment()
+	env.SetLoader(NewMapLoader(map[string]string{"page.txt": "{% for i in items %}{{ i }}{% endfor %}{{ tail }}"}))
+	vars := map[string]interface{}{"items": []int{1, 2, 3}, "tail": "\n"}
+
+	render := func(opts GenerateOptions) string {
+		stream, err := env.GenerateWithOptions("page.txt", vars, opts)
+		if err != nil {
+			t.Fatalf("GenerateWithOptions error: %v", err)
+		}
+		var buf bytes.Buffer
+		if _, err := stream.WriteTo(&buf); err != nil {
+			t.Fatalf("WriteTo error: %v", err)
+		}
+		return buf.String()
+	}
+
+	keep, trim := true, false
+	if got := render(GenerateOptions{}); got != "123" {
+		t.Fatalf("expected environment default to trim, got %q", got)
+	}
+	if got := render(GenerateOptions{KeepTrailingNewline: &keep, BufferSize: 4}); got != "123\n" {
+		t.Fatalf("expected trailing newline to be kept, got %q", got)
+	}
+
+	env.SetKeepTrailingNewline(true)
+	if got := render(GenerateOptions{}); got != "123\n" {
+		t.Fatalf("expected environment policy to keep newline, got %q", got)
+	}
+	if got := render(GenerateOptions{KeepTrailingNewline: &trim}); got != "123" {
+		t.Fatalf("expected per-call override to trim, got %q", got)
+	}
+}
+
+func TestTemplateStreamAppliesBackpressure(t *testing.T) {
+	env := NewEnvironment()
+	var produced int64
+	env.AddGlobal("tick", GlobalFunc(func(ctx *Context, args ...interface{}) (interface{}, error) {
+		return atomic.AddInt64(&produced, 1), nil
+	}))
+	finished := make(chan error, 1)
+	env.SetErrorLogger(func(err error, templateName string, pos nodes.Position) {
+		finished <- err
+	})
+
+	tmpl, err := env.ParseString("{% for i in range(1000) %}{{ tick() }},{% endfor %}", "backpressure")
+	if err != nil {
+		t.Fatalf("ParseString error: %v", err)
+	}
+	stream, err := tmpl.Generate(nil)
+	if err != nil {
+		t.Fatalf("Generate error: %v", err)
+	}
+
+	var got strings.Builder
+	for i := 0; i < 10; i++ {
+		chunk, err := stream.Next()
+		if err != nil {
+			t.Fatalf("Next error: %v", err)
+		}
+		got.WriteString(chunk)
+	}
+	if got.String() != "1,2,3,4,5," {
+		t.Fatalf("expected fragments in order, got %q", got.String())
+	}
+
+	// Once the buffer is full the renderer can finish at most the fragment
+	// it is working on before blocking on the reader.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(stream.chunks) < cap(stream.chunks) {
+		if time.Now().After(deadline) {
+			t.Fatal("renderer never filled the stream buffer")
+		}
+		runtime.Gosched()
+	}
+	if n := atomic.LoadInt64(&produced); n > 7 {
+		t.Fatalf("expected renderer to wait for the reader, produced %d values", n)
+	}
+
+	stream.Close()
+	select {
+	case err := <-finished:
+		if !errors.Is(err, ErrStreamClosed) {
+			t.Fatalf("expected the renderer to stop with ErrStreamClosed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Close to stop the renderer")
+	}
+	if n := atomic.LoadInt64(&produced); n > 7 {
+		t.Fatalf("expected Close to stop the renderer, produced %d values", n)
+	}
+	if _, err := stream.Next(); !errors.Is(err, ErrStreamClosed) {
+		t.Fatalf("expected ErrStreamClosed after Close, got %v", err)
+	}
+}
+
 func TestTemplateStreamCollect(t *testing.T) {
 	env := NewEnvironment()
 	tmpl, err := env.ParseString("{{ 'a' }}{{ 'b' }}{{ 'c' }}\n", "stream_collect")
@@ -130,3 +231,166 @@ func TestTemplateStreamPropagatesErrors(t *testing.T) {
 		}
 	}
 }
+
+func TestTemplateStreamReader(t *testing.T) {
+	env := NewEnvironment()
+	source := "{% for i in range(200) %}line {{ i }}\n{% endfor %}"
+	tmpl, err := env.ParseString(source, "stream_reader")
+	if err != nil {
+		t.Fatalf("ParseString error: %v", err)
+	}
+
+	expected, err := tmpl.ExecuteToString(nil)
+	if err != nil {
+		t.Fatalf("ExecuteToString error: %v", err)
+	}
+
+	reader, err := tmpl.Stream(nil)
+	if err != nil {
+		t.Fatalf("Stream error: %v", err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("ReadAll error: %v", err)
+	}
+	if string(data) != expected {
+		t.Fatalf("reader output differs from direct render:\n%q\n%q", data, expected)
+	}
+
+	tmpl, err = env.ParseString("before{{ 1 // 0 }}", "stream_reader_error")
+	if err != nil {
+		t.Fatalf("ParseString error: %v", err)
+	}
+	reader, err = tmpl.Stream(nil)
+	if err != nil {
+		t.Fatalf("Stream error: %v", err)
+	}
+	data, err = io.ReadAll(reader)
+	var tplErr *Error
+	if !errors.As(err, &tplErr) {
+		t.Fatalf("expected template error from Read, got %v", err)
+	}
+	if string(data) != "before" {
+		t.Fatalf("expected output before the error, got %q", data)
+	}
+}
+
+func TestEnvironmentExecuteTemplateOutputLimit(t *testing.T) {
+	env := NewEnvironment()
+	env.SetMaxOutputBytes(10)
+
+	tmpl, err := env.ParseString("{% for i in range(50) %}{{ i }},{% endfor %}", "limited")
+	if err != nil {
+		t.Fatalf("ParseString error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = env.ExecuteTemplate(tmpl, nil, &buf)
+	if !errors.Is(err, ErrOutputLimitExceeded) {
+		t.Fatalf("expected ErrOutputLimitExceeded, got %v", err)
+	}
+	if buf.String() != "0,1,2,3,4," {
+		t.Fatalf("expected truncated output to contain the first 10 bytes, got %q", buf.String())
+	}
+
+	env.SetMaxOutputBytes(0)
+	buf.Reset()
+	if err := env.ExecuteTemplate(tmpl, nil, &buf); err != nil {
+		t.Fatalf("unexpected error without a limit: %v", err)
+	}
+	if buf.Len() <= 10 {
+		t.Fatalf("expected full output without a limit, got %q", buf.String())
+	}
+}
+
+func TestOutputLimitAppliesToEveryEntryPoint(t *testing.T) {
+	env := NewEnvironment()
+	env.SetMaxOutputBytes(3)
+
+	const source = "{% block body %}abcdefgh{% endblock %}"
+	tmpl, err := env.ParseString(source, "limited")
+	if err != nil {
+		t.Fatalf("ParseString error: %v", err)
+	}
+
+	entryPoints := []struct {
+		name   string
+		render func() (string, error)
+	}{
+		{"Template.Execute", func() (string, error) {
+			var buf bytes.Buffer
+			err := tmpl.Execute(nil, &buf)
+			return buf.String(), err
+		}},
+		{"Template.RenderBlock", func() (string, error) {
+			var buf bytes.Buffer
+			err := tmpl.RenderBlock("body", nil, &buf)
+			return buf.String(), err
+		}},
+		{"Template.Generate", func() (string, error) {
+			stream, err := tmpl.Generate(nil)
+			if err != nil {
+				return "", err
+			}
+			var buf bytes.Buffer
+			_, err = stream.WriteTo(&buf)
+			return buf.String(), err
+		}},
+		{"ExecuteWithEnvironment", func() (string, error) {
+			var buf bytes.Buffer
+			err := ExecuteWithEnvironment(env, source, nil, &buf)
+			return buf.String(), err
+		}},
+		{"Environment.ExecuteTemplate", func() (string, error) {
+			var buf bytes.Buffer
+			err := env.ExecuteTemplate(tmpl, nil, &buf)
+			return buf.String(), err
+		}},
+	}
+
+	for _, tt := range entryPoints {
+		out, err := tt.render()
+		if !errors.Is(err, ErrOutputLimitExceeded) {
+			t.Fatalf("%s: expected ErrOutputLimitExceeded, got %v", tt.name, err)
+		}
+		if out != "abc" {
+			t.Fatalf("%s: expected output truncated to the limit, got %q", tt.name, out)
+		}
+	}
+
+	if _, err := tmpl.ExecuteToString(nil); !errors.Is(err, ErrOutputLimitExceeded) {
+		t.Fatalf("Template.ExecuteToString: expected ErrOutputLimitExceeded, got %v", err)
+	}
+	if _, err := ExecuteToStringWithEnvironment(env, source, nil); !errors.Is(err, ErrOutputLimitExceeded) {
+		t.Fatalf("ExecuteToStringWithEnvironment: expected ErrOutputLimitExceeded, got %v", err)
+	}
+
+	exact, err := env.ParseString("abc\n", "exact")
+	if err != nil {
+		t.Fatalf("ParseString error: %v", err)
+	}
+	if out, err := exact.ExecuteToString(nil); err != nil || out != "abc" {
+		t.Fatalf("expected output that fits after newline trimming, got %q (%v)", out, err)
+	}
+}
+
+func TestLimitWriterTruncatesPartialWrite(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewLimitWriter(&buf, 5)
+
+	if n, err := w.Write([]byte("abc")); n != 3 || err != nil {
+		t.Fatalf("unexpected first write result: %d, %v", n, err)
+	}
+	n, err := w.Write([]byte("defgh"))
+	if n != 2 || !errors.Is(err, ErrOutputLimitExceeded) {
+		t.Fatalf("expected partial write of 2 bytes with limit error, got %d, %v", n, err)
+	}
+	if n, err := w.Write([]byte("x")); n != 0 || !errors.Is(err, ErrOutputLimitExceeded) {
+		t.Fatalf("expected writes after the limit to fail, got %d, %v", n, err)
+	}
+	if buf.String() != "abcde" || w.Written() != 5 || !w.Exceeded() {
+		t.Fatalf("unexpected writer state: %q, written=%d, exceeded=%v", buf.String(), w.Written(), w.Exceeded())
+	}
+}
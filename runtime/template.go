@@ -2,10 +2,13 @@ package runtime
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
+	"sync/atomic"
 
+	"github.com/deicod/gojinja/lexer"
 	"github.com/deicod/gojinja/nodes"
 )
 
@@ -14,12 +17,18 @@ type Template struct {
 	name           string
 	environment    *Environment
 	ast            *nodes.Template
-	autoescape     bool
+	autoescape     uint32 // accessed atomically; 1 when enabled
 	blocks         map[string]*nodes.Block
 	macros         map[string]*nodes.Macro
 	imports        map[string]*Template
 	inheritanceCtx *InheritanceContext
 	macroRegistry  *MacroRegistry
+
+	parentPath      string
+	whitespaceTrims []lexer.WhitespaceTrim
+	unknownFilters  []*nodes.Filter
+	source          string
+	hasSource       bool
 }
 
 // NewTemplate creates a new template from an AST
@@ -31,15 +40,25 @@ func NewTemplate(env *Environment, ast *nodes.Template, name string) (*Template,
 		return nil, NewError(ErrorTypeTemplate, "AST cannot be nil", nodes.Position{}, nil)
 	}
 
+	var unknownFilters []*nodes.Filter
+	if env.StrictFilters() {
+		var err error
+		if unknownFilters, err = env.validateFilterNames(ast); err != nil {
+			return nil, err
+		}
+	}
+
 	template := &Template{
 		name:          name,
 		environment:   env,
 		ast:           ast,
-		autoescape:    env.shouldAutoescape(name),
+		autoescape:    boolToUint32(env.shouldAutoescape(name)),
 		blocks:        make(map[string]*nodes.Block),
 		macros:        make(map[string]*nodes.Macro),
 		imports:       make(map[string]*Template),
 		macroRegistry: env.macroRegistry,
+
+		unknownFilters: unknownFilters,
 	}
 
 	// Pre-process the template to collect blocks and macros
@@ -143,28 +162,104 @@ func (t *Template) setupInheritance() error {
 	return nil
 }
 
+// validateFilterNames walks the AST and reports the first test that is not
+// registered with the environment. Filters the environment does not know are
+// returned instead: they may be local filters of the rendering context, so
+// checkUnknownFilters verifies them before rendering starts.
+func (env *Environment) validateFilterNames(ast *nodes.Template) ([]*nodes.Filter, error) {
+	var unknown []*nodes.Filter
+	var err error
+	nodes.Walk(nodes.NodeVisitorFunc(func(node nodes.Node) interface{} {
+		if err != nil {
+			return true
+		}
+
+		switch n := node.(type) {
+		case *nodes.Filter:
+			if _, ok := env.GetFilter(n.Name); !ok {
+				unknown = append(unknown, n)
+			}
+		case *nodes.Test:
+			if _, ok := env.GetTest(n.Name); !ok {
+				err = NewTestError(n.Name, "unknown test", n.GetPosition(), n, nil)
+			}
+		case *nodes.Operand:
+			if n.Op != "is" && n.Op != "isnot" {
+				return nil
+			}
+			var nameNode *nodes.Name
+			switch expr := n.Expr.(type) {
+			case *nodes.Name:
+				nameNode = expr
+			case *nodes.Call:
+				nameNode, _ = expr.Node.(*nodes.Name)
+			}
+			if nameNode != nil {
+				if _, ok := env.GetTest(nameNode.Name); !ok {
+					err = NewTestError(nameNode.Name, "unknown test", n.GetPosition(), n.Expr, nil)
+				}
+			}
+		}
+
+		if err != nil {
+			return true
+		}
+		return nil
+	}), ast)
+	return unknown, err
+}
+
+// checkUnknownFilters reports the first filter recorded by
+// validateFilterNames that is not a local filter of ctx either.
+func (t *Template) checkUnknownFilters(ctx *Context) error {
+	for _, filter := range t.unknownFilters {
+		if _, ok := ctx.lookupFilter(filter.Name); !ok {
+			return NewFilterError(filter.Name, "unknown filter", filter.GetPosition(), filter, nil)
+		}
+	}
+	return nil
+}
+
 // Execute renders the template to the given writer with the provided context
 func (t *Template) Execute(vars map[string]interface{}, writer io.Writer) error {
+	return t.ExecuteWithGlobals(vars, nil, writer)
+}
+
+// ExecuteWithGlobals renders the template like Execute while layering globals
+// that only apply to this render, such as a request or CSRF token. Render
+// globals resolve like environment globals (including inside included and
+// imported templates) and take precedence over them, but variables in vars
+// still win. The environment itself is never modified.
+func (t *Template) ExecuteWithGlobals(vars, globals map[string]interface{}, writer io.Writer) error {
 	if writer == nil {
 		return NewError(ErrorTypeTemplate, "writer cannot be nil", nodes.Position{}, nil)
 	}
 
 	useTrim := !t.environment.ShouldKeepTrailingNewline()
 	var buffer bytes.Buffer
-	outWriter := &buffer
+	var outWriter io.Writer = &buffer
+
+	// The output limit applies after the trailing newline is trimmed, so
+	// leave room for it while rendering and enforce the exact limit below.
+	limit := t.environment.MaxOutputBytes()
+	if limit > 0 {
+		outWriter = NewLimitWriter(&buffer, limit+int64(len("\r\n")))
+	}
 
 	// Create context
 	ctx := NewContextWithEnvironment(t.environment, vars)
-	ctx.SetAutoescape(t.autoescape)
+	ctx.setRenderGlobals(globals, vars)
+	ctx.SetAutoescape(t.Autoescape())
 	ctx.current = t
 	ctx.writer = outWriter
 
-	if err := t.ExecuteWithContext(ctx); err != nil {
-		return err
+	renderErr := t.ExecuteWithContext(ctx)
+	if renderErr != nil && !errors.Is(renderErr, ErrOutputLimitExceeded) {
+		return renderErr
 	}
 
 	output := buffer.String()
-	if useTrim {
+	if useTrim && renderErr == nil {
 		switch {
 		case strings.HasSuffix(output, "\r\n"):
 			output = output[:len(output)-2]
@@ -172,18 +267,28 @@ func (t *Template) Execute(vars map[string]interface{}, writer io.Writer) error
 			output = output[:len(output)-1]
 		}
 	}
-	_, err := writer.Write([]byte(output))
-	return err
+	if limit > 0 && int64(len(output)) > limit {
+		output = output[:limit]
+		renderErr = ErrOutputLimitExceeded
+	}
+	if _, err := writer.Write([]byte(output)); err != nil {
+		t.logError(ctx, err)
+		return err
+	}
+	if renderErr != nil {
+		t.logError(ctx, renderErr)
+	}
+	return renderErr
 }
 
 // Generate returns a streaming renderer for the template that yields rendered
 // fragments as they are produced. The returned stream honours the
 // environment's trailing newline policy when collected or written.
 func (t *Template) Generate(vars map[string]interface{}) (*TemplateStream, error) {
-	stream := newTemplateStream(!t.environment.ShouldKeepTrailingNewline())
+	stream := newTemplateStream(!t.environment.ShouldKeepTrailingNewline(), 1)
 
 	ctx := NewContextWithEnvironment(t.environment, vars)
-	ctx.SetAutoescape(t.autoescape)
+	ctx.SetAutoescape(t.Autoescape())
 	ctx.current = t
 
 	go func() {
@@ -195,8 +300,23 @@ func (t *Template) Generate(vars map[string]interface{}) (*TemplateStream, error
 	return stream, nil
 }
 
+// Stream renders the template in the background and returns the output as a
+// reader. Callers that stop reading before EOF should Close the reader so the
+// renderer is released.
+func (t *Template) Stream(vars map[string]interface{}) (io.ReadCloser, error) {
+	return t.Generate(vars)
+}
+
 // ExecuteWithContext renders the template using an existing context
 func (t *Template) ExecuteWithContext(ctx *Context) error {
+	err := t.executeWithContext(ctx)
+	if err != nil {
+		t.logError(ctx, err)
+	}
+	return err
+}
+
+func (t *Template) executeWithContext(ctx *Context) error {
 	// Create evaluator - use secure evaluator if environment is sandboxed
 	var evaluator *Evaluator
 	if ctx.securityContext != nil || t.environment.IsSandboxed() {
@@ -236,6 +356,16 @@ func (t *Template) ExecuteWithContext(ctx *Context) error {
 		ctx.current = t
 	}
 
+	if err := t.checkUnknownFilters(ctx); err != nil {
+		return err
+	}
+
+	if limited := t.limitOutput(ctx); limited != nil {
+		original := ctx.writer
+		ctx.writer = limited
+		defer func() { ctx.writer = original }()
+	}
+
 	// Evaluate the template
 	result := evaluator.Evaluate(t.ast)
 	if err, ok := result.(error); ok {
@@ -250,6 +380,45 @@ func (t *Template) ExecuteWithContext(ctx *Context) error {
 	return nil
 }
 
+// limitOutput wraps ctx.writer in a LimitWriter when the environment caps
+// output with SetMaxOutputBytes. It returns nil when there is no limit or the
+// writer is already limited, e.g. for an include rendering into its parent.
+func (t *Template) limitOutput(ctx *Context) *LimitWriter {
+	if ctx.writer == nil || t.environment == nil {
+		return nil
+	}
+	if _, ok := ctx.writer.(*LimitWriter); ok {
+		return nil
+	}
+	limit := t.environment.MaxOutputBytes()
+	if limit <= 0 {
+		return nil
+	}
+	return NewLimitWriter(ctx.writer, limit)
+}
+
+// logError reports err to the environment's error logger. An error is only
+// logged by the innermost template that produced it; ctx.errorLogged is
+// carried to the including context so outer templates skip it.
+func (t *Template) logError(ctx *Context, err error) {
+	if ctx.errorLogged || t.environment == nil || t.environment.ErrorLogger() == nil {
+		return
+	}
+	ctx.errorLogged = true
+	t.reportError(err)
+}
+
+// reportError passes err to the environment's error logger without recording
+// it on a context, for failures detected outside the rendering goroutine.
+func (t *Template) reportError(err error) {
+	if t.environment == nil {
+		return
+	}
+	if logger := t.environment.ErrorLogger(); logger != nil {
+		logger(err, t.name, ErrorPosition(err))
+	}
+}
+
 // ExecuteToString renders the template to a string
 func (t *Template) ExecuteToString(vars map[string]interface{}) (string, error) {
 	var buf bytes.Buffer
@@ -261,9 +430,10 @@ func (t *Template) ExecuteToString(vars map[string]interface{}) (string, error)
 }
 
 // newModuleContext prepares a context suitable for module execution.
-func (t *Template) newModuleContext(vars map[string]interface{}) *Context {
+func (t *Template) newModuleContext(vars, globals map[string]interface{}) *Context {
 	ctx := NewContextWithEnvironment(t.environment, vars)
-	ctx.SetAutoescape(t.autoescape)
+	ctx.setRenderGlobals(globals, vars)
+	ctx.SetAutoescape(t.Autoescape())
 	ctx.current = t
 
 	var buf strings.Builder
@@ -296,9 +466,93 @@ func (t *Template) makeModuleFromContext(ctx *Context) (*MacroNamespace, error)
 	return module, nil
 }
 
+// WhitespaceReport returns the whitespace removed from the template source by
+// "-" markers, lstrip_blocks and trim_blocks, in source order. It is empty
+// unless the template was parsed with Environment.SetWhitespaceDebug(true).
+func (t *Template) WhitespaceReport() []lexer.WhitespaceTrim {
+	return t.whitespaceTrims
+}
+
+// Macros executes the template in module mode and returns its top-level
+// macros keyed by name. The macros stay bound to the module context, so they
+// can be invoked from Go with CallMacro or Macro.Execute. If the template
+// fails to execute, Macros returns nil and passes the error to the
+// environment's error logger.
+func (t *Template) Macros() map[string]*Macro {
+	module, err := t.MakeModule(nil)
+	if err != nil {
+		t.reportError(err)
+		return nil
+	}
+	return moduleMacros(module)
+}
+
+// CallMacro executes the top-level macro name and returns its rendered
+// output, escaped like a macro call inside a template. A "caller" keyword
+// argument provides the body rendered by {{ caller() }} and may be a
+// string, Markup, a GlobalFunc or a function with the GlobalFunc signature.
+func (t *Template) CallMacro(name string, args []interface{}, kwargs map[string]interface{}) (string, error) {
+	module, err := t.MakeModule(nil)
+	if err != nil {
+		return "", err
+	}
+
+	macro, ok := moduleMacros(module)[name]
+	if !ok {
+		return "", NewError(ErrorTypeTemplate, fmt.Sprintf("macro '%s' not found in template '%s'", name, t.name), nodes.Position{}, nil)
+	}
+
+	callKwargs := make(map[string]interface{}, len(kwargs))
+	for key, value := range kwargs {
+		callKwargs[key] = value
+	}
+	if caller, ok := callKwargs["caller"]; ok {
+		delete(callKwargs, "caller")
+		callerFunc, err := toCallerFunc(caller)
+		if err != nil {
+			return "", NewMacroError(name, err.Error(), macro.Position, nil)
+		}
+		callKwargs["__caller"] = callerFunc
+	}
+
+	result := NewEvaluator(module.Context).callFunction(macro, args, callKwargs, nil)
+	if err, ok := result.(error); ok {
+		return "", err
+	}
+	return toString(result), nil
+}
+
+// moduleMacros returns the macros exported by a module's root scope.
+func moduleMacros(module *MacroNamespace) map[string]*Macro {
+	macros := make(map[string]*Macro)
+	for _, name := range module.GetExportNames() {
+		value, _ := module.GetExport(name)
+		if macro, ok := value.(*Macro); ok {
+			macros[name] = macro
+		}
+	}
+	return macros
+}
+
+// toCallerFunc converts a Go value into the function bound to caller().
+func toCallerFunc(value interface{}) (GlobalFunc, error) {
+	switch v := value.(type) {
+	case GlobalFunc:
+		return v, nil
+	case func(*Context, ...interface{}) (interface{}, error):
+		return GlobalFunc(v), nil
+	case Markup:
+		return func(*Context, ...interface{}) (interface{}, error) { return v, nil }, nil
+	case string:
+		return func(*Context, ...interface{}) (interface{}, error) { return v, nil }, nil
+	default:
+		return nil, fmt.Errorf("caller must be a string or function, got %T", value)
+	}
+}
+
 // MakeModule executes the template in module mode and returns a namespace with exported members.
 func (t *Template) MakeModule(vars map[string]interface{}) (*MacroNamespace, error) {
-	ctx := t.newModuleContext(vars)
+	ctx := t.newModuleContext(vars, nil)
 	return t.makeModuleFromContext(ctx)
 }
 
@@ -382,7 +636,7 @@ func (t *Template) MakeModuleWithContext(ctx *Context, vars map[string]interface
 	defer func() { ctx.current = oldCurrent }()
 
 	oldAutoescape := ctx.autoescape
-	ctx.autoescape = t.autoescape
+	ctx.autoescape = t.Autoescape()
 	defer func() { ctx.autoescape = oldAutoescape }()
 
 	return t.makeModuleFromContext(ctx)
@@ -393,6 +647,20 @@ func (t *Template) Name() string {
 	return t.name
 }
 
+// Source returns the template source and true when it was retained at parse
+// time (see Environment.SetRetainSource).
+func (t *Template) Source() (string, bool) {
+	return t.source, t.hasSource
+}
+
+// loadPath returns the path relative template references resolve against.
+func (t *Template) loadPath() string {
+	if t.parentPath != "" {
+		return t.parentPath
+	}
+	return t.name
+}
+
 // Environment returns the template's environment
 func (t *Template) Environment() *Environment {
 	return t.environment
@@ -405,7 +673,22 @@ func (t *Template) AST() *nodes.Template {
 
 // Autoescape returns whether autoescaping is enabled
 func (t *Template) Autoescape() bool {
-	return t.autoescape
+	return atomic.LoadUint32(&t.autoescape) == 1
+}
+
+// SetAutoescape overrides the autoescape setting derived from the template
+// name, e.g. to force escaping for an in-memory template named "snippet".
+// It is safe to call while the template is rendering; renders that already
+// started keep the previous setting.
+func (t *Template) SetAutoescape(autoescape bool) {
+	atomic.StoreUint32(&t.autoescape, boolToUint32(autoescape))
+}
+
+func boolToUint32(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
 }
 
 // GetBlock returns a block by name
@@ -476,13 +759,17 @@ func (t *Template) RenderBlock(blockName string, vars map[string]interface{}, wr
 	}
 
 	ctx := NewContextWithEnvironment(t.environment, vars)
-	ctx.SetAutoescape(t.autoescape)
+	ctx.SetAutoescape(t.Autoescape())
 	ctx.current = t
 	ctx.writer = writer
+	if limited := t.limitOutput(ctx); limited != nil {
+		ctx.writer = limited
+	}
 
 	evaluator := NewEvaluator(ctx)
 	result := evaluator.Evaluate(block)
 	if err, ok := result.(error); ok {
+		t.logError(ctx, err)
 		return err
 	}
 
@@ -501,7 +788,7 @@ func (t *Template) RenderBlockToString(blockName string, vars map[string]interfa
 
 // String returns a string representation of the template
 func (t *Template) String() string {
-	return fmt.Sprintf("Template(name=%s, autoescape=%t)", t.name, t.autoescape)
+	return fmt.Sprintf("Template(name=%s, autoescape=%t)", t.name, t.Autoescape())
 }
 
 // InheritanceContext returns the template's inheritance context
@@ -1,7 +1,9 @@
 package runtime
 
 import (
+	"html/template"
 	"math"
+	"math/big"
 	"strings"
 	"testing"
 
@@ -122,6 +124,41 @@ func TestFilterAndTestPredicates(t *testing.T) {
 	}
 }
 
+type memberID int
+
+func TestInTestContainers(t *testing.T) {
+	vars := map[string]interface{}{
+		"ids":     []memberID{3, 5, 8},
+		"weights": [3]float64{1.5, 2, 2.5},
+		"lookup":  map[int]string{7: "seven"},
+		"tags":    []string{"go", "jinja"},
+		"rows":    []interface{}{[]interface{}{1, 2}, "x"},
+	}
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{ 5 is in range(10) }}|{{ 10 is in range(10) }}|{{ 4 is in range(0, 10, 2) }}|{{ 3 is in range(0, 10, 2) }}", "true|false|true|false"},
+		{"{{ 5 in range(10) }}|{{ 5 not in range(3) }}|{{ 5 is not in range(3) }}", "true|true|true"},
+		{"{{ 5 is in ids }}|{{ 4 is in ids }}", "true|false"},
+		{"{{ 2 is in weights }}|{{ 2.5 is in weights }}|{{ 3 is in weights }}", "true|true|false"},
+		{"{{ 7 is in lookup }}|{{ 8 is in lookup }}", "true|false"},
+		{"{{ 'go' is in tags }}|{{ 'py' in tags }}", "true|false"},
+		{"{{ [1, 2] is in rows }}|{{ 'x' in rows }}", "true|true"},
+		{"{{ 'ell' is in 'hello' }}|{{ 'z' in 'hello' }}", "true|false"},
+		{"{{ missing is not defined }}|{{ tags is not none }}", "true|true"},
+	}
+	for _, tt := range tests {
+		result, err := ExecuteToString(tt.template, vars)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if result != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, result)
+		}
+	}
+}
+
 func TestCallableAttribute(t *testing.T) {
 	ctx := map[string]interface{}{
 		"fn":   func() {},
@@ -173,6 +210,35 @@ func TestEscapedTest(t *testing.T) {
 	}
 }
 
+func TestEscapedTestHTMLTemplateTypes(t *testing.T) {
+	values := map[string]interface{}{
+		"html": template.HTML("<em>hi</em>"),
+		"js":   template.JS("a < b"),
+		"css":  template.CSS("a > b"),
+		"url":  template.URL("/?a=1&b=2"),
+	}
+	for name := range values {
+		tpl := "{% if " + name + " is escaped %}safe{% else %}unsafe{% endif %}"
+		result, err := ExecuteToString(tpl, values)
+		if err != nil {
+			t.Fatalf("execution error for %s: %v", name, err)
+		}
+		if result != "safe" {
+			t.Fatalf("expected %s to be escaped, got %q", name, result)
+		}
+	}
+
+	env := NewEnvironment()
+	env.SetAutoescape(true)
+	result, err := ExecuteToStringWithEnvironment(env, "{{ html|e }}", values)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if result != "<em>hi</em>" {
+		t.Fatalf("expected template.HTML not to be re-escaped, got %q", result)
+	}
+}
+
 func TestModuleTest(t *testing.T) {
 	namespace := NewMacroNamespace("helpers", nil)
 	result, err := ExecuteToString("{% if ns is module %}yes{% else %}no{% endif %}", map[string]interface{}{"ns": namespace})
@@ -303,6 +369,32 @@ func TestNamespaceGlobal(t *testing.T) {
 	}
 }
 
+func TestAutoNamespaceCreatesOnAssignment(t *testing.T) {
+	source := `{% set ns.total = 1 %}{% set ns.total = ns.total + 2 %}{{ ns.total }}`
+
+	env := NewEnvironment()
+	tpl, err := env.ParseString(source, "auto_namespace")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if _, err := tpl.ExecuteToString(nil); err == nil || !strings.Contains(err.Error(), "namespace 'ns' is undefined") {
+		t.Fatalf("expected undefined namespace error by default, got %v", err)
+	}
+
+	env.SetAutoNamespace(true)
+	tpl, err = env.ParseString(source, "auto_namespace")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	result, err := tpl.ExecuteToString(nil)
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	if result != "3" {
+		t.Fatalf("expected '3', got %q", result)
+	}
+}
+
 func TestNamespaceStatementCreatesNamespace(t *testing.T) {
 	tpl := `{% namespace ns %}{% set ns.value = 42 %}{% endnamespace %}{{ ns.value }}`
 	res, err := ExecuteToString(tpl, nil)
@@ -383,6 +475,39 @@ func TestDictGlobalKeywords(t *testing.T) {
 	}
 }
 
+func TestDictGlobalMergesMappings(t *testing.T) {
+	vars := map[string]interface{}{
+		"base":  map[string]interface{}{"a": 1, "b": 2},
+		"typed": map[string]string{"b": "typed"},
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{ dict(a=1, b=2)|tojson }}", `{"a":1,"b":2}`},
+		{"{{ dict(base, b=3, c=4)|tojson }}", `{"a":1,"b":3,"c":4}`},
+		{"{{ dict(base, typed)|tojson }}", `{"a":1,"b":"typed"}`},
+		{"{{ dict([['k', 'v'], ['n', 1]], n=2)|tojson }}", `{"k":"v","n":2}`},
+		{"{{ dict({'x': 1}, [[2, 'two']])[2] }}", "two"},
+		{"{{ base.b }}", "2"},
+	}
+
+	for _, tt := range tests {
+		res, err := ExecuteToString(tt.template, vars)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if res != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, res)
+		}
+	}
+
+	if _, err := ExecuteToString("{{ dict([['a', 1, 2]]) }}", nil); err == nil {
+		t.Fatalf("expected error for malformed pair")
+	}
+}
+
 func TestTranslationGlobals(t *testing.T) {
 	res, err := ExecuteToString("{{ _('Hello %(name)s', {'name': 'World'}) }}", nil)
 	if err != nil {
@@ -427,6 +552,87 @@ func TestDebugGlobal(t *testing.T) {
 	}
 }
 
+func TestDebugGlobalDump(t *testing.T) {
+	env := NewEnvironment()
+	tmpl, err := env.ParseString(`{% set greeting = "hi" %}{{ debug() }}`, "page.txt")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	res, err := tmpl.ExecuteToString(map[string]interface{}{"count": 3})
+	if err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	for _, want := range []string{"template: page.txt", `greeting = "hi"`, "count = 3", "filters: ", "upper", "tests: ", "defined", "globals: ", "range"} {
+		if !strings.Contains(res, want) {
+			t.Fatalf("expected debug output to contain %q, got:\n%s", want, res)
+		}
+	}
+
+	env.SetSandboxed(true)
+	ctx := NewContextWithEnvironment(env, map[string]interface{}{"count": 3})
+	dump, err := ctx.debugFunc()
+	if err != nil {
+		t.Fatalf("debug error: %v", err)
+	}
+	if res := dump.(string); !strings.Contains(res, "count = 3") || strings.Contains(res, "globals:") {
+		t.Fatalf("expected sandboxed debug output without globals, got:\n%s", res)
+	}
+}
+
+func TestRaiseGlobal(t *testing.T) {
+	env := NewEnvironment()
+	env.SetLoader(NewMapLoader(map[string]string{
+		"guard.txt": "{% if user is not defined %}{{ raise('missing required field') }}{% endif %}ok",
+		"page.txt":  "start\n{% include 'guard.txt' %}",
+	}))
+
+	tmpl, err := env.GetTemplate("page.txt")
+	if err != nil {
+		t.Fatalf("load error: %v", err)
+	}
+	_, err = tmpl.ExecuteToString(map[string]interface{}{})
+	if err == nil {
+		t.Fatal("expected raise to abort rendering")
+	}
+	if !strings.Contains(err.Error(), "missing required field") || !strings.Contains(err.Error(), "line 1") {
+		t.Fatalf("expected raised message with position, got %v", err)
+	}
+
+	out, err := tmpl.ExecuteToString(map[string]interface{}{"user": "ann"})
+	if err != nil || out != "start\nok" {
+		t.Fatalf("expected guard to pass, got %q (%v)", out, err)
+	}
+
+	if _, err := ExecuteToString("{% if true %}{{ error('bad input') }}{% endif %}", nil); err == nil || !strings.Contains(err.Error(), "bad input") {
+		t.Fatalf("expected error alias to raise, got %v", err)
+	}
+}
+
+func TestAssertGlobal(t *testing.T) {
+	vars := map[string]interface{}{
+		"user":  map[string]interface{}{"id": 7},
+		"guest": map[string]interface{}{"id": nil},
+	}
+
+	out, err := ExecuteToString("[{{ assert(user.id, 'user must have id') }}]{{ assert(true) }}", vars)
+	if err != nil {
+		t.Fatalf("unexpected assertion failure: %v", err)
+	}
+	if out != "[]" {
+		t.Fatalf("expected passing assertions to render nothing, got %q", out)
+	}
+
+	_, err = ExecuteToString("{{ assert(guest.id, 'user must have id') }}", vars)
+	if err == nil || !strings.Contains(err.Error(), "assertion failed: user must have id") {
+		t.Fatalf("expected assertion message, got %v", err)
+	}
+
+	_, err = ExecuteToString("{{ assert([]) }}", nil)
+	if err == nil || !strings.Contains(err.Error(), "assertion failed") {
+		t.Fatalf("expected default assertion message, got %v", err)
+	}
+}
+
 func TestClassGlobal(t *testing.T) {
 	res, err := ExecuteToString(`{% set User = class('User', {'role': 'guest'}) %}{{ User.role }}`, nil)
 	if err != nil {
@@ -740,3 +946,116 @@ func TestComparisonAliases(t *testing.T) {
 		t.Fatalf("expected 'no', got %q", result)
 	}
 }
+
+type hasTestUser struct {
+	Name string
+}
+
+func (u hasTestUser) Greeting() string {
+	return "hi " + u.Name
+}
+
+func TestHasAttributeTest(t *testing.T) {
+	ctx := map[string]interface{}{
+		"user":   hasTestUser{Name: "ann"},
+		"config": map[string]interface{}{"debug": false, "empty": nil},
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{ user is has('Name') }}", "true"},
+		{"{{ user is hasattr('Greeting') }}", "true"},
+		{"{{ user is has('Email') }}", "false"},
+		{"{{ config is has('debug') }}", "true"},
+		{"{{ config is has('missing') }}", "false"},
+		{"{{ missing is has('debug') }}", "false"},
+		{"{% if config is not has('port') %}default{% endif %}", "default"},
+	}
+
+	for _, tt := range tests {
+		result, err := ExecuteToString(tt.template, ctx)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if result != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, result)
+		}
+	}
+}
+
+func TestEmptyAndOneTests(t *testing.T) {
+	ctx := map[string]interface{}{
+		"none_list": []interface{}{},
+		"one_list":  []string{"a"},
+		"two_list":  []int{1, 2},
+		"no_keys":   map[string]interface{}{},
+		"one_key":   map[string]int{"a": 1},
+		"blank":     "",
+		"char":      "é",
+		"word":      "go",
+		"zero":      0,
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{ none_list is empty }}|{{ none_list is one }}", "true|false"},
+		{"{{ one_list is empty }}|{{ one_list is one }}", "false|true"},
+		{"{{ two_list is empty }}|{{ two_list is one }}", "false|false"},
+		{"{{ no_keys is empty }}|{{ no_keys is one }}", "true|false"},
+		{"{{ one_key is empty }}|{{ one_key is one }}", "false|true"},
+		{"{{ blank is empty }}|{{ char is one }}|{{ word is one }}", "true|true|false"},
+		{"{{ missing is empty }}|{{ missing is one }}", "true|false"},
+		{"{{ zero is empty }}|{{ zero is one }}", "true|false"},
+		{"{{ two_list|count }}|{{ word|count }}", "2|2"},
+	}
+
+	for _, tt := range tests {
+		result, err := ExecuteToString(tt.template, ctx)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if result != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, result)
+		}
+	}
+}
+
+func TestNumberTestCoversUnsignedAndBigNumbers(t *testing.T) {
+	type cents int64
+	huge, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	ctx := map[string]interface{}{
+		"u":     uint64(40),
+		"small": uint8(2),
+		"b":     big.NewInt(7),
+		"huge":  huge,
+		"bf":    big.NewFloat(1.5),
+		"price": cents(250),
+		"flag":  true,
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{ u is number }}|{{ small is number }}|{{ b is number }}|{{ bf is number }}|{{ price is number }}", "true|true|true|true|true"},
+		{"{{ flag is number }}|{{ '1' is number }}", "false|false"},
+		{"{{ b is integer }}|{{ bf is float }}|{{ u is integer }}|{{ price is integer }}", "true|true|true|true"},
+		{"{{ u + 2 }}|{{ u * small }}|{{ b * 6 }}|{{ price / 100 }}|{{ bf + 1 }}", "42|80|42|2.5|2.5"},
+		{"{{ u > b }}|{{ b < 8 }}|{{ huge > u }}|{{ u == 40 }}|{{ b == 7.0 }}", "true|true|true|true|true"},
+		{"{{ [u, b, small]|max }}|{{ [u, b, small]|sort|join(',') }}", "40|2,7,40"},
+	}
+
+	for _, tt := range tests {
+		result, err := ExecuteToString(tt.template, ctx)
+		if err != nil {
+			t.Fatalf("%s: execution error: %v", tt.template, err)
+		}
+		if result != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, result)
+		}
+	}
+}
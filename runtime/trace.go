@@ -0,0 +1,79 @@
+package runtime
+
+import (
+	"time"
+
+	"github.com/deicod/gojinja/nodes"
+)
+
+// TraceEvent describes a single filter, test or macro invocation.
+type TraceEvent struct {
+	Kind     string        // "filter", "test" or "macro"
+	Name     string        // filter, test or macro name
+	Input    interface{}   // the filtered or tested value; nil for macros
+	Args     []interface{} // positional arguments, followed by a kwargs map if any
+	Duration time.Duration // time spent in the call
+	Result   interface{}
+	Err      error
+}
+
+// TraceHook receives a TraceEvent after each traced invocation.
+type TraceHook func(TraceEvent)
+
+// SetTraceHook installs a hook invoked after every filter, test and macro
+// call, which helps to profile slow templates. Passing nil disables tracing.
+func (env *Environment) SetTraceHook(hook TraceHook) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.traceHook = hook
+}
+
+// TraceHook returns the hook registered via SetTraceHook.
+func (env *Environment) TraceHook() TraceHook {
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+	return env.traceHook
+}
+
+// ErrorLogger receives template execution errors together with the name of
+// the template that failed and the position recorded on the error.
+type ErrorLogger func(err error, templateName string, pos nodes.Position)
+
+// SetErrorLogger installs a logger invoked once for every error a template
+// execution produces. The logger only observes errors; they are still
+// returned to the caller. Passing nil disables logging.
+func (env *Environment) SetErrorLogger(logger ErrorLogger) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.errorLogger = logger
+}
+
+// ErrorLogger returns the logger registered via SetErrorLogger.
+func (env *Environment) ErrorLogger() ErrorLogger {
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+	return env.errorLogger
+}
+
+// contextTraceHook returns the trace hook of the context's environment, or
+// nil when tracing is disabled.
+func contextTraceHook(ctx *Context) TraceHook {
+	if ctx == nil || ctx.environment == nil {
+		return nil
+	}
+	return ctx.environment.TraceHook()
+}
+
+// traceCall runs call and reports it to the trace hook, if one is installed,
+// as an invocation of the given kind and name. The event's arguments are
+// only assembled when a hook is present.
+func (e *Evaluator) traceCall(kind, name string, input interface{}, args []interface{}, kwargs map[string]interface{}, call func() (interface{}, error)) (interface{}, error) {
+	if e.hook == nil {
+		return call()
+	}
+	callArgs := appendCallArgs(args, kwargs)
+	start := time.Now()
+	result, err := call()
+	e.hook(TraceEvent{Kind: kind, Name: name, Input: input, Args: callArgs, Duration: time.Since(start), Result: result, Err: err})
+	return result, err
+}
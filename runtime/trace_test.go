@@ -0,0 +1,182 @@
+package runtime
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/deicod/gojinja/nodes"
+)
+
+func TestTraceHookEmitsEventsInOrder(t *testing.T) {
+	env := NewEnvironment()
+	var events []TraceEvent
+	env.SetTraceHook(func(ev TraceEvent) {
+		events = append(events, ev)
+	})
+
+	source := `{% macro shout(s) %}{{ s }}!{% endmacro %}{{ name|upper|replace("A", "4") }}{% if 3 is odd %}{{ shout("x") }}{% endif %}{{ ""|default("d", boolean=true) }}`
+	out, err := ExecuteToStringWithEnvironment(env, source, map[string]interface{}{"name": "ada"})
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	if out != "4D4x!d" {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	var got []string
+	for _, ev := range events {
+		got = append(got, fmt.Sprintf("%s:%s(%v)=%v", ev.Kind, ev.Name, ev.Input, ev.Result))
+		if ev.Duration < 0 || ev.Err != nil {
+			t.Fatalf("unexpected event %+v", ev)
+		}
+	}
+	expected := []string{
+		"filter:upper(ada)=ADA",
+		"filter:replace(ADA)=4D4",
+		"test:odd(3)=true",
+		"macro:shout(<nil>)=x!",
+		"filter:default()=d",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected events:\n%s", strings.Join(got, "\n"))
+	}
+	if args := events[1].Args; len(args) != 2 || args[0] != "A" || args[1] != "4" {
+		t.Fatalf("unexpected replace args %v", args)
+	}
+	if kwargs, ok := events[4].Args[1].(map[string]interface{}); !ok || kwargs["boolean"] != true {
+		t.Fatalf("expected kwargs in default args, got %v", events[4].Args)
+	}
+
+	events = nil
+	env.SetTraceHook(nil)
+	if _, err := ExecuteToStringWithEnvironment(env, source, map[string]interface{}{"name": "ada"}); err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("expected no events without a hook, got %d", len(events))
+	}
+}
+
+func TestTraceHookReportsErrors(t *testing.T) {
+	env := NewEnvironment()
+	var events []TraceEvent
+	env.SetTraceHook(func(ev TraceEvent) {
+		events = append(events, ev)
+	})
+
+	if _, err := ExecuteToStringWithEnvironment(env, `{{ "x"|batch(0) }}`, nil); err == nil {
+		t.Fatal("expected filter error")
+	}
+	if len(events) != 1 || events[0].Name != "batch" || events[0].Err == nil {
+		t.Fatalf("expected failing batch event, got %+v", events)
+	}
+}
+
+func TestErrorLoggerReceivesTemplateAndPosition(t *testing.T) {
+	env := NewEnvironment()
+	env.SetLoader(NewMapLoader(map[string]string{
+		"page.txt":    "header\n{% include 'partial.txt' %}",
+		"partial.txt": "line one\n  {{ value|int }}",
+		"ok.txt":      "{{ 1 + 1 }}",
+	}))
+
+	type entry struct {
+		err  error
+		name string
+		pos  nodes.Position
+	}
+	var logged []entry
+	env.SetErrorLogger(func(err error, templateName string, pos nodes.Position) {
+		logged = append(logged, entry{err, templateName, pos})
+	})
+
+	_, err := env.RenderTemplate("page.txt", map[string]interface{}{"value": []int{1}})
+	if err == nil {
+		t.Fatal("expected int filter error")
+	}
+	if len(logged) != 1 {
+		t.Fatalf("expected the error to be logged once, got %d entries", len(logged))
+	}
+	if logged[0].err != err {
+		t.Fatalf("expected logger to observe the returned error, got %v", logged[0].err)
+	}
+	if logged[0].name != "partial.txt" || logged[0].pos.Line != 2 {
+		t.Fatalf("unexpected log entry: %q at %+v", logged[0].name, logged[0].pos)
+	}
+
+	logged = nil
+	if _, err := env.RenderTemplate("ok.txt", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	env.SetErrorLogger(nil)
+	if _, err := env.RenderTemplate("page.txt", map[string]interface{}{"value": []int{1}}); err == nil {
+		t.Fatal("expected error without a logger")
+	}
+	if len(logged) != 0 {
+		t.Fatalf("expected no log entries, got %d", len(logged))
+	}
+}
+
+func TestErrorLoggerCoversEveryRenderPath(t *testing.T) {
+	env := NewEnvironment()
+	var names []string
+	env.SetErrorLogger(func(err error, templateName string, pos nodes.Position) {
+		names = append(names, templateName)
+	})
+
+	tmpl, err := env.ParseString("a{% block body %}{{ value|int }}{% endblock %}", "page.txt")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	vars := map[string]interface{}{"value": []int{1}}
+
+	renders := map[string]func() error{
+		"Template.Execute": func() error { return tmpl.Execute(vars, &bytes.Buffer{}) },
+		"Template.ExecuteToString": func() error {
+			_, err := tmpl.ExecuteToString(vars)
+			return err
+		},
+		"Environment.ExecuteToString": func() error {
+			_, err := env.ExecuteToString(tmpl, vars)
+			return err
+		},
+		"Template.Stream": func() error {
+			stream, err := tmpl.Stream(vars)
+			if err != nil {
+				return err
+			}
+			defer stream.Close()
+			_, err = io.ReadAll(stream)
+			return err
+		},
+		"Template.RenderBlock": func() error { return tmpl.RenderBlock("body", vars, &bytes.Buffer{}) },
+	}
+	for name, render := range renders {
+		names = nil
+		if err := render(); err == nil {
+			t.Fatalf("%s: expected render error", name)
+		}
+		if len(names) != 1 || names[0] != "page.txt" {
+			t.Fatalf("%s: expected one log entry for page.txt, got %v", name, names)
+		}
+	}
+
+	// The output is only found to exceed the limit once the trailing
+	// newline has been trimmed, after rendering itself succeeded.
+	limited := NewEnvironment()
+	limited.SetMaxOutputBytes(3)
+	names = nil
+	limited.SetErrorLogger(func(err error, templateName string, pos nodes.Position) {
+		names = append(names, templateName)
+	})
+	if _, err := ExecuteToStringWithEnvironment(limited, "abcd", nil); !errors.Is(err, ErrOutputLimitExceeded) {
+		t.Fatalf("expected output limit error, got %v", err)
+	}
+	if len(names) != 1 {
+		t.Fatalf("expected the output limit error to be logged once, got %v", names)
+	}
+}
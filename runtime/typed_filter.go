@@ -0,0 +1,180 @@
+package runtime
+
+import (
+	"fmt"
+	"reflect"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// AddFilterTyped registers a strongly typed Go function as a filter. The
+// function receives the filtered value as its first parameter, optionally
+// preceded by a *Context, followed by the filter arguments. Template values
+// are coerced to the declared parameter types, so a func(string, int) string
+// can be called as {{ value|name("3") }}. The function may return a single
+// value, a value and an error, or only an error.
+func (env *Environment) AddFilterTyped(name string, fn interface{}) error {
+	filter, err := newTypedFilter(name, fn)
+	if err != nil {
+		return err
+	}
+	env.AddFilter(name, filter)
+	return nil
+}
+
+func newTypedFilter(name string, fn interface{}) (FilterFunc, error) {
+	fnValue := reflect.ValueOf(fn)
+	if fnValue.Kind() != reflect.Func || fnValue.IsNil() {
+		return nil, fmt.Errorf("filter %q must be a function, got %T", name, fn)
+	}
+	fnType := fnValue.Type()
+
+	params := make([]reflect.Type, fnType.NumIn())
+	for i := range params {
+		params[i] = fnType.In(i)
+	}
+	takesContext := len(params) > 0 && params[0] == contextType
+	if takesContext {
+		params = params[1:]
+	}
+	if len(params) == 0 {
+		return nil, fmt.Errorf("filter %q must accept the filtered value", name)
+	}
+
+	switch fnType.NumOut() {
+	case 1:
+	case 2:
+		if fnType.Out(1) != errorType {
+			return nil, fmt.Errorf("filter %q must return an error as its second result", name)
+		}
+	default:
+		return nil, fmt.Errorf("filter %q must return one value or a value and an error", name)
+	}
+
+	variadic := fnType.IsVariadic()
+	fixed := len(params)
+	if variadic {
+		fixed--
+	}
+
+	return func(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+		inputs := append([]interface{}{value}, args...)
+		if variadic && len(inputs) < fixed {
+			return nil, fmt.Errorf("filter %q expects at least %d arguments, got %d", name, fixed-1, len(args))
+		}
+		if !variadic && len(inputs) != fixed {
+			return nil, fmt.Errorf("filter %q expects %d arguments, got %d", name, fixed-1, len(args))
+		}
+
+		callArgs := make([]reflect.Value, 0, len(inputs)+1)
+		if takesContext {
+			callArgs = append(callArgs, reflect.ValueOf(ctx))
+		}
+		for i, input := range inputs {
+			target := params[len(params)-1]
+			if i < fixed {
+				target = params[i]
+			} else {
+				target = target.Elem()
+			}
+			converted, err := coerceArgument(input, target)
+			if err != nil {
+				if i == 0 {
+					return nil, fmt.Errorf("filter %q: value: %v", name, err)
+				}
+				return nil, fmt.Errorf("filter %q: argument %d: %v", name, i, err)
+			}
+			callArgs = append(callArgs, converted)
+		}
+
+		results := fnValue.Call(callArgs)
+		if len(results) == 2 {
+			if errVal := results[1].Interface(); errVal != nil {
+				return nil, errVal.(error)
+			}
+			return results[0].Interface(), nil
+		}
+		if results[0].Type() == errorType {
+			if errVal := results[0].Interface(); errVal != nil {
+				return nil, errVal.(error)
+			}
+			return nil, nil
+		}
+		return results[0].Interface(), nil
+	}, nil
+}
+
+// coerceArgument converts a template value to the given parameter type. It is
+// shared by typed filters and Go functions called from templates. Values are
+// turned into strings with the template string conversion, numbers convert
+// between numeric kinds as long as no value is lost, and numeric strings are
+// parsed for numeric parameters.
+func coerceArgument(value interface{}, target reflect.Type) (reflect.Value, error) {
+	if isUndefinedValue(value) {
+		if target.Kind() == reflect.String {
+			return reflect.ValueOf("").Convert(target), nil
+		}
+		value = nil
+	}
+	if value == nil {
+		switch target.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+			return reflect.Zero(target), nil
+		}
+		return reflect.Value{}, fmt.Errorf("cannot use none as %s", target)
+	}
+
+	val := reflect.ValueOf(value)
+	if val.Type().AssignableTo(target) {
+		converted := reflect.New(target).Elem()
+		converted.Set(val)
+		return converted, nil
+	}
+
+	switch {
+	case target.Kind() == reflect.String:
+		converted := reflect.New(target).Elem()
+		converted.SetString(toString(value))
+		return converted, nil
+	case isNumericKind(target.Kind()):
+		switch v := value.(type) {
+		case string:
+			return coerceNumericString(v, target)
+		case Markup:
+			return coerceNumericString(string(v), target)
+		}
+		if isNumericKind(val.Kind()) {
+			return convertNumber(val, target)
+		}
+		if num, ok := classifyNumber(value); ok && !num.isFloat() {
+			return convertNumber(reflect.ValueOf(num.intValue), target)
+		}
+	case target.Kind() == reflect.Slice:
+		items, err := sequenceToSlice(value)
+		if err != nil {
+			break
+		}
+		result := reflect.MakeSlice(target, len(items), len(items))
+		for i, item := range items {
+			elem, err := coerceArgument(item, target.Elem())
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("element %d: %v", i, err)
+			}
+			result.Index(i).Set(elem)
+		}
+		return result, nil
+	}
+
+	if val.Type().ConvertibleTo(target) && target.Kind() != reflect.Array && target.Kind() != reflect.Ptr {
+		return val.Convert(target), nil
+	}
+	return reflect.Value{}, fmt.Errorf("cannot convert %T to %s", value, target)
+}
+
+func coerceNumericString(str string, target reflect.Type) (reflect.Value, error) {
+	parsed, err := parseNumericString(str)
+	if err != nil {
+		return reflect.Value{}, fmt.Errorf("cannot convert %q to %s", str, target)
+	}
+	return convertNumber(reflect.ValueOf(parsed), target)
+}
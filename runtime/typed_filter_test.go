@@ -0,0 +1,103 @@
+package runtime
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAddFilterTypedCoercesArguments(t *testing.T) {
+	env := NewEnvironment()
+	if err := env.AddFilterTyped("repeat", func(s string, n int) string {
+		return strings.Repeat(s, n)
+	}); err != nil {
+		t.Fatalf("register repeat: %v", err)
+	}
+	if err := env.AddFilterTyped("total", func(values []int) int {
+		sum := 0
+		for _, v := range values {
+			sum += v
+		}
+		return sum
+	}); err != nil {
+		t.Fatalf("register total: %v", err)
+	}
+	if err := env.AddFilterTyped("wrap", func(s string, parts ...string) string {
+		return strings.Join(parts, s)
+	}); err != nil {
+		t.Fatalf("register wrap: %v", err)
+	}
+	if err := env.AddFilterTyped("half", func(ctx *Context, f float64) (string, error) {
+		if ctx == nil {
+			return "", errors.New("missing context")
+		}
+		if f < 0 {
+			return "", errors.New("negative input")
+		}
+		return strings.TrimRight(strings.TrimRight(toString(f/2), "0"), "."), nil
+	}); err != nil {
+		t.Fatalf("register half: %v", err)
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{`{{ "ab"|repeat(3) }}`, "ababab"},
+		{`{{ "ab"|repeat("2") }}`, "abab"},
+		{`{{ "ab"|repeat(two) }}`, "abab"},
+		{`{{ 7|repeat(2) }}`, "77"},
+		{`{{ ["1", 2, 3.0]|total }}`, "6"},
+		{`{{ "-"|wrap("a", 1, "c") }}`, "a-1-c"},
+		{`{{ "-"|wrap }}`, ""},
+		{`{{ "5"|half }}`, "2.5"},
+	}
+
+	for _, tt := range tests {
+		tmpl, err := env.ParseString(tt.template, "typed")
+		if err != nil {
+			t.Fatalf("%s: parse error: %v", tt.template, err)
+		}
+		result, err := tmpl.ExecuteToString(map[string]interface{}{"two": 2.0})
+		if err != nil {
+			t.Fatalf("%s: execute error: %v", tt.template, err)
+		}
+		if result != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, result)
+		}
+	}
+
+	failures := map[string]string{
+		`{{ "ab"|repeat("x") }}`:      "argument 1",
+		`{{ "ab"|repeat(fraction) }}`: "losing precision",
+		`{{ "ab"|repeat }}`:           "expects 1 arguments",
+		`{{ -1|half }}`:               "negative input",
+	}
+	for source, want := range failures {
+		tmpl, err := env.ParseString(source, "typed_error")
+		if err != nil {
+			t.Fatalf("%s: parse error: %v", source, err)
+		}
+		if _, err := tmpl.ExecuteToString(map[string]interface{}{"fraction": 1.5}); err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("%s: expected error containing %q, got %v", source, want, err)
+		}
+	}
+}
+
+func TestAddFilterTypedRejectsInvalidFunctions(t *testing.T) {
+	env := NewEnvironment()
+	invalid := []interface{}{
+		"not a function",
+		func() string { return "" },
+		func(string) {},
+		func(string) (string, string) { return "", "" },
+	}
+	for _, fn := range invalid {
+		if err := env.AddFilterTyped("bad", fn); err == nil {
+			t.Fatalf("expected registration error for %T", fn)
+		}
+	}
+	if _, ok := env.GetFilter("bad"); ok {
+		t.Fatal("invalid typed filter should not be registered")
+	}
+}
@@ -109,3 +109,19 @@ func isStrictUndefined(value interface{}) bool {
 	_, ok := value.(StrictUndefined)
 	return ok
 }
+
+// undefinedName returns the name an undefined value was created for, or ""
+// for undefined values that do not record one.
+func undefinedName(value undefinedType) string {
+	switch v := value.(type) {
+	case ChainableUndefined:
+		return v.name
+	case SilentUndefined:
+		return v.name
+	case StrictUndefined:
+		return v.name
+	case DebugUndefined:
+		return v.name
+	}
+	return ""
+}
@@ -1,6 +1,9 @@
 package runtime
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestUndefinedFactoryDebugDefault(t *testing.T) {
 	env := NewEnvironment()
@@ -55,6 +58,80 @@ func TestStrictUndefinedRaisesError(t *testing.T) {
 	}
 }
 
+func TestUndefinedThroughFilters(t *testing.T) {
+	env := NewEnvironment()
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"[{{ missing|upper }}]", "[]"},
+		{"[{{ missing|length }}]", "[]"},
+		{"{{ missing|upper|default('fallback') }}", "fallback"},
+		{"{{ missing|default('x')|upper }}", "X"},
+		{"{% if missing|upper %}y{% else %}n{% endif %}", "n"},
+		{"{% if missing|length %}y{% else %}n{% endif %}", "n"},
+		{"{{ not missing|upper }}|{{ missing|upper or 'b' }}|{{ missing|upper and 'b' }}", "true|b|"},
+		{"{% if missing %}y{% else %}n{% endif %}", "n"},
+	}
+	for _, tt := range tests {
+		out, err := ExecuteToStringWithEnvironment(env, tt.template, nil)
+		if err != nil {
+			t.Fatalf("%s: execute error: %v", tt.template, err)
+		}
+		if out != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, out)
+		}
+	}
+
+	for _, source := range []string{"{{ (missing|length) + 1 }}", "{{ 2 * missing|upper }}"} {
+		_, err := ExecuteToStringWithEnvironment(env, source, nil)
+		if !IsUndefinedError(err) || !strings.Contains(err.Error(), "'missing' is undefined") {
+			t.Fatalf("%s: expected undefined error for arithmetic, got %v", source, err)
+		}
+	}
+
+	strict := NewEnvironment()
+	strict.SetUndefinedFactory(func(name string) undefinedType {
+		return StrictUndefined{name: name}
+	})
+	_, err := ExecuteToStringWithEnvironment(strict, "ok\n{{ missing|upper }}", nil)
+	if !IsUndefinedError(err) {
+		t.Fatalf("expected undefined error, got %v", err)
+	}
+	if want := "line 2"; !strings.Contains(err.Error(), want) || !strings.Contains(err.Error(), "'missing' is undefined") {
+		t.Fatalf("expected positioned undefined error, got %v", err)
+	}
+
+	out, err := ExecuteToStringWithEnvironment(strict, "{{ missing|default('d')|upper }}", nil)
+	if err != nil || out != "D" {
+		t.Fatalf("expected default to handle strict undefined, got %q (%v)", out, err)
+	}
+
+	for _, e := range []*Environment{env, strict} {
+		if _, err := ExecuteToStringWithEnvironment(e, "{{ missing|nosuchfilter }}", nil); err == nil || !strings.Contains(err.Error(), "unknown filter") {
+			t.Fatalf("expected unknown filter error for undefined input, got %v", err)
+		}
+	}
+
+	custom := env.Clone()
+	custom.AddUndefinedFilter("or_dash", func(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+		if isUndefinedValue(value) {
+			return "-", nil
+		}
+		return value, nil
+	})
+	out, err = ExecuteToStringWithEnvironment(custom, "{{ missing|or_dash }}|{{ 'x'|or_dash }}", nil)
+	if err != nil || out != "-|x" {
+		t.Fatalf("expected undefined filter to receive undefined input, got %q (%v)", out, err)
+	}
+	custom.AddFilter("or_dash", func(ctx *Context, value interface{}, args ...interface{}) (interface{}, error) {
+		return "-", nil
+	})
+	if out, err = ExecuteToStringWithEnvironment(custom, "[{{ missing|or_dash }}]", nil); err != nil || out != "[]" {
+		t.Fatalf("expected AddFilter to restore pass-through, got %q (%v)", out, err)
+	}
+}
+
 func TestMissingAttributeResolvesToUndefined(t *testing.T) {
 	env := NewEnvironment()
 	tmpl, err := env.ParseString(`{{ user.name|default('anon') }}`, "attr_missing")
@@ -93,6 +170,39 @@ func TestChainableUndefinedPropagatesThroughLookups(t *testing.T) {
 	}
 }
 
+func TestUndefinedChainThroughMissingIntermediate(t *testing.T) {
+	vars := map[string]interface{}{"site": map[string]interface{}{"name": "Blog"}}
+	factories := map[string]UndefinedFactory{
+		"debug":     func(name string) undefinedType { return DebugUndefined{name: name} },
+		"strict":    func(name string) undefinedType { return StrictUndefined{name: name} },
+		"chainable": func(name string) undefinedType { return ChainableUndefined{name: name} },
+	}
+	source := `{{ site.theme.color|default('none') }}|{{ site.theme.color is defined }}|` +
+		`{{ site.theme.color is undefined }}|{% if site.theme.color is not defined %}skip{% endif %}`
+
+	for mode, factory := range factories {
+		env := NewEnvironment()
+		env.SetUndefinedFactory(factory)
+		output, err := ExecuteToStringWithEnvironment(env, source, vars)
+		if err != nil {
+			t.Fatalf("%s: execute error: %v", mode, err)
+		}
+		if output != "none|false|true|skip" {
+			t.Fatalf("%s: unexpected output %q", mode, output)
+		}
+	}
+
+	env := NewEnvironment()
+	env.SetUndefinedFactory(factories["chainable"])
+	output, err := ExecuteToStringWithEnvironment(env, `[{{ site.theme.color }}{{ site['theme']['color'] }}]`, vars)
+	if err != nil {
+		t.Fatalf("chainable: execute error: %v", err)
+	}
+	if output != "[]" {
+		t.Fatalf("expected chainable undefined to render empty, got %q", output)
+	}
+}
+
 func TestMissingIndexReturnsUndefined(t *testing.T) {
 	env := NewEnvironment()
 	tmpl, err := env.ParseString(`{{ data['missing']|default('none') }}`, "index_missing")
@@ -109,3 +219,46 @@ func TestMissingIndexReturnsUndefined(t *testing.T) {
 		t.Fatalf("expected default for missing index, got %q", output)
 	}
 }
+
+func TestDefaultFilterUndefinedNoneAndFalsy(t *testing.T) {
+	vars := map[string]interface{}{
+		"data":  map[string]interface{}{"nothing": nil},
+		"zero":  0,
+		"empty": "",
+		"name":  "go",
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{`{{ missing|default('x') }}`, "x"},
+		{`{{ missing|default('x', only_none=true) }}`, "x"},
+		{`[{{ missing|default(only_none=true) }}]`, "[]"},
+		{`[{{ none|default(only_none=true) }}]`, "[]"},
+		{`{{ missing|default({'a': 1})|length }}`, "1"},
+		{`{{ missing|default('x', true) }}`, "x"},
+		{`[{{ none|default('x') }}]`, "[]"},
+		{`{{ none|default('x', only_none=true) }}`, "x"},
+		{`{{ data.nothing|default('x', only_none=true) }}`, "x"},
+		{`{{ none|default('x', true) }}`, "x"},
+		{`{{ none|default('x', boolean=true) }}`, "x"},
+		{`{{ zero|default('x') }}`, "0"},
+		{`{{ zero|default('x', only_none=true) }}`, "0"},
+		{`{{ zero|default('x', true) }}`, "x"},
+		{`{{ empty|default('x', only_none=true) }}`, ""},
+		{`{{ empty|default('x', true) }}`, "x"},
+		{`{{ name|default('x', true, only_none=true) }}`, "go"},
+		{`{{ zero|default('x', true, only_none=true) }}`, "x"},
+	}
+
+	for _, tt := range tests {
+		output, err := ExecuteToString(tt.template, vars)
+		if err != nil {
+			t.Fatalf("%s: execute error: %v", tt.template, err)
+		}
+		if output != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.template, tt.expected, output)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package runtime
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWhitespaceControlMarkers(t *testing.T) {
+	tests := []struct {
+		name     string
+		trim     bool
+		lstrip   bool
+		template string
+		expected string
+	}{
+		{"markers", false, false, "a  \n {%- if true -%}  \n b {{- 'y' -}} c {#- note -#}\n d{% endif %}", "abycd"},
+		{"plain", false, false, "a\n  {% if true %}\nb\n{% endif %}", "a\n  \nb"},
+		{"trim_blocks", true, false, "{% if true %}\nx{% endif %}\n\ny", "x\ny"},
+		{"trim_blocks ignores later newlines", true, false, "{% if true %}x{{ 'y' }}\nz{% endif %}", "xy\nz"},
+		{"lstrip_blocks", false, true, "a\n    {% if true %}\n  b\n  {% endif %}\nc {% if 1 %}x{% endif %}", "a\n\n  b\n\nc x"},
+		{"lstrip_blocks leaves variables", false, true, "  {{ 'v' }}", "  v"},
+		{"plus keeps indentation under lstrip_blocks", false, true, "a\n    {%+ if true %}b{% endif %}\n  {% if true %}c{% endif %}", "a\n    b\nc"},
+		{"plus and minus mixed", false, true, "x\n  {%+ if true -%}\n  y\n  {%- endif %}\n  {#+ keep #}z", "x\n  y\n  z"},
+		{"plus on raw under lstrip_blocks", false, true, "  {%+ raw %}r{% endraw %}", "  r"},
+		{"plus end disables trim_blocks", true, false, "{% if true +%}\nx{% endif %}\n{% if true %}\ny{% endif %}", "\nxy"},
+		{"plus end on comment", true, true, "{# c +#}\nv", "\nv"},
+		{"trim_blocks strips only the first newline", true, false, "{% if true %}\n\n\nx{% endif %}", "\n\nx"},
+		{"trim_blocks strips one CRLF", true, false, "{% if true %}\r\n\r\nx{% endif %}", "\nx"},
+		{"trim_blocks after comment", true, false, "{# c #}\n\nx", "\nx"},
+		{"trim_blocks after endraw", true, false, "{% raw %}r{% endraw %}\n\nx", "r\nx"},
+		{"markers on raw tags", false, false, "  {%- raw -%}  x  {%- endraw -%}  y", "xy"},
+		{"inner markers on raw tags", false, false, "a {% raw -%} \t{{ x }}  {%- endraw %} b", "a {{ x }} b"},
+		{"trim_blocks with minus marker", true, false, "{% if true -%}\n\n x{% endif %}", "x"},
+		{"trim_blocks with lstrip_blocks", true, true, "  {% if true %}\n\n  x\n  {% endif %}\n\ny", "\n  x\n\ny"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := NewEnvironment()
+			env.SetTrimBlocks(tt.trim)
+			env.SetLstripBlocks(tt.lstrip)
+			out, err := ExecuteToStringWithEnvironment(env, tt.template, nil)
+			if err != nil {
+				t.Fatalf("execute error: %v", err)
+			}
+			if out != tt.expected {
+				t.Fatalf("expected %q, got %q", tt.expected, out)
+			}
+		})
+	}
+}
+
+func TestWhitespaceDebugReport(t *testing.T) {
+	env := NewEnvironment()
+	env.SetTrimBlocks(true)
+
+	source := "<ul>\n  {%- for item in items %}\n  <li>{{ item -}} </li>\n  {%- endfor %}\n</ul>"
+	tmpl, err := env.ParseString(source, "report")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if report := tmpl.WhitespaceReport(); len(report) != 0 {
+		t.Fatalf("expected no report without whitespace debug, got %v", report)
+	}
+
+	env.SetWhitespaceDebug(true)
+	tmpl, err = env.ParseString(source, "report_debug")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	out, err := tmpl.ExecuteToString(map[string]interface{}{"items": []interface{}{1, 2}})
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	if out != "<ul>  <li>1</li>  <li>2</li></ul>" {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	var lines []string
+	for _, trim := range tmpl.WhitespaceReport() {
+		lines = append(lines, trim.String())
+	}
+	expected := []string{
+		`2:3 {%- removed "\n  " (marker)`,
+		`2:25 %} removed "\n" (trim_blocks)`,
+		`3:15 -}} removed " " (marker)`,
+		`4:3 {%- removed "\n  " (marker)`,
+		`4:14 %} removed "\n" (trim_blocks)`,
+	}
+	if got := strings.Join(lines, "\n"); got != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected report:\n%s", got)
+	}
+}